@@ -0,0 +1,444 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	"twreporter.org/go-api/controllers"
+)
+
+// command runs a one-off job instead of the HTTP server.
+// It is invoked by `go-api <command name> [flags]`,
+// so that the jobs could be scheduled by cron or kubernetes cron jobs.
+type command func(cf *controllers.ControllerFactory, args []string) error
+
+var commands = map[string]command{
+	"charge-periodic-donations": chargePeriodicDonations,
+	"reconcile-donations":       reconcileDonations,
+	"issue-receipts":            issueReceipts,
+	"export-donations":          exportDonations,
+	"rotate-card-secrets":       rotateCardSecrets,
+	"remind-card-expiries":      remindCardExpiries,
+	"load-exchange-rates":       loadExchangeRates,
+	"create-campaign":           createCampaign,
+	"import-other-donations":    importOtherDonations,
+	"dispatch-webhooks":         dispatchWebhooks,
+	"queue-feedback-gifts":      queueFeedbackGifts,
+	"create-matching-rule":      createMatchingRule,
+	"report-matching-gifts":     reportMatchingGifts,
+	"import-settlement":         importSettlement,
+}
+
+func runCommand(cf *controllers.ControllerFactory, name string, args []string) error {
+	cmd, ok := commands[name]
+	if !ok {
+		var names []string
+		for n := range commands {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return fmt.Errorf("unknown command %s. available commands: %s", name, strings.Join(names, ", "))
+	}
+
+	return cmd(cf, args)
+}
+
+// chargePeriodicDonations charges the due installments of periodic donations
+func chargePeriodicDonations(cf *controllers.ControllerFactory, args []string) error {
+	fs := flag.NewFlagSet("charge-periodic-donations", flag.ContinueOnError)
+	batchSize := fs.Int("batch-size", 100, "number of periodic donations loaded at a time")
+	invalidatedWithin := fs.Duration("invalidated-within", 24*time.Hour, "periodic donations which turn invalid within this duration are included in the summary for staffs")
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	mc := cf.GetMembershipController()
+
+	summary, err := mc.ChargeDuePeriodicDonations(now, *batchSize)
+	if err != nil {
+		return err
+	}
+
+	log.Infof("charge-periodic-donations finished: %+v", summary)
+
+	atRisk, err := mc.SendAtRiskPeriodicDonationsSummary(now.Add(-*invalidatedWithin))
+	if err != nil {
+		return err
+	}
+
+	log.Infof("charge-periodic-donations: %d periodic donations at risk are summarized for staffs", atRisk)
+	return nil
+}
+
+// createCampaign creates a fundraising campaign which donations could be attributed to
+func createCampaign(cf *controllers.ControllerFactory, args []string) error {
+	fs := flag.NewFlagSet("create-campaign", flag.ContinueOnError)
+	slug := fs.String("slug", "", "slug of the campaign carried by the donation requests, e.g. 2019-year-end")
+	title := fs.String("title", "", "title of the campaign")
+	goal := fs.Uint("goal", 0, "goal amount of the campaign in TWD")
+	start := fs.String("start", "", "first date of the campaign in YYYY-MM-DD format")
+	end := fs.String("end", "", "last date of the campaign in YYYY-MM-DD format")
+	sponsor := fs.String("sponsor", "", "sponsor who matches the donations of the campaign, if any")
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	campaign, err := cf.GetMembershipController().CreateACampaign(*slug, *title, *goal, *start, *end, *sponsor)
+	if err != nil {
+		return err
+	}
+
+	log.Infof("create-campaign finished: campaign %s(id: %d) runs from %s until %s", campaign.Slug, campaign.ID, campaign.StartAt, campaign.EndAt)
+	return nil
+}
+
+// createMatchingRule creates the rule of a sponsor who matches the paid donations up to the budget
+func createMatchingRule(cf *controllers.ControllerFactory, args []string) error {
+	fs := flag.NewFlagSet("create-matching-rule", flag.ContinueOnError)
+	sponsor := fs.String("sponsor", "", "name of the sponsor")
+	email := fs.String("email", "", "email of the sponsor, where the reconciliation report is mailed to")
+	ratio := fs.Float64("ratio", 1, "amount matched for every dollar donated, e.g. 0.5 matches half of the donations")
+	budget := fs.Uint("budget", 0, "maximum amount matched in total")
+	currency := fs.String("currency", "TWD", "currency of the budget, only the donations in the currency are matched")
+	types := fs.String("types", "prime,token,others", "comma separated types of the donations to match")
+	campaign := fs.String("campaign", "", "slug of the campaign whose donations are matched, donations of any campaign are matched if it is empty")
+	start := fs.String("start", "", "first date of the rule in YYYY-MM-DD format")
+	end := fs.String("end", "", "last date of the rule in YYYY-MM-DD format")
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	rule, err := cf.GetMembershipController().CreateAMatchingRule(*sponsor, *email, *ratio, *budget, *currency, *types, *campaign, *start, *end)
+	if err != nil {
+		return err
+	}
+
+	log.Infof("create-matching-rule finished: rule(id: %d) of %s matches %s donations up to %d %s from %s until %s", rule.ID, rule.Sponsor, rule.DonationTypes, rule.Budget, rule.Currency, rule.StartAt, rule.EndAt)
+	return nil
+}
+
+// dispatchWebhooks delivers the donation and user events to the webhooks
+func dispatchWebhooks(cf *controllers.ControllerFactory, args []string) error {
+	fs := flag.NewFlagSet("dispatch-webhooks", flag.ContinueOnError)
+	batchSize := fs.Int("batch-size", 100, "number of events or deliveries loaded at a time")
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	summary, err := cf.GetMembershipController().DispatchWebhooks(time.Now(), *batchSize)
+	if err != nil {
+		return err
+	}
+
+	log.Infof("dispatch-webhooks finished: %d events dispatched, %d delivered, %d to retry, %d dead %v", summary.Dispatched, summary.Delivered, summary.Retried, len(summary.Dead), summary.Dead)
+	return nil
+}
+
+// importOtherDonations records the donations of the CSV file made outside the payment gateways
+func importOtherDonations(cf *controllers.ControllerFactory, args []string) error {
+	fs := flag.NewFlagSet("import-other-donations", flag.ContinueOnError)
+	file := fs.String("file", "", "path of the CSV file with the header of the donation fields, e.g. paid_at,pay_method,bank_reference,amount,email,name")
+	recordedBy := fs.Uint("recorded-by", 0, "user id of the staff who records the donations")
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if *file == "" || *recordedBy == 0 {
+		return fmt.Errorf("-file and -recorded-by are required")
+	}
+
+	f, err := os.Open(*file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	summary, failData, err := cf.GetMembershipController().ImportOtherMethodDonations(f, *recordedBy)
+	if err != nil {
+		return err
+	}
+
+	if failData != nil {
+		var reasons []string
+		for k, v := range failData {
+			reasons = append(reasons, fmt.Sprintf("%s: %v", k, v))
+		}
+		sort.Strings(reasons)
+		return fmt.Errorf("nothing is imported since the file is invalid.\n%s", strings.Join(reasons, "\n"))
+	}
+
+	log.Infof("import-other-donations finished: %d recorded, %d duplicated %v", summary.Created, len(summary.Duplicated), summary.Duplicated)
+	return nil
+}
+
+// importSettlement reconciles the daily settlement file of TapPay and CTBC against the donations
+func importSettlement(cf *controllers.ControllerFactory, args []string) error {
+	fs := flag.NewFlagSet("import-settlement", flag.ContinueOnError)
+	file := fs.String("file", "", "path of the CSV file with the header transaction_type,rec_trade_id,bank_transaction_id,amount,currency")
+	date := fs.String("date", "", "settlement date of the file in YYYY-MM-DD format")
+	importedBy := fs.Uint("imported-by", 0, "user id of the staff who imports the file, optional")
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if *file == "" || *date == "" {
+		return fmt.Errorf("-file and -date are required")
+	}
+
+	f, err := os.Open(*file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	summary, failData, err := cf.GetMembershipController().ReconcileASettlementFile(f, *date, *importedBy)
+	if err != nil {
+		return err
+	}
+
+	if failData != nil {
+		var reasons []string
+		for k, v := range failData {
+			reasons = append(reasons, fmt.Sprintf("%s: %v", k, v))
+		}
+		sort.Strings(reasons)
+		return fmt.Errorf("nothing is reconciled since the file is invalid.\n%s", strings.Join(reasons, "\n"))
+	}
+
+	log.Infof("import-settlement finished: %d lines of %s, %v", summary.Lines, summary.SettlementDate, summary.Results)
+	return nil
+}
+
+// loadExchangeRates stores the daily exchange rates of the CSV file
+func loadExchangeRates(cf *controllers.ControllerFactory, args []string) error {
+	fs := flag.NewFlagSet("load-exchange-rates", flag.ContinueOnError)
+	file := fs.String("file", "", "path of the CSV file with the header date,currency,rate")
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if *file == "" {
+		return fmt.Errorf("-file is required")
+	}
+
+	f, err := os.Open(*file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	count, err := cf.GetMembershipController().LoadExchangeRates(f)
+	if err != nil {
+		return err
+	}
+
+	log.Infof("load-exchange-rates finished: %d rates are loaded from %s", count, *file)
+	return nil
+}
+
+// remindCardExpiries mails the donors whose cards of periodic donations expire soon
+func remindCardExpiries(cf *controllers.ControllerFactory, args []string) error {
+	fs := flag.NewFlagSet("remind-card-expiries", flag.ContinueOnError)
+	within := fs.Int("within", 30, "donors are reminded if their cards expire within the days")
+	batchSize := fs.Int("batch-size", 100, "number of periodic donations loaded at a time")
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	summary, err := cf.GetMembershipController().RemindExpiringCards(time.Now(), *within, *batchSize)
+	if err != nil {
+		return err
+	}
+
+	log.Infof("remind-card-expiries finished: %d reminded, %d skipped, %d failed", summary.Reminded, summary.Skipped, len(summary.Failed))
+
+	if len(summary.Failed) > 0 {
+		return fmt.Errorf("donors of periodic donations %v cannot be reminded, they are reminded again next run", summary.Failed)
+	}
+	return nil
+}
+
+// queueFeedbackGifts queues the feedback gifts of the periodic donations meeting the rules for shipping
+func queueFeedbackGifts(cf *controllers.ControllerFactory, args []string) error {
+	fs := flag.NewFlagSet("queue-feedback-gifts", flag.ContinueOnError)
+	batchSize := fs.Int("batch-size", 100, "number of periodic donations loaded at a time")
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	queued, err := cf.GetMembershipController().QueueFeedbackGifts(time.Now(), *batchSize)
+	if err != nil {
+		return err
+	}
+
+	log.Infof("queue-feedback-gifts finished: %d queued", queued)
+	return nil
+}
+
+// reportMatchingGifts mails the reconciliation reports to the sponsors of the ended matching rules
+func reportMatchingGifts(cf *controllers.ControllerFactory, args []string) error {
+	fs := flag.NewFlagSet("report-matching-gifts", flag.ContinueOnError)
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	reported, err := cf.GetMembershipController().ReportMatchingGifts(time.Now())
+	if err != nil {
+		return err
+	}
+
+	log.Infof("report-matching-gifts finished: %d reports mailed", reported)
+	return nil
+}
+
+// rotateCardSecrets re-encrypts the card secrets of periodic donations by the primary key
+func rotateCardSecrets(cf *controllers.ControllerFactory, args []string) error {
+	fs := flag.NewFlagSet("rotate-card-secrets", flag.ContinueOnError)
+	batchSize := fs.Int("batch-size", 100, "number of periodic donations loaded at a time")
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	summary, err := cf.GetMembershipController().RotateCardSecrets(*batchSize)
+	if err != nil {
+		return err
+	}
+
+	log.Infof("rotate-card-secrets finished: %d rotated, %d skipped, %d failed", summary.Rotated, summary.Skipped, len(summary.Failed))
+
+	if len(summary.Failed) > 0 {
+		return fmt.Errorf("card secrets of periodic donations %v cannot be rotated, see the errors above", summary.Failed)
+	}
+	return nil
+}
+
+// reconcileDonations resolves the donations left in 'paying' by TapPay Record API
+func reconcileDonations(cf *controllers.ControllerFactory, args []string) error {
+	fs := flag.NewFlagSet("reconcile-donations", flag.ContinueOnError)
+	batchSize := fs.Int("batch-size", 100, "number of donations loaded at a time")
+	staleAfter := fs.Duration("stale-after", 10*time.Minute, "donations which are not updated for this duration are regarded as stale")
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	summary, err := cf.GetMembershipController().ReconcilePayingDonations(time.Now().Add(-*staleAfter), *batchSize)
+	if err != nil {
+		return err
+	}
+
+	log.Infof("reconcile-donations finished: %d paid, %d failed, %d refunded, %d refunds failed, %d unresolved", summary.Paid, summary.Failed, summary.Refunded, summary.RefundFailed, len(summary.Unresolved))
+
+	if len(summary.Unresolved) > 0 {
+		return fmt.Errorf("%d donations cannot be resolved, see the warnings above", len(summary.Unresolved))
+	}
+	return nil
+}
+
+// issueReceipts issues and mails the receipts of the donations paid in a month or a year
+func issueReceipts(cf *controllers.ControllerFactory, args []string) error {
+	fs := flag.NewFlagSet("issue-receipts", flag.ContinueOnError)
+	period := fs.String("period", "monthly", "period of the receipts, monthly or yearly")
+	of := fs.String("of", "", "the month(YYYY-MM) or the year(YYYY) of the receipts, defaults to the last month or the last year")
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	location, _ := time.LoadLocation("Asia/Taipei")
+	at := time.Now().In(location)
+
+	switch {
+	case *of != "" && *period == "yearly":
+		t, err := time.ParseInLocation("2006", *of, location)
+		if err != nil {
+			return fmt.Errorf("-of should be a year in YYYY format")
+		}
+		at = t
+	case *of != "":
+		t, err := time.ParseInLocation("2006-01", *of, location)
+		if err != nil {
+			return fmt.Errorf("-of should be a month in YYYY-MM format")
+		}
+		at = t
+	case *period == "yearly":
+		at = at.AddDate(-1, 0, 0)
+	default:
+		at = time.Date(at.Year(), at.Month(), 1, 0, 0, 0, 0, location).AddDate(0, -1, 0)
+	}
+
+	summary, err := cf.GetMembershipController().IssueReceipts(*period, at)
+	if err != nil {
+		return err
+	}
+
+	log.Infof("issue-receipts finished: %d issued, %d mailed, %d refunded after issued", summary.Issued, summary.Mailed, len(summary.Refunded))
+
+	// the receipts are left unchanged, staffs should void and reissue them
+	for _, refund := range summary.Refunded {
+		log.Warn(refund)
+	}
+
+	if len(summary.Failed) > 0 {
+		for _, reason := range summary.Failed {
+			log.Warn(reason)
+		}
+		return fmt.Errorf("%d receipts cannot be issued or mailed, see the warnings above", len(summary.Failed))
+	}
+	return nil
+}
+
+// exportDonations streams the accounting ledger of donations into a file or stdout
+func exportDonations(cf *controllers.ControllerFactory, args []string) error {
+	location, _ := time.LoadLocation("Asia/Taipei")
+	now := time.Now().In(location)
+	thisMonth := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, location)
+
+	fs := flag.NewFlagSet("export-donations", flag.ContinueOnError)
+	format := fs.String("format", "csv", "file format, csv or xlsx")
+	since := fs.String("since", thisMonth.AddDate(0, -1, 0).Format("2006-01-02"), "donations created on or after the date, in YYYY-MM-DD format. defaults to the first day of the last month")
+	until := fs.String("until", thisMonth.AddDate(0, 0, -1).Format("2006-01-02"), "donations created on or before the date, in YYYY-MM-DD format. defaults to the last day of the last month")
+	types := fs.String("type", "", "comma separated donation types, prime, token or others. defaults to all types")
+	status := fs.String("status", "", "status of donations, e.g. paid. defaults to all status")
+	payMethods := fs.String("pay-method", "", "comma separated pay methods, e.g. credit_card,line. defaults to all pay methods")
+	output := fs.String("output", "", "path of the exported file. defaults to stdout")
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	filter, failData := controllers.NewLedgerFilter(*since, *until, *types, *status, *payMethods)
+	if failData != nil {
+		return fmt.Errorf("invalid flags: %v", failData)
+	}
+
+	w := os.Stdout
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+
+	return cf.GetMembershipController().WriteDonationLedger(w, *format, filter)
+}
@@ -2,7 +2,11 @@ package configs
 
 import (
 	"bytes"
+	"fmt"
 	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/spf13/viper"
@@ -56,9 +60,45 @@ oauth:
         id: "" # provide your own ID
         secret: "" # provide your own secret
 donation:
-    card_secret_key: test_card_secret_key
+    card_secret_key: test_card_secret_key # the legacy key, only decrypts the card secrets encrypted before keys are versioned
+    card_secret_key_provider: env # where the versioned keys of card secrets are loaded, env or file
+    card_secret_key_file: '' # the JSON file of the keys if the provider is file
+    card_secret_key_env_prefix: GOAPI_CARD_SECRET_ # reads <prefix>PRIMARY_KEY_ID and <prefix>KEYS if the provider is env
     tappay_url: 'https://sandbox.tappaysdk.com/tpc/payment/pay-by-prime'
+    tappay_card_token_url: 'https://sandbox.tappaysdk.com/tpc/payment/pay-by-token'
+    tappay_record_url: 'https://sandbox.tappaysdk.com/tpc/transaction/query'
+    tappay_refund_url: 'https://sandbox.tappaysdk.com/tpc/transaction/refund'
+    tappay_bind_card_url: 'https://sandbox.tappaysdk.com/tpc/card/bind'
+    tappay_backend_notify_url: '' # overrides the backend_notify_url given by clients if provided
+    three_domain_secure: false # authenticates the credit card donations by 3-D Secure, clients should give result_url.frontend_redirect_url and redirect donors to payment_url
     tappay_partner_key: 'partner_6ID1DoDlaPrfHw6HBZsULfTYtDmWs0q0ZZGKMBpp4YICWBxgK97eK3RM'
+    payment_gateways: # the payment gateway of each pay method, tappay is used if omitted
+        credit_card: tappay
+    ecpay_url: 'https://ecpg-stage.ecpay.com.tw'
+    ecpay_do_action_url: 'https://ecpayment-stage.ecpay.com.tw/1.0.0/Credit/DoAction'
+    ecpay_return_url: '' # where ecpay notifies the results of the installments
+    ecpay_merchant_id: '3002607'
+    ecpay_hash_key: 'pwFHCqoQZGmho4w6'
+    ecpay_hash_iv: 'EkRm7iFT261dpevs'
+    receipt_font_path: '' # a TrueType font with Chinese glyphs, such as Noto Sans TC, to render the receipts
+    receipt_issuer: '財團法人報導者文化基金會'
+    receipt_issuer_tax_id: ''
+    dunning_retry_days: [1, 3, 7] # the failed installments are retried on these days after the first failure
+    staff_email: '' # where the summary of the periodic donations at risk is sent, no summary is sent if empty
+    currencies: # the currencies donors could donate in, with the amount range, the tappay merchant and the symbol of each
+        TWD:
+            min_amount: 1
+            max_amount: 1000000
+            merchant_id: '' # any merchant the client asks for is accepted if empty
+            symbol: 'NT$'
+            feedback_gift_min_amount: 500 # the periodic donations whose installments are less than it do not receive the feedback gifts, no gifts for the currency if 0
+    feedback_gift_min_installments: 3 # the feedback gift is queued for shipping once the installments of the periodic donation are paid
+webhooks:
+    endpoints: [] # where the donation and user events are delivered, e.g. [{url: 'https://crm.example.com/hooks', secret: 'signing secret', events: ['donation.paid']}], all events are delivered if events are omitted
+    max_attempts: 8 # the delivery turns dead after the attempts fail
+    backoff: 1m # the delay after the first failed attempt, which is doubled after each failure
+    max_backoff: 6h
+    timeout: 10s
 algolia:
     application_id: "" # provide your own application ID
     api_key: "" # provide your own api key
@@ -74,6 +114,7 @@ type ConfYaml struct {
 	DB          DBConfig       `yaml:"db"`
 	Oauth       OauthConfig    `yaml:"oauth"`
 	Donation    DonationConfig `yaml:"donation"`
+	Webhooks    WebhooksConfig `yaml:"webhooks"`
 	Algolia     AlgoliaConfig  `ymal:"algolia"`
 	Encrypt     EncryptConfig  `yaml:"encrypt"`
 }
@@ -150,9 +191,68 @@ type GoogleConfig struct {
 }
 
 type DonationConfig struct {
-	CardSecretKey    string `yaml:"card_secret_key"`
-	TapPayURL        string `yaml:"tappay_url"`
-	TapPayPartnerKey string `yaml:"tappay_partner_key"`
+	// CardSecretKey is the legacy key of card secrets, and CardSecretKey* select where the versioned keys are loaded
+	CardSecretKey          string `yaml:"card_secret_key"`
+	CardSecretKeyProvider  string `yaml:"card_secret_key_provider"`
+	CardSecretKeyFile      string `yaml:"card_secret_key_file"`
+	CardSecretKeyEnvPrefix string `yaml:"card_secret_key_env_prefix"`
+	TapPayURL              string `yaml:"tappay_url"`
+	TapPayCardTokenURL     string `yaml:"tappay_card_token_url"`
+	TapPayRecordURL        string `yaml:"tappay_record_url"`
+	TapPayRefundURL        string `yaml:"tappay_refund_url"`
+	TapPayBindCardURL      string `yaml:"tappay_bind_card_url"`
+	TapPayBackendNotifyURL string `yaml:"tappay_backend_notify_url"`
+	TapPayPartnerKey       string `yaml:"tappay_partner_key"`
+	// ThreeDomainSecure authenticates the credit card donations by 3-D Secure
+	ThreeDomainSecure bool `yaml:"three_domain_secure"`
+	// PaymentGateways selects the payment gateway of each pay method
+	PaymentGateways  map[string]string `yaml:"payment_gateways"`
+	ECPayURL         string            `yaml:"ecpay_url"`
+	ECPayDoActionURL string            `yaml:"ecpay_do_action_url"`
+	ECPayReturnURL   string            `yaml:"ecpay_return_url"`
+	ECPayMerchantID  string            `yaml:"ecpay_merchant_id"`
+	ECPayHashKey     string            `yaml:"ecpay_hash_key"`
+	ECPayHashIV      string            `yaml:"ecpay_hash_iv"`
+	// Receipt* are printed on the tax-deductible receipts
+	ReceiptFontPath    string `yaml:"receipt_font_path"`
+	ReceiptIssuer      string `yaml:"receipt_issuer"`
+	ReceiptIssuerTaxID string `yaml:"receipt_issuer_tax_id"`
+	// DunningRetryDays are the days after the first failure when the failed installments are retried
+	DunningRetryDays []int  `yaml:"dunning_retry_days"`
+	StaffEmail       string `yaml:"staff_email"`
+	// Currencies are the supported currencies by the currency codes, e.g. TWD and USD
+	Currencies map[string]CurrencyConfig `yaml:"currencies"`
+	// FeedbackGiftMinInstallments is the number of paid installments before the feedback gift of a periodic donation is shipped
+	FeedbackGiftMinInstallments uint `yaml:"feedback_gift_min_installments"`
+}
+
+// CurrencyConfig is the rule of donations in the currency.
+// Amounts are in the whole units of the currency, and no maximum is applied if MaxAmount is 0.
+type CurrencyConfig struct {
+	MinAmount  uint   `yaml:"min_amount"`
+	MaxAmount  uint   `yaml:"max_amount"`
+	MerchantID string `yaml:"merchant_id"`
+	Symbol     string `yaml:"symbol"`
+	// FeedbackGiftMinAmount is the minimum installment amount of the periodic donations receiving the feedback gifts
+	FeedbackGiftMinAmount uint `yaml:"feedback_gift_min_amount"`
+}
+
+// WebhooksConfig is where and how the outbox events are delivered
+type WebhooksConfig struct {
+	Endpoints   []WebhookEndpointConfig `yaml:"endpoints"`
+	MaxAttempts uint                    `yaml:"max_attempts"`
+	// Backoff is the delay after the first failed attempt, which is doubled after each failure up to MaxBackoff
+	Backoff    time.Duration `yaml:"backoff"`
+	MaxBackoff time.Duration `yaml:"max_backoff"`
+	Timeout    time.Duration `yaml:"timeout"`
+}
+
+// WebhookEndpointConfig is a webhook receiving the events, which are signed by the secret.
+// All events are delivered if Events is empty.
+type WebhookEndpointConfig struct {
+	URL    string   `yaml:"url" mapstructure:"url"`
+	Secret string   `yaml:"secret" mapstructure:"secret"`
+	Events []string `yaml:"events" mapstructure:"events"`
 }
 
 type AlgoliaConfig struct {
@@ -226,8 +326,48 @@ func buildConf() ConfYaml {
 
 	// TapPay
 	conf.Donation.CardSecretKey = viper.GetString("donation.card_secret_key")
+	conf.Donation.CardSecretKeyProvider = viper.GetString("donation.card_secret_key_provider")
+	conf.Donation.CardSecretKeyFile = viper.GetString("donation.card_secret_key_file")
+	conf.Donation.CardSecretKeyEnvPrefix = viper.GetString("donation.card_secret_key_env_prefix")
 	conf.Donation.TapPayURL = viper.GetString("donation.tappay_url")
+	conf.Donation.TapPayCardTokenURL = viper.GetString("donation.tappay_card_token_url")
+	conf.Donation.TapPayRecordURL = viper.GetString("donation.tappay_record_url")
+	conf.Donation.TapPayRefundURL = viper.GetString("donation.tappay_refund_url")
+	conf.Donation.TapPayBindCardURL = viper.GetString("donation.tappay_bind_card_url")
+	conf.Donation.TapPayBackendNotifyURL = viper.GetString("donation.tappay_backend_notify_url")
 	conf.Donation.TapPayPartnerKey = viper.GetString("donation.tappay_partner_key")
+	conf.Donation.ThreeDomainSecure = viper.GetBool("donation.three_domain_secure")
+
+	// Payment gateways
+	conf.Donation.PaymentGateways = viper.GetStringMapString("donation.payment_gateways")
+	conf.Donation.ECPayURL = viper.GetString("donation.ecpay_url")
+	conf.Donation.ECPayDoActionURL = viper.GetString("donation.ecpay_do_action_url")
+	conf.Donation.ECPayReturnURL = viper.GetString("donation.ecpay_return_url")
+	conf.Donation.ECPayMerchantID = viper.GetString("donation.ecpay_merchant_id")
+	conf.Donation.ECPayHashKey = viper.GetString("donation.ecpay_hash_key")
+	conf.Donation.ECPayHashIV = viper.GetString("donation.ecpay_hash_iv")
+
+	// Receipts
+	conf.Donation.ReceiptFontPath = viper.GetString("donation.receipt_font_path")
+	conf.Donation.ReceiptIssuer = viper.GetString("donation.receipt_issuer")
+	conf.Donation.ReceiptIssuerTaxID = viper.GetString("donation.receipt_issuer_tax_id")
+
+	// Dunning
+	conf.Donation.DunningRetryDays = getIntSlice("donation.dunning_retry_days")
+	conf.Donation.StaffEmail = viper.GetString("donation.staff_email")
+
+	// Currencies
+	conf.Donation.Currencies = getCurrencies("donation.currencies")
+
+	// Feedback gifts
+	conf.Donation.FeedbackGiftMinInstallments = uint(viper.GetInt("donation.feedback_gift_min_installments"))
+
+	// Webhooks
+	conf.Webhooks.Endpoints = getWebhookEndpoints("webhooks.endpoints")
+	conf.Webhooks.MaxAttempts = uint(viper.GetInt("webhooks.max_attempts"))
+	conf.Webhooks.Backoff = viper.GetDuration("webhooks.backoff")
+	conf.Webhooks.MaxBackoff = viper.GetDuration("webhooks.max_backoff")
+	conf.Webhooks.Timeout = viper.GetDuration("webhooks.timeout")
 
 	// Algolia
 	conf.Algolia.ApplicationID = viper.GetString("algolia.application_id")
@@ -239,6 +379,57 @@ func buildConf() ConfYaml {
 	return conf
 }
 
+// getIntSlice returns the value of the key as a slice of integers, the elements which are not integers are omitted
+func getIntSlice(key string) []int {
+	var ints []int
+
+	for _, v := range viper.GetStringSlice(key) {
+		if i, err := strconv.Atoi(v); err == nil {
+			ints = append(ints, i)
+		}
+	}
+
+	return ints
+}
+
+// getCurrencies returns the currency rules under the key.
+// viper lowercases the keys, so the currency codes are uppercased back.
+func getCurrencies(key string) map[string]CurrencyConfig {
+	currencies := make(map[string]CurrencyConfig)
+
+	for code := range viper.GetStringMap(key) {
+		prefix := fmt.Sprintf("%s.%s.", key, code)
+		currencies[strings.ToUpper(code)] = CurrencyConfig{
+			MinAmount:             uint(viper.GetInt(prefix + "min_amount")),
+			MaxAmount:             uint(viper.GetInt(prefix + "max_amount")),
+			MerchantID:            viper.GetString(prefix + "merchant_id"),
+			Symbol:                viper.GetString(prefix + "symbol"),
+			FeedbackGiftMinAmount: uint(viper.GetInt(prefix + "feedback_gift_min_amount")),
+		}
+	}
+
+	return currencies
+}
+
+// getWebhookEndpoints returns the webhook endpoints under the key, the endpoints without urls are omitted
+func getWebhookEndpoints(key string) []WebhookEndpointConfig {
+	var endpoints []WebhookEndpointConfig
+	var valid []WebhookEndpointConfig
+
+	if err := viper.UnmarshalKey(key, &endpoints); err != nil {
+		log.Errorf("cannot load the webhook endpoints. %s", err.Error())
+		return valid
+	}
+
+	for _, e := range endpoints {
+		if e.URL != "" {
+			valid = append(valid, e)
+		}
+	}
+
+	return valid
+}
+
 // LoadDefaultConf loads default config
 func LoadDefaultConf() (ConfYaml, error) {
 	var conf ConfYaml
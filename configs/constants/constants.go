@@ -26,4 +26,10 @@ const (
 	PrivilegeMember = 10
 	// PrivilegeAdmin ...
 	PrivilegeAdmin = 50
+
+	/* Gin Context Keys */
+
+	// GatewayCalledKey is set once the handler calls the payment gateway,
+	// the outcome of the charge may be unknown if the handler fails after it.
+	GatewayCalledKey = "gateway-called"
 )
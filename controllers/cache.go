@@ -0,0 +1,81 @@
+package controllers
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+type (
+	ttlCacheEntry struct {
+		expiresAt time.Time
+		key       string
+		value     interface{}
+	}
+
+	// ttlCache keeps the values by their keys for the ttl, such as the aggregated progress of the campaigns and the pages of the donor wall,
+	// so that the donation tables are not queried on every visit.
+	// It keeps at most `size` values, and the oldest values are dropped first.
+	ttlCache struct {
+		sync.Mutex
+		entries map[string]*list.Element
+		// order keeps the entries from the oldest to the latest, which is also the order they expire since the ttl is fixed
+		order *list.List
+		size  int
+		ttl   time.Duration
+	}
+)
+
+func newTTLCache(ttl time.Duration, size int) *ttlCache {
+	return &ttlCache{entries: make(map[string]*list.Element), order: list.New(), size: size, ttl: ttl}
+}
+
+func (tc *ttlCache) get(key string, now time.Time) (interface{}, bool) {
+	tc.Lock()
+	defer tc.Unlock()
+
+	elem, ok := tc.entries[key]
+	if !ok {
+		return nil, false
+	}
+
+	entry := elem.Value.(ttlCacheEntry)
+	if now.After(entry.expiresAt) {
+		tc.remove(elem)
+		return nil, false
+	}
+	return entry.value, true
+}
+
+// set caches the value, and drops the expired values and the oldest values beyond the size from the front of the order,
+// so that the cache never grows with the keys
+func (tc *ttlCache) set(key string, value interface{}, now time.Time) {
+	tc.Lock()
+	defer tc.Unlock()
+
+	if elem, ok := tc.entries[key]; ok {
+		tc.remove(elem)
+	}
+	tc.entries[key] = tc.order.PushBack(ttlCacheEntry{expiresAt: now.Add(tc.ttl), key: key, value: value})
+
+	for front := tc.order.Front(); front != nil; front = tc.order.Front() {
+		if tc.order.Len() <= tc.size && !now.After(front.Value.(ttlCacheEntry).expiresAt) {
+			break
+		}
+		tc.remove(front)
+	}
+}
+
+func (tc *ttlCache) remove(elem *list.Element) {
+	tc.order.Remove(elem)
+	delete(tc.entries, elem.Value.(ttlCacheEntry).key)
+}
+
+// clear drops all values, e.g. after a donor withdraws the consent to be listed on the donor wall
+func (tc *ttlCache) clear() {
+	tc.Lock()
+	defer tc.Unlock()
+
+	tc.entries = make(map[string]*list.Element)
+	tc.order.Init()
+}
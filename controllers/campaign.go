@@ -0,0 +1,183 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gin-gonic/gin"
+	"gopkg.in/guregu/null.v3"
+
+	"twreporter.org/go-api/currency"
+	"twreporter.org/go-api/models"
+)
+
+const (
+	campaignDateLayout = "2006-01-02"
+
+	// the progress of a campaign is aggregated at most once within the duration
+	campaignProgressTTL = time.Minute
+	// the progress of at most the number of campaigns is cached
+	campaignCacheSize = 100
+)
+
+var campaignSlugRegexp = regexp.MustCompile(`^[a-z0-9]+(-[a-z0-9]+)*$`)
+
+type (
+	campaignAmountResp struct {
+		Amount   uint   `json:"amount"`
+		Currency string `json:"currency"`
+	}
+
+	campaignResp struct {
+		// Amounts are the amounts raised by the currencies
+		Amounts         []campaignAmountResp `json:"amounts"`
+		Donors          uint                 `json:"donors"`
+		EndAt           time.Time            `json:"end_at"`
+		GoalAmount      uint                 `json:"goal_amount"`
+		MatchingSponsor null.String          `json:"matching_sponsor"`
+		// Raised is the amount raised in TWD
+		Raised           uint      `json:"raised"`
+		RecurringPledges uint      `json:"recurring_pledges"`
+		Slug             string    `json:"slug"`
+		StartAt          time.Time `json:"start_at"`
+		Title            string    `json:"title"`
+	}
+)
+
+// CreateACampaign creates the campaign which donations could be attributed to by the slug.
+// The dates are in YYYY-MM-DD format and inclusive, the campaign runs from the beginning of the start date
+// to the end of the end date in Taiwan.
+func (mc *MembershipController) CreateACampaign(slug string, title string, goalAmount uint, startDate string, endDate string, matchingSponsor string) (models.Campaign, error) {
+	var location, _ = time.LoadLocation("Asia/Taipei")
+	var campaign models.Campaign
+
+	if !campaignSlugRegexp.MatchString(slug) || len(slug) > 50 {
+		return campaign, errors.New("slug should consist of lowercase letters, digits and hyphens, and be at most 50 characters")
+	}
+
+	if title == "" {
+		return campaign, errors.New("title is required")
+	}
+
+	if goalAmount == 0 {
+		return campaign, errors.New("goal amount should be greater than 0")
+	}
+
+	startAt, err := time.ParseInLocation(campaignDateLayout, startDate, location)
+	if nil != err {
+		return campaign, fmt.Errorf("start date should be in YYYY-MM-DD format. %s", err.Error())
+	}
+
+	endAt, err := time.ParseInLocation(campaignDateLayout, endDate, location)
+	if nil != err {
+		return campaign, fmt.Errorf("end date should be in YYYY-MM-DD format. %s", err.Error())
+	}
+
+	if endAt.Before(startAt) {
+		return campaign, errors.New("end date should not be before start date")
+	}
+
+	campaign = models.Campaign{
+		EndAt:           endAt.AddDate(0, 0, 1),
+		GoalAmount:      goalAmount,
+		MatchingSponsor: null.NewString(matchingSponsor, matchingSponsor != ""),
+		Slug:            slug,
+		StartAt:         startAt,
+		Title:           title,
+	}
+
+	if err = mc.Storage.CreateACampaign(&campaign); nil != err {
+		return campaign, err
+	}
+
+	return campaign, nil
+}
+
+// validateCampaign checks the campaign which the donation is attributed to exists.
+// Donations made out of the date range of the campaign are still attributed to it, but do not count towards the goal.
+func (mc *MembershipController) validateCampaign(slug string) (gin.H, error) {
+	if slug == "" {
+		return nil, nil
+	}
+
+	if _, err := mc.Storage.GetACampaign(slug); nil != err {
+		appErr, _ := err.(*models.AppError)
+		if nil != appErr && appErr.StatusCode == http.StatusNotFound {
+			return gin.H{"req.Body.campaign": fmt.Sprintf("campaign %s cannot be found", slug)}, nil
+		}
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+// GetACampaign method
+// Handler for anyone to get the progress of a campaign, including the amount raised, the donors and the new recurring pledges.
+// The progress is aggregated at most once a minute.
+func (mc *MembershipController) GetACampaign(c *gin.Context) (int, gin.H, error) {
+	var location, _ = time.LoadLocation("Asia/Taipei")
+	slug := c.Param("slug")
+	now := time.Now()
+
+	if cached, ok := mc.campaigns.get(slug, now); ok {
+		return http.StatusOK, gin.H{"status": "success", "data": cached.(campaignResp)}, nil
+	}
+
+	campaign, err := mc.Storage.GetACampaign(slug)
+	if nil != err {
+		appErr, _ := err.(*models.AppError)
+		if nil != appErr && appErr.StatusCode == http.StatusNotFound {
+			return http.StatusNotFound, gin.H{"status": "fail", "data": gin.H{
+				"req.URL.slug": fmt.Sprintf("campaign %s cannot be found", slug),
+			}}, nil
+		}
+		return 0, gin.H{}, err
+	}
+
+	progress, err := mc.Storage.GetCampaignProgress(campaign)
+	if nil != err {
+		return 0, gin.H{}, err
+	}
+
+	// the amounts are converted to TWD by the rates of the last day of the campaign at the latest
+	at := now
+	if campaign.EndAt.Before(at) {
+		at = campaign.EndAt.Add(-time.Second)
+	}
+
+	rates, err := mc.Storage.GetExchangeRates(at.In(location))
+	if nil != err {
+		return 0, gin.H{}, err
+	}
+	rateTable := currency.NewRateTable(rates)
+
+	resp := campaignResp{
+		Amounts:          make([]campaignAmountResp, 0, len(progress.Amounts)),
+		Donors:           progress.Donors,
+		EndAt:            campaign.EndAt,
+		GoalAmount:       campaign.GoalAmount,
+		MatchingSponsor:  campaign.MatchingSponsor,
+		RecurringPledges: progress.RecurringPledges,
+		Slug:             campaign.Slug,
+		StartAt:          campaign.StartAt,
+		Title:            campaign.Title,
+	}
+
+	for _, a := range progress.Amounts {
+		amount, ok := rateTable.ToTWD(a.Currency, a.Amount, at)
+		if !ok {
+			log.Warnf("MembershipController.GetACampaign: no exchange rate of %s is loaded, the amount is not counted", a.Currency)
+		}
+
+		resp.Raised += amount
+		resp.Amounts = append(resp.Amounts, campaignAmountResp{Amount: a.Amount, Currency: a.Currency})
+	}
+
+	mc.campaigns.set(slug, resp, now)
+
+	return http.StatusOK, gin.H{"status": "success", "data": resp}, nil
+}
@@ -11,18 +11,22 @@ import (
 	"github.com/jinzhu/gorm"
 	"gopkg.in/mgo.v2"
 	"twreporter.org/go-api/globals"
+	"twreporter.org/go-api/keyring"
 	"twreporter.org/go-api/models"
+	"twreporter.org/go-api/payment"
 	"twreporter.org/go-api/services"
 	"twreporter.org/go-api/storage"
 	//log "github.com/Sirupsen/logrus"
 )
 
-// ControllerFactory generates controlloers by given persistent storage connection
-// and mail service
+// ControllerFactory generates controlloers by given persistent storage connection,
+// mail service, payment gateways and the keyring of card secrets
 type ControllerFactory struct {
-	gormDB      *gorm.DB
-	mgoSession  *mgo.Session
-	mailService services.MailService
+	gormDB          *gorm.DB
+	mgoSession      *mgo.Session
+	mailService     services.MailService
+	paymentGateways *payment.Gateways
+	cardKeyring     *keyring.Keyring
 }
 
 // GetGoogleController returns Google struct
@@ -53,7 +57,7 @@ func (cf *ControllerFactory) GetOAuthController(oauthType string) (oauth *OAuth)
 // GetMembershipController returns *MembershipController struct
 func (cf *ControllerFactory) GetMembershipController() *MembershipController {
 	gs := storage.NewGormStorage(cf.gormDB)
-	return NewMembershipController(gs)
+	return NewMembershipController(gs, cf.paymentGateways, cf.cardKeyring)
 }
 
 // GetNewsController returns *NewsController struct
@@ -76,7 +80,7 @@ func (cf *ControllerFactory) GetMailController() *MailController {
 	}
 	filepath = path.Join(gopath, "src/twreporter.org/go-api/template")
 
-	contrl.LoadTemplateFiles(fmt.Sprintf("%s/signin.tmpl", filepath), fmt.Sprintf("%s/success-donation.tmpl", filepath))
+	contrl.LoadTemplateFiles(fmt.Sprintf("%s/signin.tmpl", filepath), fmt.Sprintf("%s/success-donation.tmpl", filepath), fmt.Sprintf("%s/refund-donation.tmpl", filepath), fmt.Sprintf("%s/receipt.tmpl", filepath), fmt.Sprintf("%s/failed-periodic-donation.tmpl", filepath), fmt.Sprintf("%s/invalid-periodic-donation.tmpl", filepath), fmt.Sprintf("%s/at-risk-periodic-donations.tmpl", filepath), fmt.Sprintf("%s/card-expiry-reminder.tmpl", filepath), fmt.Sprintf("%s/gift-shipped.tmpl", filepath), fmt.Sprintf("%s/matching-report.tmpl", filepath))
 
 	return contrl
 }
@@ -97,11 +101,13 @@ func (cf *ControllerFactory) GetGormDB() *gorm.DB {
 }
 
 // NewControllerFactory generate *ControllerFactory struct
-func NewControllerFactory(gormDB *gorm.DB, mgoSession *mgo.Session, mailSvc services.MailService) *ControllerFactory {
+func NewControllerFactory(gormDB *gorm.DB, mgoSession *mgo.Session, mailSvc services.MailService, gateways *payment.Gateways, cardKeyring *keyring.Keyring) *ControllerFactory {
 	return &ControllerFactory{
-		gormDB:      gormDB,
-		mgoSession:  mgoSession,
-		mailService: mailSvc,
+		gormDB:          gormDB,
+		mgoSession:      mgoSession,
+		mailService:     mailSvc,
+		paymentGateways: gateways,
+		cardKeyring:     cardKeyring,
 	}
 }
 
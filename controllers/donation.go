@@ -1,16 +1,9 @@
 package controllers
 
 import (
-	"bytes"
-	"crypto/aes"
-	"crypto/cipher"
-	"crypto/rand"
-	"crypto/sha256"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
-	"io/ioutil"
 	"net/http"
 	"strconv"
 	"strings"
@@ -22,15 +15,19 @@ import (
 	"gopkg.in/go-playground/validator.v8"
 	"gopkg.in/guregu/null.v3"
 
+	"twreporter.org/go-api/configs/constants"
+	"twreporter.org/go-api/currency"
 	"twreporter.org/go-api/globals"
+	"twreporter.org/go-api/keyring"
 	"twreporter.org/go-api/models"
+	"twreporter.org/go-api/payment"
+	"twreporter.org/go-api/utils"
 )
 
 const (
-	defaultDetails        = "報導者小額捐款"
-	defaultCurrency       = "TWD"
-	defaultMerchantID     = "twreporter_CTBC"
-	defaultRequestTimeout = 45 * time.Second
+	defaultDetails    = "報導者小額捐款"
+	defaultCurrency   = "TWD"
+	defaultMerchantID = "twreporter_CTBC"
 
 	invalidPayMethodID = -1
 
@@ -42,12 +39,11 @@ const (
 	statusStopped = "stopped"
 	statusInvalid = "invalid"
 
-	tapPayRespStatusSuccess = 0
-
 	defaultPeriodicPayMethod = "credit_card"
 
-	secToMsec     = 1000
-	msecToNanosec = 1000000
+	// donation type names shown in the thank-you mail
+	periodicDonationTypeName = "定期定額"
+	primeDonationTypeName    = "單筆捐款"
 
 	monthlyFrequency = "monthly"
 	yearlyFrequency  = "yearly"
@@ -65,6 +61,7 @@ const (
 	prime payType = iota
 	token
 	periodic
+	otherMethod
 )
 
 // pay method collections
@@ -82,6 +79,11 @@ var payMethodMap = map[string]string{
 	payMethodGoogle:     "Google Pay",
 	payMethodApple:      "Apple Pay",
 	payMethodSamsung:    "Samsung Pay",
+
+	payMethodTransfer:       "銀行轉帳",
+	payMethodPostalTransfer: "郵政劃撥",
+	payMethodCheque:         "支票",
+	payMethodCash:           "現金",
 }
 
 var cardInfoTypes = map[int64]string{
@@ -94,79 +96,58 @@ var cardInfoTypes = map[int64]string{
 
 type (
 	clientReq struct {
+		models.DonorIdentity
+		models.DonorWallConsent
 		Amount       uint              `json:"amount" form:"amount" binding:"required"`
+		Campaign     string            `json:"campaign" form:"campaign"`
 		Cardholder   models.Cardholder `json:"donor" form:"donor" binding:"required,dive"`
 		Currency     string            `json:"currency" form:"currency"`
 		Details      string            `json:"details" form:"details"`
 		Frequency    string            `json:"frequency"`
 		MerchantID   string            `json:"merchant_id" form:"merchant_id"`
+		OrderNumber  string            `json:"order_number" form:"order_number"`
 		PayMethod    string            `json:"pay_method" form:"pay_method"`
 		Prime        string            `json:"prime" form:"prime" binding:"required"`
 		ResultUrl    linePayResultUrl  `json:"result_url" form:"result_url"`
+		SendReceipt  string            `json:"send_receipt" form:"send_receipt"`
 		UserID       uint              `json:"user_id" form:"user_id" binding:"required"`
 		MaxPaidTimes uint              `json:"max_paid_times" form:"max_paid_times"`
 	}
 
 	clientResp struct {
+		models.DonorIdentity
+		models.DonorWallConsent
 		Amount      uint              `json:"amount"`
+		Campaign    null.String       `json:"campaign"`
 		CardInfo    models.CardInfo   `json:"card_info"`
 		Cardholder  models.Cardholder `json:"cardholder"`
 		Currency    string            `json:"currency"`
 		Details     string            `json:"details"`
 		Frequency   string            `json:"frequency"`
 		ID          uint              `json:"id"`
+		Matching    *matchingResp     `json:"matching,omitempty"`
 		Notes       string            `json:"notes"`
 		OrderNumber string            `json:"order_number"`
 		PayMethod   string            `json:"pay_method"`
+		PaymentUrl  string            `json:"payment_url,omitempty"`
 		SendReceipt string            `json:"send_receipt"`
+		Status      string            `json:"status"`
 		ToFeedback  bool              `json:"to_feedback"`
 	}
 
-	bankTransactionTime struct {
-		StartTimeMillis string `json:"start_time_millis"`
-		EndTimeMillis   string `json:"end_time_millis"`
-	}
-
-	cardSecret struct {
-		CardToken string `json:"card_token"`
-		CardKey   string `json:"card_key"`
-	}
-
 	linePayResultUrl struct {
 		FrontendRedirectUrl string `json:"frontend_redirect_url" form:"frontend_redirect_url"`
 		BackendNotifyUrl    string `json:"backend_notify_url" form:"backend_notify_url"`
 	}
 
-	tapPayTransactionReq struct {
-		Amount      uint              `json:"amount"`
-		Cardholder  models.Cardholder `json:"cardholder"`
-		Currency    string            `json:"currency"`
-		Details     string            `json:"details"`
-		MerchantID  string            `json:"merchant_id"`
-		OrderNumber string            `json:"order_number"`
-		PartnerKey  string            `json:"partner_key"`
-		Prime       string            `json:"prime"`
-		Remember    bool              `json:"remember"`
-		ResultUrl   linePayResultUrl  `json:"result_url"`
-	}
-
-	tapPayTransactionResp struct {
-		models.TappayResp
-		BankTransactionTime   bankTransactionTime `json:"bank_transaction_time"`
-		CardInfo              models.CardInfo     `json:"card_info"`
-		CardSecret            cardSecret          `json:"card_secret"`
-		Status                int64               `json:"status"`
-		TransactionTimeMillis int64               `json:"transaction_time_millis"`
-	}
-
-	tapPayMinTransactionResp struct {
-		Status int64  `json:"status"`
-		Msg    string `json:"msg"`
-	}
+	// transaction is the result of charging on the payment gateway
+	transaction payment.Transaction
 
 	payType int
 
 	patchBody struct {
+		models.DonorIdentity
+		models.DonorWallConsent
 		Donor       models.Cardholder `json:"donor"`
 		Notes       string            `json:"notes"`
 		SendReceipt string            `json:"send_receipt"`
@@ -175,9 +156,22 @@ type (
 	}
 )
 
+// buildDonorIdentity clears the organization fields if the donor is changed to an individual.
+// Since the zero values are not updated, they are cleared by empty strings.
+func (p *patchBody) buildDonorIdentity() models.DonorIdentity {
+	d := p.DonorIdentity
+	if models.DonorTypeIndividual == d.DonorType {
+		d.CompanyName = null.StringFrom("")
+		d.TaxID = null.StringFrom("")
+	}
+	return d
+}
+
 func (p *patchBody) BuildPeriodicDonation() models.PeriodicDonation {
 	m := new(models.PeriodicDonation)
 	m.Cardholder = p.Donor
+	m.DonorIdentity = p.buildDonorIdentity()
+	m.DonorWallConsent = p.DonorWallConsent
 	m.Notes = p.Notes
 	m.SendReceipt = p.SendReceipt
 	m.ToFeedback = null.BoolFrom(p.ToFeedback)
@@ -188,17 +182,83 @@ func (p *patchBody) BuildPeriodicDonation() models.PeriodicDonation {
 func (p *patchBody) BuildPrimeDonation() models.PayByPrimeDonation {
 	m := new(models.PayByPrimeDonation)
 	m.Cardholder = p.Donor
+	m.DonorIdentity = p.buildDonorIdentity()
+	m.DonorWallConsent = p.DonorWallConsent
 	m.Notes = p.Notes
 	m.SendReceipt = p.SendReceipt
 	m.UserID = p.UserID
 	return *m
 }
 
-func (req clientReq) BuildTapPayReq(orderNumber string) tapPayTransactionReq {
-	primeReq := new(tapPayTransactionReq)
+// ValidateCurrency normalizes the currency of the request, which is TWD if omitted,
+// and checks the amount is in the range of the currency. The merchant of the currency on TapPay is selected,
+// and the fail data is returned if the client asks for another merchant.
+func (req *clientReq) ValidateCurrency() gin.H {
+	currencies := currency.FromConfig(globals.Conf.Donation)
+
+	req.Currency = strings.ToUpper(req.Currency)
+	if req.Currency == "" {
+		req.Currency = defaultCurrency
+	}
+
+	if _, ok := currencies[req.Currency]; !ok {
+		return gin.H{"req.Body.currency": fmt.Sprintf("currency is not supported. should be one of %s", strings.Join(currencies.Codes(), ", "))}
+	}
+
+	if err := currencies.Validate(req.Currency, req.Amount); nil != err {
+		return gin.H{"req.Body.amount": err.Error()}
+	}
+
+	if merchantID := currencies.MerchantID(req.Currency); merchantID != "" {
+		if req.MerchantID != "" && req.MerchantID != merchantID {
+			return gin.H{"req.Body.merchant_id": fmt.Sprintf("merchant_id should be %s for %s donations", merchantID, req.Currency)}
+		}
+		req.MerchantID = merchantID
+	}
+
+	return nil
+}
+
+// validateDonorIdentity checks an organization gives its company name and the valid unified business number(統一編號),
+// and the organization fields of individuals are dropped. The donor type is left empty if it is not changed.
+func validateDonorIdentity(d *models.DonorIdentity) gin.H {
+	switch d.DonorType {
+	case "":
+		if d.CompanyName.Valid || d.TaxID.Valid {
+			return gin.H{"req.Body.donor_type": fmt.Sprintf("donor_type should be %s to give company_name or tax_id", models.DonorTypeOrganization)}
+		}
+	case models.DonorTypeIndividual:
+		d.CompanyName = null.String{}
+		d.TaxID = null.String{}
+	case models.DonorTypeOrganization:
+		d.CompanyName = null.StringFrom(strings.TrimSpace(d.CompanyName.ValueOrZero()))
+		if d.CompanyName.String == "" {
+			return gin.H{"req.Body.company_name": "company_name is required for organizations"}
+		}
+		if !utils.IsValidTaxID(d.TaxID.ValueOrZero()) {
+			return gin.H{"req.Body.tax_id": "tax_id should be a valid unified business number of 8 digits"}
+		}
+	default:
+		return gin.H{"req.Body.donor_type": fmt.Sprintf("donor_type should be %s or %s", models.DonorTypeIndividual, models.DonorTypeOrganization)}
+	}
+	return nil
+}
+
+// ValidateDonorIdentity validates the donor identity of the request, the donor is an individual if the type is omitted
+func (req *clientReq) ValidateDonorIdentity() gin.H {
+	if req.DonorType == "" {
+		req.DonorType = models.DonorTypeIndividual
+	}
+	return validateDonorIdentity(&req.DonorIdentity)
+}
+
+func (req clientReq) BuildPrimeReq(orderNumber string, payMethod string) payment.PrimeReq {
+	primeReq := new(payment.PrimeReq)
 	primeReq.Prime = req.Prime
 	primeReq.OrderNumber = orderNumber
 	primeReq.Amount = req.Amount
+	primeReq.PayMethod = payMethod
+	primeReq.UserID = req.UserID
 
 	if req.Currency != "" {
 		primeReq.Currency = req.Currency
@@ -219,34 +279,61 @@ func (req clientReq) BuildTapPayReq(orderNumber string) tapPayTransactionReq {
 	}
 
 	primeReq.Cardholder = req.Cardholder
-	// Per required fields (even empty) of cardholder of tappay documents,
-	// use empty strings for name and phonenumber fields instead of empty.
-	if !primeReq.Cardholder.Name.Valid {
-		primeReq.Cardholder.Name = null.StringFrom("")
-	}
-
-	if !primeReq.Cardholder.PhoneNumber.Valid {
-		primeReq.Cardholder.PhoneNumber = null.StringFrom("")
-	}
-
-	primeReq.PartnerKey = globals.Conf.Donation.TapPayPartnerKey
 
 	if req.Frequency == monthlyFrequency || req.Frequency == yearlyFrequency {
 		primeReq.Remember = true
 	}
 
-	primeReq.ResultUrl = req.ResultUrl
+	primeReq.ThreeDomainSecure = requireThreeDomainSecure(payMethod)
+	primeReq.FrontendRedirectURL = req.ResultUrl.FrontendRedirectUrl
+	primeReq.BackendNotifyURL = req.ResultUrl.BackendNotifyUrl
 	return *primeReq
 }
 
+// requireThreeDomainSecure reports whether the donations of the pay method are authenticated by 3-D Secure
+func requireThreeDomainSecure(payMethod string) bool {
+	return globals.Conf.Donation.ThreeDomainSecure && payMethodCreditCard == payMethod
+}
+
+// ValidateResultUrl checks the client gives where the donor is redirected back after being authenticated by 3-D Secure
+func (req clientReq) ValidateResultUrl(payMethod string) gin.H {
+	if requireThreeDomainSecure(payMethod) && req.ResultUrl.FrontendRedirectUrl == "" {
+		return gin.H{"req.Body.result_url.frontend_redirect_url": "frontend_redirect_url is required for 3-D Secure"}
+	}
+	return nil
+}
+
+// ValidateSendReceipt checks the receipt preference is one of `sendReceipts`, it is monthly if it is omitted
+func (req clientReq) ValidateSendReceipt(sendReceipts ...string) gin.H {
+	if req.SendReceipt == "" || utils.ContainsString(sendReceipts, req.SendReceipt) {
+		return nil
+	}
+	return gin.H{"req.Body.send_receipt": fmt.Sprintf("send_receipt should be one of %s", strings.Join(sendReceipts, ", "))}
+}
+
+// sendReceiptOrDefault returns the receipt preference of the request, or monthly if it is omitted
+func (req clientReq) sendReceiptOrDefault() string {
+	if req.SendReceipt == "" {
+		return monthlyReceipt
+	}
+	return req.SendReceipt
+}
+
 func (req clientReq) BuildDraftPeriodicDonation(orderNumber string) models.PeriodicDonation {
 	const defaultDetails = "一般線上定期定額捐款"
 
 	m := new(models.PeriodicDonation)
 
 	m.Amount = req.Amount
+	m.Campaign = null.NewString(req.Campaign, req.Campaign != "")
 	m.Cardholder = req.Cardholder
 	m.Currency = req.Currency
+	m.DonorIdentity = req.DonorIdentity
+	m.DonorWallConsent = req.DonorWallConsent
+	m.HideAmount = null.BoolFrom(req.HideAmount.ValueOrZero())
+	m.ShowOnWall = null.BoolFrom(req.ShowOnWall.ValueOrZero())
+	m.MaxPaidTimes = req.MaxPaidTimes
+	m.SendReceipt = req.sendReceiptOrDefault()
 	m.UserID = req.UserID
 
 	if req.Frequency != "" {
@@ -271,10 +358,16 @@ func (req clientReq) BuildPrimeDraftRecord(orderNumber string, payMethod string)
 	m := new(models.PayByPrimeDonation)
 
 	m.Amount = req.Amount
+	m.Campaign = null.NewString(req.Campaign, req.Campaign != "")
 	m.Cardholder = req.Cardholder
 	m.Currency = req.Currency
 	m.Details = req.Details
+	m.DonorIdentity = req.DonorIdentity
+	m.DonorWallConsent = req.DonorWallConsent
+	m.HideAmount = null.BoolFrom(req.HideAmount.ValueOrZero())
+	m.ShowOnWall = null.BoolFrom(req.ShowOnWall.ValueOrZero())
 	m.MerchantID = req.MerchantID
+	m.SendReceipt = req.sendReceiptOrDefault()
 	m.UserID = req.UserID
 	m.PayMethod = payMethod
 	m.OrderNumber = orderNumber
@@ -287,6 +380,7 @@ func (req clientReq) BuildTokenDraftRecord(orderNumber string) models.PayByCardT
 	m := new(models.PayByCardTokenDonation)
 
 	m.Amount = req.Amount
+	m.Campaign = null.NewString(req.Campaign, req.Campaign != "")
 	m.Currency = req.Currency
 	m.Details = req.Details
 	m.MerchantID = req.MerchantID
@@ -298,35 +392,65 @@ func (req clientReq) BuildTokenDraftRecord(orderNumber string) models.PayByCardT
 
 func (cr *clientResp) BuildFromPeriodicDonationModel(d models.PeriodicDonation) {
 	cr.Amount = d.Amount
+	cr.Campaign = d.Campaign
 	cr.Cardholder = d.Cardholder
 	cr.CardInfo = d.CardInfo
 	cr.Currency = d.Currency
 	cr.Details = d.Details
+	cr.DonorIdentity = d.DonorIdentity
+	cr.DonorWallConsent = d.DonorWallConsent
 	cr.Frequency = d.Frequency
 	cr.ID = d.ID
 	cr.Notes = d.Notes
 	cr.OrderNumber = d.OrderNumber
 	cr.SendReceipt = d.SendReceipt
+	cr.Status = d.Status
 	cr.ToFeedback = d.ToFeedback.ValueOrZero()
 }
 
 func (cr *clientResp) BuildFromPrimeDonationModel(d models.PayByPrimeDonation) {
 	cr.Amount = d.Amount
+	cr.Campaign = d.Campaign
 	cr.Cardholder = d.Cardholder
 	cr.CardInfo = d.CardInfo
 	cr.Currency = d.Currency
 	cr.Details = d.Details
+	cr.DonorIdentity = d.DonorIdentity
+	cr.DonorWallConsent = d.DonorWallConsent
 	cr.ID = d.ID
 	cr.Notes = d.Notes
 	cr.OrderNumber = d.OrderNumber
 	cr.PayMethod = d.PayMethod
 	cr.SendReceipt = d.SendReceipt
+	cr.Status = d.Status
 	cr.ToFeedback = false
 	cr.Frequency = oneTimeFrequency
 }
 
+// BuildFromTokenDonationModel builds the response of an installment,
+// the cardholder, the donor identity and card information come from its periodic donation
+func (cr *clientResp) BuildFromTokenDonationModel(d models.PayByCardTokenDonation, pd models.PeriodicDonation) {
+	cr.Amount = d.Amount
+	cr.Campaign = d.Campaign
+	cr.Cardholder = pd.Cardholder
+	cr.CardInfo = pd.CardInfo
+	cr.Currency = d.Currency
+	cr.Details = d.Details
+	cr.DonorIdentity = pd.DonorIdentity
+	cr.DonorWallConsent = pd.DonorWallConsent
+	cr.ID = d.ID
+	cr.Notes = pd.Notes
+	cr.OrderNumber = d.OrderNumber
+	cr.PayMethod = defaultPeriodicPayMethod
+	cr.SendReceipt = pd.SendReceipt
+	cr.Status = d.Status
+	cr.ToFeedback = pd.ToFeedback.ValueOrZero()
+	cr.Frequency = pd.Frequency
+}
+
 func (cr *clientResp) BuildFromOtherMethodDonationModel(d models.PayByOtherMethodDonation) {
 	cr.Amount = d.Amount
+	cr.Campaign = d.Campaign
 	cr.Cardholder = models.Cardholder{
 		Name:        null.StringFrom(d.Name),
 		Email:       d.Email,
@@ -337,11 +461,13 @@ func (cr *clientResp) BuildFromOtherMethodDonationModel(d models.PayByOtherMetho
 	}
 	cr.Currency = d.Currency
 	cr.Details = d.Details
+	cr.DonorIdentity = models.DonorIdentity{DonorType: models.DonorTypeIndividual}
 	cr.ID = d.ID
 	cr.Notes = d.Notes
 	cr.OrderNumber = d.OrderNumber
 	cr.PayMethod = d.PayMethod
 	cr.SendReceipt = d.SendReceipt
+	cr.Status = statusPaid
 	cr.ToFeedback = false
 	cr.Frequency = oneTimeFrequency
 }
@@ -389,6 +515,16 @@ func (mc *MembershipController) sendDonationThankYouMail(body clientResp, donati
 		PhoneNumber:      body.Cardholder.PhoneNumber.ValueOrZero(),
 	}
 
+	if body.IsOrganization() {
+		reqBody.CompanyName = body.CompanyName.ValueOrZero()
+		reqBody.TaxID = body.TaxID.ValueOrZero()
+	}
+
+	if nil != body.Matching {
+		reqBody.MatchedAmount = body.Matching.MatchedAmount
+		reqBody.MatchingSponsor = body.Matching.Sponsor
+	}
+
 	if err := postMailServiceEndpoint(reqBody, fmt.Sprintf("http://localhost:%s/v1/%s", globals.LocalhostPort, globals.SendSuccessDonationRoutePath)); err != nil {
 		log.Warnf("fail to send %s donation(order_number: %s) thank you mail due to %s", donationType, body.OrderNumber, err.Error())
 	}
@@ -402,13 +538,19 @@ func (mc *MembershipController) CreateAPeriodicDonationOfAUser(c *gin.Context) (
 
 	// Validate client request
 	var err error
+	var gateway payment.PaymentGateway
 	var reqBody clientReq
-	var tapPayResp tapPayTransactionResp
+	var trx payment.Transaction
 
 	if failData, valid := bindRequestBody(c, &reqBody); valid == false {
 		return http.StatusBadRequest, gin.H{"status": "fail", "data": failData}, nil
 	}
 
+	// the fields omitted by the request are filled by the donor profile
+	if err = mc.prefillByDonorProfile(&reqBody); nil != err {
+		return 0, gin.H{}, err
+	}
+
 	if reqBody.Cardholder.Email == "" {
 		return http.StatusBadRequest, gin.H{"status": "fail", "data": gin.H{
 			"req.Body.donor.email": "donor email is not valid",
@@ -421,19 +563,57 @@ func (mc *MembershipController) CreateAPeriodicDonationOfAUser(c *gin.Context) (
 		}}, nil
 	}
 
+	if failData := reqBody.ValidateCurrency(); failData != nil {
+		return http.StatusBadRequest, gin.H{"status": "fail", "data": failData}, nil
+	}
+
+	if failData := reqBody.ValidateResultUrl(defaultPeriodicPayMethod); failData != nil {
+		return http.StatusBadRequest, gin.H{"status": "fail", "data": failData}, nil
+	}
+
+	if failData := reqBody.ValidateSendReceipt(monthlyReceipt, yearlyReceipt, noReceipt); failData != nil {
+		return http.StatusBadRequest, gin.H{"status": "fail", "data": failData}, nil
+	}
+
+	if failData := reqBody.ValidateDonorIdentity(); failData != nil {
+		return http.StatusBadRequest, gin.H{"status": "fail", "data": failData}, nil
+	}
+
+	if failData := validateDonorWallConsent(&reqBody.DonorWallConsent); failData != nil {
+		return http.StatusBadRequest, gin.H{"status": "fail", "data": failData}, nil
+	}
+
+	if failData, err := mc.validateCampaign(reqBody.Campaign); nil != err {
+		return 0, gin.H{}, err
+	} else if failData != nil {
+		return http.StatusBadRequest, gin.H{"status": "fail", "data": failData}, nil
+	}
+
+	if gateway, err = mc.Gateways.GetByPayMethod(defaultPeriodicPayMethod); nil != err {
+		return 0, gin.H{}, models.NewAppError(errWhere, err.Error(), "", http.StatusInternalServerError)
+	}
+
 	// generate periodic donation order number
 	pdOrderNumber := generateOrderNumber(periodic, getPayMethodID(payMethodCollections[0]))
 	// Build a draft periodic donation record
 	periodicDonation := reqBody.BuildDraftPeriodicDonation(pdOrderNumber)
+	periodicDonation.PaymentGateway = gateway.Name()
+
+	// generate token donation order number, or take the one of the trade created on the payment gateway
+	dOrderNumber, failData, err := mc.orderNumberOfTrade(reqBody, gateway, token, defaultPeriodicPayMethod, &models.PayByCardTokenDonation{})
+	if nil != err {
+		return 0, gin.H{}, err
+	} else if failData != nil {
+		return http.StatusBadRequest, gin.H{"status": "fail", "data": failData}, nil
+	}
 
-	// generate token donation order number
-	dOrderNumber := generateOrderNumber(token, getPayMethodID(payMethodCollections[0]))
 	// Build a draft card token donation record
 	tokenDonation := reqBody.BuildTokenDraftRecord(dOrderNumber)
+	tokenDonation.PaymentGateway = gateway.Name()
 
-	// Build Tappay prime request
-	tapPayReq := reqBody.BuildTapPayReq(dOrderNumber)
-	tapPayReq.Details = fmt.Sprintf("%s;%s", donationDetails, tapPayReq.Details)
+	// Build pay by prime request
+	primeReq := reqBody.BuildPrimeReq(dOrderNumber, defaultPeriodicPayMethod)
+	primeReq.Details = fmt.Sprintf("%s;%s", donationDetails, primeReq.Details)
 
 	// Create a draft periodic donation along with the first token donation record of that periodic donation
 	err = mc.Storage.CreateAPeriodicDonation(&periodicDonation, &tokenDonation)
@@ -443,16 +623,15 @@ func (mc *MembershipController) CreateAPeriodicDonationOfAUser(c *gin.Context) (
 		return 0, gin.H{}, models.NewAppError(errWhere, errMsg, err.Error(), http.StatusInternalServerError)
 	}
 
-	// Start Tappay transaction
-	tapPayReqJson, _ := json.Marshal(tapPayReq)
-
-	tapPayResp, err = serveHttp(tapPayReq.PartnerKey, tapPayReqJson)
+	// Start the transaction on the payment gateway
+	c.Set(constants.GatewayCalledKey, true)
+	trx, err = gateway.PayByPrime(primeReq)
 
 	if nil != err {
-		if tapPayRespStatusSuccess != tapPayResp.Status {
-			// If tappay error occurs, update the transaction status to 'fail' and mark the periodic donation as 'invalid'.
-			tokenDonation.TappayApiStatus = null.IntFrom(tapPayResp.Status)
-			tokenDonation.Msg = tapPayResp.Msg
+		if payment.StatusSuccess != trx.Status {
+			// If the payment gateway rejects the transaction, update the transaction status to 'fail' and mark the periodic donation as 'invalid'.
+			tokenDonation.TappayApiStatus = null.IntFrom(trx.Status)
+			tokenDonation.Msg = trx.Msg
 			tokenDonation.Status = statusFail
 
 			periodicDonation.Status = statusInvalid
@@ -465,9 +644,34 @@ func (mc *MembershipController) CreateAPeriodicDonationOfAUser(c *gin.Context) (
 		return 0, gin.H{}, models.NewAppError(errWhere, errMsg, "", http.StatusInternalServerError)
 	}
 
-	// append tappay response onto donation model
-	tapPayResp.AppendRespOnPerodicDonation(&periodicDonation)
-	tapPayResp.AppendRespOnTokenDonation(&tokenDonation)
+	// append the transaction onto donation model
+	transaction(trx).AppendRespOnTokenDonation(&tokenDonation)
+
+	// The first installment authenticated by 3-D Secure is not completed until the donor is authenticated on the payment_url.
+	// The result will be sent to the backend notify endpoint.
+	pending := trx.PaymentURL != ""
+
+	if pending {
+		// The card secrets are kept on the 'paying' first installment rather than the periodic donation until the donor is authenticated,
+		// and they are moved onto the periodic donation only if the installment is paid.
+		tokenDonation.Status = statusPaying
+		periodicDonation.CardInfo = trx.CardInfo
+		periodicDonation.Status = statusPaying
+		tokenDonation.PendingCardKey, tokenDonation.PendingCardToken, err = mc.encryptCardSecret(trx.CardSecret)
+	} else {
+		err = transaction(trx).AppendRespOnPerodicDonation(&periodicDonation, mc.Keyring)
+	}
+
+	if nil != err {
+		// The first installment is paid, but the card secrets cannot be stored for the later installments.
+		// Record the paid installment and mark the periodic donation as 'invalid' instead of storing the card secrets in plaintext.
+		errMsg := fmt.Sprintf("cannot encrypt the card secrets of the periodic donation(order_number: %s). %s", periodicDonation.OrderNumber, err.Error())
+		log.Error(fmt.Sprintf("%s: %s", errWhere, errMsg))
+
+		mc.Storage.UpdatePeriodicAndCardTokenDonationInTRX(periodicDonation.ID, models.PeriodicDonation{CardInfo: trx.CardInfo, Status: statusInvalid}, tokenDonation)
+
+		return 0, gin.H{}, models.NewAppError(errWhere, errMsg, "", http.StatusInternalServerError)
+	}
 
 	if err = mc.Storage.UpdatePeriodicAndCardTokenDonationInTRX(periodicDonation.ID, periodicDonation, tokenDonation); nil != err {
 		log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
@@ -477,8 +681,18 @@ func (mc *MembershipController) CreateAPeriodicDonationOfAUser(c *gin.Context) (
 	resp := new(clientResp)
 	resp.BuildFromPeriodicDonationModel(periodicDonation)
 
+	if pending {
+		resp.PaymentUrl = trx.PaymentURL
+		return http.StatusCreated, gin.H{"status": "success", "data": resp}, nil
+	}
+
+	// the match of the first installment is told to the donor
+	if err = mc.appendDonationMatching(resp, globals.TokenDonationType, tokenDonation.ID); nil != err {
+		log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+	}
+
 	// send success mail asynchronously
-	go mc.sendDonationThankYouMail(*resp, "定期定額")
+	go mc.sendDonationThankYouMail(*resp, periodicDonationTypeName)
 
 	return http.StatusCreated, gin.H{"status": "success", "data": resp}, nil
 }
@@ -487,8 +701,9 @@ func (mc *MembershipController) CreateAPeriodicDonationOfAUser(c *gin.Context) (
 func (mc *MembershipController) CreateADonationOfAUser(c *gin.Context) (int, gin.H, error) {
 	const errorWhere = "MembershipController.CreateADonationOfAUser"
 	var err error
+	var gateway payment.PaymentGateway
 	var reqBody clientReq
-	var tapPayResp tapPayTransactionResp
+	var trx payment.Transaction
 
 	// Validate client request
 	if failData, valid := bindRequestBody(c, &reqBody); valid == false {
@@ -501,20 +716,61 @@ func (mc *MembershipController) CreateADonationOfAUser(c *gin.Context) (int, gin
 		return http.StatusBadRequest, gin.H{"status": "fail", "data": gin.H{"req.Body.pay_method": err.Error()}}, nil
 	}
 
+	// the fields omitted by the request are filled by the donor profile
+	if err = mc.prefillByDonorProfile(&reqBody); nil != err {
+		return 0, gin.H{}, err
+	}
+
 	if reqBody.Cardholder.Email == "" {
 		return http.StatusBadRequest, gin.H{"status": "fail", "data": gin.H{
 			"req.Body.donor.email": "donor email is not valid",
 		}}, nil
 	}
 
-	// generate token donation order number
-	dOrderNumber := generateOrderNumber(prime, getPayMethodID(payMethod))
+	if failData := reqBody.ValidateCurrency(); failData != nil {
+		return http.StatusBadRequest, gin.H{"status": "fail", "data": failData}, nil
+	}
+
+	if failData := reqBody.ValidateResultUrl(payMethod); failData != nil {
+		return http.StatusBadRequest, gin.H{"status": "fail", "data": failData}, nil
+	}
+
+	if failData := reqBody.ValidateSendReceipt(monthlyReceipt, noReceipt); failData != nil {
+		return http.StatusBadRequest, gin.H{"status": "fail", "data": failData}, nil
+	}
+
+	if failData := reqBody.ValidateDonorIdentity(); failData != nil {
+		return http.StatusBadRequest, gin.H{"status": "fail", "data": failData}, nil
+	}
+
+	if failData := validateDonorWallConsent(&reqBody.DonorWallConsent); failData != nil {
+		return http.StatusBadRequest, gin.H{"status": "fail", "data": failData}, nil
+	}
+
+	if failData, err := mc.validateCampaign(reqBody.Campaign); nil != err {
+		return 0, gin.H{}, err
+	} else if failData != nil {
+		return http.StatusBadRequest, gin.H{"status": "fail", "data": failData}, nil
+	}
+
+	if gateway, err = mc.Gateways.GetByPayMethod(payMethod); nil != err {
+		return 0, gin.H{}, models.NewAppError(errorWhere, err.Error(), "", http.StatusInternalServerError)
+	}
+
+	// generate prime donation order number, or take the one of the trade created on the payment gateway
+	dOrderNumber, failData, err := mc.orderNumberOfTrade(reqBody, gateway, prime, payMethod, &models.PayByPrimeDonation{})
+	if nil != err {
+		return 0, gin.H{}, err
+	} else if failData != nil {
+		return http.StatusBadRequest, gin.H{"status": "fail", "data": failData}, nil
+	}
+
 	// Build a draft card prime donation record
 	primeDonation := reqBody.BuildPrimeDraftRecord(dOrderNumber, payMethod)
+	primeDonation.PaymentGateway = gateway.Name()
 
-	// Start Tappay transaction
-	// Build Tappay pay by prime request
-	tapPayReq := reqBody.BuildTapPayReq(dOrderNumber)
+	// Build pay by prime request
+	primeReq := reqBody.BuildPrimeReq(dOrderNumber, payMethod)
 
 	if err = mc.Storage.Create(&primeDonation); nil != err {
 		switch appErr := err.(type) {
@@ -525,30 +781,32 @@ func (mc *MembershipController) CreateADonationOfAUser(c *gin.Context) (int, gin
 		}
 	}
 
-	tapPayReqJson, _ := json.Marshal(tapPayReq)
-
-	tapPayResp, err = serveHttp(tapPayReq.PartnerKey, tapPayReqJson)
+	// Start the transaction on the payment gateway
+	c.Set(constants.GatewayCalledKey, true)
+	trx, err = gateway.PayByPrime(primeReq)
 
 	if nil != err {
-		if tapPayRespStatusSuccess != tapPayResp.Status {
-			// If tappay error occurs, update the transaction status to 'fail'
+		if payment.StatusSuccess != trx.Status {
+			// If the payment gateway rejects the transaction, update the transaction status to 'fail'
 			d := models.PayByPrimeDonation{}
-			d.TappayApiStatus = null.IntFrom(tapPayResp.Status)
-			d.Msg = tapPayResp.Msg
+			d.TappayApiStatus = null.IntFrom(trx.Status)
+			d.Msg = trx.Msg
 			d.Status = statusFail
-			mc.Storage.UpdateByConditions(map[string]interface{}{
-				"id": primeDonation.ID,
-			}, d)
+			mc.Storage.UpdateAPrimeDonationInTRX(primeDonation.ID, nil, d)
 		}
 		return 0, gin.H{}, models.NewAppError(errorWhere, err.Error(), "", http.StatusInternalServerError)
 	}
 
-	// append tappay response onto donation model
-	tapPayResp.AppendRespOnPrimeDonation(&primeDonation)
+	// append the transaction onto donation model
+	transaction(trx).AppendRespOnPrimeDonation(&primeDonation)
 
-	if err, _ = mc.Storage.UpdateByConditions(map[string]interface{}{
-		"id": primeDonation.ID,
-	}, primeDonation); nil != err {
+	// LINE Pay transactions and the card transactions authenticated by 3-D Secure are not completed until donors confirm them on the payment_url.
+	// The result will be sent to the backend notify endpoint.
+	if trx.PaymentURL != "" {
+		primeDonation.Status = statusPaying
+	}
+
+	if _, err = mc.Storage.UpdateAPrimeDonationInTRX(primeDonation.ID, nil, primeDonation); nil != err {
 		log.Error(err.Error())
 	}
 
@@ -556,8 +814,17 @@ func (mc *MembershipController) CreateADonationOfAUser(c *gin.Context) (int, gin
 	resp := new(clientResp)
 	resp.BuildFromPrimeDonationModel(primeDonation)
 
+	if statusPaying == primeDonation.Status {
+		resp.PaymentUrl = trx.PaymentURL
+		return http.StatusCreated, gin.H{"status": "success", "data": resp}, nil
+	}
+
+	if err = mc.appendDonationMatching(resp, globals.PrimeDonaitionType, primeDonation.ID); nil != err {
+		log.Error(fmt.Sprintf("%s: %s", errorWhere, err.Error()))
+	}
+
 	// send success mail asynchronously
-	go mc.sendDonationThankYouMail(*resp, "單筆捐款")
+	go mc.sendDonationThankYouMail(*resp, primeDonationTypeName)
 
 	return http.StatusCreated, gin.H{"status": "success", "data": resp}, nil
 }
@@ -581,6 +848,14 @@ func (mc *MembershipController) PatchADonationOfAUser(c *gin.Context, donationTy
 		return http.StatusBadRequest, gin.H{"status": "fail", "data": failData}, nil
 	}
 
+	if failData = validateDonorIdentity(&reqBody.DonorIdentity); failData != nil {
+		return http.StatusBadRequest, gin.H{"status": "fail", "data": failData}, nil
+	}
+
+	if failData = validateDonorWallConsent(&reqBody.DonorWallConsent); failData != nil {
+		return http.StatusBadRequest, gin.H{"status": "fail", "data": failData}, nil
+	}
+
 	switch donationType {
 	case globals.PeriodicDonationType:
 		d = reqBody.BuildPeriodicDonation()
@@ -605,13 +880,12 @@ func (mc *MembershipController) PatchADonationOfAUser(c *gin.Context, donationTy
 		}, nil
 	}
 
-	return http.StatusNoContent, gin.H{}, nil
-}
+	// the changed consent takes effect on the donor wall right away
+	if reqBody.ShowOnWall.Valid || reqBody.DisplayName.Valid || reqBody.HideAmount.Valid {
+		mc.donorWall.clear()
+	}
 
-// TODO
-// GetDonationsOfAUser returns the donations list of a user
-func (mc *MembershipController) GetDonationsOfAUser(c *gin.Context) (int, gin.H, error) {
-	return 0, gin.H{}, nil
+	return http.StatusNoContent, gin.H{}, nil
 }
 
 // GetADonationOfAUser returns a donation of a user
@@ -647,16 +921,21 @@ func (mc *MembershipController) GetADonationOfAUser(c *gin.Context, donationType
 		resp.BuildFromPrimeDonationModel(d)
 		_userID = uint(d.UserID)
 		break
+	case globals.TokenDonationType:
+		d := models.PayByCardTokenDonation{}
+		pd := models.PeriodicDonation{}
+		if err = mc.Storage.Get(uint(recordID), &d); nil == err {
+			err = mc.Storage.Get(d.PeriodicID, &pd)
+		}
+		resp.BuildFromTokenDonationModel(d, pd)
+		_userID = uint(pd.UserID)
+		break
 	case globals.OthersDonationType:
 		d := models.PayByOtherMethodDonation{}
 		err = mc.Storage.Get(uint(recordID), &d)
 		resp.BuildFromOtherMethodDonationModel(d)
 		_userID = uint(d.UserID)
 		break
-
-	// TODO
-	// case globasl.PayByCardTokenDonation:
-
 	default:
 		return http.StatusInternalServerError, gin.H{"status": "error", "message": fmt.Sprintf("donation type %s is not supported", donationType)}, nil
 	}
@@ -677,114 +956,48 @@ func (mc *MembershipController) GetADonationOfAUser(c *gin.Context, donationType
 		}}, nil
 	}
 
-	return http.StatusOK, gin.H{"status": "success", "data": resp}, nil
-}
-
-func (resp tapPayTransactionResp) AppendRespOnPrimeDonation(m *models.PayByPrimeDonation) {
-	m.CardInfo = resp.CardInfo
-	m.TappayResp = resp.TappayResp
-	m.TappayApiStatus = null.IntFrom(resp.Status)
-
-	ttm := time.Unix(resp.TransactionTimeMillis/secToMsec, (resp.TransactionTimeMillis%secToMsec)*msecToNanosec)
-	m.TransactionTime = null.TimeFrom(ttm)
-
-	t, err := strconv.ParseInt(resp.BankTransactionTime.StartTimeMillis, 10, strconv.IntSize)
-	if nil == err {
-		stm := time.Unix(t/secToMsec, t%secToMsec)
-		m.BankTransactionStartTime = null.TimeFrom(stm)
-	}
-
-	t, err = strconv.ParseInt(resp.BankTransactionTime.EndTimeMillis, 10, strconv.IntSize)
-	if nil == err {
-		etm := time.Unix(t/secToMsec, t%secToMsec)
-		m.BankTransactionEndTime = null.TimeFrom(etm)
+	// periodic donations are not matched, but their paid installments are
+	if globals.PeriodicDonationType != donationType {
+		if err = mc.appendDonationMatching(resp, donationType, uint(recordID)); nil != err {
+			return 0, gin.H{}, err
+		}
 	}
 
-	m.Status = statusPaid
+	return http.StatusOK, gin.H{"status": "success", "data": resp}, nil
 }
 
-func (resp tapPayTransactionResp) AppendRespOnPerodicDonation(m *models.PeriodicDonation) {
-	m.CardInfo = resp.CardInfo
-
-	ciphertext := encrypt(resp.CardSecret.CardToken, globals.Conf.Donation.CardSecretKey)
-	m.CardToken = ciphertext
-
-	ciphertext = encrypt(resp.CardSecret.CardKey, globals.Conf.Donation.CardSecretKey)
-	m.CardKey = ciphertext
-
-	t := time.Now()
-	m.LastSuccessAt = null.TimeFrom(t)
+func (t transaction) AppendRespOnPrimeDonation(m *models.PayByPrimeDonation) {
+	m.CardInfo = t.CardInfo
+	m.TappayResp = t.TappayResp
+	m.TappayApiStatus = null.IntFrom(t.Status)
 	m.Status = statusPaid
 }
 
-func (resp tapPayTransactionResp) AppendRespOnTokenDonation(m *models.PayByCardTokenDonation) {
-	m.TappayResp = resp.TappayResp
-	m.TappayApiStatus = null.IntFrom(resp.Status)
+// AppendRespOnPerodicDonation appends the transaction and the encrypted card secrets onto the periodic donation.
+// The card secrets are never stored in plaintext, an error is returned if they cannot be encrypted.
+func (t transaction) AppendRespOnPerodicDonation(m *models.PeriodicDonation, k *keyring.Keyring) error {
+	var err error
 
-	ttm := time.Unix(resp.TransactionTimeMillis/secToMsec, (resp.TransactionTimeMillis%secToMsec)*msecToNanosec)
-	m.TransactionTime = null.TimeFrom(ttm)
+	m.CardInfo = t.CardInfo
 
-	t, err := strconv.ParseInt(resp.BankTransactionTime.StartTimeMillis, 10, strconv.IntSize)
-	if nil == err {
-		stm := time.Unix(t/secToMsec, t%secToMsec)
-		m.BankTransactionStartTime = null.TimeFrom(stm)
+	if m.CardToken, err = k.Encrypt(t.CardSecret.Token); nil != err {
+		return err
 	}
 
-	t, err = strconv.ParseInt(resp.BankTransactionTime.EndTimeMillis, 10, strconv.IntSize)
-	if nil == err {
-		etm := time.Unix(t/secToMsec, t%secToMsec)
-		m.BankTransactionEndTime = null.TimeFrom(etm)
+	if m.CardKey, err = k.Encrypt(t.CardSecret.Key); nil != err {
+		return err
 	}
 
+	now := time.Now()
+	m.LastSuccessAt = null.TimeFrom(now)
 	m.Status = statusPaid
+	return nil
 }
 
-func createHash(data string) []byte {
-	hash := sha256.Sum256([]byte(data))
-	return hash[:]
-}
-
-func decrypt(data string, key string) string {
-	hashKey := createHash(key)
-	block, _ := aes.NewCipher(hashKey)
-	gcm, _ := cipher.NewGCM(block)
-	nonceSize := gcm.NonceSize()
-
-	byteData := []byte(data)
-	nonce, ciphertext := byteData[:nonceSize], byteData[nonceSize:]
-	plaintext, err := gcm.Open(nil, nonce, ciphertext, nil)
-	if nil != err {
-		log.Error(err.Error())
-	}
-
-	return string(plaintext)
-}
-
-func encrypt(data string, key string) string {
-	hashKey := createHash(key)
-
-	// create a aes block cipher by the hash value of our key
-	block, _ := aes.NewCipher(hashKey)
-
-	// use Galois Counter Mode for better efficiency
-	gcm, err := cipher.NewGCM(block)
-	if nil != err {
-		//fallback to store plaintext instead
-		log.Error("cannot create a block cipher with the given key")
-		return data
-	}
-
-	nonce := make([]byte, gcm.NonceSize())
-
-	// generate random nonce for encryption
-	if _, err := io.ReadFull(rand.Reader, nonce); nil != err {
-		//fallback to store plaintext instead
-		log.Error("cannot generate a nonce")
-		return data
-	}
-
-	// prepend the cipher with the random nonce
-	return string(gcm.Seal(nonce, nonce, []byte(data), nil))
+func (t transaction) AppendRespOnTokenDonation(m *models.PayByCardTokenDonation) {
+	m.TappayResp = t.TappayResp
+	m.TappayApiStatus = null.IntFrom(t.Status)
+	m.Status = statusPaid
 }
 
 func generateOrderNumber(t payType, payMethodID int) string {
@@ -804,69 +1017,6 @@ func getPayMethodID(payMethod string) int {
 	return invalidPayMethodID
 }
 
-func handleTapPayBodyParseError(body []byte) (tapPayTransactionResp, error) {
-	var minResp tapPayMinTransactionResp
-	var resp tapPayTransactionResp
-	var err error
-
-	if err = json.Unmarshal(body, &minResp); nil != err {
-		return tapPayTransactionResp{}, errors.New("Cannot unmarshal json response from tap pay server")
-	}
-
-	if tapPayRespStatusSuccess != minResp.Status {
-		log.Error("tap pay msg: " + minResp.Msg)
-		err = errors.New("Cannot make success transaction on tap pay")
-	}
-
-	resp.Status = minResp.Status
-	resp.Msg = minResp.Msg
-
-	return resp, err
-}
-
-func serveHttp(key string, reqBodyJson []byte) (tapPayTransactionResp, error) {
-	// Setup HTTP client with timeout
-	client := &http.Client{Timeout: defaultRequestTimeout}
-
-	req, _ := http.NewRequest("POST", globals.Conf.Donation.TapPayURL, bytes.NewBuffer(reqBodyJson))
-	req.Header.Add("x-api-key", key)
-	req.Header.Add("Content-Type", "application/json")
-
-	rawResp, err := client.Do(req)
-
-	// If fail to sending request
-	if nil != err {
-		log.Error(err.Error())
-		return tapPayTransactionResp{}, errors.New("cannot request to tap pay server")
-	}
-	defer rawResp.Body.Close()
-
-	// If timeout or other errors occur during reading the body...
-	// TODO: Might require a mechanism to notify users
-	body, err := ioutil.ReadAll(rawResp.Body)
-	if nil != err {
-		log.Error(err.Error())
-		return tapPayTransactionResp{}, errors.New("Cannot read response from tap pay server")
-	}
-
-	resp := tapPayTransactionResp{}
-
-	err = json.Unmarshal(body, &resp)
-
-	switch {
-	case nil != err:
-		log.Error(err.Error())
-		return handleTapPayBodyParseError(body)
-	case tapPayRespStatusSuccess != resp.Status:
-		log.Error("tap pay msg: " + resp.Msg)
-		return resp, errors.New("Cannot make success transaction on tap pay")
-	default:
-		// Omit intentionally
-	}
-
-	return resp, nil
-}
-
 func validatePayMethod(payMethod string) error {
 	if invalidPayMethodID != getPayMethodID(payMethod) {
 		return nil
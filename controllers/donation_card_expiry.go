@@ -0,0 +1,290 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gin-gonic/gin"
+
+	"twreporter.org/go-api/currency"
+	"twreporter.org/go-api/globals"
+	"twreporter.org/go-api/models"
+	"twreporter.org/go-api/utils"
+)
+
+// cardExpiryDateLayout is the layout of `CardInfo.ExpiryDate`
+const cardExpiryDateLayout = "200601"
+
+const (
+	defaultRemindBatchSize = 100
+
+	// the replace card link is valid until the days after the card expires,
+	// so that donors could replace the card while the failed installments are retried
+	cardReplacementLinkGraceDays = 30
+
+	defaultCardExpirationMonths = 6
+	maxCardExpirationMonths     = 24
+)
+
+type (
+	// CardExpiryReminderSummary counts the results of a card expiry reminder run
+	CardExpiryReminderSummary struct {
+		// Reminded is the number of donors reminded of the expiring cards
+		Reminded int
+		// Skipped is the number of periodic donations whose donors are reminded by other workers in the meantime
+		Skipped int
+		// Failed are the ids of the periodic donations whose reminders cannot be sent, they are reminded again next run
+		Failed []uint
+	}
+
+	cardReplacementReq struct {
+		Prime string `json:"prime" binding:"required"`
+		// Token is the token in the replace card link of the card expiry reminder
+		Token string `json:"token" binding:"required"`
+	}
+
+	cardExpirationMonthResp struct {
+		// Month is in YYYY-MM format
+		Month             string `json:"month"`
+		PeriodicDonations uint   `json:"periodic_donations"`
+		Amount            uint   `json:"amount"`
+		Reminded          uint   `json:"reminded"`
+	}
+)
+
+// cardExpiresAt returns when the card of the expiry date(YYYYMM) expires, which is the end of the month in Taiwan
+func cardExpiresAt(expiryDate string) (time.Time, error) {
+	var location, _ = time.LoadLocation("Asia/Taipei")
+
+	month, err := time.ParseInLocation(cardExpiryDateLayout, expiryDate, location)
+	if nil != err {
+		return month, err
+	}
+
+	return month.AddDate(0, 1, 0), nil
+}
+
+// cardReplacementLink returns where the donor replaces the card by the token on the support site without signing in
+func cardReplacementLink(token string) string {
+	supportSiteURL := globals.SupportSiteStagingURL
+	if globals.ProductionEnvironment == globals.Conf.Environment {
+		supportSiteURL = globals.SupportSiteURL
+	}
+
+	return fmt.Sprintf("%s/card-replacement?token=%s", supportSiteURL, url.QueryEscape(token))
+}
+
+// RemindExpiringCards mails the donors of the active periodic donations whose cards expire within `withinDays` days from `now`
+// with the links to replace the cards. Every donor is reminded once per card, the reminder is recorded before it is sent,
+// and the record is removed if the reminder fails to be sent, so that it is sent again next run.
+func (mc *MembershipController) RemindExpiringCards(now time.Time, withinDays int, batchSize int) (CardExpiryReminderSummary, error) {
+	const errWhere = "MembershipController.RemindExpiringCards"
+	var location, _ = time.LoadLocation("Asia/Taipei")
+	var afterID uint
+	var summary CardExpiryReminderSummary
+
+	if batchSize <= 0 {
+		batchSize = defaultRemindBatchSize
+	}
+
+	// the cards expire at the end of the months, those expire before the month of `now + withinDays` are due to be reminded
+	from := now.In(location).Format(cardExpiryDateLayout)
+	until := now.In(location).AddDate(0, 0, withinDays).Format(cardExpiryDateLayout)
+
+	for {
+		pds, err := mc.Storage.GetExpiringPeriodicDonations(from, until, afterID, batchSize)
+		if nil != err {
+			return summary, err
+		}
+
+		for _, pd := range pds {
+			afterID = pd.ID
+
+			reminder := models.PeriodicDonationCardExpiryReminder{
+				Email:      pd.Cardholder.Email,
+				ExpiryDate: pd.CardInfo.ExpiryDate.ValueOrZero(),
+				PeriodicID: pd.ID,
+			}
+
+			created, err := mc.Storage.CreateACardExpiryReminder(&reminder)
+			if nil != err {
+				summary.Failed = append(summary.Failed, pd.ID)
+				continue
+			}
+
+			if !created {
+				summary.Skipped++
+				continue
+			}
+
+			if err = mc.sendCardExpiryReminderMail(pd, now); nil != err {
+				log.Error(fmt.Sprintf("%s: periodic donation(id: %d). %s", errWhere, pd.ID, err.Error()))
+				mc.Storage.DeleteACardExpiryReminder(reminder.ID)
+				summary.Failed = append(summary.Failed, pd.ID)
+				continue
+			}
+
+			summary.Reminded++
+		}
+
+		if len(pds) < batchSize {
+			break
+		}
+	}
+
+	log.Infof("%s: %d reminded, %d skipped, %d failed", errWhere, summary.Reminded, summary.Skipped, len(summary.Failed))
+	return summary, nil
+}
+
+// sendCardExpiryReminderMail mails the donor the link to replace the expiring card of the periodic donation
+func (mc *MembershipController) sendCardExpiryReminderMail(pd models.PeriodicDonation, now time.Time) error {
+	var location, _ = time.LoadLocation("Asia/Taipei")
+
+	expiresAt, err := cardExpiresAt(pd.CardInfo.ExpiryDate.ValueOrZero())
+	if nil != err {
+		return fmt.Errorf("cannot parse the card expiry date %s. %s", pd.CardInfo.ExpiryDate.ValueOrZero(), err.Error())
+	}
+
+	linkExpiresAt := expiresAt.AddDate(0, 0, cardReplacementLinkGraceDays)
+	token, err := utils.RetrieveCardReplacementToken(pd.ID, pd.UserID, pd.CardInfo.ExpiryDate.ValueOrZero(), int(linkExpiresAt.Sub(now).Seconds()))
+	if nil != err {
+		return err
+	}
+
+	reqBody := cardExpiryReminderReqBody{
+		Amount:           pd.Amount,
+		CardInfoLastFour: pd.CardInfo.LastFour.ValueOrZero(),
+		Currency:         pd.Currency,
+		Email:            pd.Cardholder.Email,
+		ExpiryMonth:      expiresAt.AddDate(0, -1, 0).Format("2006-01"),
+		LinkExpiryDate:   linkExpiresAt.In(location).AddDate(0, 0, -1).Format(dunningDateLayout),
+		Name:             pd.Cardholder.Name.ValueOrZero(),
+		OrderNumber:      pd.OrderNumber,
+		ReplaceCardLink:  cardReplacementLink(token),
+	}
+
+	return postMailServiceEndpoint(reqBody, fmt.Sprintf("http://localhost:%s/v1/%s", globals.LocalhostPort, globals.SendCardExpiryReminderRoutePath))
+}
+
+// ReplaceTheCardByAReminderLink method
+// Handler for the donor to replace the expiring card of a periodic donation by the link in the card expiry reminder without signing in.
+// The link is no longer accepted once the card is replaced.
+func (mc *MembershipController) ReplaceTheCardByAReminderLink(c *gin.Context) (int, gin.H, error) {
+	var claims utils.CardReplacementJWTClaims
+	var err error
+	var failCode int
+	var failData gin.H
+	var pd models.PeriodicDonation
+	var reqBody cardReplacementReq
+
+	if data, valid := bindRequestBody(c, &reqBody); valid == false {
+		return http.StatusBadRequest, gin.H{"status": "fail", "data": data}, nil
+	}
+
+	if claims, err = utils.ParseCardReplacementToken(reqBody.Token); nil != err {
+		return http.StatusUnauthorized, gin.H{"status": "fail", "data": gin.H{
+			"req.Body.token": fmt.Sprintf("the link is invalid or expired. %s", err.Error()),
+		}}, nil
+	}
+
+	if err = mc.Storage.Get(claims.PeriodicID, &pd); nil != err {
+		appErr, _ := err.(*models.AppError)
+		if appErr.StatusCode == http.StatusNotFound {
+			return http.StatusNotFound, gin.H{"status": "fail", "data": gin.H{
+				"req.Body.token": "the periodic donation of the link cannot be found",
+			}}, nil
+		}
+		return 0, gin.H{}, err
+	}
+
+	if pd.UserID != claims.UserID {
+		return http.StatusForbidden, gin.H{"status": "fail", "data": gin.H{
+			"req.Body.token": "the link is not permitted to replace the card",
+		}}, nil
+	}
+
+	if pd.CardInfo.ExpiryDate.ValueOrZero() != claims.ExpiryDate {
+		return http.StatusConflict, gin.H{"status": "fail", "data": gin.H{
+			"req.Body.token": fmt.Sprintf("the card of the periodic donation(order_number: %s) is already replaced", pd.OrderNumber),
+		}}, nil
+	}
+
+	if pd, failCode, failData, err = mc.replaceTheCardOfAPeriodicDonation(pd, reqBody.Prime, pd.UserID); nil != err {
+		return 0, gin.H{}, err
+	} else if 0 != failCode {
+		return failCode, gin.H{"status": "fail", "data": failData}, nil
+	}
+
+	// the link holder is not signed in, only the new card is responded without the cardholder
+	return http.StatusOK, gin.H{"status": "success", "data": gin.H{
+		"card_info":    pd.CardInfo,
+		"order_number": pd.OrderNumber,
+		"status":       pd.Status,
+	}}, nil
+}
+
+// GetCardExpirations method
+// Handler for admins to list the active periodic donations whose cards expire in the upcoming months, grouped by month.
+// The months without expiring cards are listed with zero counts, and the amounts are in TWD.
+func (mc *MembershipController) GetCardExpirations(c *gin.Context) (int, gin.H, error) {
+	var location, _ = time.LoadLocation("Asia/Taipei")
+	var err error
+	var months = defaultCardExpirationMonths
+
+	if _months := c.Query("months"); _months != "" {
+		if months, err = strconv.Atoi(_months); nil != err || months < 1 || months > maxCardExpirationMonths {
+			return http.StatusBadRequest, gin.H{"status": "fail", "data": gin.H{
+				"req.URL.query.months": fmt.Sprintf("months should be an integer between 1 and %d", maxCardExpirationMonths),
+			}}, nil
+		}
+	}
+
+	now := time.Now().In(location)
+	first := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, location)
+	from := first.Format(cardExpiryDateLayout)
+	until := first.AddDate(0, months, 0).Format(cardExpiryDateLayout)
+
+	expirations, err := mc.Storage.GetCardExpirationsByMonth(from, until)
+	if nil != err {
+		return 0, gin.H{}, err
+	}
+
+	rates, err := mc.Storage.GetExchangeRates(now)
+	if nil != err {
+		return 0, gin.H{}, err
+	}
+	rateTable := currency.NewRateTable(rates)
+
+	// the amounts in the other currencies are converted to TWD by the latest rates
+	byExpiryDate := make(map[string]models.CardExpirationMonth)
+	for _, e := range expirations {
+		amount, ok := rateTable.ToTWD(e.Currency, e.Amount, now)
+		if !ok {
+			log.Warnf("MembershipController.GetCardExpirations: no exchange rate of %s is loaded, the amount is not counted", e.Currency)
+		}
+
+		m := byExpiryDate[e.ExpiryDate]
+		m.PeriodicDonations += e.PeriodicDonations
+		m.Amount += amount
+		m.Reminded += e.Reminded
+		byExpiryDate[e.ExpiryDate] = m
+	}
+
+	resp := make([]cardExpirationMonthResp, 0, months)
+	for i := 0; i < months; i++ {
+		month := first.AddDate(0, i, 0)
+		e := byExpiryDate[month.Format(cardExpiryDateLayout)]
+		resp = append(resp, cardExpirationMonthResp{
+			Month:             month.Format("2006-01"),
+			PeriodicDonations: e.PeriodicDonations,
+			Amount:            e.Amount,
+			Reminded:          e.Reminded,
+		})
+	}
+
+	return http.StatusOK, gin.H{"status": "success", "data": gin.H{"months": resp}}, nil
+}
@@ -0,0 +1,117 @@
+package controllers
+
+import (
+	"fmt"
+
+	log "github.com/Sirupsen/logrus"
+
+	"twreporter.org/go-api/models"
+	"twreporter.org/go-api/payment"
+)
+
+const defaultRotateBatchSize = 100
+
+// CardSecretRotationSummary counts the results of a card secret rotation run
+type CardSecretRotationSummary struct {
+	// Rotated is the number of periodic donations re-encrypted by the primary key
+	Rotated int
+	// Skipped is the number of periodic donations already encrypted by the primary key, or whose card is replaced in the meantime
+	Skipped int
+	// Failed are the ids of the periodic donations whose card secrets cannot be decrypted or updated
+	Failed []uint
+}
+
+// encryptCardSecret returns the card key and the card token encrypted by the primary key
+func (mc *MembershipController) encryptCardSecret(secret payment.CardSecret) (string, string, error) {
+	cardKey, err := mc.Keyring.Encrypt(secret.Key)
+	if nil != err {
+		return "", "", err
+	}
+
+	cardToken, err := mc.Keyring.Encrypt(secret.Token)
+	if nil != err {
+		return "", "", err
+	}
+
+	return cardKey, cardToken, nil
+}
+
+// decryptCardSecret returns the card secrets of the periodic donation in plaintext
+func (mc *MembershipController) decryptCardSecret(pd models.PeriodicDonation) (payment.CardSecret, error) {
+	var secret payment.CardSecret
+	var err error
+
+	if secret.Key, err = mc.Keyring.Decrypt(pd.CardKey); nil != err {
+		return secret, fmt.Errorf("cannot decrypt the card key. %s", err.Error())
+	}
+
+	if secret.Token, err = mc.Keyring.Decrypt(pd.CardToken); nil != err {
+		return secret, fmt.Errorf("cannot decrypt the card token. %s", err.Error())
+	}
+
+	return secret, nil
+}
+
+// RotateCardSecrets re-encrypts the card secrets of every periodic donation by the primary key batch by batch.
+// The retired keys could be removed from the key set once no periodic donation fails to rotate.
+// It is safe to run while donors replace their cards, the replaced card secrets are skipped.
+func (mc *MembershipController) RotateCardSecrets(batchSize int) (CardSecretRotationSummary, error) {
+	const errWhere = "MembershipController.RotateCardSecrets"
+	var afterID uint
+	var summary CardSecretRotationSummary
+
+	if batchSize <= 0 {
+		batchSize = defaultRotateBatchSize
+	}
+
+	for {
+		pds, err := mc.Storage.GetPeriodicDonationCardSecrets(afterID, batchSize)
+		if nil != err {
+			return summary, err
+		}
+
+		for _, pd := range pds {
+			afterID = pd.ID
+
+			if mc.Keyring.IsCurrent(pd.CardKey) && mc.Keyring.IsCurrent(pd.CardToken) {
+				summary.Skipped++
+				continue
+			}
+
+			secret, err := mc.decryptCardSecret(pd)
+			if nil != err {
+				log.Error(fmt.Sprintf("%s: periodic donation(id: %d). %s", errWhere, pd.ID, err.Error()))
+				summary.Failed = append(summary.Failed, pd.ID)
+				continue
+			}
+
+			cardKey, cardToken, err := mc.encryptCardSecret(secret)
+			if nil != err {
+				log.Error(fmt.Sprintf("%s: periodic donation(id: %d). cannot encrypt the card secrets. %s", errWhere, pd.ID, err.Error()))
+				summary.Failed = append(summary.Failed, pd.ID)
+				continue
+			}
+
+			updated, err := mc.Storage.UpdateTheCardSecretsOfAPeriodicDonation(pd, cardKey, cardToken)
+			if nil != err {
+				summary.Failed = append(summary.Failed, pd.ID)
+				continue
+			}
+
+			if !updated {
+				// the card is replaced after the batch is loaded, which is encrypted by the primary key already
+				summary.Skipped++
+				continue
+			}
+
+			summary.Rotated++
+		}
+
+		if len(pds) < batchSize {
+			break
+		}
+	}
+
+	log.Infof("%s: %d rotated to key %s, %d skipped, %d failed", errWhere, summary.Rotated, mc.Keyring.PrimaryKeyID(), summary.Skipped, len(summary.Failed))
+	return summary, nil
+}
@@ -0,0 +1,261 @@
+package controllers
+
+import (
+	"fmt"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"gopkg.in/guregu/null.v3"
+
+	"twreporter.org/go-api/currency"
+	"twreporter.org/go-api/globals"
+	"twreporter.org/go-api/models"
+	"twreporter.org/go-api/payment"
+)
+
+const (
+	defaultChargeBatchSize = 100
+
+	installmentDetails = "定期定額捐款"
+)
+
+type (
+	// PeriodicChargeSummary counts the results of a periodic donation charging run
+	PeriodicChargeSummary struct {
+		// Applied is the number of scheduled periodic donation changes applied before charging
+		Applied int
+		// Charged is the number of installments paid successfully
+		Charged int
+		// Failed is the number of installments rejected by the payment gateways
+		Failed int
+		// Invalidated is the number of periodic donations which turn 'invalid' after the last retries fail
+		Invalidated int
+		// Pending is the number of installments whose results are unknown, they are left in 'paying'
+		Pending int
+		// Retried is the number of failed installments retried by the dunning schedule, they are counted in Charged, Failed or Pending as well
+		Retried int
+		// Skipped is the number of periodic donations claimed by other workers or lacking card secrets
+		Skipped int
+	}
+)
+
+// ChargeDuePeriodicDonations charges the next installment of every periodic donation which is due at `now`.
+// Each installment is recorded as a PayByCardTokenDonation.
+// The scheduled changes effective at `now` are applied first, so the installments are charged with the changed amounts and frequencies.
+// The failed installments due to be retried by the dunning schedule are charged afterwards.
+// A periodic donation is claimed before charging, so running several workers at once never double-charges an installment.
+func (mc *MembershipController) ChargeDuePeriodicDonations(now time.Time, batchSize int) (PeriodicChargeSummary, error) {
+	const errWhere = "MembershipController.ChargeDuePeriodicDonations"
+	var err error
+	var summary PeriodicChargeSummary
+
+	if batchSize <= 0 {
+		batchSize = defaultChargeBatchSize
+	}
+
+	if summary.Applied, err = mc.Storage.ApplyDuePeriodicDonationChanges(now); nil != err {
+		log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+		return summary, err
+	}
+
+	getters := []func(uint) ([]models.PeriodicDonation, error){
+		func(afterID uint) ([]models.PeriodicDonation, error) {
+			return mc.Storage.GetDuePeriodicDonations(now, afterID, batchSize)
+		},
+		func(afterID uint) ([]models.PeriodicDonation, error) {
+			return mc.Storage.GetDunningPeriodicDonations(now, afterID, batchSize)
+		},
+	}
+
+	for _, get := range getters {
+		var afterID uint
+
+		for {
+			pds, err := get(afterID)
+			if nil != err {
+				log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+				return summary, err
+			}
+
+			for _, pd := range pds {
+				afterID = pd.ID
+
+				if statusFail == pd.Status {
+					summary.Retried++
+				}
+
+				switch mc.chargeAPeriodicDonation(pd, now) {
+				case statusPaid:
+					summary.Charged++
+				case statusFail:
+					summary.Failed++
+				case statusInvalid:
+					summary.Failed++
+					summary.Invalidated++
+				case statusPaying:
+					summary.Pending++
+				default:
+					summary.Skipped++
+				}
+			}
+
+			if len(pds) < batchSize {
+				break
+			}
+		}
+	}
+
+	log.Infof("%s: %d changes applied, %d charged, %d failed, %d invalidated, %d pending, %d skipped, %d retried", errWhere, summary.Applied, summary.Charged, summary.Failed, summary.Invalidated, summary.Pending, summary.Skipped, summary.Retried)
+	return summary, nil
+}
+
+// chargeAPeriodicDonation charges one installment of the periodic donation at `now`,
+// and returns the status of the installment, or empty string if it is skipped.
+// 'invalid' is returned if the last retry of the failed installment fails.
+func (mc *MembershipController) chargeAPeriodicDonation(pd models.PeriodicDonation, now time.Time) string {
+	const errWhere = "MembershipController.chargeAPeriodicDonation"
+	var claimed bool
+	var err error
+	var gateway payment.PaymentGateway
+	var paidTimes uint
+	var secret payment.CardSecret
+	var trx payment.Transaction
+
+	if pd.CardToken == "" || pd.CardKey == "" {
+		log.Error(fmt.Sprintf("%s: periodic donation(id: %d) does not have card secrets", errWhere, pd.ID))
+		return ""
+	}
+
+	// Decrypt the card secrets before the installment is claimed,
+	// so that no installment is left in 'paying' if the keys are misconfigured
+	if secret, err = mc.decryptCardSecret(pd); nil != err {
+		log.Error(fmt.Sprintf("%s: periodic donation(id: %d). %s", errWhere, pd.ID, err.Error()))
+		return ""
+	}
+
+	// The card secrets could only be charged through the payment gateway which issues them
+	if gateway, err = mc.Gateways.Get(pd.PaymentGateway); nil != err {
+		log.Error(fmt.Sprintf("%s: periodic donation(id: %d). %s", errWhere, pd.ID, err.Error()))
+		return ""
+	}
+
+	if paidTimes, err = mc.Storage.GetPaidTimesOfAPeriodicDonation(pd.ID); nil != err {
+		return ""
+	}
+
+	// The card token is bound to the merchant of the first installment
+	first, err := mc.Storage.GetTheFirstInstallmentOfAPeriodicDonation(pd.ID)
+	if nil != err {
+		return ""
+	}
+
+	td := models.PayByCardTokenDonation{
+		Amount:         pd.Amount,
+		Campaign:       pd.Campaign,
+		Currency:       pd.Currency,
+		Details:        pd.Details,
+		MerchantID:     first.MerchantID,
+		OrderNumber:    generateOrderNumber(token, getPayMethodID(defaultPeriodicPayMethod)),
+		PaymentGateway: gateway.Name(),
+		Status:         statusPaying,
+	}
+
+	if claimed, err = mc.Storage.ClaimAPeriodicDonationCharge(pd, &td); nil != err || !claimed {
+		return ""
+	}
+
+	tokenReq := payment.TokenReq{
+		Amount:      td.Amount,
+		CardSecret:  secret,
+		Currency:    td.Currency,
+		Details:     fmt.Sprintf("%s;%s", installmentDetails, td.Details),
+		MerchantID:  td.MerchantID,
+		OrderNumber: td.OrderNumber,
+	}
+
+	if tokenReq.Currency == "" {
+		tokenReq.Currency = defaultCurrency
+	}
+
+	// The installments recorded without the merchant are charged by the merchant of the currency
+	if tokenReq.MerchantID == "" {
+		tokenReq.MerchantID = currency.FromConfig(globals.Conf.Donation).MerchantID(tokenReq.Currency)
+	}
+
+	if tokenReq.MerchantID == "" {
+		tokenReq.MerchantID = defaultMerchantID
+	}
+
+	trx, err = gateway.PayByToken(tokenReq)
+
+	if nil != err {
+		if payment.StatusSuccess == trx.Status {
+			// The result of the transaction is unknown,
+			// leave the records in 'paying' and let reconciliation resolve them.
+			log.Error(fmt.Sprintf("%s: cannot get the result of the installment(order_number: %s). %s", errWhere, td.OrderNumber, err.Error()))
+			return statusPaying
+		}
+
+		td.TappayApiStatus = null.IntFrom(trx.Status)
+		td.Msg = trx.Msg
+		td.Status = statusFail
+
+		// retry the failed installment by the dunning schedule, and ask the donor to update the card
+		m := models.PeriodicDonation{ID: pd.ID}
+		dunAPeriodicDonation(pd, &m, now)
+
+		if err = mc.Storage.UpdatePeriodicAndCardTokenDonationInTRX(pd.ID, m, td); nil != err {
+			log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+			return statusFail
+		}
+
+		mc.sendPeriodicDonationFailureMail(pd, m)
+		return m.Status
+	}
+
+	transaction(trx).AppendRespOnTokenDonation(&td)
+
+	m := models.PeriodicDonation{
+		ID:            pd.ID,
+		LastSuccessAt: null.TimeFrom(nextBillingDate(pd, now)),
+		Status:        statusPaid,
+	}
+
+	// Stop the periodic donation once it reaches the max paid times
+	if paidTimes+1 >= pd.MaxPaidTimes {
+		m.Status = statusStopped
+	}
+
+	if err = mc.Storage.UpdatePeriodicAndCardTokenDonationInTRX(pd.ID, m, td); nil != err {
+		log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+	}
+
+	return statusPaid
+}
+
+// nextBillingDate returns the billing date of the installment of the periodic donation paid at `now`.
+// It is advanced from the last billing date by the frequency, so that the billing date does not drift with the delays of the charges,
+// such as the dunning retries. The periods missed while the periodic donation is paused are skipped rather than charged later.
+func nextBillingDate(pd models.PeriodicDonation, now time.Time) time.Time {
+	if !pd.LastSuccessAt.Valid {
+		return now
+	}
+
+	advance := func(t time.Time) time.Time {
+		if yearlyFrequency == pd.Frequency {
+			return t.AddDate(1, 0, 0)
+		}
+		return t.AddDate(0, 1, 0)
+	}
+
+	next := advance(pd.LastSuccessAt.Time)
+	if next.After(now) {
+		return now
+	}
+
+	for !advance(next).After(now) {
+		next = advance(next)
+	}
+
+	return next
+}
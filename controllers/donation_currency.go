@@ -0,0 +1,23 @@
+package controllers
+
+import (
+	"io"
+
+	"twreporter.org/go-api/currency"
+)
+
+// LoadExchangeRates stores the daily exchange rates of the CSV file to convert the amounts to TWD in the reports.
+// The rates of the same dates and currencies are overwritten, so the file could be loaded again after it is corrected.
+// It returns the number of the rates in the file.
+func (mc *MembershipController) LoadExchangeRates(r io.Reader) (int, error) {
+	rates, err := currency.ParseRates(r)
+	if nil != err {
+		return 0, err
+	}
+
+	if err = mc.Storage.UpsertExchangeRates(rates); nil != err {
+		return 0, err
+	}
+
+	return len(rates), nil
+}
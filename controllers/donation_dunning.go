@@ -0,0 +1,137 @@
+package controllers
+
+import (
+	"fmt"
+	"net/url"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"gopkg.in/guregu/null.v3"
+
+	"twreporter.org/go-api/globals"
+	"twreporter.org/go-api/models"
+)
+
+const dunningDateLayout = "2006-01-02"
+
+// defaultDunningRetryDays are the days after the first failure when the failed installments are retried,
+// if `donation.dunning_retry_days` is not configured
+var defaultDunningRetryDays = []int{1, 3, 7}
+
+func dunningRetryDays() []int {
+	if len(globals.Conf.Donation.DunningRetryDays) > 0 {
+		return globals.Conf.Donation.DunningRetryDays
+	}
+	return defaultDunningRetryDays
+}
+
+// dunAPeriodicDonation sets the status and the dunning of the periodic donation onto `m` after its installment fails at `now`.
+// The first failure starts the dunning, and the failed installment is retried on the days of the schedule since then.
+// The periodic donation turns 'invalid' once the last retry fails.
+func dunAPeriodicDonation(pd models.PeriodicDonation, m *models.PeriodicDonation, now time.Time) {
+	retryDays := dunningRetryDays()
+
+	// the dunning is reset once the installment is paid or the card is replaced
+	if pd.DunningStartedAt.Valid {
+		m.DunningStartedAt = pd.DunningStartedAt
+		m.DunningRetries = pd.DunningRetries + 1
+	} else {
+		m.DunningStartedAt = null.TimeFrom(now)
+		m.DunningRetries = 0
+	}
+
+	if int(m.DunningRetries) >= len(retryDays) {
+		m.NextRetryAt = null.Time{}
+		m.Status = statusInvalid
+		return
+	}
+
+	m.NextRetryAt = null.TimeFrom(m.DunningStartedAt.Time.AddDate(0, 0, retryDays[m.DunningRetries]))
+	m.Status = statusFail
+}
+
+// cardUpdateLink returns where the donor updates the card of the periodic donation on the support site
+func cardUpdateLink(pd models.PeriodicDonation) string {
+	supportSiteURL := globals.SupportSiteStagingURL
+	if globals.ProductionEnvironment == globals.Conf.Environment {
+		supportSiteURL = globals.SupportSiteURL
+	}
+
+	return fmt.Sprintf("%s/account/periodic-donations/%s/card", supportSiteURL, url.PathEscape(pd.OrderNumber))
+}
+
+// sendPeriodicDonationFailureMail asks the donor to update the card after the installment fails.
+// The donor is told when the installment is retried, or that the periodic donation is stopped after the last retry fails.
+func (mc *MembershipController) sendPeriodicDonationFailureMail(pd models.PeriodicDonation, m models.PeriodicDonation) {
+	var location, _ = time.LoadLocation("Asia/Taipei")
+
+	reqBody := periodicDonationFailureReqBody{
+		Amount:           pd.Amount,
+		CardInfoLastFour: pd.CardInfo.LastFour.ValueOrZero(),
+		Currency:         pd.Currency,
+		Email:            pd.Cardholder.Email,
+		Final:            statusInvalid == m.Status,
+		Name:             pd.Cardholder.Name.ValueOrZero(),
+		OrderNumber:      pd.OrderNumber,
+		UpdateCardLink:   cardUpdateLink(pd),
+	}
+
+	if m.NextRetryAt.Valid {
+		reqBody.NextRetryDate = m.NextRetryAt.Time.In(location).Format(dunningDateLayout)
+	}
+
+	if err := postMailServiceEndpoint(reqBody, fmt.Sprintf("http://localhost:%s/v1/%s", globals.LocalhostPort, globals.SendPeriodicDonationFailureRoutePath)); err != nil {
+		log.Warnf("fail to send periodic donation(order_number: %s) failure mail due to %s", pd.OrderNumber, err.Error())
+	}
+}
+
+// SendAtRiskPeriodicDonationsSummary mails the staffs the periodic donations whose failed installments are being retried,
+// and the ones which turn 'invalid' since `since`.
+// No summary is sent if `donation.staff_email` is not configured or no periodic donation is at risk.
+// It returns the number of the periodic donations in the summary.
+func (mc *MembershipController) SendAtRiskPeriodicDonationsSummary(since time.Time) (int, error) {
+	var location, _ = time.LoadLocation("Asia/Taipei")
+
+	if globals.Conf.Donation.StaffEmail == "" {
+		return 0, nil
+	}
+
+	pds, err := mc.Storage.GetAtRiskPeriodicDonations(since)
+	if nil != err {
+		return 0, err
+	}
+
+	if len(pds) == 0 {
+		return 0, nil
+	}
+
+	reqBody := atRiskPeriodicDonationsReqBody{
+		Email: globals.Conf.Donation.StaffEmail,
+		Since: since.In(location).Format("2006-01-02 15:04:05 UTC+8"),
+	}
+
+	for _, pd := range pds {
+		d := atRiskPeriodicDonation{
+			Amount:           pd.Amount,
+			Currency:         pd.Currency,
+			DunningRetries:   pd.DunningRetries,
+			DunningStartedAt: pd.DunningStartedAt.Time.In(location).Format(dunningDateLayout),
+			Email:            pd.Cardholder.Email,
+			Name:             pd.Cardholder.Name.ValueOrZero(),
+			OrderNumber:      pd.OrderNumber,
+			Status:           pd.Status,
+		}
+
+		if pd.NextRetryAt.Valid {
+			d.NextRetryDate = pd.NextRetryAt.Time.In(location).Format(dunningDateLayout)
+		}
+
+		reqBody.Donations = append(reqBody.Donations, d)
+	}
+
+	if err = postMailServiceEndpoint(reqBody, fmt.Sprintf("http://localhost:%s/v1/%s", globals.LocalhostPort, globals.SendAtRiskPeriodicDonationsRoutePath)); nil != err {
+		return 0, err
+	}
+
+	return len(pds), nil
+}
@@ -0,0 +1,197 @@
+package controllers
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gin-gonic/gin"
+
+	"twreporter.org/go-api/currency"
+	"twreporter.org/go-api/export"
+	"twreporter.org/go-api/globals"
+	"twreporter.org/go-api/models"
+	"twreporter.org/go-api/utils"
+)
+
+const ledgerTimeLayout = "2006-01-02 15:04:05"
+
+// ledgerColumns is the column layout of the accounting ledger.
+// Bookkeeping software imports the ledger by the positions of the columns,
+// so new columns should be appended to the end, and the existing columns should never be reordered or removed.
+var ledgerColumns = []export.Column{
+	{Name: "type"},
+	{Name: "id", Numeric: true},
+	{Name: "created_at"},
+	{Name: "transaction_time"},
+	{Name: "order_number"},
+	{Name: "bank_transaction_id"},
+	{Name: "rec_trade_id"},
+	{Name: "amount", Numeric: true},
+	{Name: "currency"},
+	{Name: "pay_method"},
+	{Name: "card_type"},
+	{Name: "card_last_four"},
+	{Name: "status"},
+	{Name: "exchange_rate", Numeric: true},
+	{Name: "amount_twd", Numeric: true},
+	{Name: "donor_type"},
+	{Name: "company_name"},
+	{Name: "tax_id"},
+}
+
+var ledgerTypes = []string{
+	globals.PrimeDonaitionType,
+	globals.TokenDonationType,
+	globals.OthersDonationType,
+}
+
+// NewLedgerFilter builds the ledger filter of the donations created from `since` to `until`, both are dates in YYYY-MM-DD format and inclusive.
+// `types` and `payMethods` could be comma separated, and empty means all.
+func NewLedgerFilter(since, until, types, status, payMethods string) (models.LedgerFilter, gin.H) {
+	var filter models.LedgerFilter
+	var location, _ = time.LoadLocation("Asia/Taipei")
+
+	t, err := time.ParseInLocation(donationsDateLayout, since, location)
+	if err != nil {
+		return filter, gin.H{"req.URL.query.since": "since should be a date in YYYY-MM-DD format"}
+	}
+	filter.Since = t
+
+	t, err = time.ParseInLocation(donationsDateLayout, until, location)
+	if err != nil {
+		return filter, gin.H{"req.URL.query.until": "until should be a date in YYYY-MM-DD format"}
+	}
+	// the donations made on `until` are included
+	filter.Until = t.AddDate(0, 0, 1)
+
+	if !filter.Since.Before(filter.Until) {
+		return filter, gin.H{"req.URL.query.since": "since should not be later than until"}
+	}
+
+	if types != "" {
+		for _, v := range strings.Split(types, ",") {
+			if !utils.ContainsString(ledgerTypes, v) {
+				return filter, gin.H{"req.URL.query.type": fmt.Sprintf("type should be one of %s", strings.Join(ledgerTypes, ", "))}
+			}
+			filter.Types = append(filter.Types, v)
+		}
+	}
+
+	filter.Status = status
+
+	if payMethods != "" {
+		filter.PayMethods = strings.Split(payMethods, ",")
+	}
+
+	return filter, nil
+}
+
+// ledgerRecord prints the entry in the order of the columns.
+// The amount is converted to TWD by the rate on the transaction date, and the rate is left empty if it is not loaded.
+func ledgerRecord(e models.LedgerEntry, rates *currency.RateTable, location *time.Location) []string {
+	var transactionTime string
+	paidAt := e.CreatedAt
+	if e.TransactionTime.Valid {
+		transactionTime = e.TransactionTime.Time.In(location).Format(ledgerTimeLayout)
+		paidAt = e.TransactionTime.Time
+	}
+
+	var exchangeRate, amountTWD string
+	if rate, ok := rates.Rate(e.Currency, paidAt); ok {
+		twd, _ := rates.ToTWD(e.Currency, e.Amount, paidAt)
+		exchangeRate = strconv.FormatFloat(rate, 'f', -1, 64)
+		amountTWD = fmt.Sprint(twd)
+	}
+
+	var cardType string
+	if e.CardInfoType.Valid {
+		cardType = cardInfoTypes[e.CardInfoType.Int64]
+	}
+
+	return []string{
+		e.Type,
+		fmt.Sprint(e.ID),
+		e.CreatedAt.In(location).Format(ledgerTimeLayout),
+		transactionTime,
+		e.OrderNumber,
+		e.BankTransactionID,
+		e.RecTradeID,
+		fmt.Sprint(e.Amount),
+		e.Currency,
+		e.PayMethod,
+		cardType,
+		e.CardInfoLastFour.ValueOrZero(),
+		e.Status,
+		exchangeRate,
+		amountTWD,
+		e.DonorType,
+		e.CompanyName,
+		e.TaxID,
+	}
+}
+
+// WriteDonationLedger streams the prime, card token and other method donations matching the filter into `w`,
+// in CSV or XLSX format. Times are in Taipei time.
+func (mc *MembershipController) WriteDonationLedger(w io.Writer, format string, filter models.LedgerFilter) error {
+	location, _ := time.LoadLocation("Asia/Taipei")
+
+	rates, err := mc.Storage.GetExchangeRates(filter.Until)
+	if nil != err {
+		return err
+	}
+	rateTable := currency.NewRateTable(rates)
+
+	ew, err := export.NewWriter(w, format, ledgerColumns)
+	if nil != err {
+		return err
+	}
+
+	if err = mc.Storage.IterateLedgerEntries(filter, func(e models.LedgerEntry) error {
+		return ew.Write(ledgerRecord(e, rateTable, location))
+	}); nil != err {
+		return err
+	}
+
+	return ew.Close()
+}
+
+// ExportDonations streams the accounting ledger of the donations for admins.
+// The response is the file instead of JSend unless the query strings are invalid.
+func (mc *MembershipController) ExportDonations(c *gin.Context) {
+	format := c.DefaultQuery("format", export.FormatCSV)
+
+	contentType, ok := export.ContentTypes[format]
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "fail", "data": gin.H{
+			"req.URL.query.format": fmt.Sprintf("format should be %s or %s", export.FormatCSV, export.FormatXLSX),
+		}})
+		return
+	}
+
+	filter, failData := NewLedgerFilter(c.Query("since"), c.Query("until"), c.Query("type"), c.Query("status"), c.Query("pay_method"))
+	if failData != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "fail", "data": failData})
+		return
+	}
+
+	c.Header("Content-Type", contentType)
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=\"donations-%s-%s.%s\"", c.Query("since"), c.Query("until"), format))
+	c.Status(http.StatusOK)
+
+	if err := mc.WriteDonationLedger(c.Writer, format, filter); nil != err {
+		appErr := appErrorTypeAssertion(err)
+		log.Error(appErr.Error())
+
+		// the broken file is left to the client once it is being streamed
+		if !c.Writer.Written() {
+			c.Header("Content-Disposition", "")
+			c.Header("Content-Type", "")
+			c.JSON(appErr.StatusCode, gin.H{"status": "error", "message": appErr.Message})
+		}
+	}
+}
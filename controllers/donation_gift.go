@@ -0,0 +1,228 @@
+package controllers
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gin-gonic/gin"
+
+	"twreporter.org/go-api/export"
+	"twreporter.org/go-api/globals"
+	"twreporter.org/go-api/models"
+)
+
+const defaultQueueGiftsBatchSize = 100
+
+// giftShippingColumns is the column layout of the shipping list handed to the logistics company
+var giftShippingColumns = []export.Column{
+	{Name: "id", Numeric: true},
+	{Name: "queued_at"},
+	{Name: "order_number"},
+	{Name: "name"},
+	{Name: "company_name"},
+	{Name: "zip_code"},
+	{Name: "address"},
+	{Name: "phone_number"},
+	{Name: "email"},
+	{Name: "amount", Numeric: true},
+	{Name: "currency"},
+}
+
+type shipAGiftReq struct {
+	// Carrier is the logistics company, e.g. 中華郵政
+	Carrier        string `json:"carrier"`
+	TrackingNumber string `json:"tracking_number" binding:"required,max=50"`
+	UserID         uint   `json:"user_id" binding:"required"`
+}
+
+// feedbackGiftRule returns the rule of the feedback gifts by the configuration
+func feedbackGiftRule() models.FeedbackGiftRule {
+	rule := models.FeedbackGiftRule{
+		MinAmounts:      make(map[string]uint),
+		MinInstallments: globals.Conf.Donation.FeedbackGiftMinInstallments,
+	}
+
+	for code, c := range globals.Conf.Donation.Currencies {
+		if c.FeedbackGiftMinAmount > 0 {
+			rule.MinAmounts[code] = c.FeedbackGiftMinAmount
+		}
+	}
+
+	return rule
+}
+
+// QueueFeedbackGifts queues the feedback gifts of the active periodic donations which want the gifts and meet the rule,
+// and returns how many gifts are queued. Each periodic donation is queued once.
+func (mc *MembershipController) QueueFeedbackGifts(now time.Time, batchSize int) (int, error) {
+	var afterID uint
+	var queued int
+	rule := feedbackGiftRule()
+
+	if batchSize <= 0 {
+		batchSize = defaultQueueGiftsBatchSize
+	}
+
+	for {
+		pds, err := mc.Storage.GetGiftEligiblePeriodicDonations(rule, afterID, batchSize)
+		if nil != err {
+			return queued, err
+		}
+
+		for _, pd := range pds {
+			afterID = pd.ID
+
+			created, err := mc.Storage.CreateAGiftFulfillment(&models.GiftFulfillment{
+				CreatedAt:  now,
+				PeriodicID: pd.ID,
+				Status:     models.GiftFulfillmentQueued,
+				UserID:     pd.UserID,
+			})
+			if nil != err {
+				return queued, err
+			}
+
+			if created {
+				queued++
+			}
+		}
+
+		if len(pds) < batchSize {
+			break
+		}
+	}
+
+	return queued, nil
+}
+
+// WriteGiftShippingList writes the queued gifts along with the addresses into `w`, in CSV or XLSX format
+func (mc *MembershipController) WriteGiftShippingList(w io.Writer, format string) error {
+	location, _ := time.LoadLocation("Asia/Taipei")
+
+	items, err := mc.Storage.GetQueuedGiftShippingItems()
+	if nil != err {
+		return err
+	}
+
+	ew, err := export.NewWriter(w, format, giftShippingColumns)
+	if nil != err {
+		return err
+	}
+
+	for _, item := range items {
+		if err = ew.Write([]string{
+			fmt.Sprint(item.ID),
+			item.QueuedAt.In(location).Format(ledgerTimeLayout),
+			item.OrderNumber,
+			item.Name.ValueOrZero(),
+			item.CompanyName,
+			item.ZipCode.ValueOrZero(),
+			item.Address.ValueOrZero(),
+			item.PhoneNumber.ValueOrZero(),
+			item.Email,
+			fmt.Sprint(item.Amount),
+			item.Currency,
+		}); nil != err {
+			return err
+		}
+	}
+
+	return ew.Close()
+}
+
+// ExportGiftShippingList streams the shipping list of the queued gifts for admins.
+// The response is the file instead of JSend unless the query strings are invalid.
+func (mc *MembershipController) ExportGiftShippingList(c *gin.Context) {
+	format := c.DefaultQuery("format", export.FormatCSV)
+
+	contentType, ok := export.ContentTypes[format]
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"status": "fail", "data": gin.H{
+			"req.URL.query.format": fmt.Sprintf("format should be %s or %s", export.FormatCSV, export.FormatXLSX),
+		}})
+		return
+	}
+
+	c.Header("Content-Type", contentType)
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=\"gifts-%s.%s\"", time.Now().Format(donationsDateLayout), format))
+	c.Status(http.StatusOK)
+
+	if err := mc.WriteGiftShippingList(c.Writer, format); nil != err {
+		appErr := appErrorTypeAssertion(err)
+		log.Error(appErr.Error())
+
+		if !c.Writer.Written() {
+			c.Header("Content-Disposition", "")
+			c.Header("Content-Type", "")
+			c.JSON(appErr.StatusCode, gin.H{"status": "error", "message": appErr.Message})
+		}
+	}
+}
+
+// ShipAGift method
+// Handler for admins to mark the queued gift shipped with the tracking number, and the donor is notified by mail
+func (mc *MembershipController) ShipAGift(c *gin.Context) (int, gin.H, error) {
+	var gf models.GiftFulfillment
+	var pd models.PeriodicDonation
+	var reqBody shipAGiftReq
+
+	if failData, valid := bindRequestBody(c, &reqBody); valid == false {
+		return http.StatusBadRequest, gin.H{"status": "fail", "data": failData}, nil
+	}
+
+	id, err := strconv.ParseUint(c.Param("id"), 10, strconv.IntSize)
+	if nil != err {
+		return http.StatusNotFound, gin.H{"status": "fail", "data": gin.H{
+			"req.URL": fmt.Sprintf("%s cannot address a found resource", c.Request.RequestURI),
+		}}, nil
+	}
+
+	shipped, err := mc.Storage.ShipAGiftFulfillment(uint(id), reqBody.Carrier, reqBody.TrackingNumber, reqBody.UserID, time.Now())
+	if nil != err {
+		return 0, gin.H{}, err
+	}
+
+	if err = mc.Storage.Get(uint(id), &gf); nil != err {
+		appErr, _ := err.(*models.AppError)
+		if nil != appErr && appErr.StatusCode == http.StatusNotFound {
+			return http.StatusNotFound, gin.H{"status": "fail", "data": gin.H{
+				"req.URL": fmt.Sprintf("gift(id: %d) cannot be found", id),
+			}}, nil
+		}
+		return 0, gin.H{}, err
+	}
+
+	if !shipped {
+		return http.StatusConflict, gin.H{"status": "fail", "data": gin.H{
+			"req.URL": fmt.Sprintf("gift(id: %d) is already shipped with the tracking number %s", id, gf.TrackingNumber.ValueOrZero()),
+		}}, nil
+	}
+
+	if err = mc.Storage.Get(gf.PeriodicID, &pd); nil != err {
+		return 0, gin.H{}, err
+	}
+
+	// send gift shipped mail asynchronously
+	go mc.sendGiftShippedMail(gf, pd)
+
+	return http.StatusOK, gin.H{"status": "success", "data": gf}, nil
+}
+
+func (mc *MembershipController) sendGiftShippedMail(gf models.GiftFulfillment, pd models.PeriodicDonation) {
+	reqBody := giftShippedReqBody{
+		Address:        pd.Cardholder.Address.ValueOrZero(),
+		Carrier:        gf.Carrier.ValueOrZero(),
+		Email:          pd.Cardholder.Email,
+		Name:           pd.Cardholder.Name.ValueOrZero(),
+		OrderNumber:    pd.OrderNumber,
+		TrackingNumber: gf.TrackingNumber.ValueOrZero(),
+		ZipCode:        pd.Cardholder.ZipCode.ValueOrZero(),
+	}
+
+	if err := postMailServiceEndpoint(reqBody, fmt.Sprintf("http://localhost:%s/v1/%s", globals.LocalhostPort, globals.SendGiftShippedRoutePath)); err != nil {
+		log.Warnf("fail to send the shipped mail of the gift(id: %d, order_number: %s) due to %s", gf.ID, pd.OrderNumber, err.Error())
+	}
+}
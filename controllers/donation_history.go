@@ -0,0 +1,240 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gopkg.in/guregu/null.v3"
+
+	"twreporter.org/go-api/globals"
+	"twreporter.org/go-api/models"
+	"twreporter.org/go-api/utils"
+)
+
+const (
+	defaultDonationsLimit = 10
+	maxDonationsLimit     = 50
+
+	donationsDateLayout = "2006-01-02"
+)
+
+var donationHistoryTypes = []string{
+	globals.PrimeDonaitionType,
+	globals.PeriodicDonationType,
+	globals.OthersDonationType,
+}
+
+type (
+	// donationHistoryRecord is a donation in the donation history of a user
+	donationHistoryRecord struct {
+		clientResp
+		CreatedAt time.Time `json:"created_at"`
+		// Installments are the card token donations charged for the periodic donation
+		Installments []installmentResp `json:"installments,omitempty"`
+		Type         string            `json:"type"`
+	}
+
+	installmentResp struct {
+		Amount      uint      `json:"amount"`
+		CreatedAt   time.Time `json:"created_at"`
+		Currency    string    `json:"currency"`
+		ID          uint      `json:"id"`
+		OrderNumber string    `json:"order_number"`
+		Status      string    `json:"status"`
+	}
+)
+
+// parseDonationFilter parses `type`, `status`, `since` and `until` query strings into models.DonationFilter.
+// `type` could be comma separated, and `since`, `until` are dates in YYYY-MM-DD format.
+func parseDonationFilter(c *gin.Context) (models.DonationFilter, gin.H) {
+	var filter models.DonationFilter
+	var location, _ = time.LoadLocation("Asia/Taipei")
+
+	if types := c.Query("type"); types != "" {
+		for _, t := range strings.Split(types, ",") {
+			if !utils.ContainsString(donationHistoryTypes, t) {
+				return filter, gin.H{"req.URL.query.type": fmt.Sprintf("type should be one of %s", strings.Join(donationHistoryTypes, ", "))}
+			}
+			filter.Types = append(filter.Types, t)
+		}
+	}
+
+	filter.Status = c.Query("status")
+
+	if since := c.Query("since"); since != "" {
+		t, err := time.ParseInLocation(donationsDateLayout, since, location)
+		if err != nil {
+			return filter, gin.H{"req.URL.query.since": "since should be a date in YYYY-MM-DD format"}
+		}
+		filter.Since = null.TimeFrom(t)
+	}
+
+	if until := c.Query("until"); until != "" {
+		t, err := time.ParseInLocation(donationsDateLayout, until, location)
+		if err != nil {
+			return filter, gin.H{"req.URL.query.until": "until should be a date in YYYY-MM-DD format"}
+		}
+		// the donations made on `until` are included
+		filter.Until = null.TimeFrom(t.AddDate(0, 0, 1))
+	}
+
+	return filter, nil
+}
+
+// GetDonationsOfAUser method
+// Handler for an authenticated user to list the prime, periodic and other method donations,
+// sorted by the creation time in descending order.
+// Periodic donations come with their installments.
+func (mc *MembershipController) GetDonationsOfAUser(c *gin.Context) (int, gin.H, error) {
+	var err error
+	var failData gin.H
+	var filter models.DonationFilter
+	var indexes []models.DonationIndex
+	var total int
+	var userID uint64
+
+	if userID, err = strconv.ParseUint(c.Param("userID"), 10, strconv.IntSize); err != nil {
+		return http.StatusNotFound, gin.H{"status": "fail", "data": gin.H{
+			"req.URL": fmt.Sprintf("%s cannot address a found resource", c.Request.RequestURI),
+		}}, nil
+	}
+
+	if filter, failData = parseDonationFilter(c); failData != nil {
+		return http.StatusBadRequest, gin.H{"status": "fail", "data": failData}, nil
+	}
+
+	limit, _ := strconv.Atoi(c.Query("limit"))
+	offset, _ := strconv.Atoi(c.Query("offset"))
+
+	if limit <= 0 {
+		limit = defaultDonationsLimit
+	}
+
+	if limit > maxDonationsLimit {
+		limit = maxDonationsLimit
+	}
+
+	if offset < 0 {
+		offset = 0
+	}
+
+	if _, err = mc.Storage.GetUserByID(fmt.Sprint(userID)); err != nil {
+		appErr, _ := err.(*models.AppError)
+		if appErr.StatusCode == http.StatusNotFound {
+			return appErr.StatusCode, gin.H{"status": "fail", "data": gin.H{
+				"req.URL": fmt.Sprintf("%s cannot address a found resource", c.Request.RequestURI),
+			}}, nil
+		}
+		return 0, gin.H{}, err
+	}
+
+	if indexes, total, err = mc.Storage.GetDonationIndexesOfAUser(uint(userID), filter, limit, offset); err != nil {
+		return 0, gin.H{}, err
+	}
+
+	records, err := mc.buildDonationHistoryRecords(indexes)
+	if err != nil {
+		return 0, gin.H{}, err
+	}
+
+	return http.StatusOK, gin.H{"status": "success", "data": gin.H{
+		"records": records,
+		"meta": models.MetaOfResponse{
+			Total:  total,
+			Offset: offset,
+			Limit:  limit,
+		},
+	}}, nil
+}
+
+// buildDonationHistoryRecords loads the donations of the indexes by types,
+// and builds the records in the order of the indexes.
+func (mc *MembershipController) buildDonationHistoryRecords(indexes []models.DonationIndex) ([]donationHistoryRecord, error) {
+	var err error
+	var ids = make(map[string][]uint)
+	var installments []models.PayByCardTokenDonation
+	var others []models.PayByOtherMethodDonation
+	var periodics []models.PeriodicDonation
+	var primes []models.PayByPrimeDonation
+
+	records := make([]donationHistoryRecord, 0, len(indexes))
+	resps := make(map[string]map[uint]donationHistoryRecord)
+
+	for _, index := range indexes {
+		ids[index.Type] = append(ids[index.Type], index.ID)
+		resps[index.Type] = make(map[uint]donationHistoryRecord)
+	}
+
+	if len(ids[globals.PrimeDonaitionType]) > 0 {
+		if err = mc.Storage.GetByConditions(map[string]interface{}{"id": ids[globals.PrimeDonaitionType]}, &primes); err != nil {
+			return records, err
+		}
+	}
+
+	for _, d := range primes {
+		r := donationHistoryRecord{CreatedAt: d.CreatedAt, Type: globals.PrimeDonaitionType}
+		r.BuildFromPrimeDonationModel(d)
+		resps[globals.PrimeDonaitionType][d.ID] = r
+	}
+
+	if len(ids[globals.PeriodicDonationType]) > 0 {
+		if err = mc.Storage.GetByConditions(map[string]interface{}{"id": ids[globals.PeriodicDonationType]}, &periodics); err != nil {
+			return records, err
+		}
+
+		if err = mc.Storage.GetByConditions(map[string]interface{}{"periodic_id": ids[globals.PeriodicDonationType]}, &installments); err != nil {
+			return records, err
+		}
+	}
+
+	// installments are listed in the order they were charged
+	sort.Slice(installments, func(i, j int) bool {
+		return installments[i].ID < installments[j].ID
+	})
+
+	for _, d := range periodics {
+		r := donationHistoryRecord{CreatedAt: d.CreatedAt, Type: globals.PeriodicDonationType}
+		r.BuildFromPeriodicDonationModel(d)
+		r.PayMethod = defaultPeriodicPayMethod
+
+		for _, td := range installments {
+			if td.PeriodicID == d.ID {
+				r.Installments = append(r.Installments, installmentResp{
+					Amount:      td.Amount,
+					CreatedAt:   td.CreatedAt,
+					Currency:    td.Currency,
+					ID:          td.ID,
+					OrderNumber: td.OrderNumber,
+					Status:      td.Status,
+				})
+			}
+		}
+
+		resps[globals.PeriodicDonationType][d.ID] = r
+	}
+
+	if len(ids[globals.OthersDonationType]) > 0 {
+		if err = mc.Storage.GetByConditions(map[string]interface{}{"id": ids[globals.OthersDonationType]}, &others); err != nil {
+			return records, err
+		}
+	}
+
+	for _, d := range others {
+		r := donationHistoryRecord{CreatedAt: d.CreatedAt, Type: globals.OthersDonationType}
+		r.BuildFromOtherMethodDonationModel(d)
+		resps[globals.OthersDonationType][d.ID] = r
+	}
+
+	for _, index := range indexes {
+		if r, ok := resps[index.Type][index.ID]; ok {
+			records = append(records, r)
+		}
+	}
+
+	return records, nil
+}
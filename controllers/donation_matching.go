@@ -0,0 +1,231 @@
+package controllers
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"gopkg.in/guregu/null.v3"
+
+	"twreporter.org/go-api/currency"
+	"twreporter.org/go-api/export"
+	"twreporter.org/go-api/globals"
+	"twreporter.org/go-api/models"
+)
+
+// the ratio is stored in decimal(5,2)
+const maxMatchingRatio = 999.99
+
+// matchableDonationTypes are the donation types which sponsors could match
+var matchableDonationTypes = []string{globals.PrimeDonaitionType, globals.TokenDonationType, globals.OthersDonationType}
+
+// matchingReportColumns is the column layout of the reconciliation report mailed to the sponsor
+var matchingReportColumns = []export.Column{
+	{Name: "paid_at"},
+	{Name: "order_number"},
+	{Name: "donation_type"},
+	{Name: "amount", Numeric: true},
+	{Name: "matched_amount", Numeric: true},
+	{Name: "currency"},
+}
+
+// matchingResp tells the donor that the donation is matched by the sponsor
+type matchingResp struct {
+	MatchedAmount uint   `json:"matched_amount"`
+	Sponsor       string `json:"sponsor"`
+}
+
+// CreateAMatchingRule creates the rule of the sponsor to match the paid donations by the ratio until the budget runs out.
+// The dates are in YYYY-MM-DD format and inclusive as the dates of campaigns.
+// The donation types are separated by commas, and all types are matched if they are empty.
+func (mc *MembershipController) CreateAMatchingRule(sponsor string, sponsorEmail string, ratio float64, budget uint, currencyCode string, donationTypes string, campaign string, startDate string, endDate string) (models.MatchingRule, error) {
+	var location, _ = time.LoadLocation("Asia/Taipei")
+	var rule models.MatchingRule
+	var types []string
+
+	if sponsor == "" || len(sponsor) > 100 {
+		return rule, errors.New("sponsor is required and should be at most 100 characters")
+	}
+
+	if _, err := mail.ParseAddress(sponsorEmail); nil != err {
+		return rule, fmt.Errorf("sponsor email is not valid. %s", err.Error())
+	}
+
+	if ratio <= 0 || ratio > maxMatchingRatio {
+		return rule, fmt.Errorf("ratio should be greater than 0 and at most %.2f", maxMatchingRatio)
+	}
+
+	if budget == 0 {
+		return rule, errors.New("budget should be greater than 0")
+	}
+
+	currencyCode = strings.ToUpper(currencyCode)
+	if currencyCode == "" {
+		currencyCode = defaultCurrency
+	}
+
+	currencies := currency.FromConfig(globals.Conf.Donation)
+	if _, ok := currencies[currencyCode]; !ok {
+		return rule, fmt.Errorf("currency is not supported. should be one of %s", strings.Join(currencies.Codes(), ", "))
+	}
+
+	if donationTypes == "" {
+		types = matchableDonationTypes
+	}
+
+	for _, t := range strings.Split(donationTypes, ",") {
+		t = strings.TrimSpace(t)
+		if t == "" {
+			continue
+		}
+		if !isMatchableDonationType(t) {
+			return rule, fmt.Errorf("donation type %s is not supported. should be one of %s", t, strings.Join(matchableDonationTypes, ", "))
+		}
+		types = append(types, t)
+	}
+
+	if campaign != "" {
+		if _, err := mc.Storage.GetACampaign(campaign); nil != err {
+			return rule, err
+		}
+	}
+
+	startAt, err := time.ParseInLocation(campaignDateLayout, startDate, location)
+	if nil != err {
+		return rule, fmt.Errorf("start date should be in YYYY-MM-DD format. %s", err.Error())
+	}
+
+	endAt, err := time.ParseInLocation(campaignDateLayout, endDate, location)
+	if nil != err {
+		return rule, fmt.Errorf("end date should be in YYYY-MM-DD format. %s", err.Error())
+	}
+
+	if endAt.Before(startAt) {
+		return rule, errors.New("end date should not be before start date")
+	}
+
+	rule = models.MatchingRule{
+		Budget:        budget,
+		Campaign:      null.NewString(campaign, campaign != ""),
+		Currency:      currencyCode,
+		DonationTypes: strings.Join(types, ","),
+		EndAt:         endAt.AddDate(0, 0, 1),
+		Ratio:         ratio,
+		Sponsor:       sponsor,
+		SponsorEmail:  sponsorEmail,
+		StartAt:       startAt,
+	}
+
+	if err = mc.Storage.CreateAMatchingRule(&rule); nil != err {
+		return rule, err
+	}
+
+	return rule, nil
+}
+
+func isMatchableDonationType(t string) bool {
+	for _, v := range matchableDonationTypes {
+		if v == t {
+			return true
+		}
+	}
+	return false
+}
+
+// appendDonationMatching appends the match of the donation onto the response, if the donation is matched by a sponsor
+func (mc *MembershipController) appendDonationMatching(resp *clientResp, donationType string, donationID uint) error {
+	m, err := mc.Storage.GetADonationMatch(donationType, donationID)
+	if nil != err {
+		appErr, _ := err.(*models.AppError)
+		if nil != appErr && appErr.StatusCode == http.StatusNotFound {
+			return nil
+		}
+		return err
+	}
+
+	resp.Matching = &matchingResp{
+		MatchedAmount: m.MatchedAmount,
+		Sponsor:       m.Sponsor,
+	}
+	return nil
+}
+
+// ReportMatchingGifts mails the reconciliation reports to the sponsors of the ended rules, and returns how many reports are mailed.
+// The report of a rule is mailed once, and it is mailed again by the next run if the mail fails.
+func (mc *MembershipController) ReportMatchingGifts(now time.Time) (int, error) {
+	var reported int
+
+	rules, err := mc.Storage.GetUnreportedMatchingRules(now)
+	if nil != err {
+		return reported, err
+	}
+
+	for _, rule := range rules {
+		if err = mc.sendMatchingReport(rule); nil != err {
+			log.Errorf("fail to mail the report of the matching rule(id: %d) to the sponsor(%s) due to %s", rule.ID, rule.Sponsor, err.Error())
+			continue
+		}
+
+		marked, err := mc.Storage.MarkAMatchingRuleReported(rule.ID, now)
+		if nil != err {
+			return reported, err
+		}
+
+		if marked {
+			reported++
+		}
+	}
+
+	return reported, nil
+}
+
+func (mc *MembershipController) sendMatchingReport(rule models.MatchingRule) error {
+	var location, _ = time.LoadLocation("Asia/Taipei")
+	var report bytes.Buffer
+
+	matches, err := mc.Storage.GetDonationMatchesOfARule(rule.ID)
+	if nil != err {
+		return err
+	}
+
+	ew, err := export.NewCSVWriter(&report, matchingReportColumns)
+	if nil != err {
+		return err
+	}
+
+	for _, m := range matches {
+		if err = ew.Write([]string{
+			m.CreatedAt.In(location).Format(ledgerTimeLayout),
+			m.OrderNumber,
+			m.DonationType,
+			fmt.Sprint(m.Amount),
+			fmt.Sprint(m.MatchedAmount),
+			m.Currency,
+		}); nil != err {
+			return err
+		}
+	}
+
+	if err = ew.Close(); nil != err {
+		return err
+	}
+
+	reqBody := matchingReportReqBody{
+		Budget:    rule.Budget,
+		Consumed:  rule.Consumed,
+		Currency:  rule.Currency,
+		Donations: uint(len(matches)),
+		Email:     rule.SponsorEmail,
+		EndDate:   rule.EndAt.In(location).AddDate(0, 0, -1).Format(campaignDateLayout),
+		Report:    report.Bytes(),
+		Sponsor:   rule.Sponsor,
+		StartDate: rule.StartAt.In(location).Format(campaignDateLayout),
+	}
+
+	return postMailServiceEndpoint(reqBody, fmt.Sprintf("http://localhost:%s/v1/%s", globals.LocalhostPort, globals.SendMatchingReportRoutePath))
+}
@@ -0,0 +1,288 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gin-gonic/gin"
+
+	"twreporter.org/go-api/globals"
+	"twreporter.org/go-api/models"
+	"twreporter.org/go-api/payment"
+)
+
+type (
+	// backendNotifyReq is the transaction result TapPay sends to `result_url.backend_notify_url`
+	backendNotifyReq struct {
+		Amount      uint   `json:"amount"`
+		Msg         string `json:"msg"`
+		OrderNumber string `json:"order_number" binding:"required"`
+		RecTradeID  string `json:"rec_trade_id" binding:"required"`
+		Status      int64  `json:"status"`
+	}
+
+	// tradeRecord is the trade record kept by the payment gateway
+	tradeRecord payment.Record
+)
+
+// toDonationStatus maps the state of the trade record onto the status of donations
+func (r tradeRecord) toDonationStatus() string {
+	switch r.State {
+	case payment.RecordStatePaid:
+		return statusPaid
+	case payment.RecordStateFailed:
+		return statusFail
+	default:
+		return statusPaying
+	}
+}
+
+// appendRecordOnTappayResp appends the trade record onto the payment gateway response fields of donations
+func (r tradeRecord) appendRecordOnTappayResp(m *models.TappayResp) {
+	m.AuthCode = r.AuthCode
+	m.BankResultCode = r.BankResultCode
+	m.BankResultMsg = r.BankResultMsg
+	m.BankTransactionID = r.BankTransactionID
+	m.RecTradeID = r.RecTradeID
+	m.TappayRecordStatus = r.TappayRecordStatus
+
+	if r.TransactionTime.Valid {
+		m.TransactionTime = r.TransactionTime
+	}
+}
+
+// AppendRecordOnPrimeDonation appends the trade record onto the prime donation
+func (r tradeRecord) AppendRecordOnPrimeDonation(m *models.PayByPrimeDonation) {
+	r.appendRecordOnTappayResp(&m.TappayResp)
+
+	// Card info is absent for the payments not made by cards, such as LINE Pay
+	if r.CardInfo.LastFour.Valid {
+		m.CardInfo = r.CardInfo
+	}
+
+	m.Status = r.toDonationStatus()
+}
+
+// AppendRecordOnTokenDonation appends the trade record onto the card token donation
+func (r tradeRecord) AppendRecordOnTokenDonation(m *models.PayByCardTokenDonation) {
+	r.appendRecordOnTappayResp(&m.TappayResp)
+	m.Status = r.toDonationStatus()
+}
+
+// queryRecord looks up the trade record on the payment gateway of the name
+func (mc *MembershipController) queryRecord(gatewayName string, filters payment.RecordFilters) (tradeRecord, error) {
+	gateway, err := mc.Gateways.Get(gatewayName)
+	if nil != err {
+		return tradeRecord{}, err
+	}
+
+	record, err := gateway.QueryRecord(filters)
+	return tradeRecord(record), err
+}
+
+// resolveAPayingPrimeDonation syncs the status of a 'paying' prime donation with the trade record on the payment gateway.
+// The thank-you mail is sent once the donation turns into 'paid'.
+func (mc *MembershipController) resolveAPayingPrimeDonation(d *models.PayByPrimeDonation, recTradeID string) error {
+	const errWhere = "MembershipController.resolveAPayingPrimeDonation"
+	var err error
+	var record tradeRecord
+	var rowsAffected int64
+
+	if record, err = mc.queryRecord(d.PaymentGateway, payment.RecordFilters{
+		OrderNumber: d.OrderNumber,
+		RecTradeID:  recTradeID,
+	}); nil != err {
+		log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+		return err
+	}
+
+	if record.Amount != d.Amount {
+		err = fmt.Errorf("amount of the trade record(%d) does not match the donation(order_number: %s, amount: %d)", record.Amount, d.OrderNumber, d.Amount)
+		log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+		return err
+	}
+
+	if statusPaying == record.toDonationStatus() {
+		return nil
+	}
+
+	m := models.PayByPrimeDonation{}
+	record.AppendRecordOnPrimeDonation(&m)
+
+	// Only update the donation which is still 'paying',
+	// so the thank-you mail is sent only once even if notify and polling arrive at the same time.
+	if rowsAffected, err = mc.Storage.UpdateAPrimeDonationInTRX(d.ID, []string{statusPaying}, m); nil != err {
+		return err
+	}
+
+	record.AppendRecordOnPrimeDonation(d)
+
+	if 0 != rowsAffected && statusPaid == d.Status {
+		resp := new(clientResp)
+		resp.BuildFromPrimeDonationModel(*d)
+		if err = mc.appendDonationMatching(resp, globals.PrimeDonaitionType, d.ID); nil != err {
+			log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+		}
+		go mc.sendDonationThankYouMail(*resp, primeDonationTypeName)
+	}
+
+	return nil
+}
+
+// ReceiveBackendNotify method
+// Handler for TapPay to notify the results of the transactions which require donors' confirmation, such as LINE Pay and 3-D Secure.
+// Since the notification is not signed, the result is verified with the trade record on the payment gateway.
+func (mc *MembershipController) ReceiveBackendNotify(c *gin.Context) (int, gin.H, error) {
+	const errorWhere = "MembershipController.ReceiveBackendNotify"
+	var err error
+	var reqBody backendNotifyReq
+
+	if failData, valid := bindRequestBody(c, &reqBody); valid == false {
+		return http.StatusBadRequest, gin.H{"status": "fail", "data": failData}, nil
+	}
+
+	d := models.PayByPrimeDonation{}
+	if err = mc.Storage.GetByConditions(map[string]interface{}{
+		"order_number": reqBody.OrderNumber,
+	}, &d); nil != err {
+		appErr, _ := err.(*models.AppError)
+		if nil != appErr && appErr.StatusCode == http.StatusNotFound {
+			// the first installment of a periodic donation authenticated by 3-D Secure
+			return mc.receiveCardTokenDonationNotify(reqBody)
+		}
+		return 0, gin.H{}, err
+	}
+
+	// The donation has been resolved by previous notifications or status polling
+	if statusPaying != d.Status {
+		return http.StatusOK, gin.H{"status": "success", "data": gin.H{"order_number": d.OrderNumber, "status": d.Status}}, nil
+	}
+
+	if err = mc.resolveAPayingPrimeDonation(&d, reqBody.RecTradeID); nil != err {
+		return 0, gin.H{}, models.NewAppError(errorWhere, "Fails to verify the transaction result", err.Error(), http.StatusInternalServerError)
+	}
+
+	return http.StatusOK, gin.H{"status": "success", "data": gin.H{"order_number": d.OrderNumber, "status": d.Status}}, nil
+}
+
+// receiveCardTokenDonationNotify resolves the 'paying' first installment of a periodic donation by the notification
+func (mc *MembershipController) receiveCardTokenDonationNotify(reqBody backendNotifyReq) (int, gin.H, error) {
+	const errorWhere = "MembershipController.receiveCardTokenDonationNotify"
+	var err error
+
+	d := models.PayByCardTokenDonation{}
+	if err = mc.Storage.GetByConditions(map[string]interface{}{
+		"order_number": reqBody.OrderNumber,
+	}, &d); nil != err {
+		appErr, _ := err.(*models.AppError)
+		if nil != appErr && appErr.StatusCode == http.StatusNotFound {
+			return http.StatusNotFound, gin.H{"status": "fail", "data": gin.H{
+				"req.Body.order_number": fmt.Sprintf("donation(order_number: %s) is not found", reqBody.OrderNumber),
+			}}, nil
+		}
+		return 0, gin.H{}, err
+	}
+
+	// The donation has been resolved by previous notifications or status polling
+	if statusPaying != d.Status {
+		return http.StatusOK, gin.H{"status": "success", "data": gin.H{"order_number": d.OrderNumber, "status": d.Status}}, nil
+	}
+
+	if "" == d.RecTradeID {
+		d.RecTradeID = reqBody.RecTradeID
+	}
+
+	status, err := mc.resolveAPayingCardTokenDonation(d)
+	if nil != err {
+		return 0, gin.H{}, models.NewAppError(errorWhere, "Fails to verify the transaction result", err.Error(), http.StatusInternalServerError)
+	}
+
+	return http.StatusOK, gin.H{"status": "success", "data": gin.H{"order_number": d.OrderNumber, "status": status}}, nil
+}
+
+// GetAPrimeDonationStatusOfAUser method
+// Handler for an authenticated user to poll the status of a prime donation by the order number.
+// If the donation is still 'paying', the status is synced with the payment gateway before responding.
+// The order number of a periodic donation is accepted as well.
+func (mc *MembershipController) GetAPrimeDonationStatusOfAUser(c *gin.Context) (int, gin.H, error) {
+	var err error
+	var userID uint64
+
+	if userID, err = strconv.ParseUint(c.Query("user_id"), 10, strconv.IntSize); err != nil {
+		return http.StatusBadRequest, gin.H{"status": "fail", "data": gin.H{
+			"req.URL.query": "?user_id=:userID, userID should be integer",
+		}}, nil
+	}
+
+	d := models.PayByPrimeDonation{}
+	if err = mc.Storage.GetByConditions(map[string]interface{}{
+		"order_number": c.Param("order_number"),
+	}, &d); nil != err {
+		appErr, _ := err.(*models.AppError)
+		if nil != appErr && appErr.StatusCode == http.StatusNotFound {
+			return mc.getAPeriodicDonationStatusOfAUser(c, uint(userID))
+		}
+		return 0, gin.H{}, err
+	}
+
+	if d.UserID != uint(userID) {
+		return http.StatusForbidden, gin.H{"status": "fail", "data": gin.H{
+			"req.Headers.Authorization": fmt.Sprintf("%s is forbidden to access", c.Request.RequestURI),
+		}}, nil
+	}
+
+	if statusPaying == d.Status && d.RecTradeID != "" {
+		// Keep responding the current status even if the payment gateway is not reachable
+		mc.resolveAPayingPrimeDonation(&d, d.RecTradeID)
+	}
+
+	return http.StatusOK, gin.H{"status": "success", "data": gin.H{
+		"id":           d.ID,
+		"order_number": d.OrderNumber,
+		"status":       d.Status,
+	}}, nil
+}
+
+// getAPeriodicDonationStatusOfAUser responds the status of a periodic donation by the order number.
+// If the first installment is still authenticated by 3-D Secure, the status is synced with the payment gateway before responding.
+func (mc *MembershipController) getAPeriodicDonationStatusOfAUser(c *gin.Context, userID uint) (int, gin.H, error) {
+	var err error
+
+	d := models.PeriodicDonation{}
+	if err = mc.Storage.GetByConditions(map[string]interface{}{
+		"order_number": c.Param("order_number"),
+	}, &d); nil != err {
+		appErr, _ := err.(*models.AppError)
+		if nil != appErr && appErr.StatusCode == http.StatusNotFound {
+			return appErr.StatusCode, gin.H{"status": "fail", "data": gin.H{
+				"req.URL": fmt.Sprintf("%s cannot address a found resource", c.Request.RequestURI),
+			}}, nil
+		}
+		return 0, gin.H{}, err
+	}
+
+	if d.UserID != userID {
+		return http.StatusForbidden, gin.H{"status": "fail", "data": gin.H{
+			"req.Headers.Authorization": fmt.Sprintf("%s is forbidden to access", c.Request.RequestURI),
+		}}, nil
+	}
+
+	td := models.PayByCardTokenDonation{}
+	if statusPaying == d.Status && nil == mc.Storage.GetByConditions(map[string]interface{}{
+		"periodic_id": d.ID,
+		"status":      statusPaying,
+	}, &td) && td.RecTradeID != "" {
+		// Keep responding the current status even if the payment gateway is not reachable
+		if _, err = mc.resolveAPayingCardTokenDonation(td); nil == err {
+			mc.Storage.Get(d.ID, &d)
+		}
+	}
+
+	return http.StatusOK, gin.H{"status": "success", "data": gin.H{
+		"id":           d.ID,
+		"order_number": d.OrderNumber,
+		"status":       d.Status,
+	}}, nil
+}
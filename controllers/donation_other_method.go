@@ -0,0 +1,502 @@
+package controllers
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net/http"
+	"net/mail"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gin-gonic/gin"
+	"gopkg.in/guregu/null.v3"
+
+	"twreporter.org/go-api/currency"
+	"twreporter.org/go-api/globals"
+	"twreporter.org/go-api/models"
+	"twreporter.org/go-api/utils"
+)
+
+const (
+	payMethodTransfer       = "transfer"
+	payMethodPostalTransfer = "postal_transfer"
+	payMethodCheque         = "cheque"
+	payMethodCash           = "cash"
+
+	otherMethodDonationDetails = "報導者線下捐款"
+	otherMethodPaidAtLayout    = "2006-01-02"
+	maxBankReferenceLength     = 50
+)
+
+// otherPayMethodCollections are the pay methods of the donations made outside the payment gateways
+var otherPayMethodCollections = []string{
+	payMethodTransfer,
+	payMethodPostalTransfer,
+	payMethodCheque,
+	payMethodCash,
+}
+
+// bankReferenceRequired are the pay methods whose donations should be recorded with the bank references,
+// so that the same transfer is never recorded twice
+var bankReferenceRequired = map[string]bool{
+	payMethodTransfer:       true,
+	payMethodPostalTransfer: true,
+}
+
+// otherMethodDonationColumns are the columns of the CSV file of other method donations, the order of the columns does not matter
+var otherMethodDonationColumns = []string{"paid_at", "pay_method", "bank_reference", "amount", "currency", "email", "name", "national_id", "phone_number", "address", "zip_code", "send_receipt", "campaign", "details", "notes"}
+
+// requiredOtherMethodDonationColumns should be in the header of the CSV file
+var requiredOtherMethodDonationColumns = []string{"paid_at", "pay_method", "amount", "email"}
+
+type (
+	otherMethodDonationReq struct {
+		Amount        uint              `json:"amount" binding:"required"`
+		BankReference string            `json:"bank_reference"`
+		Campaign      string            `json:"campaign"`
+		Currency      string            `json:"currency"`
+		Details       string            `json:"details"`
+		Donor         models.Cardholder `json:"donor"`
+		Notes         string            `json:"notes"`
+		// PaidAt is the date when the money is received, in YYYY-MM-DD format
+		PaidAt      string `json:"paid_at" binding:"required"`
+		PayMethod   string `json:"pay_method" binding:"required"`
+		SendReceipt string `json:"send_receipt"`
+		// UserID is the staff who records the donation
+		UserID uint `json:"user_id" binding:"required"`
+	}
+
+	// OtherMethodDonationImportSummary counts the results of importing a CSV file of other method donations
+	OtherMethodDonationImportSummary struct {
+		// Created is the number of donations recorded
+		Created int `json:"created"`
+		// Duplicated are the bank references which are recorded already, their rows are skipped
+		Duplicated []string `json:"duplicated"`
+	}
+)
+
+// validate checks the fields of the request and normalizes them, the fail data is keyed by the fields.
+// It returns when the donation is paid, which is the beginning of the paid date in Taiwan.
+func (req *otherMethodDonationReq) validate(now time.Time) (time.Time, gin.H) {
+	var location, _ = time.LoadLocation("Asia/Taipei")
+	var failData = gin.H{}
+	var paidAt time.Time
+	var err error
+
+	if paidAt, err = time.ParseInLocation(otherMethodPaidAtLayout, req.PaidAt, location); nil != err {
+		failData["paid_at"] = "paid_at should be a date in YYYY-MM-DD format"
+	} else if paidAt.After(now) {
+		failData["paid_at"] = "paid_at should not be in the future"
+	}
+
+	if invalidPayMethodID == getOtherPayMethodID(req.PayMethod) {
+		failData["pay_method"] = fmt.Sprintf("pay_method should be one of %s", strings.Join(otherPayMethodCollections, ", "))
+	}
+
+	req.BankReference = strings.TrimSpace(req.BankReference)
+	if req.BankReference == "" && bankReferenceRequired[req.PayMethod] {
+		failData["bank_reference"] = fmt.Sprintf("bank_reference is required for %s donations", req.PayMethod)
+	} else if len(req.BankReference) > maxBankReferenceLength {
+		failData["bank_reference"] = fmt.Sprintf("bank_reference should be at most %d characters", maxBankReferenceLength)
+	}
+
+	if _, err = mail.ParseAddress(req.Donor.Email); nil != err {
+		failData["donor.email"] = "donor email is not valid"
+	}
+
+	req.Currency = strings.ToUpper(req.Currency)
+	if req.Currency == "" {
+		req.Currency = defaultCurrency
+	}
+
+	currencies := currency.FromConfig(globals.Conf.Donation)
+	if _, ok := currencies[req.Currency]; !ok {
+		failData["currency"] = fmt.Sprintf("currency is not supported. should be one of %s", strings.Join(currencies.Codes(), ", "))
+	} else if err = currencies.Validate(req.Currency, req.Amount); nil != err {
+		failData["amount"] = err.Error()
+	}
+
+	switch req.SendReceipt {
+	case "":
+		req.SendReceipt = monthlyReceipt
+	case monthlyReceipt, noReceipt:
+	default:
+		failData["send_receipt"] = "send_receipt should be `monthly` or `no`"
+	}
+
+	if len(failData) > 0 {
+		return paidAt, failData
+	}
+	return paidAt, nil
+}
+
+// buildModel builds the donation of the donor paid at `paidAt`
+func (req otherMethodDonationReq) buildModel(paidAt time.Time, donorID uint) models.PayByOtherMethodDonation {
+	m := models.PayByOtherMethodDonation{
+		Address:       req.Donor.Address.ValueOrZero(),
+		Amount:        req.Amount,
+		BankReference: null.NewString(req.BankReference, req.BankReference != ""),
+		Campaign:      null.NewString(req.Campaign, req.Campaign != ""),
+		CreatedAt:     paidAt,
+		Currency:      req.Currency,
+		Details:       req.Details,
+		Email:         req.Donor.Email,
+		Name:          req.Donor.Name.ValueOrZero(),
+		NationalID:    req.Donor.NationalID.ValueOrZero(),
+		Notes:         req.Notes,
+		OrderNumber:   generateOrderNumber(otherMethod, getOtherPayMethodID(req.PayMethod)),
+		PayMethod:     req.PayMethod,
+		PhoneNumber:   req.Donor.PhoneNumber.ValueOrZero(),
+		RecordedBy:    null.IntFrom(int64(req.UserID)),
+		SendReceipt:   req.SendReceipt,
+		UserID:        donorID,
+		ZipCode:       req.Donor.ZipCode.ValueOrZero(),
+	}
+
+	if m.Details == "" {
+		m.Details = otherMethodDonationDetails
+	}
+
+	return m
+}
+
+func getOtherPayMethodID(payMethod string) int {
+	for ind, v := range otherPayMethodCollections {
+		if v == payMethod {
+			return ind
+		}
+	}
+	return invalidPayMethodID
+}
+
+// prefixFailData prefixes the keys of the fail data keyed by the fields, e.g. `req.Body.`
+func prefixFailData(prefix string, failData gin.H) gin.H {
+	prefixed := gin.H{}
+	for k, v := range failData {
+		prefixed[prefix+k] = v
+	}
+	return prefixed
+}
+
+// validateAnOtherMethodDonation validates the request including its campaign, the fail data is keyed by the fields
+func (mc *MembershipController) validateAnOtherMethodDonation(req *otherMethodDonationReq, now time.Time) (time.Time, gin.H, error) {
+	paidAt, failData := req.validate(now)
+
+	campaignFailData, err := mc.validateCampaign(req.Campaign)
+	if nil != err {
+		return paidAt, nil, err
+	}
+
+	if campaignFailData != nil {
+		if failData == nil {
+			failData = gin.H{}
+		}
+		failData["campaign"] = campaignFailData["req.Body.campaign"]
+	}
+
+	return paidAt, failData, nil
+}
+
+// getOrCreateADonor returns the user of the email, the user is created if the donor never signs in
+func (mc *MembershipController) getOrCreateADonor(email string) (models.User, error) {
+	user, err := mc.Storage.GetUserByEmail(email)
+	if nil == err {
+		return user, nil
+	}
+
+	if appErr, _ := err.(*models.AppError); nil == appErr || appErr.StatusCode != http.StatusNotFound {
+		return user, err
+	}
+
+	return mc.Storage.InsertUserByEmail(email)
+}
+
+// recordAnOtherMethodDonation records the validated donation for the user of the donor email
+func (mc *MembershipController) recordAnOtherMethodDonation(req otherMethodDonationReq, paidAt time.Time) (models.PayByOtherMethodDonation, error) {
+	donor, err := mc.getOrCreateADonor(req.Donor.Email)
+	if nil != err {
+		return models.PayByOtherMethodDonation{}, err
+	}
+
+	m := req.buildModel(paidAt, donor.ID)
+	err = mc.Storage.CreateAPayByOtherMethodDonation(&m)
+	return m, err
+}
+
+// followUpOtherMethodDonations sends the thank-you mails of the recorded donations,
+// and issues the receipts of the donations paid in the periods whose receipts are issued already.
+func (mc *MembershipController) followUpOtherMethodDonations(ds []models.PayByOtherMethodDonation, now time.Time) {
+	var periods []string
+	var lates = make(map[string]time.Time)
+
+	for _, d := range ds {
+		resp := new(clientResp)
+		resp.BuildFromOtherMethodDonationModel(d)
+		if err := mc.appendDonationMatching(resp, globals.OthersDonationType, d.ID); nil != err {
+			log.Error(err.Error())
+		}
+		mc.sendDonationThankYouMail(*resp, primeDonationTypeName)
+
+		periodType := monthlyReceipt
+		if noReceipt == d.SendReceipt {
+			periodType = yearlyReceipt
+		}
+
+		paidIn, _, _ := receiptPeriod(periodType, d.CreatedAt)
+		current, _, _ := receiptPeriod(periodType, now)
+		key := fmt.Sprintf("%s/%s", periodType, paidIn.Format(otherMethodPaidAtLayout))
+
+		if _, ok := lates[key]; !ok && paidIn.Before(current) {
+			periods = append(periods, key)
+			lates[key] = paidIn
+		}
+	}
+
+	sort.Strings(periods)
+	for _, key := range periods {
+		periodType := strings.Split(key, "/")[0]
+
+		summary, err := mc.IssueReceipts(periodType, lates[key])
+		if nil != err {
+			log.Errorf("cannot issue the %s receipts of %s for the other method donations. %s", periodType, lates[key].Format(otherMethodPaidAtLayout), err.Error())
+			continue
+		}
+
+		for _, reason := range summary.Failed {
+			log.Warn(reason)
+		}
+	}
+}
+
+// CreateAnOtherMethodDonation method
+// Handler for admins to record a donation made outside the payment gateways, such as a bank transfer or a cheque.
+// The donor is matched to the user of the email, and thanked by mail.
+// The receipt is issued right away if the receipts of the period when it is paid are issued already.
+func (mc *MembershipController) CreateAnOtherMethodDonation(c *gin.Context) (int, gin.H, error) {
+	var reqBody otherMethodDonationReq
+	now := time.Now()
+
+	if failData, valid := bindRequestBody(c, &reqBody); valid == false {
+		return http.StatusBadRequest, gin.H{"status": "fail", "data": failData}, nil
+	}
+
+	paidAt, failData, err := mc.validateAnOtherMethodDonation(&reqBody, now)
+	if nil != err {
+		return 0, gin.H{}, err
+	} else if failData != nil {
+		return http.StatusBadRequest, gin.H{"status": "fail", "data": prefixFailData("req.Body.", failData)}, nil
+	}
+
+	d, err := mc.recordAnOtherMethodDonation(reqBody, paidAt)
+	if nil != err {
+		if appErr, _ := err.(*models.AppError); nil != appErr && appErr.StatusCode == http.StatusConflict {
+			return http.StatusConflict, gin.H{"status": "fail", "data": gin.H{
+				"req.Body.bank_reference": fmt.Sprintf("the donation of bank_reference %s is recorded already", reqBody.BankReference),
+			}}, nil
+		}
+		return 0, gin.H{}, err
+	}
+
+	go mc.followUpOtherMethodDonations([]models.PayByOtherMethodDonation{d}, now)
+
+	resp := new(clientResp)
+	resp.BuildFromOtherMethodDonationModel(d)
+	return http.StatusCreated, gin.H{"status": "success", "data": resp}, nil
+}
+
+// parseOtherMethodDonations reads the donations from the CSV file with the header of `otherMethodDonationColumns`, e.g.
+//
+//	paid_at,pay_method,bank_reference,amount,email,name
+//	2019-06-03,transfer,TX20190603001,1000,donor@example.com,王小明
+//
+// Rows are keyed by their line numbers.
+func parseOtherMethodDonations(r io.Reader, recordedBy uint) ([]int, map[int]*otherMethodDonationReq, error) {
+	var lines []int
+	var reqs = make(map[int]*otherMethodDonationReq)
+
+	cr := csv.NewReader(r)
+	cr.TrimLeadingSpace = true
+
+	header, err := cr.Read()
+	if nil != err {
+		return lines, reqs, fmt.Errorf("cannot read the header. %s", err.Error())
+	}
+
+	// the byte order mark is prepended to the files exported by Excel
+	columns := make(map[string]int)
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "\ufeff")))
+		if !utils.ContainsString(otherMethodDonationColumns, name) {
+			return lines, reqs, fmt.Errorf("column %s is not supported. should be some of %s", name, strings.Join(otherMethodDonationColumns, ", "))
+		}
+		columns[name] = i
+	}
+
+	for _, name := range requiredOtherMethodDonationColumns {
+		if _, ok := columns[name]; !ok {
+			return lines, reqs, fmt.Errorf("column %s is required", name)
+		}
+	}
+
+	cr.FieldsPerRecord = len(header)
+	for line := 2; ; line++ {
+		record, err := cr.Read()
+		if io.EOF == err {
+			break
+		}
+		if nil != err {
+			return lines, reqs, err
+		}
+
+		get := func(name string) string {
+			if i, ok := columns[name]; ok {
+				return strings.TrimSpace(record[i])
+			}
+			return ""
+		}
+
+		req := &otherMethodDonationReq{
+			BankReference: get("bank_reference"),
+			Campaign:      get("campaign"),
+			Currency:      get("currency"),
+			Details:       get("details"),
+			Donor: models.Cardholder{
+				Address:     null.NewString(get("address"), get("address") != ""),
+				Email:       get("email"),
+				Name:        null.NewString(get("name"), get("name") != ""),
+				NationalID:  null.NewString(get("national_id"), get("national_id") != ""),
+				PhoneNumber: null.NewString(get("phone_number"), get("phone_number") != ""),
+				ZipCode:     null.NewString(get("zip_code"), get("zip_code") != ""),
+			},
+			Notes:       get("notes"),
+			PaidAt:      get("paid_at"),
+			PayMethod:   get("pay_method"),
+			SendReceipt: get("send_receipt"),
+			UserID:      recordedBy,
+		}
+
+		// the amount is validated with the currency, 0 is regarded as invalid
+		if amount, err := strconv.ParseUint(strings.Replace(get("amount"), ",", "", -1), 10, 32); nil == err {
+			req.Amount = uint(amount)
+		}
+
+		lines = append(lines, line)
+		reqs[line] = req
+	}
+
+	return lines, reqs, nil
+}
+
+// importOtherMethodDonations records the donations of the CSV file by the staff.
+// The file is rejected as a whole if any row is invalid, and the fail data is keyed by the line numbers and the fields.
+// The rows of the bank references which are recorded already are skipped, so the same file could be imported again.
+func (mc *MembershipController) importOtherMethodDonations(r io.Reader, recordedBy uint, now time.Time) (OtherMethodDonationImportSummary, []models.PayByOtherMethodDonation, gin.H, error) {
+	var created []models.PayByOtherMethodDonation
+	var failData = gin.H{}
+	var paidAts = make(map[int]time.Time)
+	var references = make(map[string]int)
+	var summary = OtherMethodDonationImportSummary{Duplicated: []string{}}
+
+	lines, reqs, err := parseOtherMethodDonations(r, recordedBy)
+	if nil != err {
+		return summary, created, gin.H{"req.Body.file": err.Error()}, nil
+	}
+
+	if len(lines) == 0 {
+		return summary, created, gin.H{"req.Body.file": "no donation is in the file"}, nil
+	}
+
+	for _, line := range lines {
+		paidAt, rowFailData, err := mc.validateAnOtherMethodDonation(reqs[line], now)
+		if nil != err {
+			return summary, created, nil, err
+		}
+
+		prefix := fmt.Sprintf("req.Body.file.line.%d.", line)
+		for k, v := range prefixFailData(prefix, rowFailData) {
+			failData[k] = v
+		}
+
+		if ref := reqs[line].BankReference; ref != "" {
+			if first, ok := references[ref]; ok {
+				failData[prefix+"bank_reference"] = fmt.Sprintf("bank_reference %s is on line %d already", ref, first)
+			} else {
+				references[ref] = line
+			}
+		}
+
+		paidAts[line] = paidAt
+	}
+
+	if len(failData) > 0 {
+		return summary, created, failData, nil
+	}
+
+	for _, line := range lines {
+		d, err := mc.recordAnOtherMethodDonation(*reqs[line], paidAts[line])
+		if nil != err {
+			if appErr, _ := err.(*models.AppError); nil != appErr && appErr.StatusCode == http.StatusConflict {
+				summary.Duplicated = append(summary.Duplicated, reqs[line].BankReference)
+				continue
+			}
+			return summary, created, nil, fmt.Errorf("cannot record the donation on line %d, the donations above are recorded. %s", line, err.Error())
+		}
+
+		created = append(created, d)
+		summary.Created++
+	}
+
+	log.Infof("MembershipController.importOtherMethodDonations: %d recorded, %d duplicated", summary.Created, len(summary.Duplicated))
+	return summary, created, nil, nil
+}
+
+// ImportOtherMethodDonations records the donations of the CSV file by the staff, and follows them up
+// as the ones recorded one by one before it returns. The fail data is returned if the file is rejected.
+func (mc *MembershipController) ImportOtherMethodDonations(r io.Reader, recordedBy uint) (OtherMethodDonationImportSummary, gin.H, error) {
+	now := time.Now()
+
+	summary, created, failData, err := mc.importOtherMethodDonations(r, recordedBy, now)
+	mc.followUpOtherMethodDonations(created, now)
+
+	return summary, failData, err
+}
+
+// ImportOtherMethodDonationsByAFile method
+// Handler for admins to import the CSV file of other method donations,
+// which is uploaded as the `file` field of the multipart form along with `user_id`.
+func (mc *MembershipController) ImportOtherMethodDonationsByAFile(c *gin.Context) (int, gin.H, error) {
+	var form = struct {
+		UserID uint `form:"user_id" binding:"required"`
+	}{}
+
+	if err := c.ShouldBind(&form); nil != err {
+		return http.StatusBadRequest, gin.H{"status": "fail", "data": gin.H{"req.Body.user_id": err.Error()}}, nil
+	}
+
+	fh, err := c.FormFile("file")
+	if nil != err {
+		return http.StatusBadRequest, gin.H{"status": "fail", "data": gin.H{"req.Body.file": "file is required"}}, nil
+	}
+
+	f, err := fh.Open()
+	if nil != err {
+		return 0, gin.H{}, models.NewAppError("MembershipController.ImportOtherMethodDonationsByAFile", "cannot open the uploaded file", err.Error(), http.StatusInternalServerError)
+	}
+	defer f.Close()
+
+	now := time.Now()
+	summary, created, failData, err := mc.importOtherMethodDonations(f, form.UserID, now)
+	go mc.followUpOtherMethodDonations(created, now)
+
+	if nil != err {
+		return 0, gin.H{}, models.NewAppError("MembershipController.ImportOtherMethodDonationsByAFile", err.Error(), "", http.StatusInternalServerError)
+	} else if failData != nil {
+		return http.StatusBadRequest, gin.H{"status": "fail", "data": failData}, nil
+	}
+
+	return http.StatusCreated, gin.H{"status": "success", "data": summary}, nil
+}
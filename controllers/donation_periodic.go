@@ -0,0 +1,373 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gopkg.in/guregu/null.v3"
+
+	"twreporter.org/go-api/currency"
+	"twreporter.org/go-api/globals"
+	"twreporter.org/go-api/models"
+	"twreporter.org/go-api/payment"
+	"twreporter.org/go-api/utils"
+)
+
+// periodic donations which could be stopped by donors
+var stoppableStatuses = []string{"to_pay", statusPaid, statusFail, statusInvalid}
+
+// periodic donations which could replace the cards
+var cardReplaceableStatuses = []string{statusPaid, statusFail, statusInvalid}
+
+// the longest period a periodic donation could be paused
+const maxPausedMonths = 12
+
+type (
+	stopPeriodicDonationReq struct {
+		Reason string `json:"reason" binding:"required,max=100"`
+		UserID uint   `json:"user_id" binding:"required"`
+	}
+
+	replaceCardReq struct {
+		Prime  string `json:"prime" binding:"required"`
+		UserID uint   `json:"user_id" binding:"required"`
+	}
+
+	// periodicDonationChangeReq changes the amount, the frequency or the pause of a periodic donation.
+	// The omitted fields are left unchanged.
+	periodicDonationChangeReq struct {
+		Amount uint `json:"amount"`
+		// EffectiveDate is a date in YYYY-MM-DD format, the change is effective at once if it is omitted
+		EffectiveDate string `json:"effective_date"`
+		Frequency     string `json:"frequency"`
+		// PausedUntil is a date in YYYY-MM-DD format, the periodic donation resumes if it is not after the effective date
+		PausedUntil string `json:"paused_until"`
+		UserID      uint   `json:"user_id" binding:"required"`
+	}
+)
+
+// getAPeriodicDonationOfAUser loads the periodic donation addressed by the url.
+// The fail data is returned along with the status code if the periodic donation is not found or not owned by the user.
+func (mc *MembershipController) getAPeriodicDonationOfAUser(c *gin.Context, userID uint) (models.PeriodicDonation, int, gin.H, error) {
+	var err error
+	var recordID uint64
+
+	pd := models.PeriodicDonation{}
+
+	if recordID, err = strconv.ParseUint(c.Param("id"), 10, strconv.IntSize); err != nil {
+		return pd, http.StatusNotFound, gin.H{
+			"req.URL": fmt.Sprintf("%s cannot address a found resource", c.Request.RequestURI),
+		}, nil
+	}
+
+	if err = mc.Storage.Get(uint(recordID), &pd); nil != err {
+		appErr, _ := err.(*models.AppError)
+		if appErr.StatusCode == http.StatusNotFound {
+			return pd, appErr.StatusCode, gin.H{
+				"req.URL": fmt.Sprintf("%s cannot address a found resource", c.Request.RequestURI),
+			}, nil
+		}
+		return pd, 0, nil, err
+	}
+
+	if pd.UserID != userID {
+		return pd, http.StatusForbidden, gin.H{
+			"req.Headers.Authorization": fmt.Sprintf("%s is forbidden to access", c.Request.RequestURI),
+		}, nil
+	}
+
+	return pd, 0, nil, nil
+}
+
+// StopAPeriodicDonationOfAUser method
+// Handler for an authenticated user to stop a periodic donation with a reason.
+// The periodic donation could not be stopped while an installment is being charged.
+func (mc *MembershipController) StopAPeriodicDonationOfAUser(c *gin.Context) (int, gin.H, error) {
+	var err error
+	var failCode int
+	var failData gin.H
+	var pd models.PeriodicDonation
+	var reqBody stopPeriodicDonationReq
+	var rowsAffected int64
+
+	if data, valid := bindRequestBody(c, &reqBody); valid == false {
+		return http.StatusBadRequest, gin.H{"status": "fail", "data": data}, nil
+	}
+
+	if pd, failCode, failData, err = mc.getAPeriodicDonationOfAUser(c, reqBody.UserID); nil != err {
+		return 0, gin.H{}, err
+	} else if 0 != failCode {
+		return failCode, gin.H{"status": "fail", "data": failData}, nil
+	}
+
+	m := models.PeriodicDonation{
+		Status:     statusStopped,
+		StopReason: reqBody.Reason,
+		StoppedAt:  null.TimeFrom(time.Now()),
+	}
+
+	if rowsAffected, err = mc.Storage.StopAPeriodicDonation(pd.ID, stoppableStatuses, m); nil != err {
+		return 0, gin.H{}, err
+	}
+
+	if 0 == rowsAffected {
+		return http.StatusConflict, gin.H{"status": "fail", "data": gin.H{
+			"req.URL": fmt.Sprintf("the periodic donation(order_number: %s) is %s, it could not be stopped", pd.OrderNumber, pd.Status),
+		}}, nil
+	}
+
+	pd.Status = m.Status
+	pd.StopReason = m.StopReason
+	pd.StoppedAt = m.StoppedAt
+
+	resp := new(clientResp)
+	resp.BuildFromPeriodicDonationModel(pd)
+
+	return http.StatusOK, gin.H{"status": "success", "data": resp}, nil
+}
+
+// ReplaceTheCardOfAPeriodicDonationOfAUser method
+// Handler for an authenticated user to replace the card of a periodic donation with a new prime.
+// The new card is bound without charging on the payment gateway currently selected for credit cards,
+// and the card info of the replaced card is kept as an audit trail.
+func (mc *MembershipController) ReplaceTheCardOfAPeriodicDonationOfAUser(c *gin.Context) (int, gin.H, error) {
+	var err error
+	var failCode int
+	var failData gin.H
+	var pd models.PeriodicDonation
+	var reqBody replaceCardReq
+
+	if data, valid := bindRequestBody(c, &reqBody); valid == false {
+		return http.StatusBadRequest, gin.H{"status": "fail", "data": data}, nil
+	}
+
+	if pd, failCode, failData, err = mc.getAPeriodicDonationOfAUser(c, reqBody.UserID); nil != err {
+		return 0, gin.H{}, err
+	} else if 0 != failCode {
+		return failCode, gin.H{"status": "fail", "data": failData}, nil
+	}
+
+	if pd, failCode, failData, err = mc.replaceTheCardOfAPeriodicDonation(pd, reqBody.Prime, reqBody.UserID); nil != err {
+		return 0, gin.H{}, err
+	} else if 0 != failCode {
+		return failCode, gin.H{"status": "fail", "data": failData}, nil
+	}
+
+	resp := new(clientResp)
+	resp.BuildFromPeriodicDonationModel(pd)
+
+	return http.StatusOK, gin.H{"status": "success", "data": resp}, nil
+}
+
+// replaceTheCardOfAPeriodicDonation binds the card of the prime and replaces the card of the periodic donation by it.
+// `userID` is who replaces the card, which is recorded in the card change.
+// The periodic donation with the new card is returned, or the fail data if the card could not be replaced.
+func (mc *MembershipController) replaceTheCardOfAPeriodicDonation(pd models.PeriodicDonation, prime string, userID uint) (models.PeriodicDonation, int, gin.H, error) {
+	const errWhere = "MembershipController.replaceTheCardOfAPeriodicDonation"
+	var card payment.Card
+	var err error
+	var first models.PayByCardTokenDonation
+	var gateway payment.PaymentGateway
+
+	// Fail fast before binding the card on the payment gateway
+	if !utils.ContainsString(cardReplaceableStatuses, pd.Status) || !pd.LastSuccessAt.Valid {
+		return pd, http.StatusConflict, gin.H{
+			"req.URL": fmt.Sprintf("the periodic donation(order_number: %s) is %s, the card could not be replaced", pd.OrderNumber, pd.Status),
+		}, nil
+	}
+
+	// The card token is bound to the merchant of the first installment
+	if first, err = mc.Storage.GetTheFirstInstallmentOfAPeriodicDonation(pd.ID); nil != err {
+		return pd, 0, nil, err
+	}
+
+	bindCardReq := payment.BindCardReq{
+		Cardholder: pd.Cardholder,
+		Currency:   pd.Currency,
+		MerchantID: first.MerchantID,
+		Prime:      prime,
+		UserID:     pd.UserID,
+	}
+
+	if bindCardReq.Currency == "" {
+		bindCardReq.Currency = defaultCurrency
+	}
+
+	if bindCardReq.MerchantID == "" {
+		bindCardReq.MerchantID = defaultMerchantID
+	}
+
+	if gateway, err = mc.Gateways.GetByPayMethod(defaultPeriodicPayMethod); nil != err {
+		return pd, 0, nil, models.NewAppError(errWhere, err.Error(), "", http.StatusInternalServerError)
+	}
+
+	if card, err = gateway.BindCard(bindCardReq); nil != err {
+		return pd, 0, nil, models.NewAppError(errWhere, err.Error(), card.Msg, http.StatusInternalServerError)
+	}
+
+	m := models.PeriodicDonation{
+		CardInfo:       card.CardInfo,
+		ID:             pd.ID,
+		PaymentGateway: gateway.Name(),
+	}
+
+	if m.CardKey, m.CardToken, err = mc.encryptCardSecret(card.CardSecret); nil != err {
+		return pd, 0, nil, models.NewAppError(errWhere, fmt.Sprintf("cannot encrypt the new card secrets. %s", err.Error()), "", http.StatusInternalServerError)
+	}
+
+	if err = mc.Storage.ReplaceTheCardOfAPeriodicDonation(m, &models.PeriodicDonationCardChange{UserID: userID}); nil != err {
+		appErr, _ := err.(*models.AppError)
+		if appErr.StatusCode == http.StatusConflict {
+			return pd, appErr.StatusCode, gin.H{
+				"req.URL": appErr.Message,
+			}, nil
+		}
+		return pd, 0, nil, err
+	}
+
+	pd.CardInfo = m.CardInfo
+	pd.PaymentGateway = m.PaymentGateway
+	pd.Status = statusPaid
+
+	return pd, 0, nil, nil
+}
+
+// BuildPeriodicDonationChange validates the request and builds the periodic donation change.
+// The fail data is returned if the request is not valid.
+func (req periodicDonationChangeReq) BuildPeriodicDonationChange(now time.Time) (models.PeriodicDonationChange, gin.H) {
+	var location, _ = time.LoadLocation("Asia/Taipei")
+
+	m := models.PeriodicDonationChange{
+		EffectiveAt: now,
+		UserID:      req.UserID,
+	}
+
+	if 0 == req.Amount && "" == req.Frequency && "" == req.PausedUntil {
+		return m, gin.H{"req.Body": "at least one of amount, frequency and paused_until should be provided"}
+	}
+
+	if 0 != req.Amount {
+		m.Amount = null.IntFrom(int64(req.Amount))
+	}
+
+	if "" != req.Frequency {
+		if req.Frequency != monthlyFrequency && req.Frequency != yearlyFrequency {
+			return m, gin.H{"req.Body.frequency": "frequency is not supported. should be `monthly` or `yearly`"}
+		}
+		m.Frequency = null.StringFrom(req.Frequency)
+	}
+
+	if "" != req.EffectiveDate {
+		t, err := time.ParseInLocation(donationsDateLayout, req.EffectiveDate, location)
+		if err != nil {
+			return m, gin.H{"req.Body.effective_date": "effective_date should be a date in YYYY-MM-DD format"}
+		}
+
+		// the change made on the effective date is effective at once
+		if t.After(now) {
+			m.EffectiveAt = t
+		} else if t.AddDate(0, 0, 1).Before(now) {
+			return m, gin.H{"req.Body.effective_date": "effective_date should not be in the past"}
+		}
+	}
+
+	if "" != req.PausedUntil {
+		t, err := time.ParseInLocation(donationsDateLayout, req.PausedUntil, location)
+		if err != nil {
+			return m, gin.H{"req.Body.paused_until": "paused_until should be a date in YYYY-MM-DD format"}
+		}
+
+		if t.After(m.EffectiveAt.AddDate(0, maxPausedMonths, 0)) {
+			return m, gin.H{"req.Body.paused_until": fmt.Sprintf("a periodic donation could be paused for %d months at most", maxPausedMonths)}
+		}
+		m.PausedUntil = null.TimeFrom(t)
+	}
+
+	return m, nil
+}
+
+// ChangeAPeriodicDonationOfAUser method
+// Handler for an authenticated user to change the amount, the frequency or the pause of a periodic donation.
+// The change is scheduled if the effective date is in the future, and the charge of the installments follows it after the effective date.
+func (mc *MembershipController) ChangeAPeriodicDonationOfAUser(c *gin.Context) (int, gin.H, error) {
+	var err error
+	var failCode int
+	var failData gin.H
+	var m models.PeriodicDonationChange
+	var pd models.PeriodicDonation
+	var reqBody periodicDonationChangeReq
+
+	if data, valid := bindRequestBody(c, &reqBody); valid == false {
+		return http.StatusBadRequest, gin.H{"status": "fail", "data": data}, nil
+	}
+
+	now := time.Now()
+
+	if m, failData = reqBody.BuildPeriodicDonationChange(now); nil != failData {
+		return http.StatusBadRequest, gin.H{"status": "fail", "data": failData}, nil
+	}
+
+	if pd, failCode, failData, err = mc.getAPeriodicDonationOfAUser(c, reqBody.UserID); nil != err {
+		return 0, gin.H{}, err
+	} else if 0 != failCode {
+		return failCode, gin.H{"status": "fail", "data": failData}, nil
+	}
+
+	// the new amount is charged in the currency of the periodic donation
+	if 0 != reqBody.Amount {
+		if err = currency.FromConfig(globals.Conf.Donation).Validate(pd.Currency, reqBody.Amount); nil != err {
+			return http.StatusBadRequest, gin.H{"status": "fail", "data": gin.H{"req.Body.amount": err.Error()}}, nil
+		}
+	}
+
+	m.PeriodicID = pd.ID
+
+	if err = mc.Storage.CreateAPeriodicDonationChange(&m, now); nil != err {
+		appErr, _ := err.(*models.AppError)
+		if appErr.StatusCode == http.StatusConflict {
+			return appErr.StatusCode, gin.H{"status": "fail", "data": gin.H{
+				"req.URL": appErr.Message,
+			}}, nil
+		}
+		return 0, gin.H{}, err
+	}
+
+	return http.StatusCreated, gin.H{"status": "success", "data": m}, nil
+}
+
+// GetChangesOfAPeriodicDonationOfAUser method
+// Handler for an authenticated user to list the changes of a periodic donation, the latest change comes first.
+func (mc *MembershipController) GetChangesOfAPeriodicDonationOfAUser(c *gin.Context) (int, gin.H, error) {
+	var changes []models.PeriodicDonationChange
+	var err error
+	var failCode int
+	var failData gin.H
+	var pd models.PeriodicDonation
+	var userID uint64
+
+	if userID, err = strconv.ParseUint(c.Query("user_id"), 10, strconv.IntSize); err != nil {
+		return http.StatusBadRequest, gin.H{"status": "fail", "data": gin.H{
+			"req.URL.query": "?user_id=:userID, userID should be integer",
+		}}, nil
+	}
+
+	if pd, failCode, failData, err = mc.getAPeriodicDonationOfAUser(c, uint(userID)); nil != err {
+		return 0, gin.H{}, err
+	} else if 0 != failCode {
+		return failCode, gin.H{"status": "fail", "data": failData}, nil
+	}
+
+	if err = mc.Storage.GetByConditions(map[string]interface{}{"periodic_id": pd.ID}, &changes); nil != err {
+		return 0, gin.H{}, err
+	}
+
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].ID > changes[j].ID
+	})
+
+	return http.StatusOK, gin.H{"status": "success", "data": changes}, nil
+}
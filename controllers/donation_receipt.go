@@ -0,0 +1,278 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gin-gonic/gin"
+	"gopkg.in/guregu/null.v3"
+
+	"twreporter.org/go-api/globals"
+	"twreporter.org/go-api/models"
+	"twreporter.org/go-api/receipt"
+)
+
+const (
+	monthlyReceipt = "monthly"
+	yearlyReceipt  = "yearly"
+	noReceipt      = "no"
+)
+
+// receiptSendReceipts are the `send_receipt` of the donations issued on the monthly and the yearly receipts.
+// The donations of which donors ask for no receipts are issued once a year without mailing,
+// so that every paid donation is on a receipt for tax declaration.
+var receiptSendReceipts = map[string][]string{
+	monthlyReceipt: {monthlyReceipt},
+	yearlyReceipt:  {yearlyReceipt, noReceipt},
+}
+
+// ReceiptSummary counts the results of a receipt issuing run
+type ReceiptSummary struct {
+	// Issued is the number of receipts created
+	Issued int
+	// Mailed is the number of receipts mailed, including the ones failed to be mailed previously
+	Mailed int
+	// Failed are the reasons why receipts cannot be issued or mailed, they should be checked by staffs
+	Failed []string
+	// Refunded are the donations refunded in the period after they are issued on the receipts,
+	// staffs should void and reissue the receipts
+	Refunded []string
+}
+
+// receiptPeriod returns the month or the year `at` is in, in Taipei time
+func receiptPeriod(periodType string, at time.Time) (time.Time, time.Time, error) {
+	location, _ := time.LoadLocation("Asia/Taipei")
+	at = at.In(location)
+
+	switch periodType {
+	case monthlyReceipt:
+		start := time.Date(at.Year(), at.Month(), 1, 0, 0, 0, 0, location)
+		return start, start.AddDate(0, 1, 0), nil
+	case yearlyReceipt:
+		start := time.Date(at.Year(), time.January, 1, 0, 0, 0, 0, location)
+		return start, start.AddDate(1, 0, 0), nil
+	}
+
+	return time.Time{}, time.Time{}, fmt.Errorf("period type %s is not supported. should be `monthly` or `yearly`", periodType)
+}
+
+// receiptPeriodLabel displays the period of the receipt, e.g. 2019 年 5 月
+func receiptPeriodLabel(mr models.Receipt) string {
+	location, _ := time.LoadLocation("Asia/Taipei")
+	start := mr.PeriodStart.In(location)
+
+	if yearlyReceipt == mr.PeriodType {
+		return fmt.Sprintf("%d 年", start.Year())
+	}
+	return fmt.Sprintf("%d 年 %d 月", start.Year(), start.Month())
+}
+
+// IssueReceipts issues the receipts of the donations paid in the month or the year which `at` is in.
+// The paid donations of a donor are issued on one receipt unless the names, the national IDs, the organizations or the currencies on them are different,
+// and the amounts refunded partially are excluded.
+// The receipts are mailed unless the donors ask for no receipts,
+// and the receipts failed to be mailed previously are mailed again.
+// The donations refunded in the period after their receipts of the period type are issued are reported for staffs.
+func (mc *MembershipController) IssueReceipts(periodType string, at time.Time) (ReceiptSummary, error) {
+	var keys []string
+	var summary ReceiptSummary
+
+	start, end, err := receiptPeriod(periodType, at)
+	if nil != err {
+		return summary, err
+	}
+
+	donations, err := mc.Storage.GetReceiptableDonations(receiptSendReceipts[periodType], start, end)
+	if nil != err {
+		return summary, err
+	}
+
+	receipts := make(map[string]*models.Receipt)
+	items := make(map[string][]models.ReceiptItem)
+
+	for _, d := range donations {
+		key := fmt.Sprintf("%d/%s/%s/%s/%s/%s/%s", d.UserID, d.Name, d.NationalID, d.CompanyName, d.TaxID, d.Currency, d.SendReceipt)
+
+		if _, ok := receipts[key]; !ok {
+			keys = append(keys, key)
+			receipts[key] = &models.Receipt{
+				CompanyName: d.CompanyName,
+				Currency:    d.Currency,
+				Name:        d.Name,
+				NationalID:  d.NationalID,
+				PeriodEnd:   end,
+				PeriodStart: start,
+				PeriodType:  periodType,
+				SendReceipt: d.SendReceipt,
+				TaxID:       d.TaxID,
+				UserID:      d.UserID,
+			}
+		}
+
+		// the latest contact of the donor is printed on the receipt
+		mr := receipts[key]
+		mr.Address = d.Address
+		mr.Amount += d.Amount
+		mr.Email = d.Email
+
+		items[key] = append(items[key], models.ReceiptItem{
+			Amount:       d.Amount,
+			DonationID:   d.DonationID,
+			DonationType: d.DonationType,
+			OrderNumber:  d.OrderNumber,
+			PaidAt:       d.PaidAt,
+		})
+	}
+
+	for _, key := range keys {
+		mr := receipts[key]
+
+		if err := mc.Storage.CreateAReceipt(mr, items[key]); nil != err {
+			summary.Failed = append(summary.Failed, fmt.Sprintf("cannot issue the receipt of the user(id: %d): %s", mr.UserID, err.Error()))
+			continue
+		}
+
+		summary.Issued++
+
+		// the receipt is rendered again when it is downloaded or mailed if it fails here
+		if _, err := mc.getAReceiptPDF(mr); nil != err {
+			log.Warnf("cannot render the receipt(%s): %s", mr.ReceiptNumber, err.Error())
+		}
+	}
+
+	var unmailed []models.Receipt
+	if err := mc.Storage.GetByConditions(map[string]interface{}{
+		"mailed_at":    nil,
+		"send_receipt": []string{monthlyReceipt, yearlyReceipt},
+	}, &unmailed); nil != err {
+		return summary, err
+	}
+
+	for _, mr := range unmailed {
+		if err := mc.mailAReceipt(mr); nil != err {
+			summary.Failed = append(summary.Failed, fmt.Sprintf("cannot mail the receipt(%s): %s", mr.ReceiptNumber, err.Error()))
+			continue
+		}
+		summary.Mailed++
+	}
+
+	refunds, err := mc.Storage.GetRefundsOfIssuedReceipts(periodType, start, end)
+	if nil != err {
+		return summary, err
+	}
+
+	for _, r := range refunds {
+		summary.Refunded = append(summary.Refunded, fmt.Sprintf("the %s donation(order_number: %s) on the receipt(%s) of the user(id: %d) is refunded %d %s at %s",
+			r.DonationType, r.OrderNumber, r.ReceiptNumber, r.UserID, r.Amount, r.Currency, r.RefundedAt.Format(time.RFC3339)))
+	}
+
+	return summary, nil
+}
+
+// getAReceiptPDF returns the PDF file of the receipt, and renders it if it is not rendered yet
+func (mc *MembershipController) getAReceiptPDF(mr *models.Receipt) ([]byte, error) {
+	var items []models.ReceiptItem
+
+	if len(mr.PDF) > 0 {
+		return mr.PDF, nil
+	}
+
+	if err := mc.Storage.GetByConditions(map[string]interface{}{"receipt_id": mr.ID}, &items); nil != err {
+		return nil, err
+	}
+
+	pdf, err := receipt.NewRenderer(globals.Conf.Donation).Render(*mr, items)
+	if nil != err {
+		return nil, err
+	}
+
+	if err, _ = mc.Storage.UpdateByConditions(map[string]interface{}{"id": mr.ID}, &models.Receipt{PDF: pdf}); nil != err {
+		return nil, err
+	}
+
+	mr.PDF = pdf
+	return pdf, nil
+}
+
+func (mc *MembershipController) mailAReceipt(mr models.Receipt) error {
+	pdf, err := mc.getAReceiptPDF(&mr)
+	if nil != err {
+		return err
+	}
+
+	reqBody := receiptMailReqBody{
+		Amount:        mr.Amount,
+		Currency:      mr.Currency,
+		Email:         mr.Email,
+		Name:          mr.Name,
+		Period:        receiptPeriodLabel(mr),
+		ReceiptNumber: mr.ReceiptNumber,
+		Receipt:       pdf,
+	}
+
+	if mr.IsOrganization() {
+		reqBody.Name = mr.CompanyName
+	}
+
+	if err = postMailServiceEndpoint(reqBody, fmt.Sprintf("http://localhost:%s/v1/%s", globals.LocalhostPort, globals.SendReceiptRoutePath)); nil != err {
+		return err
+	}
+
+	err, _ = mc.Storage.UpdateByConditions(map[string]interface{}{"id": mr.ID}, &models.Receipt{MailedAt: null.TimeFrom(time.Now())})
+	return err
+}
+
+// GetReceiptsOfAUser returns the receipts issued to the user
+func (mc *MembershipController) GetReceiptsOfAUser(c *gin.Context) (int, gin.H, error) {
+	userID, err := strconv.ParseUint(c.Param("userID"), 10, strconv.IntSize)
+	if nil != err {
+		return http.StatusNotFound, gin.H{"status": "fail", "data": gin.H{
+			"req.URL": fmt.Sprintf("%s cannot address a found resource", c.Request.RequestURI),
+		}}, nil
+	}
+
+	receipts, err := mc.Storage.GetReceiptsOfAUser(uint(userID))
+	if nil != err {
+		return 0, gin.H{}, err
+	}
+
+	return http.StatusOK, gin.H{"status": "success", "data": gin.H{"records": receipts}}, nil
+}
+
+// DownloadAReceiptOfAUser responds the PDF file of the receipt issued to the user.
+// The response is the file instead of JSend unless the receipt cannot be downloaded.
+func (mc *MembershipController) DownloadAReceiptOfAUser(c *gin.Context) {
+	var mr models.Receipt
+
+	receiptNumber := c.Param("receiptNumber")
+
+	if err := mc.Storage.GetByConditions(map[string]interface{}{
+		"receipt_number": receiptNumber,
+		"user_id":        c.Param("userID"),
+	}, &mr); nil != err {
+		appErr := appErrorTypeAssertion(err)
+		if http.StatusNotFound == appErr.StatusCode {
+			c.JSON(http.StatusNotFound, gin.H{"status": "fail", "data": gin.H{
+				"req.URL": fmt.Sprintf("%s cannot address a found resource", c.Request.RequestURI),
+			}})
+			return
+		}
+		log.Error(appErr.Error())
+		c.JSON(appErr.StatusCode, gin.H{"status": "error", "message": appErr.Message})
+		return
+	}
+
+	pdf, err := mc.getAReceiptPDF(&mr)
+	if nil != err {
+		appErr := appErrorTypeAssertion(err)
+		log.Error(appErr.Error())
+		c.JSON(appErr.StatusCode, gin.H{"status": "error", "message": appErr.Message})
+		return
+	}
+
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=\"twreporter-receipt-%s.pdf\"", receiptNumber))
+	c.Data(http.StatusOK, "application/pdf", pdf)
+}
@@ -0,0 +1,312 @@
+package controllers
+
+import (
+	"fmt"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"gopkg.in/guregu/null.v3"
+
+	"twreporter.org/go-api/globals"
+	"twreporter.org/go-api/models"
+	"twreporter.org/go-api/payment"
+)
+
+const defaultReconcileBatchSize = 100
+
+type (
+	// UnresolvedDonation is a stale 'paying' donation which cannot be resolved by reconciliation
+	UnresolvedDonation struct {
+		ID          uint
+		OrderNumber string
+		Reason      string
+		Type        string
+	}
+
+	// ReconciliationSummary counts the results of a reconciliation run
+	ReconciliationSummary struct {
+		// Paid is the number of donations resolved as 'paid'
+		Paid int
+		// Failed is the number of donations resolved as 'fail'
+		Failed int
+		// Refunded is the number of refunds resolved as 'refunded'
+		Refunded int
+		// RefundFailed is the number of refunds resolved as 'fail'
+		RefundFailed int
+		// Unresolved are the donations left in 'paying' or with refunds left in 'refunding', they should be checked by staffs
+		Unresolved []UnresolvedDonation
+	}
+)
+
+func (s *ReconciliationSummary) count(status string) {
+	switch status {
+	case statusPaid:
+		s.Paid++
+	case statusFail:
+		s.Failed++
+	}
+}
+
+// ReconcilePayingDonations resolves the prime and card token donations which are left in 'paying' since `before`,
+// such as the process dies or the payment gateway times out while paying, and the refunds which are left in 'refunding' likewise.
+// The results are looked up on the payment gateways, and the donations which cannot be resolved are reported in the summary.
+func (mc *MembershipController) ReconcilePayingDonations(before time.Time, batchSize int) (ReconciliationSummary, error) {
+	const errWhere = "MembershipController.ReconcilePayingDonations"
+	var afterID uint
+	var summary ReconciliationSummary
+
+	if batchSize <= 0 {
+		batchSize = defaultReconcileBatchSize
+	}
+
+	for {
+		var primes []models.PayByPrimeDonation
+		if err := mc.Storage.GetStalePayingDonations(before, afterID, batchSize, &primes); nil != err {
+			return summary, err
+		}
+
+		for _, d := range primes {
+			afterID = d.ID
+
+			if err := mc.resolveAPayingPrimeDonation(&d, d.RecTradeID); nil != err {
+				summary.Unresolved = append(summary.Unresolved, UnresolvedDonation{ID: d.ID, OrderNumber: d.OrderNumber, Reason: err.Error(), Type: globals.PrimeDonaitionType})
+				continue
+			}
+
+			if statusPaying == d.Status {
+				summary.Unresolved = append(summary.Unresolved, UnresolvedDonation{ID: d.ID, OrderNumber: d.OrderNumber, Reason: "the transaction is still pending on the payment gateway", Type: globals.PrimeDonaitionType})
+				continue
+			}
+
+			summary.count(d.Status)
+		}
+
+		if len(primes) < batchSize {
+			break
+		}
+	}
+
+	afterID = 0
+
+	for {
+		var tokens []models.PayByCardTokenDonation
+		if err := mc.Storage.GetStalePayingDonations(before, afterID, batchSize, &tokens); nil != err {
+			return summary, err
+		}
+
+		for _, d := range tokens {
+			afterID = d.ID
+
+			status, err := mc.resolveAPayingCardTokenDonation(d)
+			if nil != err {
+				summary.Unresolved = append(summary.Unresolved, UnresolvedDonation{ID: d.ID, OrderNumber: d.OrderNumber, Reason: err.Error(), Type: globals.TokenDonationType})
+				continue
+			}
+
+			summary.count(status)
+		}
+
+		if len(tokens) < batchSize {
+			break
+		}
+	}
+
+	afterID = 0
+
+	for {
+		refunds, err := mc.Storage.GetStaleRefundingRefunds(before, afterID, batchSize)
+		if nil != err {
+			return summary, err
+		}
+
+		for _, r := range refunds {
+			afterID = r.ID
+
+			status, orderNumber, err := mc.resolveARefundingDonationRefund(r)
+			if nil != err {
+				summary.Unresolved = append(summary.Unresolved, UnresolvedDonation{ID: r.DonationID, OrderNumber: orderNumber, Reason: fmt.Sprintf("refund(id: %d) is left in refunding. %s", r.ID, err.Error()), Type: r.DonationType})
+				continue
+			}
+
+			switch status {
+			case statusRefunded:
+				summary.Refunded++
+			case statusFail:
+				summary.RefundFailed++
+			}
+		}
+
+		if len(refunds) < batchSize {
+			break
+		}
+	}
+
+	for _, u := range summary.Unresolved {
+		log.Warnf("%s: %s donation(id: %d, order_number: %s) is unresolved. %s", errWhere, u.Type, u.ID, u.OrderNumber, u.Reason)
+	}
+
+	log.Infof("%s: %d paid, %d failed, %d refunded, %d refunds failed, %d unresolved", errWhere, summary.Paid, summary.Failed, summary.Refunded, summary.RefundFailed, len(summary.Unresolved))
+	return summary, nil
+}
+
+// resolveAPayingCardTokenDonation syncs the status of a 'paying' card token donation and its periodic donation with the trade record on the payment gateway,
+// and returns the resolved status of the card token donation.
+func (mc *MembershipController) resolveAPayingCardTokenDonation(d models.PayByCardTokenDonation) (string, error) {
+	const errWhere = "MembershipController.resolveAPayingCardTokenDonation"
+	var err error
+	var paidTimes uint
+	var record tradeRecord
+	var resolved bool
+
+	pd := models.PeriodicDonation{}
+	if err = mc.Storage.Get(d.PeriodicID, &pd); nil != err {
+		return "", err
+	}
+
+	if record, err = mc.queryRecord(d.PaymentGateway, payment.RecordFilters{
+		OrderNumber: d.OrderNumber,
+		RecTradeID:  d.RecTradeID,
+	}); nil != err {
+		log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+		return "", err
+	}
+
+	if record.Amount != d.Amount {
+		err = fmt.Errorf("amount of the trade record(%d) does not match the donation(order_number: %s, amount: %d)", record.Amount, d.OrderNumber, d.Amount)
+		log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+		return "", err
+	}
+
+	if statusPaying == record.toDonationStatus() {
+		return "", fmt.Errorf("the transaction is still pending on the payment gateway")
+	}
+
+	td := models.PayByCardTokenDonation{ID: d.ID}
+	record.AppendRecordOnTokenDonation(&td)
+
+	m := models.PeriodicDonation{ID: pd.ID}
+	// The first installment is paid along with binding the card of the periodic donation.
+	// The card secrets are kept on the installment only if it is authenticated by 3-D Secure,
+	// while the periodic donations created before keep them on their own.
+	isFirst := !pd.LastSuccessAt.Valid
+	hasCardSecrets := "" != d.PendingCardToken || "" != pd.CardToken
+
+	switch {
+	case statusFail == td.Status && isFirst:
+		m.Status = statusInvalid
+	case statusFail == td.Status:
+		dunAPeriodicDonation(pd, &m, time.Now())
+	default:
+		m.LastSuccessAt = td.TransactionTime
+		if !m.LastSuccessAt.Valid {
+			m.LastSuccessAt = null.TimeFrom(time.Now())
+		}
+
+		if !isFirst {
+			m.LastSuccessAt = null.TimeFrom(nextBillingDate(pd, m.LastSuccessAt.Time))
+		}
+
+		m.Status = statusPaid
+		if paidTimes, err = mc.Storage.GetPaidTimesOfAPeriodicDonation(pd.ID); nil == err && paidTimes+1 >= pd.MaxPaidTimes {
+			m.Status = statusStopped
+		}
+
+		if isFirst && record.CardInfo.LastFour.Valid {
+			m.CardInfo = record.CardInfo
+		}
+
+		if isFirst && "" != d.PendingCardToken {
+			m.CardKey = d.PendingCardKey
+			m.CardToken = d.PendingCardToken
+		}
+
+		if isFirst && !hasCardSecrets {
+			// Trade records do not contain card secrets, the donor has to replace the card to continue the periodic donation
+			m.Status = statusInvalid
+		}
+	}
+
+	if resolved, err = mc.Storage.ResolveAPayingCardTokenDonation(td, m); nil != err {
+		return "", err
+	}
+
+	if resolved && statusFail == td.Status && isFirst && "" != pd.CardToken {
+		// the card which fails to be authenticated is never charged
+		if _, err = mc.Storage.UpdateTheCardSecretsOfAPeriodicDonation(pd, "", ""); nil != err {
+			log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+		}
+	}
+
+	if resolved && statusFail == td.Status && !isFirst {
+		mc.sendPeriodicDonationFailureMail(pd, m)
+	}
+
+	if resolved && statusPaid == td.Status && isFirst && hasCardSecrets {
+		pd.CardInfo = m.CardInfo
+		pd.Status = m.Status
+		resp := new(clientResp)
+		resp.BuildFromPeriodicDonationModel(pd)
+		if err = mc.appendDonationMatching(resp, globals.TokenDonationType, td.ID); nil != err {
+			log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+		}
+		go mc.sendDonationThankYouMail(*resp, periodicDonationTypeName)
+	}
+
+	if statusPaid == td.Status && isFirst && !hasCardSecrets {
+		return td.Status, fmt.Errorf("the first installment is paid but the card secret is lost, the periodic donation(id: %d) is invalid until the card is replaced", pd.ID)
+	}
+
+	return td.Status, nil
+}
+
+// resolveARefundingDonationRefund resolves the 'refunding' refund by the refunded amount of the trade record on the payment gateway,
+// and returns the resolved status of the refund along with the order number of the donation.
+// The refund is refunded if the refunded amount covers it besides the refunds refunded already,
+// and it is failed if the refunded amount covers none of it.
+func (mc *MembershipController) resolveARefundingDonationRefund(refund models.DonationRefund) (string, string, error) {
+	const errWhere = "MembershipController.resolveARefundingDonationRefund"
+	var d refundedDonation
+	var err error
+	var fullyRefunded bool
+	var record tradeRecord
+	var refunded uint
+
+	if d, err = mc.getRefundedDonation(refund.DonationType, refund.DonationID); nil != err {
+		return "", "", err
+	}
+
+	if record, err = mc.queryRecord(d.PaymentGateway, payment.RecordFilters{
+		OrderNumber: d.OrderNumber,
+		RecTradeID:  refund.RecTradeID,
+	}); nil != err {
+		log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+		return "", d.OrderNumber, err
+	}
+
+	if !record.RefundReported {
+		return "", d.OrderNumber, fmt.Errorf("the payment gateway %s does not report the refunded amount", d.PaymentGateway)
+	}
+
+	if refunded, err = mc.Storage.GetRefundedAmountOfADonation(refund.DonationType, refund.DonationID); nil != err {
+		return "", d.OrderNumber, err
+	}
+
+	switch {
+	case record.RefundedAmount >= refunded+refund.Amount:
+		refund.Status = statusRefunded
+	case record.RefundedAmount <= refunded:
+		refund.Status = statusFail
+	default:
+		return "", d.OrderNumber, fmt.Errorf("the refunded amount(%d) on the payment gateway covers part of the refund(amount: %d)", record.RefundedAmount, refund.Amount)
+	}
+
+	if fullyRefunded, err = mc.Storage.UpdateADonationRefundInTRX(refund); nil != err {
+		return "", d.OrderNumber, err
+	}
+
+	if statusRefunded == refund.Status {
+		go mc.sendDonationRefundMail(d, refund, fullyRefunded)
+	}
+
+	return refund.Status, d.OrderNumber, nil
+}
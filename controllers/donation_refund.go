@@ -0,0 +1,210 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gin-gonic/gin"
+	"gopkg.in/guregu/null.v3"
+
+	"twreporter.org/go-api/globals"
+	"twreporter.org/go-api/models"
+	"twreporter.org/go-api/payment"
+)
+
+const (
+	statusRefunding = "refunding"
+	statusRefunded  = "refunded"
+)
+
+type (
+	refundReq struct {
+		// Amount is optional, the rest of the donation amount is refunded if it is omitted
+		Amount uint   `json:"amount"`
+		Reason string `json:"reason" binding:"max=100"`
+		UserID uint   `json:"user_id" binding:"required"`
+	}
+
+	// refundedDonation is the information of the donation which is needed to refund and notify donors
+	refundedDonation struct {
+		Amount         uint
+		Currency       string
+		Email          string
+		Name           string
+		OrderNumber    string
+		PaymentGateway string
+		RecTradeID     string
+		TypeName       string
+	}
+)
+
+// getRefundedDonation loads the prime or card token donation to refund.
+// Donors of card token donations are the cardholders of their periodic donations.
+func (mc *MembershipController) getRefundedDonation(donationType string, id uint) (refundedDonation, error) {
+	var err error
+
+	switch donationType {
+	case globals.PrimeDonaitionType:
+		d := models.PayByPrimeDonation{}
+		if err = mc.Storage.Get(id, &d); nil != err {
+			return refundedDonation{}, err
+		}
+
+		return refundedDonation{
+			Amount:         d.Amount,
+			Currency:       d.Currency,
+			Email:          d.Cardholder.Email,
+			Name:           d.Cardholder.Name.ValueOrZero(),
+			OrderNumber:    d.OrderNumber,
+			PaymentGateway: d.PaymentGateway,
+			RecTradeID:     d.RecTradeID,
+			TypeName:       primeDonationTypeName,
+		}, nil
+	case globals.TokenDonationType:
+		d := models.PayByCardTokenDonation{}
+		if err = mc.Storage.Get(id, &d); nil != err {
+			return refundedDonation{}, err
+		}
+
+		pd := models.PeriodicDonation{}
+		if err = mc.Storage.Get(d.PeriodicID, &pd); nil != err {
+			return refundedDonation{}, err
+		}
+
+		return refundedDonation{
+			Amount:         d.Amount,
+			Currency:       d.Currency,
+			Email:          pd.Cardholder.Email,
+			Name:           pd.Cardholder.Name.ValueOrZero(),
+			OrderNumber:    d.OrderNumber,
+			PaymentGateway: d.PaymentGateway,
+			RecTradeID:     d.RecTradeID,
+			TypeName:       periodicDonationTypeName,
+		}, nil
+	default:
+		return refundedDonation{}, models.NewAppError("MembershipController.getRefundedDonation", fmt.Sprintf("donation type %s cannot be refunded", donationType), "", http.StatusInternalServerError)
+	}
+}
+
+// RefundADonation method
+// Handler for an admin to refund a prime or card token donation through the payment gateway it is made through.
+// Refunds are partial if the amount is given, otherwise the rest of the donation amount is refunded.
+func (mc *MembershipController) RefundADonation(c *gin.Context, donationType string) (int, gin.H, error) {
+	const errorWhere = "MembershipController.RefundADonation"
+	var d refundedDonation
+	var err error
+	var fullyRefunded bool
+	var gateway payment.PaymentGateway
+	var gatewayRefund payment.Refund
+	var recordID uint64
+	var reqBody refundReq
+
+	if recordID, err = strconv.ParseUint(c.Param("id"), 10, strconv.IntSize); err != nil {
+		return http.StatusNotFound, gin.H{"status": "fail", "data": gin.H{
+			"url": fmt.Sprintf("%s cannot address a found resource", c.Request.RequestURI),
+		}}, nil
+	}
+
+	if failData, valid := bindRequestBody(c, &reqBody); valid == false {
+		return http.StatusBadRequest, gin.H{"status": "fail", "data": failData}, nil
+	}
+
+	if d, err = mc.getRefundedDonation(donationType, uint(recordID)); nil != err {
+		appErr, _ := err.(*models.AppError)
+		if appErr.StatusCode == http.StatusNotFound {
+			return appErr.StatusCode, gin.H{"status": "fail", "data": gin.H{
+				"req.URL": fmt.Sprintf("%s cannot address a found resource", c.Request.RequestURI),
+			}}, nil
+		}
+		return 0, gin.H{}, err
+	}
+
+	if reqBody.Amount > d.Amount {
+		return http.StatusBadRequest, gin.H{"status": "fail", "data": gin.H{
+			"req.Body.amount": fmt.Sprintf("amount should not be greater than the donation amount(%d)", d.Amount),
+		}}, nil
+	}
+
+	if d.RecTradeID == "" {
+		return http.StatusConflict, gin.H{"status": "fail", "data": gin.H{
+			"req.URL": fmt.Sprintf("donation(order_number: %s) does not have a transaction to refund", d.OrderNumber),
+		}}, nil
+	}
+
+	if gateway, err = mc.Gateways.Get(d.PaymentGateway); nil != err {
+		return 0, gin.H{}, models.NewAppError(errorWhere, err.Error(), "", http.StatusInternalServerError)
+	}
+
+	refund := models.DonationRefund{
+		Amount:       reqBody.Amount,
+		Currency:     d.Currency,
+		DonationID:   uint(recordID),
+		DonationType: donationType,
+		Reason:       reqBody.Reason,
+		RecTradeID:   d.RecTradeID,
+		RequestedBy:  reqBody.UserID,
+		Status:       statusRefunding,
+	}
+
+	// the amount of the refund is decided while creating the draft record
+	if err = mc.Storage.CreateADraftDonationRefund(&refund); nil != err {
+		appErr, _ := err.(*models.AppError)
+		if appErr.StatusCode == http.StatusConflict {
+			return appErr.StatusCode, gin.H{"status": "fail", "data": gin.H{
+				"req.Body.amount": appErr.Message,
+			}}, nil
+		}
+		return 0, gin.H{}, models.NewAppError(errorWhere, "Fails to create a draft refund record", appErr.Error(), appErr.StatusCode)
+	}
+
+	gatewayRefund, err = gateway.Refund(payment.RefundReq{
+		Amount:      refund.Amount,
+		OrderNumber: d.OrderNumber,
+		RecTradeID:  refund.RecTradeID,
+	})
+
+	if nil != err && payment.StatusSuccess == gatewayRefund.Status {
+		// The result of the refund is unknown, leave the record in 'refunding'
+		return 0, gin.H{}, models.NewAppError(errorWhere, err.Error(), fmt.Sprintf("refund(id: %d) is left in refunding", refund.ID), http.StatusInternalServerError)
+	}
+
+	refund.Msg = gatewayRefund.Msg
+	refund.TappayApiStatus = null.IntFrom(gatewayRefund.Status)
+
+	if nil != err {
+		refund.Status = statusFail
+		mc.Storage.UpdateADonationRefundInTRX(refund)
+		return 0, gin.H{}, models.NewAppError(errorWhere, err.Error(), gatewayRefund.Msg, http.StatusInternalServerError)
+	}
+
+	refund.RefundID = gatewayRefund.RefundID
+	refund.Status = statusRefunded
+
+	if fullyRefunded, err = mc.Storage.UpdateADonationRefundInTRX(refund); nil != err {
+		log.Error(err.Error())
+	}
+
+	// send refund mail asynchronously
+	go mc.sendDonationRefundMail(d, refund, fullyRefunded)
+
+	return http.StatusCreated, gin.H{"status": "success", "data": refund}, nil
+}
+
+func (mc *MembershipController) sendDonationRefundMail(d refundedDonation, refund models.DonationRefund, fullyRefunded bool) {
+	reqBody := donationRefundReqBody{
+		Amount:         d.Amount,
+		Currency:       d.Currency,
+		DonationType:   d.TypeName,
+		Email:          d.Email,
+		FullyRefunded:  fullyRefunded,
+		Name:           d.Name,
+		OrderNumber:    d.OrderNumber,
+		RefundedAmount: refund.Amount,
+	}
+
+	if err := postMailServiceEndpoint(reqBody, fmt.Sprintf("http://localhost:%s/v1/%s", globals.LocalhostPort, globals.SendRefundDonationRoutePath)); err != nil {
+		log.Warnf("fail to send %s donation(order_number: %s) refund mail due to %s", d.TypeName, d.OrderNumber, err.Error())
+	}
+}
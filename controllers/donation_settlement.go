@@ -0,0 +1,464 @@
+package controllers
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gin-gonic/gin"
+	"gopkg.in/guregu/null.v3"
+
+	"twreporter.org/go-api/models"
+	"twreporter.org/go-api/utils"
+)
+
+// settlementColumns are the columns of the daily settlement file of TapPay and CTBC, the order of the columns does not matter
+var settlementColumns = []string{"transaction_type", "rec_trade_id", "bank_transaction_id", "amount", "currency"}
+
+// settlementTransactionTypes are the transaction types of the lines, the lines without the type are payments
+var settlementTransactionTypes = []string{models.SettlementPayment, models.SettlementRefund, models.SettlementChargeback}
+
+// settlementResults are the results of the reconciliation which the report could be filtered by
+var settlementResults = []string{
+	models.ReconciliationMatched,
+	models.ReconciliationMissingDonation,
+	models.ReconciliationMissingSettlement,
+	models.ReconciliationAmountMismatch,
+	models.ReconciliationStatusMismatch,
+	models.ReconciliationChargeback,
+}
+
+type (
+	settlementLine struct {
+		Amount            int64
+		BankTransactionID string
+		Currency          string
+		Line              int
+		RecTradeID        string
+		TransactionType   string
+	}
+
+	// SettlementImportSummary counts the results of reconciling a settlement file
+	SettlementImportSummary struct {
+		// Lines is the number of the lines in the file
+		Lines int `json:"lines"`
+		// Results are the numbers of the reconciliation results by the results, including the donations missing in the file
+		Results        map[string]int `json:"results"`
+		SettlementDate string         `json:"settlement_date"`
+	}
+)
+
+// parseSettlementLines reads the lines of the settlement file with the header of `settlementColumns`, e.g.
+//
+//	transaction_type,rec_trade_id,bank_transaction_id,amount,currency
+//	payment,D20191201abcdef,TP20191201abcdef,500,TWD
+//
+// The amounts of refunds and chargebacks could be negative. The fail data is keyed by the line numbers and the fields.
+func parseSettlementLines(r io.Reader) ([]settlementLine, gin.H) {
+	var failData = gin.H{}
+	var keys = make(map[string]int)
+	var lines []settlementLine
+
+	cr := csv.NewReader(r)
+	cr.TrimLeadingSpace = true
+
+	header, err := cr.Read()
+	if nil != err {
+		return lines, gin.H{"req.Body.file": fmt.Sprintf("cannot read the header. %s", err.Error())}
+	}
+
+	// the byte order mark is prepended to the files exported by Excel
+	columns := make(map[string]int)
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "\ufeff")))
+		if !utils.ContainsString(settlementColumns, name) {
+			return lines, gin.H{"req.Body.file": fmt.Sprintf("column %s is not supported. should be some of %s", name, strings.Join(settlementColumns, ", "))}
+		}
+		columns[name] = i
+	}
+
+	if _, ok := columns["amount"]; !ok {
+		return lines, gin.H{"req.Body.file": "column amount is required"}
+	}
+
+	_, hasRecTradeID := columns["rec_trade_id"]
+	_, hasBankTransactionID := columns["bank_transaction_id"]
+	if !hasRecTradeID && !hasBankTransactionID {
+		return lines, gin.H{"req.Body.file": "column rec_trade_id or bank_transaction_id is required"}
+	}
+
+	cr.FieldsPerRecord = len(header)
+	for line := 2; ; line++ {
+		record, err := cr.Read()
+		if io.EOF == err {
+			break
+		}
+		if nil != err {
+			return lines, gin.H{"req.Body.file": err.Error()}
+		}
+
+		get := func(name string) string {
+			if i, ok := columns[name]; ok {
+				return strings.TrimSpace(record[i])
+			}
+			return ""
+		}
+
+		l := settlementLine{
+			BankTransactionID: get("bank_transaction_id"),
+			Currency:          strings.ToUpper(get("currency")),
+			Line:              line,
+			RecTradeID:        get("rec_trade_id"),
+			TransactionType:   strings.ToLower(get("transaction_type")),
+		}
+
+		prefix := fmt.Sprintf("req.Body.file.line.%d.", line)
+
+		if l.TransactionType == "" {
+			l.TransactionType = models.SettlementPayment
+		} else if !utils.ContainsString(settlementTransactionTypes, l.TransactionType) {
+			failData[prefix+"transaction_type"] = fmt.Sprintf("transaction_type should be one of %s", strings.Join(settlementTransactionTypes, ", "))
+		}
+
+		if l.Currency == "" {
+			l.Currency = defaultCurrency
+		}
+
+		if l.RecTradeID == "" && l.BankTransactionID == "" {
+			failData[prefix+"rec_trade_id"] = "rec_trade_id or bank_transaction_id is required"
+		} else if models.SettlementRefund != l.TransactionType {
+			// the same transaction should be settled once by each transaction type,
+			// except the refunds since a donation could be refunded partially several times
+			key := fmt.Sprintf("%s/%s/%s", l.TransactionType, l.RecTradeID, l.BankTransactionID)
+			if first, ok := keys[key]; ok {
+				failData[prefix+"rec_trade_id"] = fmt.Sprintf("the transaction is on line %d already", first)
+			} else {
+				keys[key] = line
+			}
+		}
+
+		if l.Amount, err = strconv.ParseInt(strings.Replace(get("amount"), ",", "", -1), 10, 64); nil != err || 0 == l.Amount {
+			failData[prefix+"amount"] = "amount should be a non-zero integer"
+		}
+
+		lines = append(lines, l)
+	}
+
+	if len(failData) > 0 {
+		return lines, failData
+	}
+
+	if len(lines) == 0 {
+		return lines, gin.H{"req.Body.file": "no transaction is in the file"}
+	}
+
+	return lines, nil
+}
+
+// takeASettledRefund removes the refund of the amount from the refunds of the donation and returns it, the refunded one is preferred.
+// It returns nil if the donation has no refund of the amount.
+func takeASettledRefund(refundsOf map[string][]models.DonationRefund, key string, amount uint) *models.DonationRefund {
+	refunds := refundsOf[key]
+	taken := -1
+
+	for i := range refunds {
+		if refunds[i].Amount != amount {
+			continue
+		}
+		if taken == -1 || statusRefunded == refunds[i].Status {
+			taken = i
+		}
+		if statusRefunded == refunds[i].Status {
+			break
+		}
+	}
+
+	if taken == -1 {
+		return nil
+	}
+
+	refund := refunds[taken]
+	refundsOf[key] = append(refunds[:taken:taken], refunds[taken+1:]...)
+	return &refund
+}
+
+// reconcileASettlementLine compares the line with the donation of the same transaction, the donation is nil if it is not found.
+// A refund line is compared with the refund of the donation taken by the line instead, which is nil if no refund of the amount is found.
+func reconcileASettlementLine(l settlementLine, d *models.SettlementDonation, refund *models.DonationRefund) models.SettlementReconciliation {
+	r := models.SettlementReconciliation{
+		BankTransactionID: null.NewString(l.BankTransactionID, l.BankTransactionID != ""),
+		Currency:          l.Currency,
+		Line:              null.IntFrom(int64(l.Line)),
+		RecTradeID:        null.NewString(l.RecTradeID, l.RecTradeID != ""),
+		SettledAmount:     null.IntFrom(l.Amount),
+		TransactionType:   null.StringFrom(l.TransactionType),
+	}
+
+	if nil != d {
+		r.DonationAmount = null.IntFrom(int64(d.Amount))
+		r.DonationID = null.IntFrom(int64(d.ID))
+		r.DonationType = null.StringFrom(d.Type)
+		r.OrderNumber = null.StringFrom(d.OrderNumber)
+	}
+
+	amount := l.Amount
+	if amount < 0 {
+		amount = -amount
+	}
+
+	switch {
+	case models.SettlementChargeback == l.TransactionType:
+		r.Result = models.ReconciliationChargeback
+	case nil == d:
+		r.Result = models.ReconciliationMissingDonation
+	case models.SettlementRefund == l.TransactionType && (nil == refund || l.Currency != refund.Currency):
+		r.Result = models.ReconciliationAmountMismatch
+	case models.SettlementRefund == l.TransactionType && statusRefunded != refund.Status:
+		r.Result = models.ReconciliationStatusMismatch
+	case models.SettlementRefund == l.TransactionType:
+		r.Result = models.ReconciliationMatched
+	case uint(amount) != d.Amount || l.Currency != d.Currency:
+		r.Result = models.ReconciliationAmountMismatch
+	case statusPaid != d.Status && statusRefunded != d.Status:
+		r.Result = models.ReconciliationStatusMismatch
+	default:
+		r.Result = models.ReconciliationMatched
+	}
+
+	return r
+}
+
+// reconcileASettlementFile reconciles the settlement file of the date against the prime and card token donations charged through TapPay.
+// The lines are matched to the donations by the rec trade ids or the bank transaction ids,
+// and the donations paid on the date but not settled in the file are reported as missing.
+// The results replace the ones of the same date imported before.
+func (mc *MembershipController) reconcileASettlementFile(r io.Reader, settlementDate string, importedBy uint, now time.Time) (SettlementImportSummary, gin.H, error) {
+	var location, _ = time.LoadLocation("Asia/Taipei")
+	var bankTransactionIDs []string
+	var recTradeIDs []string
+	var records []models.SettlementReconciliation
+	var summary = SettlementImportSummary{Results: make(map[string]int), SettlementDate: settlementDate}
+
+	date, err := time.ParseInLocation(donationsDateLayout, settlementDate, location)
+	if nil != err {
+		return summary, gin.H{"req.Body.settlement_date": "settlement_date should be a date in YYYY-MM-DD format"}, nil
+	} else if date.After(now) {
+		return summary, gin.H{"req.Body.settlement_date": "settlement_date should not be in the future"}, nil
+	}
+
+	lines, failData := parseSettlementLines(r)
+	if nil != failData {
+		return summary, failData, nil
+	}
+
+	for _, l := range lines {
+		if l.RecTradeID != "" {
+			recTradeIDs = append(recTradeIDs, l.RecTradeID)
+		}
+		if l.BankTransactionID != "" {
+			bankTransactionIDs = append(bankTransactionIDs, l.BankTransactionID)
+		}
+	}
+
+	donations, err := mc.Storage.GetSettlementDonationsByTransactionIDs(recTradeIDs, bankTransactionIDs)
+	if nil != err {
+		return summary, nil, err
+	}
+
+	byRecTradeID := make(map[string]*models.SettlementDonation)
+	byBankTransactionID := make(map[string]*models.SettlementDonation)
+	for i := range donations {
+		d := &donations[i]
+		if d.RecTradeID != "" {
+			byRecTradeID[d.RecTradeID] = d
+		}
+		if d.BankTransactionID != "" {
+			byBankTransactionID[d.BankTransactionID] = d
+		}
+	}
+
+	// the refund lines are matched to the refunds of the donations, since the donations refunded partially are left paid
+	var donationRecTradeIDs []string
+	for _, d := range donations {
+		if d.RecTradeID != "" {
+			donationRecTradeIDs = append(donationRecTradeIDs, d.RecTradeID)
+		}
+	}
+
+	refunds, err := mc.Storage.GetRefundsByRecTradeIDs(donationRecTradeIDs)
+	if nil != err {
+		return summary, nil, err
+	}
+
+	refundsOf := make(map[string][]models.DonationRefund)
+	for _, refund := range refunds {
+		key := fmt.Sprintf("%s/%d", refund.DonationType, refund.DonationID)
+		refundsOf[key] = append(refundsOf[key], refund)
+	}
+
+	// settled are the donations whose payments are in the file
+	settled := make(map[string]bool)
+
+	for _, l := range lines {
+		var refund *models.DonationRefund
+
+		d := byRecTradeID[l.RecTradeID]
+		if nil == d {
+			d = byBankTransactionID[l.BankTransactionID]
+		}
+
+		if nil != d && models.SettlementPayment == l.TransactionType {
+			settled[fmt.Sprintf("%s/%d", d.Type, d.ID)] = true
+		}
+
+		if nil != d && models.SettlementRefund == l.TransactionType {
+			amount := l.Amount
+			if amount < 0 {
+				amount = -amount
+			}
+			refund = takeASettledRefund(refundsOf, fmt.Sprintf("%s/%d", d.Type, d.ID), uint(amount))
+		}
+
+		records = append(records, reconcileASettlementLine(l, d, refund))
+	}
+
+	expected, err := mc.Storage.GetSettlementDonationsByTransactionTime(date, date.AddDate(0, 0, 1))
+	if nil != err {
+		return summary, nil, err
+	}
+
+	for _, d := range expected {
+		if settled[fmt.Sprintf("%s/%d", d.Type, d.ID)] {
+			continue
+		}
+
+		records = append(records, models.SettlementReconciliation{
+			BankTransactionID: null.NewString(d.BankTransactionID, d.BankTransactionID != ""),
+			Currency:          d.Currency,
+			DonationAmount:    null.IntFrom(int64(d.Amount)),
+			DonationID:        null.IntFrom(int64(d.ID)),
+			DonationType:      null.StringFrom(d.Type),
+			OrderNumber:       null.StringFrom(d.OrderNumber),
+			RecTradeID:        null.NewString(d.RecTradeID, d.RecTradeID != ""),
+			Result:            models.ReconciliationMissingSettlement,
+		})
+	}
+
+	for i := range records {
+		records[i].ImportedBy = null.NewInt(int64(importedBy), importedBy != 0)
+		summary.Results[records[i].Result]++
+	}
+
+	if err = mc.Storage.ReplaceSettlementReconciliations(settlementDate, records); nil != err {
+		return summary, nil, err
+	}
+
+	summary.Lines = len(lines)
+
+	log.Infof("MembershipController.reconcileASettlementFile: the settlement of %s is reconciled. %+v", settlementDate, summary.Results)
+	return summary, nil, nil
+}
+
+// ReconcileASettlementFile reconciles the settlement file of the date imported by the staff, the fail data is returned if the file is rejected
+func (mc *MembershipController) ReconcileASettlementFile(r io.Reader, settlementDate string, importedBy uint) (SettlementImportSummary, gin.H, error) {
+	return mc.reconcileASettlementFile(r, settlementDate, importedBy, time.Now())
+}
+
+// ImportASettlementFile method
+// Handler for admins to import the daily settlement file of TapPay and CTBC,
+// which is uploaded as the `file` field of the multipart form along with `settlement_date` and `user_id`.
+func (mc *MembershipController) ImportASettlementFile(c *gin.Context) (int, gin.H, error) {
+	var form = struct {
+		SettlementDate string `form:"settlement_date" binding:"required"`
+		UserID         uint   `form:"user_id" binding:"required"`
+	}{}
+
+	if err := c.ShouldBind(&form); nil != err {
+		return http.StatusBadRequest, gin.H{"status": "fail", "data": gin.H{"req.Body": err.Error()}}, nil
+	}
+
+	fh, err := c.FormFile("file")
+	if nil != err {
+		return http.StatusBadRequest, gin.H{"status": "fail", "data": gin.H{"req.Body.file": "file is required"}}, nil
+	}
+
+	f, err := fh.Open()
+	if nil != err {
+		return 0, gin.H{}, models.NewAppError("MembershipController.ImportASettlementFile", "cannot open the uploaded file", err.Error(), http.StatusInternalServerError)
+	}
+	defer f.Close()
+
+	summary, failData, err := mc.reconcileASettlementFile(f, form.SettlementDate, form.UserID, time.Now())
+	if nil != err {
+		return 0, gin.H{}, err
+	} else if failData != nil {
+		return http.StatusBadRequest, gin.H{"status": "fail", "data": failData}, nil
+	}
+
+	return http.StatusCreated, gin.H{"status": "success", "data": summary}, nil
+}
+
+// GetSettlementReconciliations method
+// Handler for admins to get the reconciliation report of a settlement date.
+// The results could be filtered by `result`, and the numbers of all results are summarized.
+func (mc *MembershipController) GetSettlementReconciliations(c *gin.Context) (int, gin.H, error) {
+	var location, _ = time.LoadLocation("Asia/Taipei")
+
+	settlementDate := c.Param("date")
+	if _, err := time.ParseInLocation(donationsDateLayout, settlementDate, location); nil != err {
+		return http.StatusBadRequest, gin.H{"status": "fail", "data": gin.H{
+			"req.URL.date": "date should be in YYYY-MM-DD format",
+		}}, nil
+	}
+
+	result := c.Query("result")
+	if result != "" && !utils.ContainsString(settlementResults, result) {
+		return http.StatusBadRequest, gin.H{"status": "fail", "data": gin.H{
+			"req.URL.query.result": fmt.Sprintf("result should be one of %s", strings.Join(settlementResults, ", ")),
+		}}, nil
+	}
+
+	limit, _ := strconv.Atoi(c.Query("limit"))
+	offset, _ := strconv.Atoi(c.Query("offset"))
+
+	if limit <= 0 {
+		limit = defaultDonationsLimit
+	}
+
+	if limit > maxDonationsLimit {
+		limit = maxDonationsLimit
+	}
+
+	if offset < 0 {
+		offset = 0
+	}
+
+	records, total, err := mc.Storage.GetSettlementReconciliations(settlementDate, result, limit, offset)
+	if nil != err {
+		return 0, gin.H{}, err
+	}
+
+	counts, err := mc.Storage.CountSettlementReconciliations(settlementDate)
+	if nil != err {
+		return 0, gin.H{}, err
+	}
+
+	if records == nil {
+		records = []models.SettlementReconciliation{}
+	}
+
+	if counts == nil {
+		counts = []models.SettlementResultCount{}
+	}
+
+	return http.StatusOK, gin.H{"status": "success", "data": gin.H{
+		"records": records,
+		"meta":    models.MetaOfResponse{Total: total, Offset: offset, Limit: limit},
+		"summary": counts,
+	}}, nil
+}
@@ -0,0 +1,132 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"twreporter.org/go-api/currency"
+	"twreporter.org/go-api/globals"
+	"twreporter.org/go-api/models"
+	"twreporter.org/go-api/payment"
+)
+
+// tradeReq creates the trade of a prime donation, or the first installment of a periodic donation if the frequency is given
+type tradeReq struct {
+	Amount    uint   `json:"amount" binding:"required"`
+	Currency  string `json:"currency"`
+	Details   string `json:"details"`
+	Frequency string `json:"frequency"`
+	PayMethod string `json:"pay_method"`
+	UserID    uint   `json:"user_id" binding:"required"`
+}
+
+// CreateATradeOfAUser method
+// Handler for an authenticated user to create the trade of the donation on the payment gateway which needs it, such as ECPay.
+// The token of the trade is given to the SDK of the payment gateway,
+// and the donation request carries the order number of the trade along with the prime returned by the SDK.
+func (mc *MembershipController) CreateATradeOfAUser(c *gin.Context) (int, gin.H, error) {
+	const errorWhere = "MembershipController.CreateATradeOfAUser"
+	var reqBody tradeReq
+	var t = prime
+
+	if failData, valid := bindRequestBody(c, &reqBody); valid == false {
+		return http.StatusBadRequest, gin.H{"status": "fail", "data": failData}, nil
+	}
+
+	payMethod := reqBody.PayMethod
+	switch reqBody.Frequency {
+	case "":
+		if err := validatePayMethod(payMethod); nil != err {
+			return http.StatusBadRequest, gin.H{"status": "fail", "data": gin.H{"req.Body.pay_method": err.Error()}}, nil
+		}
+	case monthlyFrequency, yearlyFrequency:
+		// the first installments of periodic donations are charged by credit cards
+		payMethod = defaultPeriodicPayMethod
+		t = token
+	default:
+		return http.StatusBadRequest, gin.H{"status": "fail", "data": gin.H{
+			"req.Body.frequency": "frequency is not supported. should be `monthly` or `yearly`",
+		}}, nil
+	}
+
+	currencies := currency.FromConfig(globals.Conf.Donation)
+	reqBody.Currency = strings.ToUpper(reqBody.Currency)
+	if reqBody.Currency == "" {
+		reqBody.Currency = defaultCurrency
+	}
+
+	if err := currencies.Validate(reqBody.Currency, reqBody.Amount); nil != err {
+		return http.StatusBadRequest, gin.H{"status": "fail", "data": gin.H{"req.Body.amount": err.Error()}}, nil
+	}
+
+	if reqBody.Details == "" {
+		reqBody.Details = defaultDetails
+	}
+
+	gateway, err := mc.Gateways.GetByPayMethod(payMethod)
+	if nil != err {
+		return 0, gin.H{}, models.NewAppError(errorWhere, err.Error(), "", http.StatusInternalServerError)
+	}
+
+	creator, ok := gateway.(payment.TradeCreator)
+	if !ok {
+		return http.StatusBadRequest, gin.H{"status": "fail", "data": gin.H{
+			"req.Body.pay_method": fmt.Sprintf("the donations of %s are made by the primes without trades", payMethod),
+		}}, nil
+	}
+
+	user, err := mc.Storage.GetUserByID(fmt.Sprint(reqBody.UserID))
+	if nil != err {
+		return 0, gin.H{}, err
+	}
+
+	orderNumber := generateOrderNumber(t, getPayMethodID(payMethod))
+
+	tradeToken, err := creator.CreateTrade(payment.TradeReq{
+		Amount:      reqBody.Amount,
+		Currency:    reqBody.Currency,
+		Details:     reqBody.Details,
+		Email:       user.Email.ValueOrZero(),
+		OrderNumber: orderNumber,
+		Remember:    t == token,
+		UserID:      reqBody.UserID,
+	})
+	if nil != err {
+		return 0, gin.H{}, models.NewAppError(errorWhere, err.Error(), "", http.StatusInternalServerError)
+	}
+
+	return http.StatusCreated, gin.H{"status": "success", "data": gin.H{
+		"amount":       reqBody.Amount,
+		"currency":     reqBody.Currency,
+		"order_number": orderNumber,
+		"token":        tradeToken,
+	}}, nil
+}
+
+// orderNumberOfTrade returns the order number of the trade which the donation pays if the payment gateway creates trades,
+// otherwise a new order number is generated.
+// The order number of a trade is paid once, `m` is the model of the donations to look up the used order number.
+func (mc *MembershipController) orderNumberOfTrade(req clientReq, gateway payment.PaymentGateway, t payType, payMethod string, m interface{}) (string, gin.H, error) {
+	if _, ok := gateway.(payment.TradeCreator); !ok {
+		return generateOrderNumber(t, getPayMethodID(payMethod)), nil, nil
+	}
+
+	if !strings.HasPrefix(req.OrderNumber, orderPrefix+"-") || !strings.HasSuffix(req.OrderNumber, fmt.Sprintf("%d%d", t, getPayMethodID(payMethod))) {
+		return "", gin.H{"req.Body.order_number": "order_number of the trade created by POST /v1/donations/trades is required"}, nil
+	}
+
+	err := mc.Storage.GetByConditions(map[string]interface{}{"order_number": req.OrderNumber}, m)
+	if nil == err {
+		return "", gin.H{"req.Body.order_number": "the trade of order_number is paid already"}, nil
+	}
+
+	appErr, _ := err.(*models.AppError)
+	if nil == appErr || appErr.StatusCode != http.StatusNotFound {
+		return "", nil, err
+	}
+
+	return req.OrderNumber, nil, nil
+}
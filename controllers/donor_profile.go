@@ -0,0 +1,251 @@
+package controllers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gopkg.in/guregu/null.v3"
+
+	"twreporter.org/go-api/models"
+	"twreporter.org/go-api/utils"
+)
+
+// the stop reason of the periodic donations whose card is removed by the donor
+const cardRemovedStopReason = "the card is removed by the donor"
+
+// donorProfileSendReceipts are the receipt preferences of the donor profiles, which both the prime and the periodic donations accept
+var donorProfileSendReceipts = []string{monthlyReceipt, noReceipt}
+
+type donorProfileReq struct {
+	Cardholder  models.Cardholder `json:"cardholder" binding:"dive"`
+	SendReceipt string            `json:"send_receipt"`
+}
+
+// parseUserIDParam parses the user id in the url, which is validated by the middleware against the user of the JWT
+func parseUserIDParam(c *gin.Context) (uint, gin.H) {
+	userID, err := strconv.ParseUint(c.Param("userID"), 10, strconv.IntSize)
+	if err != nil {
+		return 0, gin.H{"req.URL": fmt.Sprintf("%s cannot address a found resource", c.Request.RequestURI)}
+	}
+	return uint(userID), nil
+}
+
+// prefillByDonorProfile fills the fields of the cardholder and the receipt preference which the request omits by the donor profile of the user.
+// The request is left unchanged if the user has no donor profile.
+func (mc *MembershipController) prefillByDonorProfile(req *clientReq) error {
+	profile, err := mc.Storage.GetADonorProfile(req.UserID)
+	if nil != err {
+		appErr, _ := err.(*models.AppError)
+		if nil != appErr && appErr.StatusCode == http.StatusNotFound {
+			return nil
+		}
+		return err
+	}
+
+	if req.Cardholder.Email == "" {
+		req.Cardholder.Email = profile.Email
+	}
+
+	for _, field := range []struct {
+		dst *null.String
+		src null.String
+	}{
+		{&req.Cardholder.Address, profile.Address},
+		{&req.Cardholder.Name, profile.Name},
+		{&req.Cardholder.NationalID, profile.NationalID},
+		{&req.Cardholder.PhoneNumber, profile.PhoneNumber},
+		{&req.Cardholder.ZipCode, profile.ZipCode},
+	} {
+		if field.dst.ValueOrZero() == "" {
+			*field.dst = field.src
+		}
+	}
+
+	if req.SendReceipt == "" {
+		req.SendReceipt = profile.SendReceipt
+	}
+
+	return nil
+}
+
+// GetTheDonorProfileOfAUser method
+// Handler for an authenticated user to get the saved details which pre-fill the new donations
+func (mc *MembershipController) GetTheDonorProfileOfAUser(c *gin.Context) (int, gin.H, error) {
+	userID, failData := parseUserIDParam(c)
+	if failData != nil {
+		return http.StatusNotFound, gin.H{"status": "fail", "data": failData}, nil
+	}
+
+	profile, err := mc.Storage.GetADonorProfile(userID)
+	if nil != err {
+		appErr, _ := err.(*models.AppError)
+		if nil != appErr && appErr.StatusCode == http.StatusNotFound {
+			return http.StatusNotFound, gin.H{"status": "fail", "data": gin.H{
+				"req.URL": fmt.Sprintf("the user(id: %d) has no donor profile", userID),
+			}}, nil
+		}
+		return 0, gin.H{}, err
+	}
+
+	return http.StatusOK, gin.H{"status": "success", "data": profile}, nil
+}
+
+// SaveTheDonorProfileOfAUser method
+// Handler for an authenticated user to save the default cardholder and the receipt preference.
+// The profile is replaced as a whole, so the omitted fields are cleared.
+func (mc *MembershipController) SaveTheDonorProfileOfAUser(c *gin.Context) (int, gin.H, error) {
+	var reqBody donorProfileReq
+
+	userID, failData := parseUserIDParam(c)
+	if failData != nil {
+		return http.StatusNotFound, gin.H{"status": "fail", "data": failData}, nil
+	}
+
+	if data, valid := bindRequestBody(c, &reqBody); valid == false {
+		return http.StatusBadRequest, gin.H{"status": "fail", "data": data}, nil
+	}
+
+	if reqBody.SendReceipt == "" {
+		reqBody.SendReceipt = monthlyReceipt
+	} else if !utils.ContainsString(donorProfileSendReceipts, reqBody.SendReceipt) {
+		return http.StatusBadRequest, gin.H{"status": "fail", "data": gin.H{
+			"req.Body.send_receipt": fmt.Sprintf("send_receipt should be one of %s", strings.Join(donorProfileSendReceipts, ", ")),
+		}}, nil
+	}
+
+	profile := models.DonorProfile{
+		Cardholder:  reqBody.Cardholder,
+		SendReceipt: reqBody.SendReceipt,
+		UserID:      userID,
+	}
+
+	if err := mc.Storage.SaveADonorProfile(&profile); nil != err {
+		return 0, gin.H{}, err
+	}
+
+	return http.StatusOK, gin.H{"status": "success", "data": profile}, nil
+}
+
+// cardOnFileID derives the id of the card from its masked card info, so that the same card of several periodic donations is listed once
+func cardOnFileID(ci models.CardInfo) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s/%s/%s/%d", ci.BinCode.ValueOrZero(), ci.LastFour.ValueOrZero(), ci.ExpiryDate.ValueOrZero(), ci.Type.ValueOrZero())))
+	return hex.EncodeToString(sum[:8])
+}
+
+// getCardsOnFileOfAUser groups the active periodic donations of the user by their cards,
+// and returns the cards in the order they are first used along with the periodic donations charged by each card
+func (mc *MembershipController) getCardsOnFileOfAUser(userID uint) ([]models.CardOnFile, map[string][]models.PeriodicDonation, error) {
+	cards := []models.CardOnFile{}
+	periodicDonations := make(map[string][]models.PeriodicDonation)
+
+	pds, err := mc.Storage.GetCardedPeriodicDonationsOfAUser(userID)
+	if nil != err {
+		return cards, periodicDonations, err
+	}
+
+	indexes := make(map[string]int)
+
+	for _, pd := range pds {
+		id := cardOnFileID(pd.CardInfo)
+
+		if _, ok := indexes[id]; !ok {
+			indexes[id] = len(cards)
+			cards = append(cards, models.CardOnFile{
+				ExpiryDate:        pd.ExpiryDate.ValueOrZero(),
+				ID:                id,
+				LastFour:          pd.LastFour.ValueOrZero(),
+				PeriodicDonations: []string{},
+				Type:              cardInfoTypes[pd.Type.ValueOrZero()],
+			})
+		}
+
+		card := &cards[indexes[id]]
+		card.PeriodicDonations = append(card.PeriodicDonations, pd.OrderNumber)
+		periodicDonations[id] = append(periodicDonations[id], pd)
+	}
+
+	return cards, periodicDonations, nil
+}
+
+// GetCardsOnFileOfAUser method
+// Handler for an authenticated user to list the masked cards which the active periodic donations are charged by
+func (mc *MembershipController) GetCardsOnFileOfAUser(c *gin.Context) (int, gin.H, error) {
+	userID, failData := parseUserIDParam(c)
+	if failData != nil {
+		return http.StatusNotFound, gin.H{"status": "fail", "data": failData}, nil
+	}
+
+	cards, _, err := mc.getCardsOnFileOfAUser(userID)
+	if nil != err {
+		return 0, gin.H{}, err
+	}
+
+	return http.StatusOK, gin.H{"status": "success", "data": cards}, nil
+}
+
+// RemoveACardOnFileOfAUser method
+// Handler for an authenticated user to remove a card on file, which stops the periodic donations charged by the card.
+// The donor confirms the removal by `?confirm=true`, otherwise the periodic donations to be stopped are returned without removing the card.
+func (mc *MembershipController) RemoveACardOnFileOfAUser(c *gin.Context) (int, gin.H, error) {
+	userID, failData := parseUserIDParam(c)
+	if failData != nil {
+		return http.StatusNotFound, gin.H{"status": "fail", "data": failData}, nil
+	}
+
+	cards, periodicDonations, err := mc.getCardsOnFileOfAUser(userID)
+	if nil != err {
+		return 0, gin.H{}, err
+	}
+
+	var card *models.CardOnFile
+	for i := range cards {
+		if cards[i].ID == c.Param("cardID") {
+			card = &cards[i]
+		}
+	}
+
+	if nil == card {
+		return http.StatusNotFound, gin.H{"status": "fail", "data": gin.H{
+			"req.URL": fmt.Sprintf("%s cannot address a found resource", c.Request.RequestURI),
+		}}, nil
+	}
+
+	if confirm, _ := strconv.ParseBool(c.Query("confirm")); !confirm {
+		return http.StatusConflict, gin.H{"status": "fail", "data": gin.H{
+			"req.URL.query.confirm": "removing the card stops the periodic donations charged by it, confirm by ?confirm=true",
+			"periodic_donations":    card.PeriodicDonations,
+		}}, nil
+	}
+
+	m := models.PeriodicDonation{
+		Status:     statusStopped,
+		StopReason: cardRemovedStopReason,
+		StoppedAt:  null.TimeFrom(time.Now()),
+	}
+
+	var ids []uint
+	for _, pd := range periodicDonations[card.ID] {
+		ids = append(ids, pd.ID)
+	}
+
+	stopped, err := mc.Storage.StopThePeriodicDonationsOfARemovedCard(ids, m)
+	if nil != err {
+		return 0, gin.H{}, err
+	}
+
+	// the periodic donations which are stopped by other requests meanwhile are not listed
+	card.PeriodicDonations = []string{}
+	for _, pd := range periodicDonations[card.ID] {
+		if utils.ContainsUint(stopped, pd.ID) {
+			card.PeriodicDonations = append(card.PeriodicDonations, pd.OrderNumber)
+		}
+	}
+
+	return http.StatusOK, gin.H{"status": "success", "data": card}, nil
+}
@@ -0,0 +1,147 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"gopkg.in/guregu/null.v3"
+
+	"twreporter.org/go-api/models"
+	"twreporter.org/go-api/utils"
+)
+
+const (
+	donorWallMonthLayout = "2006-01"
+
+	// the donor wall is queried at most once within the duration for the same page
+	donorWallTTL = time.Minute
+	// at most the number of pages are cached, the oldest pages are dropped first
+	donorWallCacheSize = 1000
+	// the pages deeper than the offset are not listed, so that the cached pages are bounded
+	maxDonorWallOffset = 1000
+	// the donations of the months earlier than the number of months ago are not listed
+	maxDonorWallMonths = 120
+
+	maxDisplayNameLength = 50
+)
+
+// donorWallPageSizes are the limits of the pages of the donor wall,
+// the pages of the other sizes are not served so that the cached pages are bounded
+var donorWallPageSizes = []int{10, 20, 50}
+
+type donorWallPage struct {
+	meta    models.MetaOfResponse
+	records []models.DonorWallEntry
+}
+
+// validateDonorWallConsent checks the donor who agrees to be listed on the donor wall gives the display name.
+// The display name is trimmed, and it is left empty if it is not changed.
+func validateDonorWallConsent(d *models.DonorWallConsent) gin.H {
+	if d.DisplayName.Valid {
+		d.DisplayName = null.StringFrom(strings.TrimSpace(d.DisplayName.String))
+	}
+
+	if utf8.RuneCountInString(d.DisplayName.ValueOrZero()) > maxDisplayNameLength {
+		return gin.H{"req.Body.display_name": fmt.Sprintf("display_name should be at most %d characters", maxDisplayNameLength)}
+	}
+
+	if d.ShowOnWall.ValueOrZero() && d.DisplayName.ValueOrZero() == "" {
+		return gin.H{"req.Body.display_name": "display_name is required to be shown on the donor wall"}
+	}
+
+	return nil
+}
+
+// GetDonorWall method
+// Handler for anyone to list the donations whose donors agree to be thanked on the donor wall, the latest first.
+// The donations could be filtered by `campaign` and `month` in YYYY-MM format, and the pages are cached for a minute.
+// The pages are of the fixed sizes and start at the multiples of the size, so that anyone could not fill the cache with arbitrary pages.
+func (mc *MembershipController) GetDonorWall(c *gin.Context) (int, gin.H, error) {
+	var location, _ = time.LoadLocation("Asia/Taipei")
+	var filter models.DonorWallFilter
+	now := time.Now()
+
+	filter.Campaign = c.Query("campaign")
+	if filter.Campaign != "" && !campaignSlugRegexp.MatchString(filter.Campaign) {
+		return http.StatusBadRequest, gin.H{"status": "fail", "data": gin.H{
+			"req.URL.query.campaign": "campaign should be the slug of a campaign",
+		}}, nil
+	}
+
+	month := c.Query("month")
+	if month != "" {
+		t, err := time.ParseInLocation(donorWallMonthLayout, month, location)
+		if err != nil {
+			return http.StatusBadRequest, gin.H{"status": "fail", "data": gin.H{
+				"req.URL.query.month": "month should be in YYYY-MM format",
+			}}, nil
+		}
+
+		thisMonth := time.Date(now.In(location).Year(), now.In(location).Month(), 1, 0, 0, 0, 0, location)
+		if t.After(thisMonth) || t.Before(thisMonth.AddDate(0, -maxDonorWallMonths, 0)) {
+			return http.StatusBadRequest, gin.H{"status": "fail", "data": gin.H{
+				"req.URL.query.month": fmt.Sprintf("month should be within the last %d months", maxDonorWallMonths),
+			}}, nil
+		}
+
+		filter.Since = null.TimeFrom(t)
+		filter.Until = null.TimeFrom(t.AddDate(0, 1, 0))
+	}
+
+	limit, _ := strconv.Atoi(c.Query("limit"))
+	offset, _ := strconv.Atoi(c.Query("offset"))
+
+	if limit <= 0 {
+		limit = defaultDonationsLimit
+	}
+
+	if !utils.ContainsInt(donorWallPageSizes, limit) {
+		return http.StatusBadRequest, gin.H{"status": "fail", "data": gin.H{
+			"req.URL.query.limit": fmt.Sprintf("limit should be one of %v", donorWallPageSizes),
+		}}, nil
+	}
+
+	if offset < 0 {
+		offset = 0
+	}
+
+	if offset > maxDonorWallOffset {
+		offset = maxDonorWallOffset
+	}
+
+	if offset%limit != 0 {
+		return http.StatusBadRequest, gin.H{"status": "fail", "data": gin.H{
+			"req.URL.query.offset": "offset should be a multiple of limit",
+		}}, nil
+	}
+
+	key := fmt.Sprintf("%s/%s/%d/%d", filter.Campaign, month, limit, offset)
+
+	cached, ok := mc.donorWall.get(key, now)
+	page, _ := cached.(donorWallPage)
+	if !ok {
+		records, total, err := mc.Storage.GetDonorWallEntries(filter, limit, offset)
+		if err != nil {
+			return 0, gin.H{}, err
+		}
+
+		page = donorWallPage{
+			meta:    models.MetaOfResponse{Total: total, Offset: offset, Limit: limit},
+			records: records,
+		}
+		if page.records == nil {
+			page.records = []models.DonorWallEntry{}
+		}
+		mc.donorWall.set(key, page, now)
+	}
+
+	return http.StatusOK, gin.H{"status": "success", "data": gin.H{
+		"records": page.records,
+		"meta":    page.meta,
+	}}, nil
+}
@@ -8,12 +8,15 @@ import (
 	"html/template"
 	"io/ioutil"
 	"net/http"
+	"path/filepath"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/gin-gonic/gin"
 	"gopkg.in/guregu/null.v3"
 
+	"twreporter.org/go-api/currency"
+	"twreporter.org/go-api/globals"
 	"twreporter.org/go-api/services"
 	"twreporter.org/go-api/utils"
 )
@@ -28,16 +31,116 @@ type donationSuccessReqBody struct {
 	Amount            uint     `json:"amount" binding:"required"`
 	CardInfoLastFour  string   `json:"card_info_last_four"`
 	CardInfoType      string   `json:"card_info_type"`
+	CompanyName       string   `json:"company_name"`
 	Currency          string   `json:"currency"`
 	DonationTimestamp null.Int `json:"donation_timestamp"`
 	DonationLink      string   `json:"donation_link"`
 	DonationMethod    string   `json:"donation_method" binding:"required"`
 	DonationType      string   `json:"donation_type" binding:"required"`
 	Email             string   `json:"email" binding:"required"`
+	MatchedAmount     uint     `json:"matched_amount"`
+	MatchingSponsor   string   `json:"matching_sponsor"`
 	Name              string   `json:"name"`
 	NationalID        string   `json:"national_id"`
 	OrderNumber       string   `json:"order_number" binding:"required"`
 	PhoneNumber       string   `json:"phone_number"`
+	TaxID             string   `json:"tax_id"`
+}
+
+type donationRefundReqBody struct {
+	Amount         uint   `json:"amount" binding:"required"`
+	Currency       string `json:"currency"`
+	DonationType   string `json:"donation_type" binding:"required"`
+	Email          string `json:"email" binding:"required"`
+	FullyRefunded  bool   `json:"fully_refunded"`
+	Name           string `json:"name"`
+	OrderNumber    string `json:"order_number" binding:"required"`
+	RefundedAmount uint   `json:"refunded_amount" binding:"required"`
+}
+
+type receiptMailReqBody struct {
+	Amount   uint   `json:"amount" binding:"required"`
+	Currency string `json:"currency"`
+	Email    string `json:"email" binding:"required"`
+	Name     string `json:"name"`
+	// Period is the period of the receipt to be displayed, e.g. 2019 年 5 月
+	Period        string `json:"period" binding:"required"`
+	ReceiptNumber string `json:"receipt_number" binding:"required"`
+	// Receipt is the base64 encoded PDF file of the receipt
+	Receipt []byte `json:"receipt" binding:"required"`
+}
+
+type periodicDonationFailureReqBody struct {
+	Amount           uint   `json:"amount" binding:"required"`
+	CardInfoLastFour string `json:"card_info_last_four"`
+	Currency         string `json:"currency"`
+	Email            string `json:"email" binding:"required"`
+	// Final tells the last retry fails and the periodic donation is stopped
+	Final         bool   `json:"final"`
+	Name          string `json:"name"`
+	NextRetryDate string `json:"next_retry_date"`
+	OrderNumber   string `json:"order_number" binding:"required"`
+	// UpdateCardLink is where the donor updates the card
+	UpdateCardLink string `json:"update_card_link" binding:"required"`
+}
+
+type cardExpiryReminderReqBody struct {
+	Amount           uint   `json:"amount" binding:"required"`
+	CardInfoLastFour string `json:"card_info_last_four"`
+	Currency         string `json:"currency"`
+	Email            string `json:"email" binding:"required"`
+	// ExpiryMonth is the month when the card expires in YYYY-MM format
+	ExpiryMonth string `json:"expiry_month" binding:"required"`
+	// LinkExpiryDate is the date when the replace card link expires in YYYY-MM-DD format
+	LinkExpiryDate string `json:"link_expiry_date" binding:"required"`
+	Name           string `json:"name"`
+	OrderNumber    string `json:"order_number" binding:"required"`
+	// ReplaceCardLink is where the donor replaces the card without signing in
+	ReplaceCardLink string `json:"replace_card_link" binding:"required"`
+}
+
+type giftShippedReqBody struct {
+	Address        string `json:"address"`
+	Carrier        string `json:"carrier"`
+	Email          string `json:"email" binding:"required"`
+	Name           string `json:"name"`
+	OrderNumber    string `json:"order_number" binding:"required"`
+	TrackingNumber string `json:"tracking_number" binding:"required"`
+	ZipCode        string `json:"zip_code"`
+}
+
+type matchingReportReqBody struct {
+	Budget   uint   `json:"budget" binding:"required"`
+	Consumed uint   `json:"consumed"`
+	Currency string `json:"currency"`
+	// Donations is the number of the matched donations
+	Donations uint   `json:"donations"`
+	Email     string `json:"email" binding:"required"`
+	// EndDate is the last date of the rule in YYYY-MM-DD format
+	EndDate string `json:"end_date" binding:"required"`
+	// Report is the CSV file of the matched donations
+	Report    []byte `json:"report" binding:"required"`
+	Sponsor   string `json:"sponsor" binding:"required"`
+	StartDate string `json:"start_date" binding:"required"`
+}
+
+type atRiskPeriodicDonation struct {
+	Amount           uint   `json:"amount"`
+	Currency         string `json:"currency"`
+	DunningRetries   uint   `json:"dunning_retries"`
+	DunningStartedAt string `json:"dunning_started_at"`
+	Email            string `json:"email"`
+	Name             string `json:"name"`
+	NextRetryDate    string `json:"next_retry_date"`
+	OrderNumber      string `json:"order_number"`
+	Status           string `json:"status"`
+}
+
+type atRiskPeriodicDonationsReqBody struct {
+	Donations []atRiskPeriodicDonation `json:"donations" binding:"required"`
+	// Email is the address of the staffs
+	Email string `json:"email" binding:"required"`
+	Since string `json:"since"`
 }
 
 // NewMailController is used to new *MailController
@@ -54,9 +157,17 @@ type MailController struct {
 	MailService  services.MailService
 }
 
+// mailTemplateFuncs are the functions used by the mail templates,
+// `formatAmount` prints the amount with the symbol of the currency, e.g. {{formatAmount .Currency .Amount}}
+var mailTemplateFuncs = template.FuncMap{
+	"formatAmount": func(code string, amount uint) string {
+		return currency.FromConfig(globals.Conf.Donation).Format(code, amount)
+	},
+}
+
 // LoadTemplateFiles is a wrapper function to parse template files
 func (contrl *MailController) LoadTemplateFiles(filenames ...string) {
-	contrl.HTMLTemplate = template.Must(template.ParseFiles(filenames...))
+	contrl.HTMLTemplate = template.Must(template.New(filepath.Base(filenames[0])).Funcs(mailTemplateFuncs).ParseFiles(filenames...))
 }
 
 // SendActivation retrieves email and activation link from rqeuest body,
@@ -147,6 +258,279 @@ func (contrl *MailController) SendDonationSuccessMail(c *gin.Context) (int, gin.
 	return http.StatusNoContent, gin.H{}, nil
 }
 
+// SendDonationRefundMail retrieves the refund information from request body,
+// and invoke MailService to send refund confirmation mail
+func (contrl *MailController) SendDonationRefundMail(c *gin.Context) (int, gin.H, error) {
+	const subject = "報導者退款通知"
+	const taipeiLocationName = "Asia/Taipei"
+	var err error
+	var failData gin.H
+	var location *time.Location
+	var mailBody string
+	var out bytes.Buffer
+	var reqBody donationRefundReqBody
+	var valid bool
+
+	if failData, valid = bindRequestBody(c, &reqBody); valid == false {
+		return http.StatusBadRequest, gin.H{"status": "fail", "data": failData}, nil
+	}
+
+	if reqBody.Currency == "" {
+		// give default Currency
+		reqBody.Currency = "TWD"
+	}
+
+	location, _ = time.LoadLocation(taipeiLocationName)
+
+	var templateData = struct {
+		donationRefundReqBody
+		RefundDatetime string
+	}{
+		reqBody,
+		time.Now().In(location).Format("2006-01-02 15:04:05 UTC+8"),
+	}
+
+	if err = contrl.HTMLTemplate.ExecuteTemplate(&out, "refund-donation.tmpl", templateData); err != nil {
+		log.Error(err)
+		return http.StatusInternalServerError, gin.H{"status": "error", "message": "can not create donation refund mail body"}, nil
+	}
+
+	mailBody = out.String()
+
+	// send email through mail service
+	if err = contrl.MailService.Send(reqBody.Email, subject, mailBody); err != nil {
+		log.Error(err)
+		return http.StatusInternalServerError, gin.H{"status": "error", "message": fmt.Sprintf("can not send donation refund mail to %s", reqBody.Email)}, nil
+	}
+
+	return http.StatusNoContent, gin.H{}, nil
+}
+
+// SendReceiptMail retrieves the receipt from request body,
+// and invoke MailService to send the mail with the PDF file of the receipt attached
+func (contrl *MailController) SendReceiptMail(c *gin.Context) (int, gin.H, error) {
+	const subject = "報導者捐款收據"
+	var err error
+	var failData gin.H
+	var mailBody string
+	var out bytes.Buffer
+	var reqBody receiptMailReqBody
+	var valid bool
+
+	if failData, valid = bindRequestBody(c, &reqBody); valid == false {
+		return http.StatusBadRequest, gin.H{"status": "fail", "data": failData}, nil
+	}
+
+	if reqBody.Currency == "" {
+		// give default Currency
+		reqBody.Currency = "TWD"
+	}
+
+	if err = contrl.HTMLTemplate.ExecuteTemplate(&out, "receipt.tmpl", reqBody); err != nil {
+		log.Error(err)
+		return http.StatusInternalServerError, gin.H{"status": "error", "message": "can not create receipt mail body"}, nil
+	}
+
+	mailBody = out.String()
+
+	attachment := services.Attachment{
+		ContentType: "application/pdf",
+		Data:        reqBody.Receipt,
+		Filename:    fmt.Sprintf("twreporter-receipt-%s.pdf", reqBody.ReceiptNumber),
+	}
+
+	// send email through mail service
+	if err = contrl.MailService.SendWithAttachments(reqBody.Email, subject, mailBody, []services.Attachment{attachment}); err != nil {
+		log.Error(err)
+		return http.StatusInternalServerError, gin.H{"status": "error", "message": fmt.Sprintf("can not send receipt mail to %s", reqBody.Email)}, nil
+	}
+
+	return http.StatusNoContent, gin.H{}, nil
+}
+
+// SendPeriodicDonationFailureMail retrieves the failed installment from request body,
+// and invoke MailService to send the mail asking the donor to update the card
+func (contrl *MailController) SendPeriodicDonationFailureMail(c *gin.Context) (int, gin.H, error) {
+	var err error
+	var failData gin.H
+	var mailBody string
+	var out bytes.Buffer
+	var reqBody periodicDonationFailureReqBody
+	var valid bool
+
+	subject := "報導者定期定額扣款失敗通知"
+	templateName := "failed-periodic-donation.tmpl"
+
+	if failData, valid = bindRequestBody(c, &reqBody); valid == false {
+		return http.StatusBadRequest, gin.H{"status": "fail", "data": failData}, nil
+	}
+
+	if reqBody.Currency == "" {
+		// give default Currency
+		reqBody.Currency = "TWD"
+	}
+
+	if reqBody.Final {
+		subject = "報導者定期定額捐款已停止"
+		templateName = "invalid-periodic-donation.tmpl"
+	}
+
+	if err = contrl.HTMLTemplate.ExecuteTemplate(&out, templateName, reqBody); err != nil {
+		log.Error(err)
+		return http.StatusInternalServerError, gin.H{"status": "error", "message": "can not create periodic donation failure mail body"}, nil
+	}
+
+	mailBody = out.String()
+
+	// send email through mail service
+	if err = contrl.MailService.Send(reqBody.Email, subject, mailBody); err != nil {
+		log.Error(err)
+		return http.StatusInternalServerError, gin.H{"status": "error", "message": fmt.Sprintf("can not send periodic donation failure mail to %s", reqBody.Email)}, nil
+	}
+
+	return http.StatusNoContent, gin.H{}, nil
+}
+
+// SendCardExpiryReminderMail retrieves the expiring card of the periodic donation from request body,
+// and invoke MailService to remind the donor to replace the card
+func (contrl *MailController) SendCardExpiryReminderMail(c *gin.Context) (int, gin.H, error) {
+	const subject = "報導者定期定額信用卡即將到期通知"
+	var err error
+	var failData gin.H
+	var mailBody string
+	var out bytes.Buffer
+	var reqBody cardExpiryReminderReqBody
+	var valid bool
+
+	if failData, valid = bindRequestBody(c, &reqBody); valid == false {
+		return http.StatusBadRequest, gin.H{"status": "fail", "data": failData}, nil
+	}
+
+	if reqBody.Currency == "" {
+		// give default Currency
+		reqBody.Currency = "TWD"
+	}
+
+	if err = contrl.HTMLTemplate.ExecuteTemplate(&out, "card-expiry-reminder.tmpl", reqBody); err != nil {
+		log.Error(err)
+		return http.StatusInternalServerError, gin.H{"status": "error", "message": "can not create card expiry reminder mail body"}, nil
+	}
+
+	mailBody = out.String()
+
+	// send email through mail service
+	if err = contrl.MailService.Send(reqBody.Email, subject, mailBody); err != nil {
+		log.Error(err)
+		return http.StatusInternalServerError, gin.H{"status": "error", "message": fmt.Sprintf("can not send card expiry reminder mail to %s", reqBody.Email)}, nil
+	}
+
+	return http.StatusNoContent, gin.H{}, nil
+}
+
+// SendGiftShippedMail retrieves the shipped feedback gift from request body,
+// and invoke MailService to notify the donor with the tracking number
+func (contrl *MailController) SendGiftShippedMail(c *gin.Context) (int, gin.H, error) {
+	const subject = "報導者回饋禮已寄出"
+	var err error
+	var failData gin.H
+	var mailBody string
+	var out bytes.Buffer
+	var reqBody giftShippedReqBody
+	var valid bool
+
+	if failData, valid = bindRequestBody(c, &reqBody); valid == false {
+		return http.StatusBadRequest, gin.H{"status": "fail", "data": failData}, nil
+	}
+
+	if err = contrl.HTMLTemplate.ExecuteTemplate(&out, "gift-shipped.tmpl", reqBody); err != nil {
+		log.Error(err)
+		return http.StatusInternalServerError, gin.H{"status": "error", "message": "can not create gift shipped mail body"}, nil
+	}
+
+	mailBody = out.String()
+
+	// send email through mail service
+	if err = contrl.MailService.Send(reqBody.Email, subject, mailBody); err != nil {
+		log.Error(err)
+		return http.StatusInternalServerError, gin.H{"status": "error", "message": fmt.Sprintf("can not send gift shipped mail to %s", reqBody.Email)}, nil
+	}
+
+	return http.StatusNoContent, gin.H{}, nil
+}
+
+// SendMatchingReportMail retrieves the matched donations of the ended rule from request body,
+// and invoke MailService to send the reconciliation report to the sponsor with the CSV file attached
+func (contrl *MailController) SendMatchingReportMail(c *gin.Context) (int, gin.H, error) {
+	const subject = "報導者配捐對帳報告"
+	var err error
+	var failData gin.H
+	var mailBody string
+	var out bytes.Buffer
+	var reqBody matchingReportReqBody
+	var valid bool
+
+	if failData, valid = bindRequestBody(c, &reqBody); valid == false {
+		return http.StatusBadRequest, gin.H{"status": "fail", "data": failData}, nil
+	}
+
+	if reqBody.Currency == "" {
+		// give default Currency
+		reqBody.Currency = "TWD"
+	}
+
+	if err = contrl.HTMLTemplate.ExecuteTemplate(&out, "matching-report.tmpl", reqBody); err != nil {
+		log.Error(err)
+		return http.StatusInternalServerError, gin.H{"status": "error", "message": "can not create matching report mail body"}, nil
+	}
+
+	mailBody = out.String()
+
+	attachment := services.Attachment{
+		ContentType: "text/csv",
+		Data:        reqBody.Report,
+		Filename:    fmt.Sprintf("twreporter-matching-%s-%s.csv", reqBody.StartDate, reqBody.EndDate),
+	}
+
+	// send email through mail service
+	if err = contrl.MailService.SendWithAttachments(reqBody.Email, subject, mailBody, []services.Attachment{attachment}); err != nil {
+		log.Error(err)
+		return http.StatusInternalServerError, gin.H{"status": "error", "message": fmt.Sprintf("can not send matching report mail to %s", reqBody.Email)}, nil
+	}
+
+	return http.StatusNoContent, gin.H{}, nil
+}
+
+// SendAtRiskPeriodicDonationsMail retrieves the periodic donations at risk from request body,
+// and invoke MailService to send the summary to the staffs
+func (contrl *MailController) SendAtRiskPeriodicDonationsMail(c *gin.Context) (int, gin.H, error) {
+	const subject = "定期定額扣款失敗摘要"
+	var err error
+	var failData gin.H
+	var mailBody string
+	var out bytes.Buffer
+	var reqBody atRiskPeriodicDonationsReqBody
+	var valid bool
+
+	if failData, valid = bindRequestBody(c, &reqBody); valid == false {
+		return http.StatusBadRequest, gin.H{"status": "fail", "data": failData}, nil
+	}
+
+	if err = contrl.HTMLTemplate.ExecuteTemplate(&out, "at-risk-periodic-donations.tmpl", reqBody); err != nil {
+		log.Error(err)
+		return http.StatusInternalServerError, gin.H{"status": "error", "message": "can not create at-risk periodic donations mail body"}, nil
+	}
+
+	mailBody = out.String()
+
+	// send email through mail service
+	if err = contrl.MailService.Send(reqBody.Email, subject, mailBody); err != nil {
+		log.Error(err)
+		return http.StatusInternalServerError, gin.H{"status": "error", "message": fmt.Sprintf("can not send at-risk periodic donations mail to %s", reqBody.Email)}, nil
+	}
+
+	return http.StatusNoContent, gin.H{}, nil
+}
+
 func postMailServiceEndpoint(reqBody interface{}, endpoint string) error {
 	var body []byte
 	var err error
@@ -1,18 +1,35 @@
 package controllers
 
 import (
+	"twreporter.org/go-api/keyring"
+	"twreporter.org/go-api/payment"
 	"twreporter.org/go-api/storage"
 	//log "github.com/Sirupsen/logrus"
 )
 
 // NewMembershipController ...
-func NewMembershipController(s storage.MembershipStorage) *MembershipController {
-	return &MembershipController{s}
+func NewMembershipController(s storage.MembershipStorage, g *payment.Gateways, k *keyring.Keyring) *MembershipController {
+	return &MembershipController{
+		Storage:   s,
+		Gateways:  g,
+		Keyring:   k,
+		campaigns: newTTLCache(campaignProgressTTL, campaignCacheSize),
+		donorWall: newTTLCache(donorWallTTL, donorWallCacheSize),
+	}
 }
 
 // MembershipController ...
 type MembershipController struct {
 	Storage storage.MembershipStorage
+	// Gateways are the payment gateways donations are made through
+	Gateways *payment.Gateways
+	// Keyring encrypts the card secrets of periodic donations
+	Keyring *keyring.Keyring
+
+	// campaigns caches the progress of the campaigns
+	campaigns *ttlCache
+	// donorWall caches the pages of the donor wall
+	donorWall *ttlCache
 }
 
 // Close is the method of Controller interface
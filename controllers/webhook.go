@@ -0,0 +1,335 @@
+package controllers
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gin-gonic/gin"
+	"gopkg.in/guregu/null.v3"
+
+	"twreporter.org/go-api/configs"
+	"twreporter.org/go-api/globals"
+	"twreporter.org/go-api/models"
+	"twreporter.org/go-api/utils"
+)
+
+const (
+	webhookEventHeader     = "X-Twreporter-Event"
+	webhookDeliveryHeader  = "X-Twreporter-Delivery"
+	webhookSignatureHeader = "X-Twreporter-Signature"
+
+	defaultDeadWebhookDeliveriesLimit = 20
+	maxDeadWebhookDeliveriesLimit     = 100
+)
+
+type (
+	// WebhookDispatchSummary counts the results of a dispatch run
+	WebhookDispatchSummary struct {
+		// Dispatched is the number of events whose deliveries are created
+		Dispatched int
+		// Delivered is the number of deliveries accepted by the endpoints
+		Delivered int
+		// Retried is the number of failed attempts which are attempted again later
+		Retried int
+		// Dead are the ids of the deliveries which fail the last attempts, they are listed by the dead-letter endpoint
+		Dead []uint
+	}
+
+	webhookBody struct {
+		CreatedAt time.Time       `json:"created_at"`
+		Data      json.RawMessage `json:"data"`
+		ID        uint            `json:"id"`
+		Type      string          `json:"type"`
+	}
+
+	webhookDeliveryResp struct {
+		Attempts    uint        `json:"attempts"`
+		DeliveredAt null.Time   `json:"delivered_at"`
+		Endpoint    string      `json:"endpoint"`
+		Event       webhookBody `json:"event"`
+		ID          uint        `json:"id"`
+		LastError   null.String `json:"last_error"`
+		Status      string      `json:"status"`
+		UpdatedAt   time.Time   `json:"updated_at"`
+	}
+
+	requeueWebhookDeliveryReq struct {
+		UserID uint `json:"user_id" binding:"required"`
+	}
+)
+
+// signWebhookBody signs the timestamp and the body by HMAC-SHA256 of the secret.
+// Receivers compute the HMAC of `<timestamp>.<body>` to verify the `X-Twreporter-Signature` header,
+// and reject the old timestamps to prevent replays.
+func signWebhookBody(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return fmt.Sprintf("t=%d,v1=%s", timestamp, hex.EncodeToString(mac.Sum(nil)))
+}
+
+// webhookEndpoint returns the configured endpoint of the url
+func webhookEndpoint(url string) (configs.WebhookEndpointConfig, bool) {
+	for _, e := range globals.Conf.Webhooks.Endpoints {
+		if e.URL == url {
+			return e, true
+		}
+	}
+	return configs.WebhookEndpointConfig{}, false
+}
+
+// webhookBackoff returns the delay after the failed attempts, which is doubled after each failure up to the max backoff
+func webhookBackoff(attempts uint) time.Duration {
+	conf := globals.Conf.Webhooks
+	backoff := conf.Backoff
+
+	for i := uint(1); i < attempts; i++ {
+		backoff *= 2
+		if conf.MaxBackoff > 0 && backoff >= conf.MaxBackoff {
+			return conf.MaxBackoff
+		}
+	}
+
+	return backoff
+}
+
+func buildWebhookBody(d models.WebhookDeliveryWithEvent) webhookBody {
+	return webhookBody{
+		CreatedAt: d.EventCreatedAt,
+		Data:      json.RawMessage(d.EventPayload),
+		ID:        d.EventID,
+		Type:      d.EventType,
+	}
+}
+
+// DispatchWebhooks creates the deliveries of the outbox events to the endpoints subscribing them,
+// and delivers the due deliveries. The failed deliveries are attempted again by the backoff,
+// and turn dead after `webhooks.max_attempts` attempts. It is safe to run several workers at once.
+func (mc *MembershipController) DispatchWebhooks(now time.Time, batchSize int) (WebhookDispatchSummary, error) {
+	var summary WebhookDispatchSummary
+
+	for {
+		events, err := mc.Storage.GetUndispatchedOutboxEvents(batchSize)
+		if nil != err {
+			return summary, err
+		}
+
+		for _, e := range events {
+			var deliveries []models.WebhookDelivery
+
+			for _, endpoint := range globals.Conf.Webhooks.Endpoints {
+				if len(endpoint.Events) > 0 && !utils.ContainsString(endpoint.Events, e.Type) {
+					continue
+				}
+				deliveries = append(deliveries, models.WebhookDelivery{
+					Endpoint:      endpoint.URL,
+					NextAttemptAt: now,
+					Status:        models.WebhookDeliveryPending,
+				})
+			}
+
+			// the events subscribed by no endpoint are marked dispatched as well
+			dispatched, err := mc.Storage.DispatchAnOutboxEvent(e, deliveries, now)
+			if nil != err {
+				return summary, err
+			}
+
+			if dispatched {
+				summary.Dispatched++
+			}
+		}
+
+		if len(events) < batchSize {
+			break
+		}
+	}
+
+	var afterID uint
+	for {
+		deliveries, err := mc.Storage.GetDueWebhookDeliveries(now, afterID, batchSize)
+		if nil != err {
+			return summary, err
+		}
+
+		for _, d := range deliveries {
+			afterID = d.ID
+
+			if err = mc.deliverAWebhook(d, now, &summary); nil != err {
+				return summary, err
+			}
+		}
+
+		if len(deliveries) < batchSize {
+			break
+		}
+	}
+
+	return summary, nil
+}
+
+// deliverAWebhook attempts the delivery and records the result
+func (mc *MembershipController) deliverAWebhook(d models.WebhookDeliveryWithEvent, now time.Time, summary *WebhookDispatchSummary) error {
+	timeout := globals.Conf.Webhooks.Timeout
+
+	// the delivery is postponed while it is attempted, so it is attempted again by others if this worker crashes
+	claimed, err := mc.Storage.ClaimAWebhookDelivery(d.WebhookDelivery, now.Add(2*timeout+webhookBackoff(1)))
+	if nil != err || !claimed {
+		return err
+	}
+
+	m := d.WebhookDelivery
+	m.Attempts++
+
+	if attemptErr := postAWebhook(d, timeout); nil != attemptErr {
+		m.LastError = null.StringFrom(truncate(attemptErr.Error(), 255))
+
+		if m.Attempts >= globals.Conf.Webhooks.MaxAttempts {
+			m.Status = models.WebhookDeliveryDead
+			summary.Dead = append(summary.Dead, m.ID)
+			log.Warnf("webhook delivery(id: %d, event: %s, endpoint: %s) is dead after %d attempts. %s", m.ID, d.EventType, m.Endpoint, m.Attempts, attemptErr.Error())
+		} else {
+			m.NextAttemptAt = now.Add(webhookBackoff(m.Attempts))
+			summary.Retried++
+		}
+	} else {
+		m.DeliveredAt = null.TimeFrom(now)
+		m.Status = models.WebhookDeliveryDelivered
+		summary.Delivered++
+	}
+
+	return mc.Storage.UpdateAWebhookDelivery(m)
+}
+
+// postAWebhook posts the signed event to the endpoint, any 2xx response is regarded as delivered
+func postAWebhook(d models.WebhookDeliveryWithEvent, timeout time.Duration) error {
+	endpoint, ok := webhookEndpoint(d.Endpoint)
+	if !ok {
+		return fmt.Errorf("endpoint %s is no longer configured", d.Endpoint)
+	}
+
+	body, err := json.Marshal(buildWebhookBody(d))
+	if nil != err {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", endpoint.URL, bytes.NewBuffer(body))
+	if nil != err {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhookEventHeader, d.EventType)
+	req.Header.Set(webhookDeliveryHeader, strconv.FormatUint(uint64(d.ID), 10))
+	req.Header.Set(webhookSignatureHeader, signWebhookBody(endpoint.Secret, time.Now().Unix(), body))
+
+	client := &http.Client{Timeout: timeout}
+	resp, err := client.Do(req)
+	if nil != err {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		respBody, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 100))
+		return fmt.Errorf("endpoint responds %d: %s", resp.StatusCode, respBody)
+	}
+
+	return nil
+}
+
+// truncate cuts the string to fit the column
+func truncate(s string, length int) string {
+	if len(s) <= length {
+		return s
+	}
+	return s[:length]
+}
+
+// GetDeadWebhookDeliveries method
+// Handler for admins to list the dead webhook deliveries, the latest first
+func (mc *MembershipController) GetDeadWebhookDeliveries(c *gin.Context) (int, gin.H, error) {
+	limit, _ := strconv.Atoi(c.Query("limit"))
+	offset, _ := strconv.Atoi(c.Query("offset"))
+
+	if limit <= 0 {
+		limit = defaultDeadWebhookDeliveriesLimit
+	}
+
+	if limit > maxDeadWebhookDeliveriesLimit {
+		limit = maxDeadWebhookDeliveriesLimit
+	}
+
+	if offset < 0 {
+		offset = 0
+	}
+
+	deliveries, total, err := mc.Storage.GetDeadWebhookDeliveries(offset, limit)
+	if nil != err {
+		return 0, gin.H{}, err
+	}
+
+	records := make([]webhookDeliveryResp, 0, len(deliveries))
+	for _, d := range deliveries {
+		records = append(records, webhookDeliveryResp{
+			Attempts:    d.Attempts,
+			DeliveredAt: d.DeliveredAt,
+			Endpoint:    d.Endpoint,
+			Event:       buildWebhookBody(d),
+			ID:          d.ID,
+			LastError:   d.LastError,
+			Status:      d.Status,
+			UpdatedAt:   d.UpdatedAt,
+		})
+	}
+
+	return http.StatusOK, gin.H{"status": "success", "data": gin.H{
+		"records": records,
+		"meta": models.MetaOfResponse{
+			Total:  total,
+			Offset: offset,
+			Limit:  limit,
+		},
+	}}, nil
+}
+
+// RequeueADeadWebhookDelivery method
+// Handler for admins to deliver a dead webhook delivery again, e.g. after the endpoint is fixed.
+// The delivery is attempted by the next dispatch run.
+func (mc *MembershipController) RequeueADeadWebhookDelivery(c *gin.Context) (int, gin.H, error) {
+	var reqBody requeueWebhookDeliveryReq
+
+	if failData, valid := bindRequestBody(c, &reqBody); valid == false {
+		return http.StatusBadRequest, gin.H{"status": "fail", "data": failData}, nil
+	}
+
+	id, err := strconv.ParseUint(c.Param("id"), 10, strconv.IntSize)
+	if nil != err {
+		return http.StatusNotFound, gin.H{"status": "fail", "data": gin.H{
+			"req.URL": fmt.Sprintf("%s cannot address a found resource", c.Request.RequestURI),
+		}}, nil
+	}
+
+	requeued, err := mc.Storage.RequeueADeadWebhookDelivery(uint(id), time.Now())
+	if nil != err {
+		return 0, gin.H{}, err
+	}
+
+	if !requeued {
+		return http.StatusNotFound, gin.H{"status": "fail", "data": gin.H{
+			"req.URL": fmt.Sprintf("dead webhook delivery(id: %d) cannot be found", id),
+		}}, nil
+	}
+
+	return http.StatusNoContent, gin.H{}, nil
+}
@@ -0,0 +1,90 @@
+// Package currency validates and formats the amounts of donations in the supported currencies,
+// and converts them to TWD by the daily exchange rates.
+package currency
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"twreporter.org/go-api/configs"
+)
+
+// TWD is the currency of the bookkeeping
+const TWD = "TWD"
+
+// defaultCurrencies are used if `donation.currencies` is not configured
+var defaultCurrencies = Currencies{
+	TWD: configs.CurrencyConfig{
+		MinAmount: 1,
+		Symbol:    "NT$",
+	},
+}
+
+// Currencies are the rules of the supported currencies by the currency codes
+type Currencies map[string]configs.CurrencyConfig
+
+// FromConfig returns the currencies of `donation.currencies`, only TWD is supported if it is not configured
+func FromConfig(conf configs.DonationConfig) Currencies {
+	if len(conf.Currencies) > 0 {
+		return Currencies(conf.Currencies)
+	}
+	return defaultCurrencies
+}
+
+// Codes returns the supported currency codes in alphabetical order
+func (cs Currencies) Codes() []string {
+	var codes []string
+	for code := range cs {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	return codes
+}
+
+// Validate checks the currency is supported and the amount is in its range
+func (cs Currencies) Validate(code string, amount uint) error {
+	c, ok := cs[code]
+	if !ok {
+		return fmt.Errorf("currency %s is not supported. should be one of %s", code, strings.Join(cs.Codes(), ", "))
+	}
+
+	if amount < c.MinAmount {
+		return fmt.Errorf("amount should be at least %s", cs.Format(code, c.MinAmount))
+	}
+
+	if c.MaxAmount > 0 && amount > c.MaxAmount {
+		return fmt.Errorf("amount should be at most %s", cs.Format(code, c.MaxAmount))
+	}
+
+	return nil
+}
+
+// MerchantID returns the TapPay merchant which charges in the currency, or empty if any merchant is accepted
+func (cs Currencies) MerchantID(code string) string {
+	return cs[code].MerchantID
+}
+
+// Format prints the amount with the symbol of the currency and thousands separators, e.g. NT$1,000 or US$30.
+// The currency code is printed instead if the currency has no symbol.
+func (cs Currencies) Format(code string, amount uint) string {
+	if c, ok := cs[code]; ok && c.Symbol != "" {
+		return c.Symbol + FormatNumber(amount)
+	}
+	return fmt.Sprintf("%s %s", code, FormatNumber(amount))
+}
+
+// FormatNumber prints the amount with thousands separators, e.g. 12,000
+func FormatNumber(amount uint) string {
+	s := fmt.Sprint(amount)
+	var out []byte
+
+	for i := range s {
+		if i > 0 && (len(s)-i)%3 == 0 {
+			out = append(out, ',')
+		}
+		out = append(out, s[i])
+	}
+
+	return string(out)
+}
@@ -0,0 +1,128 @@
+package currency
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"twreporter.org/go-api/models"
+)
+
+const rateDateLayout = "2006-01-02"
+
+var currencyCodeRegexp = regexp.MustCompile(`^[A-Z]{3}$`)
+
+// DateOf returns the date of the time in Taiwan, which is the midnight in UTC as `models.ExchangeRate.Date`
+func DateOf(t time.Time) time.Time {
+	location, _ := time.LoadLocation("Asia/Taipei")
+	y, m, d := t.In(location).Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+}
+
+// ParseRates reads the daily rates from the CSV file with the header `date,currency,rate`, e.g.
+//
+//	date,currency,rate
+//	2019-06-03,USD,31.52
+//	2019-06-03,HKD,4.02
+//
+// The rate is the TWD amount of a unit of the currency on the date, which is in YYYY-MM-DD format.
+func ParseRates(r io.Reader) ([]models.ExchangeRate, error) {
+	var rates []models.ExchangeRate
+
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = 3
+	cr.TrimLeadingSpace = true
+
+	header, err := cr.Read()
+	if nil != err {
+		return nil, fmt.Errorf("cannot read the header of the rates. %s", err.Error())
+	}
+
+	if strings.Join(header, ",") != "date,currency,rate" {
+		return nil, fmt.Errorf("the header of the rates should be `date,currency,rate`")
+	}
+
+	for line := 2; ; line++ {
+		record, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if nil != err {
+			return nil, fmt.Errorf("cannot read the rates. %s", err.Error())
+		}
+
+		date, err := time.Parse(rateDateLayout, record[0])
+		if nil != err {
+			return nil, fmt.Errorf("line %d: date should be in YYYY-MM-DD format", line)
+		}
+
+		code := strings.ToUpper(record[1])
+		if !currencyCodeRegexp.MatchString(code) || code == TWD {
+			return nil, fmt.Errorf("line %d: currency should be a currency code other than %s", line, TWD)
+		}
+
+		rate, err := strconv.ParseFloat(record[2], 64)
+		if nil != err || rate <= 0 {
+			return nil, fmt.Errorf("line %d: rate should be a positive number", line)
+		}
+
+		rates = append(rates, models.ExchangeRate{Currency: code, Date: date, Rate: rate})
+	}
+
+	return rates, nil
+}
+
+// RateTable converts the amounts to TWD by the rates on or before the dates
+type RateTable struct {
+	rates map[string][]models.ExchangeRate
+}
+
+// NewRateTable returns the rate table of the rates
+func NewRateTable(rates []models.ExchangeRate) *RateTable {
+	t := &RateTable{rates: make(map[string][]models.ExchangeRate)}
+
+	for _, r := range rates {
+		t.rates[r.Currency] = append(t.rates[r.Currency], r)
+	}
+
+	for _, rs := range t.rates {
+		sort.Slice(rs, func(i, j int) bool { return rs[i].Date.Before(rs[j].Date) })
+	}
+
+	return t
+}
+
+// Rate returns the latest rate of the currency on or before the date of `at`.
+// The rate of TWD is always 1, and false is returned if no rate is found.
+func (t *RateTable) Rate(code string, at time.Time) (float64, bool) {
+	if code == TWD {
+		return 1, true
+	}
+
+	rs := t.rates[code]
+	date := DateOf(at)
+
+	// the first rate after the date
+	i := sort.Search(len(rs), func(i int) bool { return rs[i].Date.After(date) })
+	if i == 0 {
+		return 0, false
+	}
+
+	return rs[i-1].Rate, true
+}
+
+// ToTWD converts the amount in the currency to TWD by the rate on or before the date of `at`, rounded to the nearest integer
+func (t *RateTable) ToTWD(code string, amount uint, at time.Time) (uint, bool) {
+	rate, ok := t.Rate(code, at)
+	if !ok {
+		return 0, false
+	}
+
+	return uint(math.Floor(float64(amount)*rate + 0.5)), true
+}
@@ -0,0 +1,76 @@
+// Package export streams tabular records into CSV or XLSX files.
+// Records are written one by one, so that large exports never stay in memory.
+package export
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+)
+
+// supported file formats
+const (
+	FormatCSV  = "csv"
+	FormatXLSX = "xlsx"
+)
+
+// ContentTypes are the MIME types of the file formats
+var ContentTypes = map[string]string{
+	FormatCSV:  "text/csv; charset=utf-8",
+	FormatXLSX: "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+}
+
+// Column is a column of the exported file
+type Column struct {
+	Name string
+	// Numeric columns are written as numbers instead of text in XLSX files
+	Numeric bool
+}
+
+// Writer writes the header on creation, and then the records in the order of the columns.
+// Close must be called to complete the file.
+type Writer interface {
+	Write(record []string) error
+	Close() error
+}
+
+// NewWriter returns the writer of the format
+func NewWriter(w io.Writer, format string, columns []Column) (Writer, error) {
+	switch format {
+	case FormatCSV:
+		return NewCSVWriter(w, columns)
+	case FormatXLSX:
+		return NewXLSXWriter(w, columns)
+	}
+
+	return nil, fmt.Errorf("format %s is not supported. should be `%s` or `%s`", format, FormatCSV, FormatXLSX)
+}
+
+type csvWriter struct {
+	w *csv.Writer
+}
+
+// NewCSVWriter returns the writer of the CSV file with the header of the columns
+func NewCSVWriter(w io.Writer, columns []Column) (Writer, error) {
+	cw := &csvWriter{w: csv.NewWriter(w)}
+
+	var header []string
+	for _, c := range columns {
+		header = append(header, c.Name)
+	}
+
+	if err := cw.Write(header); nil != err {
+		return nil, err
+	}
+
+	return cw, nil
+}
+
+func (cw *csvWriter) Write(record []string) error {
+	return cw.w.Write(record)
+}
+
+func (cw *csvWriter) Close() error {
+	cw.w.Flush()
+	return cw.w.Error()
+}
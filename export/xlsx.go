@@ -0,0 +1,151 @@
+package export
+
+import (
+	"archive/zip"
+	"bufio"
+	"encoding/xml"
+	"fmt"
+	"io"
+)
+
+// xlsxParts are the parts of a workbook with a single worksheet, except the worksheet itself.
+// The worksheet is the last part of the zip file, so that its rows could be written one by one.
+var xlsxParts = []struct {
+	name    string
+	content string
+}{
+	{"[Content_Types].xml", xml.Header + `<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">` +
+		`<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>` +
+		`<Default Extension="xml" ContentType="application/xml"/>` +
+		`<Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/>` +
+		`<Override PartName="/xl/worksheets/sheet1.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/>` +
+		`</Types>`},
+	{"_rels/.rels", xml.Header + `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+		`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/>` +
+		`</Relationships>`},
+	{"xl/workbook.xml", xml.Header + `<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships">` +
+		`<sheets><sheet name="Sheet1" sheetId="1" r:id="rId1"/></sheets>` +
+		`</workbook>`},
+	{"xl/_rels/workbook.xml.rels", xml.Header + `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+		`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet1.xml"/>` +
+		`</Relationships>`},
+}
+
+const (
+	xlsxSheetName   = "xl/worksheets/sheet1.xml"
+	xlsxSheetHeader = xml.Header + `<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>`
+	xlsxSheetFooter = `</sheetData></worksheet>`
+)
+
+type xlsxWriter struct {
+	columns []Column
+	row     int
+	sheet   *bufio.Writer
+	zw      *zip.Writer
+}
+
+// NewXLSXWriter returns the writer of the XLSX file with the header of the columns.
+// Texts are written as inline strings, so no shared string table is kept in memory.
+func NewXLSXWriter(w io.Writer, columns []Column) (Writer, error) {
+	xw := &xlsxWriter{columns: columns, zw: zip.NewWriter(w)}
+
+	for _, part := range xlsxParts {
+		f, err := xw.zw.Create(part.name)
+		if nil != err {
+			return nil, err
+		}
+		if _, err = io.WriteString(f, part.content); nil != err {
+			return nil, err
+		}
+	}
+
+	f, err := xw.zw.Create(xlsxSheetName)
+	if nil != err {
+		return nil, err
+	}
+
+	xw.sheet = bufio.NewWriter(f)
+	if _, err = xw.sheet.WriteString(xlsxSheetHeader); nil != err {
+		return nil, err
+	}
+
+	var header []string
+	for _, c := range columns {
+		header = append(header, c.Name)
+	}
+
+	// the header is text even if the column is numeric
+	if err = xw.writeRow(header, false); nil != err {
+		return nil, err
+	}
+
+	return xw, nil
+}
+
+func (xw *xlsxWriter) Write(record []string) error {
+	return xw.writeRow(record, true)
+}
+
+func (xw *xlsxWriter) writeRow(record []string, typed bool) error {
+	xw.row++
+
+	if _, err := fmt.Fprintf(xw.sheet, `<row r="%d">`, xw.row); nil != err {
+		return err
+	}
+
+	for i, v := range record {
+		if "" == v {
+			continue
+		}
+
+		ref := fmt.Sprintf("%s%d", xlsxColumnName(i), xw.row)
+
+		if typed && i < len(xw.columns) && xw.columns[i].Numeric {
+			if _, err := fmt.Fprintf(xw.sheet, `<c r="%s"><v>`, ref); nil != err {
+				return err
+			}
+			if err := xml.EscapeText(xw.sheet, []byte(v)); nil != err {
+				return err
+			}
+			if _, err := xw.sheet.WriteString(`</v></c>`); nil != err {
+				return err
+			}
+			continue
+		}
+
+		if _, err := fmt.Fprintf(xw.sheet, `<c r="%s" t="inlineStr"><is><t xml:space="preserve">`, ref); nil != err {
+			return err
+		}
+		if err := xml.EscapeText(xw.sheet, []byte(v)); nil != err {
+			return err
+		}
+		if _, err := xw.sheet.WriteString(`</t></is></c>`); nil != err {
+			return err
+		}
+	}
+
+	_, err := xw.sheet.WriteString(`</row>`)
+	return err
+}
+
+func (xw *xlsxWriter) Close() error {
+	if _, err := xw.sheet.WriteString(xlsxSheetFooter); nil != err {
+		return err
+	}
+
+	if err := xw.sheet.Flush(); nil != err {
+		return err
+	}
+
+	return xw.zw.Close()
+}
+
+// xlsxColumnName returns the name of the zero-based column index, e.g. A, Z, AA
+func xlsxColumnName(i int) string {
+	name := ""
+	for i >= 0 {
+		name = string(rune('A'+i%26)) + name
+		i = i/26 - 1
+	}
+	return name
+}
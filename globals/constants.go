@@ -19,6 +19,14 @@ const (
 	// route path
 	SendActivationRoutePath      = "mail/send_activation"
 	SendSuccessDonationRoutePath = "mail/send_success_donation"
+	SendRefundDonationRoutePath  = "mail/send_refund_donation"
+	SendReceiptRoutePath         = "mail/send_receipt"
+
+	SendPeriodicDonationFailureRoutePath = "mail/send_periodic_donation_failure"
+	SendAtRiskPeriodicDonationsRoutePath = "mail/send_at_risk_periodic_donations"
+	SendCardExpiryReminderRoutePath      = "mail/send_card_expiry_reminder"
+	SendGiftShippedRoutePath             = "mail/send_gift_shipped"
+	SendMatchingReportRoutePath          = "mail/send_matching_report"
 
 	// controller name
 	MembershipController = "membership_controller"
@@ -59,6 +67,12 @@ const (
 	TablePayByPrimeDonations       = "pay_by_prime_donations"
 	TablePayByCardTokenDonations   = "pay_by_card_token_donations"
 	TablePayByOtherMethodDonations = "pay_by_other_method_donations"
+	TablePeriodicDonations         = "periodic_donations"
+	TableDonationRefunds           = "donation_refunds"
+	TableGiftFulfillments          = "gift_fulfillments"
+	TableMatchingRules             = "matching_rules"
+	TableDonationMatches           = "donation_matches"
+	TableSettlementReconciliations = "settlement_reconciliations"
 
 	// oauth type
 	GoogleOAuth   = "Google"
@@ -71,5 +85,6 @@ const (
 	OthersDonationType   = "others"
 
 	// jwt prefix
-	MailServiceJWTPrefix = "mail-service-jwt-"
+	MailServiceJWTPrefix     = "mail-service-jwt-"
+	CardReplacementJWTPrefix = "card-replacement-jwt-"
 )
@@ -0,0 +1,198 @@
+// Package keyring encrypts secrets, such as the card secrets of periodic donations, by versioned AES-256-GCM keys.
+// The ID of the encryption key is prefixed on the ciphertext, so that several keys could decrypt at the same time
+// and the primary key, which encrypts new secrets, could be rotated.
+package keyring
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+
+	"twreporter.org/go-api/configs"
+)
+
+// keyIDDelimiter encloses the key ID, e.g. `$2019-06$<nonce><ciphertext>`
+const keyIDDelimiter = "$"
+
+// keyIDPattern is the format of key IDs, which should never contain the delimiter
+var keyIDPattern = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,32}$`)
+
+// KeySet is the key material loaded by providers
+type KeySet struct {
+	// PrimaryKeyID is the ID of the key which encrypts new secrets
+	PrimaryKeyID string `json:"primary_key_id"`
+	// Keys are the base64 encoded 256-bit keys by their IDs.
+	// The retired keys should be kept until the secrets encrypted by them are rotated.
+	Keys map[string]string `json:"keys"`
+}
+
+// Keyring encrypts by the primary key, and decrypts by the key of which the ID is prefixed on the ciphertext.
+// The ciphertext without a key ID was encrypted before keys are versioned, and is decrypted by the legacy key.
+type Keyring struct {
+	aeads        map[string]cipher.AEAD
+	legacy       cipher.AEAD
+	primaryKeyID string
+}
+
+// New returns the keyring of the key material loaded by the provider of the config.
+// `donation.card_secret_key` is kept as the legacy key to decrypt the card secrets which are not rotated yet.
+func New(conf configs.DonationConfig) (*Keyring, error) {
+	p, err := NewProvider(conf)
+	if nil != err {
+		return nil, err
+	}
+
+	ks, err := p.Load()
+	if nil != err {
+		return nil, err
+	}
+
+	return NewKeyring(ks, conf.CardSecretKey)
+}
+
+// NewKeyring returns the keyring of the key set.
+// The legacy key is the passphrase of which the SHA-256 hash encrypted the secrets before keys are versioned,
+// it could be empty if there is no such secret.
+func NewKeyring(ks KeySet, legacyKey string) (*Keyring, error) {
+	k := &Keyring{
+		aeads:        make(map[string]cipher.AEAD),
+		primaryKeyID: ks.PrimaryKeyID,
+	}
+
+	for id, encoded := range ks.Keys {
+		if !keyIDPattern.MatchString(id) {
+			return nil, fmt.Errorf("key ID %s is not valid. should match %s", id, keyIDPattern.String())
+		}
+
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if nil != err {
+			return nil, fmt.Errorf("key %s is not base64 encoded. %s", id, err.Error())
+		}
+
+		if len(key) != 32 {
+			return nil, fmt.Errorf("key %s should be 256 bits, but got %d bits", id, len(key)*8)
+		}
+
+		if k.aeads[id], err = newAEAD(key); nil != err {
+			return nil, fmt.Errorf("cannot create the cipher of key %s. %s", id, err.Error())
+		}
+	}
+
+	if _, ok := k.aeads[k.primaryKeyID]; !ok {
+		return nil, fmt.Errorf("primary key %s is not found in the keys", k.primaryKeyID)
+	}
+
+	if legacyKey != "" {
+		hash := sha256.Sum256([]byte(legacyKey))
+
+		var err error
+		if k.legacy, err = newAEAD(hash[:]); nil != err {
+			return nil, fmt.Errorf("cannot create the cipher of the legacy key. %s", err.Error())
+		}
+	}
+
+	return k, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if nil != err {
+		return nil, err
+	}
+
+	// use Galois Counter Mode for better efficiency
+	return cipher.NewGCM(block)
+}
+
+// PrimaryKeyID returns the ID of the key which encrypts new secrets
+func (k *Keyring) PrimaryKeyID() string {
+	return k.primaryKeyID
+}
+
+// Encrypt encrypts the plaintext by the primary key.
+// The ciphertext is the key ID, the random nonce and the sealed plaintext.
+func (k *Keyring) Encrypt(plaintext string) (string, error) {
+	aead := k.aeads[k.primaryKeyID]
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); nil != err {
+		return "", fmt.Errorf("cannot generate a nonce. %s", err.Error())
+	}
+
+	prefix := keyIDDelimiter + k.primaryKeyID + keyIDDelimiter
+
+	return prefix + string(aead.Seal(nonce, nonce, []byte(plaintext), nil)), nil
+}
+
+// Decrypt decrypts the ciphertext by the key of which the ID is prefixed,
+// or by the legacy key if the ciphertext is not prefixed by a known key ID.
+func (k *Keyring) Decrypt(ciphertext string) (string, error) {
+	id, sealed := k.split(ciphertext)
+
+	aead := k.legacy
+	if id != "" {
+		aead = k.aeads[id]
+	}
+
+	if aead == nil {
+		return "", errors.New("the ciphertext is not encrypted by any known key")
+	}
+
+	if len(sealed) < aead.NonceSize() {
+		return "", errors.New("the ciphertext is too short")
+	}
+
+	nonce, data := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, []byte(nonce), []byte(data), nil)
+	if nil != err {
+		return "", fmt.Errorf("cannot decrypt the ciphertext by key %s. %s", k.keyName(id), err.Error())
+	}
+
+	return string(plaintext), nil
+}
+
+// KeyID returns the ID of the key which encrypted the ciphertext, or empty string if it is encrypted by the legacy key
+func (k *Keyring) KeyID(ciphertext string) string {
+	id, _ := k.split(ciphertext)
+	return id
+}
+
+// IsCurrent reports whether the ciphertext is encrypted by the primary key
+func (k *Keyring) IsCurrent(ciphertext string) bool {
+	return k.KeyID(ciphertext) == k.primaryKeyID
+}
+
+// split separates the key ID from the ciphertext.
+// The legacy ciphertext starts with the random nonce, which could look like a prefix by chance,
+// so the prefix is recognized only if the key is in the keyring.
+func (k *Keyring) split(ciphertext string) (string, string) {
+	if !strings.HasPrefix(ciphertext, keyIDDelimiter) {
+		return "", ciphertext
+	}
+
+	end := strings.Index(ciphertext[1:], keyIDDelimiter)
+	if end < 0 {
+		return "", ciphertext
+	}
+
+	id := ciphertext[1 : end+1]
+	if _, ok := k.aeads[id]; !ok {
+		return "", ciphertext
+	}
+
+	return id, ciphertext[end+2:]
+}
+
+func (k *Keyring) keyName(id string) string {
+	if id == "" {
+		return "legacy"
+	}
+	return id
+}
@@ -0,0 +1,103 @@
+package keyring
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"twreporter.org/go-api/configs"
+)
+
+// providers of the key material
+const (
+	ProviderEnv  = "env"
+	ProviderFile = "file"
+)
+
+// defaultEnvPrefix is the prefix of the environment variables read by EnvProvider if no prefix is configured
+const defaultEnvPrefix = "GOAPI_CARD_SECRET_"
+
+// Provider loads the key material
+type Provider interface {
+	Load() (KeySet, error)
+}
+
+// NewProvider returns the provider selected by `donation.card_secret_key_provider`, `env` if omitted
+func NewProvider(conf configs.DonationConfig) (Provider, error) {
+	switch conf.CardSecretKeyProvider {
+	case "", ProviderEnv:
+		prefix := conf.CardSecretKeyEnvPrefix
+		if prefix == "" {
+			prefix = defaultEnvPrefix
+		}
+		return EnvProvider{Prefix: prefix}, nil
+	case ProviderFile:
+		return FileProvider{Path: conf.CardSecretKeyFile}, nil
+	}
+
+	return nil, fmt.Errorf("key provider %s is not supported. should be `%s` or `%s`", conf.CardSecretKeyProvider, ProviderEnv, ProviderFile)
+}
+
+// FileProvider loads the key set from the JSON file, e.g.
+//
+//	{
+//	    "primary_key_id": "2019-06",
+//	    "keys": {
+//	        "2019-01": "<base64 encoded 256-bit key>",
+//	        "2019-06": "<base64 encoded 256-bit key>"
+//	    }
+//	}
+//
+// The file is usually mounted from kubernetes secrets.
+type FileProvider struct {
+	Path string
+}
+
+// Load reads the key set from the file
+func (p FileProvider) Load() (KeySet, error) {
+	var ks KeySet
+
+	content, err := ioutil.ReadFile(p.Path)
+	if nil != err {
+		return ks, fmt.Errorf("cannot read the key file %s. %s", p.Path, err.Error())
+	}
+
+	if err = json.Unmarshal(content, &ks); nil != err {
+		return ks, fmt.Errorf("cannot parse the key file %s. %s", p.Path, err.Error())
+	}
+
+	return ks, nil
+}
+
+// EnvProvider loads the key set from the environment variables, e.g. with the prefix `GOAPI_CARD_SECRET_`
+//
+//	GOAPI_CARD_SECRET_PRIMARY_KEY_ID=2019-06
+//	GOAPI_CARD_SECRET_KEYS=2019-01:<base64 encoded 256-bit key>,2019-06:<base64 encoded 256-bit key>
+type EnvProvider struct {
+	Prefix string
+}
+
+// Load reads the key set from the environment variables
+func (p EnvProvider) Load() (KeySet, error) {
+	ks := KeySet{
+		PrimaryKeyID: os.Getenv(p.Prefix + "PRIMARY_KEY_ID"),
+		Keys:         make(map[string]string),
+	}
+
+	keys := os.Getenv(p.Prefix + "KEYS")
+	if keys == "" {
+		return ks, fmt.Errorf("environment variable %sKEYS is not set", p.Prefix)
+	}
+
+	for _, pair := range strings.Split(keys, ",") {
+		kv := strings.SplitN(strings.TrimSpace(pair), ":", 2)
+		if len(kv) != 2 {
+			return ks, fmt.Errorf("environment variable %sKEYS should be comma separated <key ID>:<key> pairs", p.Prefix)
+		}
+		ks.Keys[kv[0]] = kv[1]
+	}
+
+	return ks, nil
+}
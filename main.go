@@ -3,11 +3,14 @@ package main
 import (
 	"fmt"
 	"net/http"
+	"os"
 	"time"
 
 	"twreporter.org/go-api/configs"
 	"twreporter.org/go-api/controllers"
 	"twreporter.org/go-api/globals"
+	"twreporter.org/go-api/keyring"
+	"twreporter.org/go-api/payment"
 	"twreporter.org/go-api/routers"
 	"twreporter.org/go-api/services"
 	"twreporter.org/go-api/utils"
@@ -19,6 +22,8 @@ import (
 func main() {
 	var err error
 	var cf *controllers.ControllerFactory
+	var gateways *payment.Gateways
+	var cardKeyring *keyring.Keyring
 
 	globals.Conf, err = configs.LoadConf("")
 	if err != nil {
@@ -33,6 +38,29 @@ func main() {
 		panic(err)
 	}
 
+	// mailSender := services.NewSMTPMailService() // use office365 to send mails
+	mailSvc := services.NewAmazonMailService() // use Amazon SES to send mails
+
+	// select the payment gateways of pay methods
+	if gateways, err = payment.NewGateways(globals.Conf.Donation); err != nil {
+		panic(fmt.Errorf("Fatal error payment gateways config: %s \n", err))
+	}
+
+	// load the versioned keys of card secrets
+	if cardKeyring, err = keyring.New(globals.Conf.Donation); err != nil {
+		panic(fmt.Errorf("Fatal error card secret keys: %s \n", err))
+	}
+
+	// run the given command, e.g. `go-api charge-periodic-donations`, instead of the HTTP server
+	if len(os.Args) > 1 {
+		cf = controllers.NewControllerFactory(db, nil, mailSvc, gateways, cardKeyring)
+		if err = runCommand(cf, os.Args[1], os.Args[2:]); err != nil {
+			log.Error(err.Error())
+			os.Exit(1)
+		}
+		return
+	}
+
 	log.Info("Connecting to MongoDB replica")
 	session, err := utils.InitMongoDB()
 	defer session.Close()
@@ -40,10 +68,7 @@ func main() {
 		panic(err)
 	}
 
-	// mailSender := services.NewSMTPMailService() // use office365 to send mails
-	mailSvc := services.NewAmazonMailService() // use Amazon SES to send mails
-
-	cf = controllers.NewControllerFactory(db, session, mailSvc)
+	cf = controllers.NewControllerFactory(db, session, mailSvc, gateways, cardKeyring)
 
 	// set up the router
 	router := routers.SetupRouter(cf)
@@ -215,7 +215,8 @@ CREATE TABLE `pay_by_prime_donations` (
   `order_number` varchar(50) NOT NULL,
   `currency` char(3) DEFAULT 'TWD' NOT NULL,
   `pay_method` enum('credit_card', 'line', 'apple', 'google', 'samsung') NOT NULL,
-  `status` enum('paying', 'paid', 'fail') NOT NULL,
+  `payment_gateway` varchar(20) DEFAULT 'tappay' NOT NULL,
+  `status` enum('paying', 'paid', 'fail', 'refunded') NOT NULL,
   `send_receipt` enum('monthly', 'no') DEFAULT 'monthly',
   `tappay_api_status` int NULL DEFAULT NULL,
   `msg` varchar(100) NULL DEFAULT NULL,
@@ -245,10 +246,18 @@ CREATE TABLE `pay_by_prime_donations` (
   `card_info_country_code` varchar(10) DEFAULT NULL, 
   `card_info_expiry_date` varchar(6) DEFAULT NULL, 
   `notes` varchar(100) DEFAULT NULL,
+  `campaign` varchar(50) DEFAULT NULL,
+  `donor_type` enum('individual','organization') NOT NULL DEFAULT 'individual',
+  `company_name` varchar(100) DEFAULT NULL,
+  `tax_id` char(8) DEFAULT NULL,
+  `display_name` varchar(50) DEFAULT NULL,
+  `hide_amount` tinyint(1) DEFAULT 0,
+  `show_on_wall` tinyint(1) DEFAULT 0,
   PRIMARY KEY (`id`),
   KEY `idx_pay_by_prime_donations_status` (`status`),
   KEY `idx_pay_by_prime_donations_pay_method` (`pay_method`),
   KEY `idx_pay_by_prime_donations_order_number` (`order_number`),
+  KEY `idx_pay_by_prime_donations_campaign` (`campaign`),
   CONSTRAINT `fk_pay_by_prime_donations_user_id` FOREIGN KEY (`user_id`) REFERENCES `users` (`id`) ON DELETE NO ACTION ON UPDATE NO ACTION
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
 /*!40101 SET character_set_client = @saved_cs_client */;
@@ -279,10 +288,15 @@ CREATE TABLE `pay_by_other_method_donations` (
   `address` varchar(100) DEFAULT NULL,
   `national_id` varchar(20) DEFAULT NULL,
   `user_id` int(10) unsigned NOT NULL,
+  `campaign` varchar(50) DEFAULT NULL,
+  `bank_reference` varchar(50) DEFAULT NULL,
+  `recorded_by` int(10) unsigned DEFAULT NULL,
   PRIMARY KEY (`id`),
+  UNIQUE KEY `idx_pay_by_other_method_donations_bank_reference` (`bank_reference`),
   KEY `idx_pay_by_other_method_donations_pay_method` (`pay_method`),
   KEY `idx_pay_by_other_method_donations_amount` (`amount`),
   KEY `idx_pay_by_other_method_order_number` (`order_number`),
+  KEY `idx_pay_by_other_method_donations_campaign` (`campaign`),
   CONSTRAINT `fk_pay_by_other_method_donations_user_id` FOREIGN KEY (`user_id`) REFERENCES `users` (`id`) ON DELETE NO ACTION ON UPDATE NO ACTION
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
 /*!40101 SET character_set_client = @saved_cs_client */;
@@ -328,12 +342,29 @@ CREATE TABLE `periodic_donations` (
   `card_info_expiry_date` varchar(6) DEFAULT NULL, 
   `notes` varchar(100) DEFAULT NULL,
   `max_paid_times` int NOT NULL DEFAULT 2147483647,
+  `stop_reason` varchar(100) DEFAULT NULL,
+  `stopped_at` timestamp NULL DEFAULT NULL,
+  `paused_until` timestamp NULL DEFAULT NULL,
+  `payment_gateway` varchar(20) DEFAULT 'tappay' NOT NULL,
+  `dunning_started_at` timestamp NULL DEFAULT NULL,
+  `dunning_retries` int unsigned NOT NULL DEFAULT 0,
+  `next_retry_at` timestamp NULL DEFAULT NULL,
+  `campaign` varchar(50) DEFAULT NULL,
+  `donor_type` enum('individual','organization') NOT NULL DEFAULT 'individual',
+  `company_name` varchar(100) DEFAULT NULL,
+  `tax_id` char(8) DEFAULT NULL,
+  `display_name` varchar(50) DEFAULT NULL,
+  `hide_amount` tinyint(1) DEFAULT 0,
+  `show_on_wall` tinyint(1) DEFAULT 0,
 
   PRIMARY KEY (`id`),
   KEY `idx_periodic_donations_status` (`status`),
   KEY `idx_periodic_donations_amount` (`amount`),
   KEY `idx_periodic_donations_order_number` (`order_number`),
   KEY `idx_periodic_donations_last_success_at` (`last_success_at`),
+  KEY `idx_periodic_donations_paused_until` (`paused_until`),
+  KEY `idx_periodic_donations_next_retry_at` (`next_retry_at`),
+  KEY `idx_periodic_donations_campaign` (`campaign`),
   CONSTRAINT `fk_periodic_donations_user_id` FOREIGN KEY (`user_id`) REFERENCES `users` (`id`) ON DELETE NO ACTION ON UPDATE NO ACTION
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
 /*!40101 SET character_set_client = @saved_cs_client */;
@@ -352,7 +383,8 @@ CREATE TABLE `pay_by_card_token_donations` (
   `updated_at` timestamp DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
   `deleted_at` timestamp NULL DEFAULT NULL,
   `periodic_id` int(10) unsigned NOT NULL,
-  `status` enum('paying', 'paid', 'fail') NOT NULL,
+  `payment_gateway` varchar(20) DEFAULT 'tappay' NOT NULL,
+  `status` enum('paying', 'paid', 'fail', 'refunded') NOT NULL,
   `tappay_api_status` int NULL DEFAULT NULL, 
   `msg` varchar(100) NULL DEFAULT NULL,
   `tappay_record_status` int NULL DEFAULT NULL,
@@ -370,11 +402,440 @@ CREATE TABLE `pay_by_card_token_donations` (
   `bank_transaction_end_time` timestamp NULL DEFAULT NULL,
   `bank_result_code` varchar(50) NULL DEFAULT NULL,
   `bank_result_msg` varchar(50) NULL DEFAULT NULL,
+  `campaign` varchar(50) DEFAULT NULL,
+  `pending_card_key` tinyblob NULL DEFAULT NULL,
+  `pending_card_token` tinyblob NULL DEFAULT NULL,
   PRIMARY KEY (`id`),
   KEY `idx_pay_by_card_token_donations_status` (`status`),
   KEY `idx_pay_by_card_token_donations_amount` (`amount`),
   KEY `idx_pay_by_card_token_donations_order_number` (`order_number`),
+  KEY `idx_pay_by_card_token_donations_campaign` (`campaign`),
   CONSTRAINT `fk_pay_by_card_token_donations_periodic_id` FOREIGN KEY (`periodic_id`) REFERENCES `periodic_donations` (`id`) ON DELETE NO ACTION ON UPDATE NO ACTION
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
 /*!40101 SET character_set_client = @saved_cs_client */;
 
+--
+-- Table structure for table `donation_refunds`
+--
+
+DROP TABLE IF EXISTS `donation_refunds`;
+/*!40101 SET @saved_cs_client     = @@character_set_client */;
+/*!40101 SET character_set_client = utf8mb4 */;
+CREATE TABLE `donation_refunds` (
+  `id` int(10) unsigned NOT NULL AUTO_INCREMENT,
+  `created_at` timestamp DEFAULT CURRENT_TIMESTAMP,
+  `updated_at` timestamp DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+  `deleted_at` timestamp NULL DEFAULT NULL,
+  `donation_id` int(10) unsigned NOT NULL,
+  `donation_type` enum('prime', 'token') NOT NULL,
+  `rec_trade_id` varchar(20) NOT NULL,
+  `refund_id` varchar(50) NULL DEFAULT NULL,
+  `amount` int(10) unsigned NOT NULL,
+  `currency` char(3) DEFAULT 'TWD' NOT NULL,
+  `status` enum('refunding', 'refunded', 'fail') NOT NULL,
+  `tappay_api_status` int NULL DEFAULT NULL,
+  `msg` varchar(100) NULL DEFAULT NULL,
+  `reason` varchar(100) NULL DEFAULT NULL,
+  `requested_by` int(10) unsigned NOT NULL,
+  PRIMARY KEY (`id`),
+  KEY `idx_donation_refunds_donation` (`donation_id`, `donation_type`),
+  KEY `idx_donation_refunds_status` (`status`),
+  CONSTRAINT `fk_donation_refunds_requested_by` FOREIGN KEY (`requested_by`) REFERENCES `users` (`id`) ON DELETE NO ACTION ON UPDATE NO ACTION
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+/*!40101 SET character_set_client = @saved_cs_client */;
+
+--
+-- Table structure for table `campaigns`
+--
+
+DROP TABLE IF EXISTS `campaigns`;
+/*!40101 SET @saved_cs_client     = @@character_set_client */;
+/*!40101 SET character_set_client = utf8mb4 */;
+CREATE TABLE `campaigns` (
+  `id` int(10) unsigned NOT NULL AUTO_INCREMENT,
+  `created_at` timestamp DEFAULT CURRENT_TIMESTAMP,
+  `updated_at` timestamp DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+  `deleted_at` timestamp NULL DEFAULT NULL,
+  `slug` varchar(50) NOT NULL,
+  `title` varchar(100) NOT NULL,
+  `goal_amount` int(10) unsigned NOT NULL,
+  `start_at` timestamp NOT NULL,
+  `end_at` timestamp NOT NULL,
+  `matching_sponsor` varchar(100) DEFAULT NULL,
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `idx_campaigns_slug` (`slug`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+/*!40101 SET character_set_client = @saved_cs_client */;
+
+--
+-- Table structure for table `exchange_rates`
+--
+
+DROP TABLE IF EXISTS `exchange_rates`;
+/*!40101 SET @saved_cs_client     = @@character_set_client */;
+/*!40101 SET character_set_client = utf8mb4 */;
+CREATE TABLE `exchange_rates` (
+  `id` int(10) unsigned NOT NULL AUTO_INCREMENT,
+  `created_at` timestamp DEFAULT CURRENT_TIMESTAMP,
+  `updated_at` timestamp DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+  `deleted_at` timestamp NULL DEFAULT NULL,
+  `date` date NOT NULL,
+  `currency` varchar(3) NOT NULL,
+  `rate` decimal(16,6) NOT NULL,
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `idx_exchange_rates_date_currency` (`date`, `currency`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+/*!40101 SET character_set_client = @saved_cs_client */;
+
+--
+-- Table structure for table `periodic_donation_card_changes`
+--
+
+DROP TABLE IF EXISTS `periodic_donation_card_changes`;
+/*!40101 SET @saved_cs_client     = @@character_set_client */;
+/*!40101 SET character_set_client = utf8mb4 */;
+CREATE TABLE `periodic_donation_card_changes` (
+  `id` int(10) unsigned NOT NULL AUTO_INCREMENT,
+  `created_at` timestamp DEFAULT CURRENT_TIMESTAMP,
+  `updated_at` timestamp DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+  `deleted_at` timestamp NULL DEFAULT NULL,
+  `periodic_id` int(10) unsigned NOT NULL,
+  `user_id` int(10) unsigned NOT NULL,
+  `card_info_bin_code` varchar(6) DEFAULT NULL,
+  `card_info_last_four` varchar(4) DEFAULT NULL,
+  `card_info_issuer` varchar(50) DEFAULT NULL,
+  `card_info_funding` tinyint DEFAULT NULL,
+  `card_info_type` tinyint DEFAULT NULL,
+  `card_info_level` varchar(10) DEFAULT NULL,
+  `card_info_country` varchar(30) DEFAULT NULL,
+  `card_info_country_code` varchar(10) DEFAULT NULL,
+  `card_info_expiry_date` varchar(6) DEFAULT NULL,
+  PRIMARY KEY (`id`),
+  KEY `idx_periodic_donation_card_changes_periodic_id` (`periodic_id`),
+  CONSTRAINT `fk_periodic_donation_card_changes_periodic_id` FOREIGN KEY (`periodic_id`) REFERENCES `periodic_donations` (`id`) ON DELETE NO ACTION ON UPDATE NO ACTION,
+  CONSTRAINT `fk_periodic_donation_card_changes_user_id` FOREIGN KEY (`user_id`) REFERENCES `users` (`id`) ON DELETE NO ACTION ON UPDATE NO ACTION
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+/*!40101 SET character_set_client = @saved_cs_client */;
+
+--
+-- Table structure for table `periodic_donation_card_expiry_reminders`
+--
+
+DROP TABLE IF EXISTS `periodic_donation_card_expiry_reminders`;
+/*!40101 SET @saved_cs_client     = @@character_set_client */;
+/*!40101 SET character_set_client = utf8mb4 */;
+CREATE TABLE `periodic_donation_card_expiry_reminders` (
+  `id` int(10) unsigned NOT NULL AUTO_INCREMENT,
+  `created_at` timestamp DEFAULT CURRENT_TIMESTAMP,
+  `updated_at` timestamp DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+  `deleted_at` timestamp NULL DEFAULT NULL,
+  `periodic_id` int(10) unsigned NOT NULL,
+  `card_info_expiry_date` varchar(6) NOT NULL,
+  `email` varchar(100) NOT NULL,
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `idx_periodic_donation_card_expiry_reminders_periodic_id_expiry_date` (`periodic_id`, `card_info_expiry_date`),
+  CONSTRAINT `fk_periodic_donation_card_expiry_reminders_periodic_id` FOREIGN KEY (`periodic_id`) REFERENCES `periodic_donations` (`id`) ON DELETE NO ACTION ON UPDATE NO ACTION
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+/*!40101 SET character_set_client = @saved_cs_client */;
+
+--
+-- Table structure for table `periodic_donation_changes`
+--
+
+DROP TABLE IF EXISTS `periodic_donation_changes`;
+/*!40101 SET @saved_cs_client     = @@character_set_client */;
+/*!40101 SET character_set_client = utf8mb4 */;
+CREATE TABLE `periodic_donation_changes` (
+  `id` int(10) unsigned NOT NULL AUTO_INCREMENT,
+  `created_at` timestamp DEFAULT CURRENT_TIMESTAMP,
+  `updated_at` timestamp DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+  `deleted_at` timestamp NULL DEFAULT NULL,
+  `periodic_id` int(10) unsigned NOT NULL,
+  `user_id` int(10) unsigned NOT NULL,
+  `status` enum('scheduled', 'applied', 'cancelled') NOT NULL,
+  `effective_at` timestamp NOT NULL,
+  `applied_at` timestamp NULL DEFAULT NULL,
+  `amount` int(10) unsigned NULL DEFAULT NULL,
+  `frequency` enum('monthly', 'yearly') NULL DEFAULT NULL,
+  `paused_until` timestamp NULL DEFAULT NULL,
+  `previous_amount` int(10) unsigned NULL DEFAULT NULL,
+  `previous_frequency` enum('monthly', 'yearly') NULL DEFAULT NULL,
+  `previous_paused_until` timestamp NULL DEFAULT NULL,
+  PRIMARY KEY (`id`),
+  KEY `idx_periodic_donation_changes_periodic_id` (`periodic_id`),
+  KEY `idx_periodic_donation_changes_status_effective_at` (`status`, `effective_at`),
+  CONSTRAINT `fk_periodic_donation_changes_periodic_id` FOREIGN KEY (`periodic_id`) REFERENCES `periodic_donations` (`id`) ON DELETE NO ACTION ON UPDATE NO ACTION,
+  CONSTRAINT `fk_periodic_donation_changes_user_id` FOREIGN KEY (`user_id`) REFERENCES `users` (`id`) ON DELETE NO ACTION ON UPDATE NO ACTION
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+/*!40101 SET character_set_client = @saved_cs_client */;
+
+--
+-- Table structure for table `idempotency_keys`
+--
+
+DROP TABLE IF EXISTS `idempotency_keys`;
+/*!40101 SET @saved_cs_client     = @@character_set_client */;
+/*!40101 SET character_set_client = utf8mb4 */;
+CREATE TABLE `idempotency_keys` (
+  `id` int(10) unsigned NOT NULL AUTO_INCREMENT,
+  `created_at` timestamp DEFAULT CURRENT_TIMESTAMP,
+  `updated_at` timestamp DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+  `user_id` int(10) unsigned NOT NULL,
+  `key` varchar(255) NOT NULL,
+  `fingerprint` char(64) NOT NULL,
+  `status_code` int NOT NULL DEFAULT 0,
+  `response_body` mediumtext NULL DEFAULT NULL,
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `idx_idempotency_keys_user_id_key` (`user_id`, `key`),
+  CONSTRAINT `fk_idempotency_keys_user_id` FOREIGN KEY (`user_id`) REFERENCES `users` (`id`) ON DELETE NO ACTION ON UPDATE NO ACTION
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+/*!40101 SET character_set_client = @saved_cs_client */;
+
+--
+-- Table structure for table `receipt_serials`
+--
+
+DROP TABLE IF EXISTS `receipt_serials`;
+/*!40101 SET @saved_cs_client     = @@character_set_client */;
+/*!40101 SET character_set_client = utf8mb4 */;
+CREATE TABLE `receipt_serials` (
+  `year` int(10) unsigned NOT NULL,
+  `last_serial` int(10) unsigned NOT NULL,
+  PRIMARY KEY (`year`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+/*!40101 SET character_set_client = @saved_cs_client */;
+
+--
+-- Table structure for table `receipts`
+--
+
+DROP TABLE IF EXISTS `receipts`;
+/*!40101 SET @saved_cs_client     = @@character_set_client */;
+/*!40101 SET character_set_client = utf8mb4 */;
+CREATE TABLE `receipts` (
+  `id` int(10) unsigned NOT NULL AUTO_INCREMENT,
+  `created_at` timestamp DEFAULT CURRENT_TIMESTAMP,
+  `updated_at` timestamp DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+  `deleted_at` timestamp NULL DEFAULT NULL,
+  `receipt_number` varchar(20) NOT NULL,
+  `user_id` int(10) unsigned NOT NULL,
+  `period_type` enum('monthly', 'yearly') NOT NULL,
+  `period_start` timestamp NOT NULL,
+  `period_end` timestamp NOT NULL,
+  `send_receipt` enum('no', 'monthly', 'yearly') NOT NULL,
+  `email` varchar(100) NOT NULL,
+  `name` varchar(30) DEFAULT NULL,
+  `national_id` varchar(20) DEFAULT NULL,
+  `company_name` varchar(100) DEFAULT NULL,
+  `tax_id` char(8) DEFAULT NULL,
+  `address` varchar(100) DEFAULT NULL,
+  `amount` int(10) unsigned NOT NULL,
+  `currency` varchar(3) NOT NULL DEFAULT 'TWD',
+  `pdf` mediumblob NULL DEFAULT NULL,
+  `mailed_at` timestamp NULL DEFAULT NULL,
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `idx_receipts_receipt_number` (`receipt_number`),
+  KEY `idx_receipts_user_id` (`user_id`),
+  KEY `idx_receipts_period_start` (`period_start`),
+  CONSTRAINT `fk_receipts_user_id` FOREIGN KEY (`user_id`) REFERENCES `users` (`id`) ON DELETE NO ACTION ON UPDATE NO ACTION
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+/*!40101 SET character_set_client = @saved_cs_client */;
+
+--
+-- Table structure for table `receipt_items`
+--
+
+DROP TABLE IF EXISTS `receipt_items`;
+/*!40101 SET @saved_cs_client     = @@character_set_client */;
+/*!40101 SET character_set_client = utf8mb4 */;
+CREATE TABLE `receipt_items` (
+  `id` int(10) unsigned NOT NULL AUTO_INCREMENT,
+  `created_at` timestamp DEFAULT CURRENT_TIMESTAMP,
+  `updated_at` timestamp DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+  `receipt_id` int(10) unsigned NOT NULL,
+  `donation_type` enum('prime', 'token', 'others') NOT NULL,
+  `donation_id` int(10) unsigned NOT NULL,
+  `order_number` varchar(50) NOT NULL,
+  `amount` int(10) unsigned NOT NULL,
+  `paid_at` timestamp NOT NULL,
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `idx_receipt_items_donation` (`donation_id`, `donation_type`),
+  KEY `idx_receipt_items_receipt_id` (`receipt_id`),
+  CONSTRAINT `fk_receipt_items_receipt_id` FOREIGN KEY (`receipt_id`) REFERENCES `receipts` (`id`) ON DELETE NO ACTION ON UPDATE NO ACTION
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+/*!40101 SET character_set_client = @saved_cs_client */;
+
+--
+-- Table structure for table `outbox_events`
+--
+
+DROP TABLE IF EXISTS `outbox_events`;
+/*!40101 SET @saved_cs_client     = @@character_set_client */;
+/*!40101 SET character_set_client = utf8mb4 */;
+CREATE TABLE `outbox_events` (
+  `id` int(10) unsigned NOT NULL AUTO_INCREMENT,
+  `created_at` timestamp DEFAULT CURRENT_TIMESTAMP,
+  `dispatched_at` timestamp NULL DEFAULT NULL,
+  `type` varchar(30) NOT NULL,
+  `payload` text NOT NULL,
+  PRIMARY KEY (`id`),
+  KEY `idx_outbox_events_created_at` (`created_at`),
+  KEY `idx_outbox_events_dispatched_at` (`dispatched_at`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+/*!40101 SET character_set_client = @saved_cs_client */;
+
+--
+-- Table structure for table `webhook_deliveries`
+--
+
+DROP TABLE IF EXISTS `webhook_deliveries`;
+/*!40101 SET @saved_cs_client     = @@character_set_client */;
+/*!40101 SET character_set_client = utf8mb4 */;
+CREATE TABLE `webhook_deliveries` (
+  `id` int(10) unsigned NOT NULL AUTO_INCREMENT,
+  `created_at` timestamp DEFAULT CURRENT_TIMESTAMP,
+  `updated_at` timestamp DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+  `event_id` int(10) unsigned NOT NULL,
+  `endpoint` varchar(255) NOT NULL,
+  `status` enum('pending', 'delivered', 'dead') NOT NULL DEFAULT 'pending',
+  `attempts` int(10) unsigned NOT NULL DEFAULT 0,
+  `next_attempt_at` timestamp NOT NULL,
+  `last_error` varchar(255) DEFAULT NULL,
+  `delivered_at` timestamp NULL DEFAULT NULL,
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `idx_webhook_deliveries_event_id_endpoint` (`event_id`, `endpoint`),
+  KEY `idx_webhook_deliveries_status_next_attempt_at` (`status`, `next_attempt_at`),
+  CONSTRAINT `fk_webhook_deliveries_event_id` FOREIGN KEY (`event_id`) REFERENCES `outbox_events` (`id`) ON DELETE NO ACTION ON UPDATE NO ACTION
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+/*!40101 SET character_set_client = @saved_cs_client */;
+
+--
+-- Table structure for table `gift_fulfillments`
+--
+
+DROP TABLE IF EXISTS `gift_fulfillments`;
+/*!40101 SET @saved_cs_client     = @@character_set_client */;
+/*!40101 SET character_set_client = utf8mb4 */;
+CREATE TABLE `gift_fulfillments` (
+  `id` int(10) unsigned NOT NULL AUTO_INCREMENT,
+  `created_at` timestamp DEFAULT CURRENT_TIMESTAMP,
+  `updated_at` timestamp DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+  `periodic_id` int(10) unsigned NOT NULL,
+  `user_id` int(10) unsigned NOT NULL,
+  `status` enum('queued', 'shipped') NOT NULL DEFAULT 'queued',
+  `carrier` varchar(50) DEFAULT NULL,
+  `tracking_number` varchar(50) DEFAULT NULL,
+  `shipped_at` timestamp NULL DEFAULT NULL,
+  `shipped_by` int(10) unsigned DEFAULT NULL,
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `idx_gift_fulfillments_periodic_id` (`periodic_id`),
+  KEY `idx_gift_fulfillments_status` (`status`),
+  CONSTRAINT `fk_gift_fulfillments_periodic_id` FOREIGN KEY (`periodic_id`) REFERENCES `periodic_donations` (`id`) ON DELETE NO ACTION ON UPDATE NO ACTION,
+  CONSTRAINT `fk_gift_fulfillments_user_id` FOREIGN KEY (`user_id`) REFERENCES `users` (`id`) ON DELETE NO ACTION ON UPDATE NO ACTION
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+/*!40101 SET character_set_client = @saved_cs_client */;
+
+--
+-- Table structure for table `matching_rules`
+--
+
+DROP TABLE IF EXISTS `matching_rules`;
+/*!40101 SET @saved_cs_client     = @@character_set_client */;
+/*!40101 SET character_set_client = utf8mb4 */;
+CREATE TABLE `matching_rules` (
+  `id` int(10) unsigned NOT NULL AUTO_INCREMENT,
+  `created_at` timestamp DEFAULT CURRENT_TIMESTAMP,
+  `updated_at` timestamp DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+  `sponsor` varchar(100) NOT NULL,
+  `sponsor_email` varchar(100) NOT NULL,
+  `ratio` decimal(5,2) NOT NULL,
+  `budget` int(10) unsigned NOT NULL,
+  `consumed` int(10) unsigned NOT NULL DEFAULT '0',
+  `currency` char(3) NOT NULL DEFAULT 'TWD',
+  `donation_types` set('prime', 'token', 'others') NOT NULL,
+  `campaign` varchar(50) DEFAULT NULL,
+  `start_at` timestamp NOT NULL,
+  `end_at` timestamp NOT NULL,
+  `reported_at` timestamp NULL DEFAULT NULL,
+  PRIMARY KEY (`id`),
+  KEY `idx_matching_rules_end_at` (`end_at`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+/*!40101 SET character_set_client = @saved_cs_client */;
+
+--
+-- Table structure for table `donation_matches`
+--
+
+DROP TABLE IF EXISTS `donation_matches`;
+/*!40101 SET @saved_cs_client     = @@character_set_client */;
+/*!40101 SET character_set_client = utf8mb4 */;
+CREATE TABLE `donation_matches` (
+  `id` int(10) unsigned NOT NULL AUTO_INCREMENT,
+  `created_at` timestamp DEFAULT CURRENT_TIMESTAMP,
+  `rule_id` int(10) unsigned NOT NULL,
+  `donation_type` enum('prime', 'token', 'others') NOT NULL,
+  `donation_id` int(10) unsigned NOT NULL,
+  `order_number` varchar(50) NOT NULL,
+  `amount` int(10) unsigned NOT NULL,
+  `matched_amount` int(10) unsigned NOT NULL,
+  `currency` char(3) NOT NULL DEFAULT 'TWD',
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `idx_donation_matches_donation_type_donation_id` (`donation_type`, `donation_id`),
+  KEY `idx_donation_matches_rule_id` (`rule_id`),
+  CONSTRAINT `fk_donation_matches_rule_id` FOREIGN KEY (`rule_id`) REFERENCES `matching_rules` (`id`) ON DELETE NO ACTION ON UPDATE NO ACTION
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+/*!40101 SET character_set_client = @saved_cs_client */;
+
+--
+-- Table structure for table `donor_profiles`
+--
+
+DROP TABLE IF EXISTS `donor_profiles`;
+/*!40101 SET @saved_cs_client     = @@character_set_client */;
+/*!40101 SET character_set_client = utf8mb4 */;
+CREATE TABLE `donor_profiles` (
+  `id` int(10) unsigned NOT NULL AUTO_INCREMENT,
+  `created_at` timestamp DEFAULT CURRENT_TIMESTAMP,
+  `updated_at` timestamp DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+  `user_id` int(10) unsigned NOT NULL,
+  `cardholder_email` varchar(100) NOT NULL,
+  `cardholder_name` varchar(30) DEFAULT NULL,
+  `cardholder_phone_number` varchar(20) DEFAULT NULL,
+  `cardholder_address` varchar(100) DEFAULT NULL,
+  `cardholder_national_id` varchar(20) DEFAULT NULL,
+  `cardholder_zip_code` varchar(10) DEFAULT NULL,
+  `send_receipt` enum('no','monthly') NOT NULL DEFAULT 'monthly',
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `idx_donor_profiles_user_id` (`user_id`),
+  CONSTRAINT `fk_donor_profiles_user_id` FOREIGN KEY (`user_id`) REFERENCES `users` (`id`) ON DELETE NO ACTION ON UPDATE NO ACTION
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+/*!40101 SET character_set_client = @saved_cs_client */;
+
+--
+-- Table structure for table `settlement_reconciliations`
+--
+
+DROP TABLE IF EXISTS `settlement_reconciliations`;
+/*!40101 SET @saved_cs_client     = @@character_set_client */;
+/*!40101 SET character_set_client = utf8mb4 */;
+CREATE TABLE `settlement_reconciliations` (
+  `id` int(10) unsigned NOT NULL AUTO_INCREMENT,
+  `created_at` timestamp DEFAULT CURRENT_TIMESTAMP,
+  `settlement_date` char(10) NOT NULL,
+  `line` int unsigned DEFAULT NULL,
+  `transaction_type` enum('payment','refund','chargeback') DEFAULT NULL,
+  `rec_trade_id` varchar(20) DEFAULT NULL,
+  `bank_transaction_id` varchar(50) DEFAULT NULL,
+  `settled_amount` int DEFAULT NULL,
+  `currency` char(3) NOT NULL,
+  `donation_type` enum('prime','token') DEFAULT NULL,
+  `donation_id` int(10) unsigned DEFAULT NULL,
+  `order_number` varchar(50) DEFAULT NULL,
+  `donation_amount` int(10) unsigned DEFAULT NULL,
+  `result` enum('matched','missing_donation','missing_settlement','amount_mismatch','status_mismatch','chargeback') NOT NULL,
+  `imported_by` int(10) unsigned DEFAULT NULL,
+  PRIMARY KEY (`id`),
+  KEY `idx_settlement_reconciliations_settlement_date` (`settlement_date`),
+  KEY `idx_settlement_reconciliations_result` (`result`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+/*!40101 SET character_set_client = @saved_cs_client */;
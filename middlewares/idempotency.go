@@ -0,0 +1,160 @@
+package middlewares
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gin-gonic/gin"
+
+	"twreporter.org/go-api/configs/constants"
+	"twreporter.org/go-api/models"
+	"twreporter.org/go-api/storage"
+)
+
+const (
+	idempotencyKeyHeader      = "Idempotency-Key"
+	idempotentReplayedHeader  = "Idempotent-Replayed"
+	maxIdempotencyKeyLength   = 255
+	idempotencyKeyFailDataKey = "req.Headers.Idempotency-Key"
+
+	// idempotencyKeyProcessingTimeout is longer than the write timeout of the server,
+	// the requests which are still in progress after it are regarded as abandoned, e.g. the process dies
+	idempotencyKeyProcessingTimeout = time.Minute
+)
+
+// responseRecorder keeps a copy of the response body written by the handlers
+type responseRecorder struct {
+	gin.ResponseWriter
+	body *bytes.Buffer
+}
+
+func (w responseRecorder) Write(b []byte) (int, error) {
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+func (w responseRecorder) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
+
+// ValidateIdempotencyKey replays the response of the previous request made with the same `Idempotency-Key` header
+// by the same user within the window, instead of processing the request again.
+// The request is rejected if the key is reused with a different request, or the previous request is still being processed.
+// The key is released if the handler panics or responds with a server error before it calls the payment gateway,
+// so that the request could be retried with the key.
+// Once the payment gateway is called, the charge may be made even if the handler fails,
+// so the server error is kept and replayed as well rather than charging the donor again.
+// Requests without the header are processed as usual.
+// It should be used after ValidateAuthorization.
+func ValidateIdempotencyKey(s storage.MembershipStorage, window time.Duration) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var body []byte
+		var claimed bool
+		var err error
+		var m models.IdempotencyKey
+		var userID uint64
+
+		key := c.GetHeader(idempotencyKeyHeader)
+		if key == "" {
+			return
+		}
+
+		if len(key) > maxIdempotencyKeyLength {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"status": "fail", "data": gin.H{
+				idempotencyKeyFailDataKey: fmt.Sprintf("Idempotency-Key should be at most %d characters", maxIdempotencyKeyLength),
+			}})
+			return
+		}
+
+		userProperty := c.Request.Context().Value(authUserProperty)
+		userIDClaim := userProperty.(*jwt.Token).Claims.(jwt.MapClaims)["user_id"]
+		if userID, err = strconv.ParseUint(fmt.Sprint(userIDClaim), 10, strconv.IntSize); err != nil {
+			c.AbortWithStatus(http.StatusUnauthorized)
+			return
+		}
+
+		// reuse the body bound by the previous middlewares, since the request body could be read only once
+		if cached, ok := c.Get(gin.BodyBytesKey); ok {
+			body, _ = cached.([]byte)
+		} else {
+			body, _ = ioutil.ReadAll(c.Request.Body)
+			c.Set(gin.BodyBytesKey, body)
+		}
+
+		fingerprint := sha256.Sum256([]byte(fmt.Sprintf("%s %s\n%s", c.Request.Method, c.Request.URL.Path, body)))
+
+		if m, claimed, err = s.ClaimAnIdempotencyKey(models.IdempotencyKey{
+			Fingerprint: hex.EncodeToString(fingerprint[:]),
+			Key:         key,
+			UserID:      uint(userID),
+		}, time.Now().Add(-window), time.Now().Add(-idempotencyKeyProcessingTimeout)); err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"status": "error", "message": err.Error()})
+			return
+		}
+
+		if !claimed {
+			switch {
+			case m.Fingerprint != hex.EncodeToString(fingerprint[:]):
+				c.AbortWithStatusJSON(http.StatusUnprocessableEntity, gin.H{"status": "fail", "data": gin.H{
+					idempotencyKeyFailDataKey: "Idempotency-Key is used by another request",
+				}})
+			case m.StatusCode == 0:
+				c.AbortWithStatusJSON(http.StatusConflict, gin.H{"status": "fail", "data": gin.H{
+					idempotencyKeyFailDataKey: "the request with the same Idempotency-Key is being processed",
+				}})
+			default:
+				c.Header(idempotentReplayedHeader, "true")
+				c.Data(m.StatusCode, "application/json; charset=utf-8", []byte(m.ResponseBody))
+				c.Abort()
+			}
+			return
+		}
+
+		recorder := responseRecorder{ResponseWriter: c.Writer, body: new(bytes.Buffer)}
+		c.Writer = recorder
+
+		defer func() {
+			if r := recover(); r != nil {
+				if c.GetBool(constants.GatewayCalledKey) {
+					saveAnIdempotentResponse(s, m.ID, http.StatusInternalServerError, `{"message":"the result of the payment is unknown","status":"error"}`)
+				} else {
+					releaseAnIdempotencyKey(s, m.ID)
+				}
+				panic(r)
+			}
+		}()
+
+		c.Next()
+
+		if recorder.Status() >= http.StatusInternalServerError && !c.GetBool(constants.GatewayCalledKey) {
+			releaseAnIdempotencyKey(s, m.ID)
+			return
+		}
+
+		saveAnIdempotentResponse(s, m.ID, recorder.Status(), recorder.body.String())
+	}
+}
+
+func saveAnIdempotentResponse(s storage.MembershipStorage, id uint, statusCode int, body string) {
+	if err, _ := s.UpdateByConditions(map[string]interface{}{"id": id}, &models.IdempotencyKey{
+		ResponseBody: body,
+		StatusCode:   statusCode,
+	}); err != nil {
+		log.Errorf("cannot save the response of the idempotency key(id: %d): %s", id, err.Error())
+	}
+}
+
+func releaseAnIdempotencyKey(s storage.MembershipStorage, id uint) {
+	if err := s.ReleaseAnIdempotencyKey(id); err != nil {
+		log.Errorf("cannot release the idempotency key(id: %d): %s", id, err.Error())
+	}
+}
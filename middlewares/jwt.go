@@ -5,7 +5,9 @@ import (
 	"fmt"
 	"net/http"
 
+	"twreporter.org/go-api/configs/constants"
 	"twreporter.org/go-api/globals"
+	"twreporter.org/go-api/storage"
 	"twreporter.org/go-api/utils"
 
 	//log "github.com/Sirupsen/logrus"
@@ -65,6 +67,24 @@ func ValidateUserID() gin.HandlerFunc {
 	}
 }
 
+// ValidateAdminPrivilege checks the user of claim userID in the jwt has admin privilege.
+// It should be used after ValidateAuthorization.
+// if the user is not an admin, return the 403 response
+func ValidateAdminPrivilege(s storage.MembershipStorage) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userProperty := c.Request.Context().Value(authUserProperty)
+		userIDClaim := userProperty.(*jwt.Token).Claims.(jwt.MapClaims)["user_id"]
+
+		user, err := s.GetUserByID(fmt.Sprint(userIDClaim))
+		if err != nil || user.Privilege < constants.PrivilegeAdmin {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"status": "fail", "data": gin.H{
+				"req.Headers.Authorization": "the request is not permitted to reach the resource",
+			}})
+			return
+		}
+	}
+}
+
 func ValidateUserIDInReqBody() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		var body = struct {
@@ -79,7 +99,16 @@ func ValidateUserIDInReqBody() gin.HandlerFunc {
 
 		// gin.Context.Bind does not support to bind `JSON` body multiple times
 		// the alternative is to use gin.Context.ShouldBindBodyWith function to bind
-		if err = c.ShouldBindBodyWith(&body, binding.JSON); err == nil {
+		if c.ContentType() == binding.MIMEMultipartPOSTForm {
+			// the multipart form, such as the one with an uploaded file, is parsed once and kept by the request,
+			// so it is bound before the body is read by gin.Context.ShouldBindBodyWith
+			if err = c.ShouldBindWith(&body, binding.FormMultipart); err != nil {
+				c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"status": "fail", "data": gin.H{
+					"req.Body.user_id": err.Error(),
+				}})
+				return
+			}
+		} else if err = c.ShouldBindBodyWith(&body, binding.JSON); err == nil {
 			// omit intentionally
 		} else if err = c.Bind(&body); err != nil {
 			// bind other format rather than JSON
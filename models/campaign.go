@@ -0,0 +1,40 @@
+package models
+
+import (
+	"time"
+
+	"gopkg.in/guregu/null.v3"
+)
+
+// Campaign is a fundraising drive, such as the year-end drive or the drive of a special investigation.
+// Donations are attributed to the campaign by its slug, and those made in [StartAt, EndAt) count towards the goal.
+type Campaign struct {
+	CreatedAt time.Time  `json:"created_at"`
+	DeletedAt *time.Time `json:"deleted_at"`
+	EndAt     time.Time  `gorm:"not null" json:"end_at"`
+	// GoalAmount is in TWD
+	GoalAmount uint `gorm:"type:int(10) unsigned;not null" json:"goal_amount"`
+	ID         uint `gorm:"primary_key" json:"id"`
+	// MatchingSponsor is the sponsor who matches the donations of the campaign, if any
+	MatchingSponsor null.String `gorm:"type:varchar(100)" json:"matching_sponsor"`
+	Slug            string      `gorm:"type:varchar(50);not null;unique_index:idx_campaigns_slug" json:"slug"`
+	StartAt         time.Time   `gorm:"not null" json:"start_at"`
+	Title           string      `gorm:"type:varchar(100);not null" json:"title"`
+	UpdatedAt       time.Time   `json:"updated_at"`
+}
+
+// CampaignAmount is the amount raised in a currency
+type CampaignAmount struct {
+	Amount   uint
+	Currency string
+}
+
+// CampaignProgress is what the paid donations of a campaign raise
+type CampaignProgress struct {
+	// Amounts are the amounts raised by the currencies
+	Amounts []CampaignAmount
+	// Donors counts the distinct donors by their emails
+	Donors uint
+	// RecurringPledges counts the periodic donations pledged in the campaign whose first installments are paid
+	RecurringPledges uint
+}
@@ -42,82 +42,237 @@ type Cardholder struct {
 	ZipCode     null.String `gorm:"column:cardholder_zip_code;type:varchar(10)" json:"zip_code"`
 }
 
+// donor types of the prime and periodic donations
+const (
+	DonorTypeIndividual   = "individual"
+	DonorTypeOrganization = "organization"
+)
+
+// DonorIdentity tells whether a donation is made by the cardholder or an organization, such as a company or a foundation.
+// The cardholder is the contact of the organization,
+// and the receipts are issued to the company name and the unified business number(統一編號) of the organization.
+type DonorIdentity struct {
+	CompanyName null.String `gorm:"column:company_name;type:varchar(100)" json:"company_name"`
+	DonorType   string      `gorm:"column:donor_type;type:ENUM('individual','organization');default:'individual';not null" json:"donor_type"`
+	TaxID       null.String `gorm:"column:tax_id;type:char(8)" json:"tax_id"`
+}
+
+// IsOrganization reports whether the donation is made by an organization
+func (d DonorIdentity) IsOrganization() bool {
+	return DonorTypeOrganization == d.DonorType
+}
+
+// DonorWallConsent is whether the donor agrees to be thanked on the public donor wall.
+// The donation is listed by DisplayName instead of the name of the cardholder, and without the amount if HideAmount is true.
+// The card token donations follow the consent of their periodic donations.
+type DonorWallConsent struct {
+	DisplayName null.String `gorm:"column:display_name;type:varchar(50)" json:"display_name"`
+	HideAmount  null.Bool   `gorm:"column:hide_amount;type:tinyint(1);default:0" json:"hide_amount"`
+	ShowOnWall  null.Bool   `gorm:"column:show_on_wall;type:tinyint(1);default:0" json:"show_on_wall"`
+}
+
 type PayByPrimeDonation struct {
 	CardInfo
 	Cardholder
+	DonorIdentity
+	DonorWallConsent
 	TappayResp
-	Amount      uint       `gorm:"not null" json:"amount"`
-	CreatedAt   time.Time  `json:"created_at"`
-	Currency    string     `gorm:"type:varchar(3);default:'TWD';not null" json:"currency"`
-	DeletedAt   *time.Time `json:"deleted_at"`
-	Details     string     `gorm:"type:varchar(50);not null" json:"details"`
-	ID          uint       `gorm:"primary_key" json:"id"`
-	MerchantID  string     `gorm:"type:varchar(30);not null" json:"merchant_id"`
-	Notes       string     `gorm:"type:varchar(100)" json:"notes"`
-	OrderNumber string     `gorm:"type:varchar(50);not null" json:"order_number"`
-	PayMethod   string     `gorm:"type:ENUM('credit_card','line','apple','google','samsung');not null;index:idx_pay_by_prime_donations_cardholder_email_pay_method" json:"pay_method"`
-	SendReceipt string     `gorm:"type:ENUM('no', 'monthly');default:'monthly'" json:"send_receipt"`
-	Status      string     `gorm:"type:ENUM('paying','paid','fail');not null" json:"status"`
-	UpdatedAt   time.Time  `json:"updated_at"`
-	UserID      uint       `gorm:"type:int(10);unsigned;not null" json:"user_id"`
+	Amount uint `gorm:"not null" json:"amount"`
+	// Campaign is the slug of the campaign which the donation is attributed to
+	Campaign    null.String `gorm:"type:varchar(50);index:idx_pay_by_prime_donations_campaign" json:"campaign"`
+	CreatedAt   time.Time   `json:"created_at"`
+	Currency    string      `gorm:"type:varchar(3);default:'TWD';not null" json:"currency"`
+	DeletedAt   *time.Time  `json:"deleted_at"`
+	Details     string      `gorm:"type:varchar(50);not null" json:"details"`
+	ID          uint        `gorm:"primary_key" json:"id"`
+	MerchantID  string      `gorm:"type:varchar(30);not null" json:"merchant_id"`
+	Notes       string      `gorm:"type:varchar(100)" json:"notes"`
+	OrderNumber string      `gorm:"type:varchar(50);not null" json:"order_number"`
+	PayMethod   string      `gorm:"type:ENUM('credit_card','line','apple','google','samsung');not null;index:idx_pay_by_prime_donations_cardholder_email_pay_method" json:"pay_method"`
+	// PaymentGateway is the payment gateway the donation is made through
+	PaymentGateway string    `gorm:"type:varchar(20);default:'tappay';not null" json:"payment_gateway"`
+	SendReceipt    string    `gorm:"type:ENUM('no', 'monthly');default:'monthly'" json:"send_receipt"`
+	Status         string    `gorm:"type:ENUM('paying','paid','fail','refunded');not null" json:"status"`
+	UpdatedAt      time.Time `json:"updated_at"`
+	UserID         uint      `gorm:"type:int(10);unsigned;not null" json:"user_id"`
 }
 
 type PayByCardTokenDonation struct {
 	TappayResp
-	Amount      uint       `gorm:"not null;index:idx_pay_by_card_token_donations_amount" json:"amount"`
-	CreatedAt   time.Time  `json:"created_at"`
-	Currency    string     `gorm:"type:varchar(3);default:'TWD';not null" json:"currency"`
-	DeletedAt   *time.Time `json:"deleted_at"`
-	Details     string     `gorm:"type:varchar(50);not null" json:"details"`
-	ID          uint       `gorm:"primary_key" json:"id"`
-	MerchantID  string     `gorm:"type:varchar(30);not null" json:"merchant_id"`
-	OrderNumber string     `gorm:"type:varchar(50);not null" json:"order_number"`
-	PeriodicID  uint       `gorm:"not null;index:idx_pay_by_card_token_donations_periodic_id" json:"periodic_id"`
-	Status      string     `gorm:"type:ENUM('paying','paid','fail');not null" json:"status"`
-	UpdatedAt   time.Time  `json:"updated_at"`
+	Amount uint `gorm:"not null;index:idx_pay_by_card_token_donations_amount" json:"amount"`
+	// Campaign is the campaign of the periodic donation when the installment is charged
+	Campaign    null.String `gorm:"type:varchar(50);index:idx_pay_by_card_token_donations_campaign" json:"campaign"`
+	CreatedAt   time.Time   `json:"created_at"`
+	Currency    string      `gorm:"type:varchar(3);default:'TWD';not null" json:"currency"`
+	DeletedAt   *time.Time  `json:"deleted_at"`
+	Details     string      `gorm:"type:varchar(50);not null" json:"details"`
+	ID          uint        `gorm:"primary_key" json:"id"`
+	MerchantID  string      `gorm:"type:varchar(30);not null" json:"merchant_id"`
+	OrderNumber string      `gorm:"type:varchar(50);not null" json:"order_number"`
+	// PaymentGateway is the payment gateway the installment is charged through
+	PaymentGateway string `gorm:"type:varchar(20);default:'tappay';not null" json:"payment_gateway"`
+	// PendingCardKey and PendingCardToken are the encrypted card secrets bound by the first installment which the donor is confirming on the payment url.
+	// They are moved onto the periodic donation only if the installment is paid, and erased once it is resolved.
+	PendingCardKey   string    `gorm:"type:tinyblob" json:"-"`
+	PendingCardToken string    `gorm:"type:tinyblob" json:"-"`
+	PeriodicID       uint      `gorm:"not null;index:idx_pay_by_card_token_donations_periodic_id" json:"periodic_id"`
+	Status           string    `gorm:"type:ENUM('paying','paid','fail','refunded');not null" json:"status"`
+	UpdatedAt        time.Time `json:"updated_at"`
 }
 
+// PayByOtherMethodDonation is a donation made outside the payment gateways, such as a bank transfer or a cheque.
+// It is recorded by staffs after the money is received, and CreatedAt is when it is paid.
 type PayByOtherMethodDonation struct {
-	Address     string     `gorm:"type:varchar(100)" json:"address"`
-	Amount      uint       `gorm:"type:int(10) unsigned;index:idx_pay_by_other_donations_amount" json:"amount"`
-	CreatedAt   time.Time  `json:"created_at"`
-	Currency    string     `gorm:"type:char(3);default:'TWD';not null" json:"currency"`
-	DeletedAt   *time.Time `json:"deleted_at"`
-	Details     string     `gorm:"type:varchar(50);not null" json:"details"`
-	Email       string     `gorm:"type:varchar(100);not null" json:"email"`
-	ID          uint       `gorm:"primary_key" json:"id"`
-	MerchantID  string     `gorm:"type:varchar(30);not null" json:"merchant_id"`
-	Name        string     `gorm:"type:varchar(30)" json:"name"`
-	NationalID  string     `gorm:"type:varchar(20)" json:"national_id"`
-	Notes       string     `gorm:"type:varchar(100)" json:"notes"`
-	OrderNumber string     `gorm:"type:varchar(50);not null" json:"order_number"`
-	PayMethod   string     `gorm:"type:varchar(50);not null;index:idx_pay_by_other_donations_pay_method" json:"pay_method"`
-	PhoneNumber string     `gorm:"type:varchar(20)" json:"phone_number"`
-	SendReceipt string     `gorm:"type:ENUM('no', 'monthly');default:'monthly'" json:"send_receipt"`
-	UpdatedAt   time.Time  `json:"updated_at"`
-	UserID      uint       `gorm:"type:int(10) unsigned;not null" json:"user_id"`
-	ZipCode     string     `gorm:"type:varchar(10)" json:"zip_code"`
+	Address  string      `gorm:"type:varchar(100)" json:"address"`
+	Amount   uint        `gorm:"type:int(10) unsigned;index:idx_pay_by_other_donations_amount" json:"amount"`
+	Campaign null.String `gorm:"type:varchar(50);index:idx_pay_by_other_method_donations_campaign" json:"campaign"`
+	// BankReference is the reference of the bank transfer or the number of the cheque, it is unique among the donations
+	BankReference null.String `gorm:"type:varchar(50);unique_index:idx_pay_by_other_method_donations_bank_reference" json:"bank_reference"`
+	CreatedAt     time.Time   `json:"created_at"`
+	Currency      string      `gorm:"type:char(3);default:'TWD';not null" json:"currency"`
+	DeletedAt     *time.Time  `json:"deleted_at"`
+	Details       string      `gorm:"type:varchar(50);not null" json:"details"`
+	Email         string      `gorm:"type:varchar(100);not null" json:"email"`
+	ID            uint        `gorm:"primary_key" json:"id"`
+	MerchantID    string      `gorm:"type:varchar(30);not null" json:"merchant_id"`
+	Name          string      `gorm:"type:varchar(30)" json:"name"`
+	NationalID    string      `gorm:"type:varchar(20)" json:"national_id"`
+	Notes         string      `gorm:"type:varchar(100)" json:"notes"`
+	OrderNumber   string      `gorm:"type:varchar(50);not null" json:"order_number"`
+	PayMethod     string      `gorm:"type:varchar(50);not null;index:idx_pay_by_other_donations_pay_method" json:"pay_method"`
+	PhoneNumber   string      `gorm:"type:varchar(20)" json:"phone_number"`
+	// RecordedBy is the staff who records the donation
+	RecordedBy  null.Int  `gorm:"type:int(10) unsigned" json:"recorded_by"`
+	SendReceipt string    `gorm:"type:ENUM('no', 'monthly');default:'monthly'" json:"send_receipt"`
+	UpdatedAt   time.Time `json:"updated_at"`
+	UserID      uint      `gorm:"type:int(10) unsigned;not null" json:"user_id"`
+	ZipCode     string    `gorm:"type:varchar(10)" json:"zip_code"`
 }
 
 type PeriodicDonation struct {
 	Cardholder
 	CardInfo
-	Amount        uint       `gorm:"type:int(10) unsigned;not null;index:idx_periodic_donations_amount" json:"amount"`
-	CardKey       string     `gorm:"type:tinyblob" json:"card_key"`
-	CardToken     string     `gorm:"type:tinyblob" json:"card_token"`
-	CreatedAt     time.Time  `json:"created_at"`
-	Currency      string     `gorm:"type:varchar(3);default:'TWD';not null" json:"currency"`
-	DeletedAt     *time.Time `json:"deleted_at"`
-	Details       string     `gorm:"type:varchar(50);not null" json:"details"`
-	Frequency     string     `gorm:"type:ENUM('monthly', 'yearly');default:'monthly'" json:"frequency"`
-	ID            uint       `gorm:"primary_key" json:"id"`
-	LastSuccessAt null.Time  `json:"last_success_at"`
-	MaxPaidTimes  uint       `json:"max_paid_times" gorm:"type:int;not null;default:2147483647"`
-	Notes         string     `gorm:"type:varchar(100)" json:"notes"`
-	OrderNumber   string     `gorm:"type:varchar(50);not null" json:"order_number"`
-	SendReceipt   string     `gorm:"type:ENUM('no', 'monthly', 'yearly');default:'monthly'" json:"send_receipt"`
-	Status        string     `gorm:"type:ENUM('to_pay','paying','paid','fail','stopped','invalid');not null" json:"status"`
-	ToFeedback    null.Bool  `gorm:"type:tinyint(1);default:1" json:"to_feedback"`
-	UpdatedAt     time.Time  `json:"updated_at"`
-	UserID        uint       `gorm:"type:int(10) unsigned;not null" json:"user_id"`
+	DonorIdentity
+	DonorWallConsent
+	Amount uint `gorm:"type:int(10) unsigned;not null;index:idx_periodic_donations_amount" json:"amount"`
+	// Campaign is the slug of the campaign which the periodic donation is pledged in
+	Campaign  null.String `gorm:"type:varchar(50);index:idx_periodic_donations_campaign" json:"campaign"`
+	CardKey   string      `gorm:"type:tinyblob" json:"card_key"`
+	CardToken string      `gorm:"type:tinyblob" json:"card_token"`
+	CreatedAt time.Time   `json:"created_at"`
+	Currency  string      `gorm:"type:varchar(3);default:'TWD';not null" json:"currency"`
+	DeletedAt *time.Time  `json:"deleted_at"`
+	Details   string      `gorm:"type:varchar(50);not null" json:"details"`
+	// DunningStartedAt is when the installment fails for the first time, and the failed installment is retried by the schedule since then.
+	// DunningRetries counts the retries, and NextRetryAt is when the next retry is due.
+	DunningRetries   uint      `gorm:"type:int unsigned;not null;default:0" json:"dunning_retries"`
+	DunningStartedAt null.Time `json:"dunning_started_at"`
+	Frequency        string    `gorm:"type:ENUM('monthly', 'yearly');default:'monthly'" json:"frequency"`
+	ID               uint      `gorm:"primary_key" json:"id"`
+	LastSuccessAt    null.Time `json:"last_success_at"`
+	MaxPaidTimes     uint      `json:"max_paid_times" gorm:"type:int;not null;default:2147483647"`
+	NextRetryAt      null.Time `gorm:"index:idx_periodic_donations_next_retry_at" json:"next_retry_at"`
+	Notes            string    `gorm:"type:varchar(100)" json:"notes"`
+	OrderNumber      string    `gorm:"type:varchar(50);not null" json:"order_number"`
+	PausedUntil      null.Time `json:"paused_until"`
+	// PaymentGateway is the payment gateway the card secrets are issued by
+	PaymentGateway string    `gorm:"type:varchar(20);default:'tappay';not null" json:"payment_gateway"`
+	SendReceipt    string    `gorm:"type:ENUM('no', 'monthly', 'yearly');default:'monthly'" json:"send_receipt"`
+	Status         string    `gorm:"type:ENUM('to_pay','paying','paid','fail','stopped','invalid');not null" json:"status"`
+	StopReason     string    `gorm:"type:varchar(100)" json:"stop_reason"`
+	StoppedAt      null.Time `json:"stopped_at"`
+	ToFeedback     null.Bool `gorm:"type:tinyint(1);default:1" json:"to_feedback"`
+	UpdatedAt      time.Time `json:"updated_at"`
+	UserID         uint      `gorm:"type:int(10) unsigned;not null" json:"user_id"`
+}
+
+// DonationFilter narrows down the donations of a user
+type DonationFilter struct {
+	// Types are the donation types, e.g. prime, periodic_donation and others. Empty means all types.
+	Types []string
+	// Status is the status of donations. Other method donations are regarded as paid.
+	Status string
+	// Since and Until are the range of the creation time, Since is inclusive and Until is exclusive.
+	Since null.Time
+	Until null.Time
+}
+
+// DonationIndex locates a donation in one of the donation tables
+type DonationIndex struct {
+	CreatedAt time.Time
+	ID        uint
+	Type      string
+}
+
+// DonationRefund records a refund of a prime or card token donation made through the payment gateways
+type DonationRefund struct {
+	Amount          uint       `gorm:"type:int(10) unsigned;not null" json:"amount"`
+	CreatedAt       time.Time  `json:"created_at"`
+	Currency        string     `gorm:"type:varchar(3);default:'TWD';not null" json:"currency"`
+	DeletedAt       *time.Time `json:"deleted_at"`
+	DonationID      uint       `gorm:"type:int(10) unsigned;not null;index:idx_donation_refunds_donation" json:"donation_id"`
+	DonationType    string     `gorm:"type:ENUM('prime','token');not null;index:idx_donation_refunds_donation" json:"donation_type"`
+	ID              uint       `gorm:"primary_key" json:"id"`
+	Msg             string     `gorm:"type:varchar(100)" json:"msg"`
+	Reason          string     `gorm:"type:varchar(100)" json:"reason"`
+	RecTradeID      string     `gorm:"type:varchar(20);not null" json:"rec_trade_id"`
+	RefundID        string     `gorm:"type:varchar(50)" json:"refund_id"`
+	RequestedBy     uint       `gorm:"type:int(10) unsigned;not null" json:"requested_by"`
+	Status          string     `gorm:"type:ENUM('refunding','refunded','fail');not null" json:"status"`
+	TappayApiStatus null.Int   `json:"tappay_api_status"`
+	UpdatedAt       time.Time  `json:"updated_at"`
+}
+
+// PeriodicDonationCardChange keeps the card which is replaced by the donor of a periodic donation
+type PeriodicDonationCardChange struct {
+	CardInfo
+	CreatedAt  time.Time  `json:"created_at"`
+	DeletedAt  *time.Time `json:"deleted_at"`
+	ID         uint       `gorm:"primary_key" json:"id"`
+	PeriodicID uint       `gorm:"type:int(10) unsigned;not null;index:idx_periodic_donation_card_changes_periodic_id" json:"periodic_id"`
+	UpdatedAt  time.Time  `json:"updated_at"`
+	UserID     uint       `gorm:"type:int(10) unsigned;not null" json:"user_id"`
+}
+
+// PeriodicDonationChange records a change of the amount, the frequency or the pause of a periodic donation.
+// Null fields are left unchanged. The change is scheduled until it is effective,
+// and the previous values of the periodic donation are kept once it is applied.
+type PeriodicDonationChange struct {
+	Amount              null.Int    `gorm:"type:int(10) unsigned" json:"amount"`
+	AppliedAt           null.Time   `json:"applied_at"`
+	CreatedAt           time.Time   `json:"created_at"`
+	DeletedAt           *time.Time  `json:"deleted_at"`
+	EffectiveAt         time.Time   `gorm:"not null;index:idx_periodic_donation_changes_status_effective_at" json:"effective_at"`
+	Frequency           null.String `gorm:"type:ENUM('monthly','yearly')" json:"frequency"`
+	ID                  uint        `gorm:"primary_key" json:"id"`
+	PausedUntil         null.Time   `json:"paused_until"`
+	PeriodicID          uint        `gorm:"type:int(10) unsigned;not null;index:idx_periodic_donation_changes_periodic_id" json:"periodic_id"`
+	PreviousAmount      null.Int    `gorm:"type:int(10) unsigned" json:"previous_amount"`
+	PreviousFrequency   null.String `gorm:"type:ENUM('monthly','yearly')" json:"previous_frequency"`
+	PreviousPausedUntil null.Time   `json:"previous_paused_until"`
+	Status              string      `gorm:"type:ENUM('scheduled','applied','cancelled');not null;index:idx_periodic_donation_changes_status_effective_at" json:"status"`
+	UpdatedAt           time.Time   `json:"updated_at"`
+	UserID              uint        `gorm:"type:int(10) unsigned;not null" json:"user_id"`
+}
+
+// PeriodicDonationCardExpiryReminder records that the donor is reminded of the card expiring in the month,
+// so that the donor is reminded once per card.
+type PeriodicDonationCardExpiryReminder struct {
+	CreatedAt  time.Time  `json:"created_at"`
+	DeletedAt  *time.Time `json:"deleted_at"`
+	Email      string     `gorm:"type:varchar(100);not null" json:"email"`
+	ExpiryDate string     `gorm:"column:card_info_expiry_date;type:varchar(6);not null;unique_index:idx_periodic_donation_card_expiry_reminders_periodic_id_expiry_date" json:"expiry_date"`
+	ID         uint       `gorm:"primary_key" json:"id"`
+	PeriodicID uint       `gorm:"type:int(10) unsigned;not null;unique_index:idx_periodic_donation_card_expiry_reminders_periodic_id_expiry_date" json:"periodic_id"`
+	UpdatedAt  time.Time  `json:"updated_at"`
+}
+
+// CardExpirationMonth summarizes the active periodic donations in the currency whose cards expire in the month
+type CardExpirationMonth struct {
+	Currency string `gorm:"column:currency"`
+	// ExpiryDate is the month in YYYYMM format
+	ExpiryDate        string `gorm:"column:card_info_expiry_date"`
+	PeriodicDonations uint   `gorm:"column:periodic_donations"`
+	Amount            uint   `gorm:"column:amount"`
+	Reminded          uint   `gorm:"column:reminded"`
 }
@@ -0,0 +1,29 @@
+package models
+
+import (
+	"time"
+)
+
+// DonorProfile is the saved details of a donor, which pre-fill the new donations of the user.
+// The fields of the cardholder which a donation request gives are kept, and the rest are filled by the profile.
+type DonorProfile struct {
+	Cardholder
+	CreatedAt time.Time `json:"created_at"`
+	ID        uint      `gorm:"primary_key" json:"id"`
+	// SendReceipt is how the receipts of the new donations are sent, `monthly` or `no`
+	SendReceipt string    `gorm:"type:ENUM('no', 'monthly');default:'monthly';not null" json:"send_receipt"`
+	UpdatedAt   time.Time `json:"updated_at"`
+	UserID      uint      `gorm:"type:int(10) unsigned;not null;unique_index:idx_donor_profiles_user_id" json:"user_id"`
+}
+
+// CardOnFile is a card which the active periodic donations of a donor are charged by.
+// Only the masked card info is kept, and the periodic donations charged by the same card are grouped together.
+type CardOnFile struct {
+	// ID identifies the card among the cards of the donor, it is derived from the masked card info
+	ID         string `json:"id"`
+	ExpiryDate string `json:"expiry_date"`
+	LastFour   string `json:"last_four"`
+	Type       string `json:"type"`
+	// PeriodicDonations are the order numbers of the periodic donations charged by the card
+	PeriodicDonations []string `json:"periodic_donations"`
+}
@@ -0,0 +1,29 @@
+package models
+
+import (
+	"time"
+
+	"gopkg.in/guregu/null.v3"
+)
+
+// DonorWallFilter narrows down the donations listed on the donor wall
+type DonorWallFilter struct {
+	// Campaign is the slug of the campaign which the donations are attributed to, empty means all campaigns
+	Campaign string
+	// Since and Until are the range of the creation time, Since is inclusive and Until is exclusive
+	Since null.Time
+	Until null.Time
+}
+
+// DonorWallEntry is a paid prime donation or a periodic donation whose first installment is paid,
+// listed on the donor wall with the consent of the donor.
+// It carries nothing to identify the donor but the display name, and Amount is null if the donor hides it.
+type DonorWallEntry struct {
+	Amount      null.Int    `json:"amount"`
+	Campaign    null.String `json:"campaign"`
+	CreatedAt   time.Time   `json:"created_at"`
+	Currency    string      `json:"currency"`
+	DisplayName string      `json:"display_name"`
+	// Frequency is one_time for prime donations, or the frequency of the periodic donation
+	Frequency string `json:"frequency"`
+}
@@ -0,0 +1,17 @@
+package models
+
+import (
+	"time"
+)
+
+// ExchangeRate is the TWD amount of a unit of the currency on the date.
+// Date is the midnight in UTC of the date in Taiwan, since the rates are published daily in Taiwan.
+type ExchangeRate struct {
+	CreatedAt time.Time  `json:"created_at"`
+	Currency  string     `gorm:"type:varchar(3);not null;unique_index:idx_exchange_rates_date_currency" json:"currency"`
+	Date      time.Time  `gorm:"type:date;not null;unique_index:idx_exchange_rates_date_currency" json:"date"`
+	DeletedAt *time.Time `json:"deleted_at"`
+	ID        uint       `gorm:"primary_key" json:"id"`
+	Rate      float64    `gorm:"type:decimal(16,6);not null" json:"rate"`
+	UpdatedAt time.Time  `json:"updated_at"`
+}
@@ -0,0 +1,53 @@
+package models
+
+import (
+	"time"
+
+	"gopkg.in/guregu/null.v3"
+)
+
+// statuses of the gift fulfillments
+const (
+	GiftFulfillmentQueued  = "queued"
+	GiftFulfillmentShipped = "shipped"
+)
+
+// GiftFulfillment is the shipping of the feedback gift to the donor of a periodic donation.
+// A periodic donation is queued once it meets the rules of the feedback gift, and CreatedAt is when it is queued.
+type GiftFulfillment struct {
+	// Carrier is the logistics company, e.g. 中華郵政
+	Carrier    null.String `gorm:"type:varchar(50)" json:"carrier"`
+	CreatedAt  time.Time   `json:"created_at"`
+	ID         uint        `gorm:"primary_key" json:"id"`
+	PeriodicID uint        `gorm:"type:int(10) unsigned;not null;unique_index:idx_gift_fulfillments_periodic_id" json:"periodic_id"`
+	ShippedAt  null.Time   `json:"shipped_at"`
+	// ShippedBy is the staff who marks the gift shipped
+	ShippedBy      null.Int    `gorm:"type:int(10) unsigned" json:"shipped_by"`
+	Status         string      `gorm:"type:ENUM('queued','shipped');not null;default:'queued';index:idx_gift_fulfillments_status" json:"status"`
+	TrackingNumber null.String `gorm:"type:varchar(50)" json:"tracking_number"`
+	UpdatedAt      time.Time   `json:"updated_at"`
+	UserID         uint        `gorm:"type:int(10) unsigned;not null" json:"user_id"`
+}
+
+// FeedbackGiftRule is what a periodic donation should meet before its feedback gift is shipped
+type FeedbackGiftRule struct {
+	// MinAmounts are the minimum installment amounts by the currencies, the periodic donations in other currencies are not eligible
+	MinAmounts map[string]uint
+	// MinInstallments is the number of paid installments
+	MinInstallments uint
+}
+
+// GiftShippingItem is a queued gift along with where it is shipped to.
+// The cardholder is read from the periodic donation when the list is exported,
+// so that the address updated by the donor after the gift is queued is shipped to.
+type GiftShippingItem struct {
+	Cardholder
+	Amount uint
+	// CompanyName is the organization which the gift is shipped to, it is empty for individuals
+	CompanyName string
+	Currency    string
+	ID          uint
+	OrderNumber string
+	PeriodicID  uint
+	QueuedAt    time.Time
+}
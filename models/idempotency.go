@@ -0,0 +1,20 @@
+package models
+
+import (
+	"time"
+)
+
+// IdempotencyKey keeps the response of a request made with the `Idempotency-Key` header by a user,
+// so that the retried requests are replayed instead of being processed again.
+type IdempotencyKey struct {
+	CreatedAt   time.Time `json:"created_at"`
+	Fingerprint string    `gorm:"type:char(64);not null" json:"fingerprint"`
+	ID          uint      `gorm:"primary_key" json:"id"`
+	Key         string    `gorm:"type:varchar(255);not null;unique_index:idx_idempotency_keys_user_id_key" json:"key"`
+	// ResponseBody and StatusCode are the response of the first request.
+	// StatusCode is zero until the first request is processed.
+	ResponseBody string    `gorm:"type:mediumtext" json:"response_body"`
+	StatusCode   int       `gorm:"not null;default:0" json:"status_code"`
+	UpdatedAt    time.Time `json:"updated_at"`
+	UserID       uint      `gorm:"type:int(10) unsigned;not null;unique_index:idx_idempotency_keys_user_id_key" json:"user_id"`
+}
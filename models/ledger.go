@@ -0,0 +1,41 @@
+package models
+
+import (
+	"time"
+
+	"gopkg.in/guregu/null.v3"
+)
+
+// LedgerFilter narrows down the donations in the accounting ledger
+type LedgerFilter struct {
+	// Types are the donation types, e.g. prime, token and others. Empty means all types.
+	Types []string
+	// Status is the status of donations. Other method donations are regarded as paid.
+	Status string
+	// PayMethods are the pay methods of donations. Empty means all pay methods.
+	PayMethods []string
+	// Since and Until are the range of the creation time, Since is inclusive and Until is exclusive.
+	Since time.Time
+	Until time.Time
+}
+
+// LedgerEntry is a donation in the accounting ledger.
+// Card token donations take the card information and the donor identity from their periodic donations.
+type LedgerEntry struct {
+	Amount            uint
+	BankTransactionID string
+	CardInfoLastFour  null.String
+	CardInfoType      null.Int
+	CompanyName       string
+	CreatedAt         time.Time
+	Currency          string
+	DonorType         string
+	ID                uint
+	OrderNumber       string
+	PayMethod         string
+	RecTradeID        string
+	Status            string
+	TaxID             string
+	TransactionTime   null.Time
+	Type              string
+}
@@ -0,0 +1,67 @@
+package models
+
+import (
+	"time"
+
+	"gopkg.in/guregu/null.v3"
+)
+
+// MatchingRule is the pledge of a sponsor to match the paid donations made in [StartAt, EndAt) by the ratio,
+// until the matched amount reaches the budget.
+// The reconciliation report is mailed to the sponsor after the rule ends, and ReportedAt is when it is mailed.
+type MatchingRule struct {
+	// Budget is the maximum amount the sponsor matches in total, in the currency of the rule
+	Budget uint `gorm:"type:int(10) unsigned;not null" json:"budget"`
+	// Campaign is the slug of the campaign whose donations are matched, the donations of any campaign are matched if it is null
+	Campaign null.String `gorm:"type:varchar(50)" json:"campaign"`
+	// Consumed is the amount matched so far, it never exceeds Budget
+	Consumed  uint      `gorm:"type:int(10) unsigned;not null;default:0" json:"consumed"`
+	CreatedAt time.Time `json:"created_at"`
+	// Currency is the currency of the budget, only the donations in the currency are matched
+	Currency string `gorm:"type:char(3);default:'TWD';not null" json:"currency"`
+	// DonationTypes are the types of the donations to match, e.g. prime,token,others
+	DonationTypes string    `gorm:"type:SET('prime','token','others');not null" json:"donation_types"`
+	EndAt         time.Time `gorm:"not null;index:idx_matching_rules_end_at" json:"end_at"`
+	ID            uint      `gorm:"primary_key" json:"id"`
+	// Ratio is the amount matched for every dollar donated, e.g. 1 for one-to-one matching
+	Ratio        float64   `gorm:"type:decimal(5,2);not null" json:"ratio"`
+	ReportedAt   null.Time `json:"reported_at"`
+	Sponsor      string    `gorm:"type:varchar(100);not null" json:"sponsor"`
+	SponsorEmail string    `gorm:"type:varchar(100);not null" json:"sponsor_email"`
+	StartAt      time.Time `gorm:"not null" json:"start_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+// DonationMatch is the amount matched by a sponsor for a paid donation, a donation is matched by one rule at most.
+// The match is reduced in proportion to the refunds of the donation, and removed once the donation is fully refunded.
+// CreatedAt is when the donation is paid.
+type DonationMatch struct {
+	// Amount is the amount of the donation, excluding the refunded amount
+	Amount       uint      `gorm:"type:int(10) unsigned;not null" json:"amount"`
+	CreatedAt    time.Time `json:"created_at"`
+	Currency     string    `gorm:"type:char(3);default:'TWD';not null" json:"currency"`
+	DonationID   uint      `gorm:"type:int(10) unsigned;not null;unique_index:idx_donation_matches_donation_type_donation_id" json:"donation_id"`
+	DonationType string    `gorm:"type:ENUM('prime','token','others');not null;unique_index:idx_donation_matches_donation_type_donation_id" json:"donation_type"`
+	ID           uint      `gorm:"primary_key" json:"id"`
+	// MatchedAmount is the amount the sponsor gives for the donation
+	MatchedAmount uint   `gorm:"type:int(10) unsigned;not null" json:"matched_amount"`
+	OrderNumber   string `gorm:"type:varchar(50);not null" json:"order_number"`
+	RuleID        uint   `gorm:"type:int(10) unsigned;not null;index:idx_donation_matches_rule_id" json:"rule_id"`
+}
+
+// DonationMatchWithSponsor is the match along with the sponsor of its rule
+type DonationMatchWithSponsor struct {
+	DonationMatch
+	Sponsor string
+}
+
+// MatchableDonation is a paid donation to be matched by the active rules
+type MatchableDonation struct {
+	Amount       uint
+	Campaign     null.String
+	CreatedAt    time.Time
+	Currency     string
+	DonationType string
+	ID           uint
+	OrderNumber  string
+}
@@ -0,0 +1,99 @@
+package models
+
+import (
+	"time"
+
+	"gopkg.in/guregu/null.v3"
+)
+
+// types of the outbox events
+const (
+	EventDonationPaid   = "donation.paid"
+	EventDonationFailed = "donation.failed"
+	EventPledgeCreated  = "pledge.created"
+	EventPledgeStopped  = "pledge.stopped"
+	EventUserCreated    = "user.created"
+)
+
+// statuses of the webhook deliveries
+const (
+	WebhookDeliveryPending   = "pending"
+	WebhookDeliveryDelivered = "delivered"
+	WebhookDeliveryDead      = "dead"
+)
+
+// OutboxEvent is an event of donations or users, which is written in the same transaction as the change,
+// so that an event is never lost for a committed change nor sent for a rolled back one.
+// DispatchedAt is when the deliveries to the webhooks subscribing the event are created.
+type OutboxEvent struct {
+	CreatedAt    time.Time `gorm:"index:idx_outbox_events_created_at" json:"created_at"`
+	DispatchedAt null.Time `gorm:"index:idx_outbox_events_dispatched_at" json:"dispatched_at"`
+	ID           uint      `gorm:"primary_key" json:"id"`
+	// Payload is the JSON of the event data, e.g. DonationEventData
+	Payload string `gorm:"type:text;not null" json:"payload"`
+	Type    string `gorm:"type:varchar(30);not null" json:"type"`
+}
+
+// WebhookDelivery is the delivery of an outbox event to a webhook endpoint.
+// The pending delivery is attempted at NextAttemptAt, and it turns dead after the last attempt fails.
+type WebhookDelivery struct {
+	Attempts    uint      `gorm:"type:int unsigned;not null;default:0" json:"attempts"`
+	CreatedAt   time.Time `json:"created_at"`
+	DeliveredAt null.Time `json:"delivered_at"`
+	Endpoint    string    `gorm:"type:varchar(255);not null;unique_index:idx_webhook_deliveries_event_id_endpoint" json:"endpoint"`
+	EventID     uint      `gorm:"type:int(10) unsigned;not null;unique_index:idx_webhook_deliveries_event_id_endpoint" json:"event_id"`
+	ID          uint      `gorm:"primary_key" json:"id"`
+	// LastError is why the last attempt fails, e.g. the response status or the network error
+	LastError     null.String `gorm:"type:varchar(255)" json:"last_error"`
+	NextAttemptAt time.Time   `gorm:"not null;index:idx_webhook_deliveries_status_next_attempt_at" json:"next_attempt_at"`
+	Status        string      `gorm:"type:ENUM('pending','delivered','dead');not null;default:'pending';index:idx_webhook_deliveries_status_next_attempt_at" json:"status"`
+	UpdatedAt     time.Time   `json:"updated_at"`
+}
+
+// WebhookDeliveryWithEvent is the delivery along with the event to deliver
+type WebhookDeliveryWithEvent struct {
+	WebhookDelivery
+	EventCreatedAt time.Time
+	EventPayload   string
+	EventType      string
+}
+
+// DonationEventData is the payload of donation.paid and donation.failed events
+type DonationEventData struct {
+	Amount   uint        `json:"amount"`
+	Campaign null.String `json:"campaign"`
+	Currency string      `json:"currency"`
+	// DonationType is prime or token, the installments of periodic donations are token donations
+	DonationType string `json:"donation_type"`
+	Email        string `json:"email"`
+	ID           uint   `json:"id"`
+	// Msg is the message of the payment gateway, e.g. why the transaction fails
+	Msg         string `json:"msg"`
+	OrderNumber string `json:"order_number"`
+	PayMethod   string `json:"pay_method"`
+	PeriodicID  uint   `json:"periodic_id,omitempty"`
+	Status      string `json:"status"`
+	UserID      uint   `json:"user_id"`
+}
+
+// PledgeEventData is the payload of pledge.created and pledge.stopped events
+type PledgeEventData struct {
+	Amount      uint        `json:"amount"`
+	Campaign    null.String `json:"campaign"`
+	Currency    string      `json:"currency"`
+	Email       string      `json:"email"`
+	Frequency   string      `json:"frequency"`
+	ID          uint        `json:"id"`
+	OrderNumber string      `json:"order_number"`
+	// Status is stopped if the donor stops the pledge, or invalid if the pledge cannot be charged anymore
+	Status     string `json:"status"`
+	StopReason string `json:"stop_reason"`
+	UserID     uint   `json:"user_id"`
+}
+
+// UserEventData is the payload of user.created events
+type UserEventData struct {
+	Email            null.String `json:"email"`
+	ID               uint        `json:"id"`
+	RegistrationDate null.Time   `json:"registration_date"`
+}
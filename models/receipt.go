@@ -0,0 +1,94 @@
+package models
+
+import (
+	"time"
+
+	"gopkg.in/guregu/null.v3"
+)
+
+// Receipt is the tax-deductible receipt of the donations paid by a donor in a month or a year.
+// The donations on a receipt share the name, the national ID, the organization and the currency on the donations.
+// The receipts of the donations made by organizations are issued to the company names and the tax IDs.
+type Receipt struct {
+	Address     string     `gorm:"type:varchar(100)" json:"address"`
+	Amount      uint       `gorm:"type:int(10) unsigned;not null" json:"amount"`
+	CompanyName string     `gorm:"type:varchar(100)" json:"company_name"`
+	CreatedAt   time.Time  `json:"created_at"`
+	Currency    string     `gorm:"type:varchar(3);default:'TWD';not null" json:"currency"`
+	DeletedAt   *time.Time `json:"deleted_at"`
+	Email       string     `gorm:"type:varchar(100);not null" json:"email"`
+	ID          uint       `gorm:"primary_key" json:"id"`
+	MailedAt    null.Time  `json:"mailed_at"`
+	Name        string     `gorm:"type:varchar(30)" json:"name"`
+	NationalID  string     `gorm:"type:varchar(20)" json:"national_id"`
+	// PDF is rendered once the receipt number is assigned, and it is empty until then
+	PDF []byte `gorm:"type:mediumblob" json:"-"`
+	// PeriodStart is inclusive and PeriodEnd is exclusive
+	PeriodEnd     time.Time `gorm:"not null" json:"period_end"`
+	PeriodStart   time.Time `gorm:"not null;index:idx_receipts_period_start" json:"period_start"`
+	PeriodType    string    `gorm:"type:ENUM('monthly','yearly');not null" json:"period_type"`
+	ReceiptNumber string    `gorm:"type:varchar(20);not null;unique_index:idx_receipts_receipt_number" json:"receipt_number"`
+	// SendReceipt is copied from the donations, the receipt is mailed unless it is 'no'
+	SendReceipt string `gorm:"type:ENUM('no','monthly','yearly');not null" json:"send_receipt"`
+	// TaxID is the unified business number(統一編號) of the organization, it is empty for individuals
+	TaxID     string    `gorm:"type:char(8)" json:"tax_id"`
+	UpdatedAt time.Time `json:"updated_at"`
+	UserID    uint      `gorm:"type:int(10) unsigned;not null;index:idx_receipts_user_id" json:"user_id"`
+}
+
+// IsOrganization reports whether the receipt is issued to an organization
+func (mr Receipt) IsOrganization() bool {
+	return mr.TaxID != ""
+}
+
+// ReceiptItem is a donation on a receipt. A donation could be on one receipt only.
+type ReceiptItem struct {
+	Amount       uint      `gorm:"type:int(10) unsigned;not null" json:"amount"`
+	CreatedAt    time.Time `json:"created_at"`
+	DonationID   uint      `gorm:"type:int(10) unsigned;not null;unique_index:idx_receipt_items_donation" json:"donation_id"`
+	DonationType string    `gorm:"type:ENUM('prime','token','others');not null;unique_index:idx_receipt_items_donation" json:"donation_type"`
+	ID           uint      `gorm:"primary_key" json:"id"`
+	OrderNumber  string    `gorm:"type:varchar(50);not null" json:"order_number"`
+	PaidAt       time.Time `gorm:"not null" json:"paid_at"`
+	ReceiptID    uint      `gorm:"type:int(10) unsigned;not null;index:idx_receipt_items_receipt_id" json:"receipt_id"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+// ReceiptSerial keeps the last serial number of the receipts issued in a year,
+// so that receipt numbers are sequential without gaps.
+type ReceiptSerial struct {
+	LastSerial uint `gorm:"type:int(10) unsigned;not null" json:"last_serial"`
+	Year       uint `gorm:"primary_key;auto_increment:false" json:"year"`
+}
+
+// ReceiptableDonation is a paid donation which is not on any receipt yet,
+// along with the donor information printed on the receipt
+type ReceiptableDonation struct {
+	Address string
+	// Amount excludes the refunded amount of the donation refunded partially
+	Amount       uint
+	CompanyName  string
+	Currency     string
+	DonationID   uint
+	DonationType string
+	Email        string
+	Name         string
+	NationalID   string
+	OrderNumber  string
+	PaidAt       time.Time
+	SendReceipt  string
+	TaxID        string
+	UserID       uint
+}
+
+// ReceiptRefund is a refund of the donation on a receipt, which is completed after the receipt is issued
+type ReceiptRefund struct {
+	Amount        uint
+	Currency      string
+	DonationID    uint
+	DonationType  string
+	OrderNumber   string
+	ReceiptNumber string
+	RefundedAt    time.Time
+	UserID        uint
+}
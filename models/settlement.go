@@ -0,0 +1,75 @@
+package models
+
+import (
+	"time"
+
+	"gopkg.in/guregu/null.v3"
+)
+
+// transaction types of the lines in the settlement files
+const (
+	SettlementPayment    = "payment"
+	SettlementRefund     = "refund"
+	SettlementChargeback = "chargeback"
+)
+
+// results of reconciling the settlement files against the donations
+const (
+	// ReconciliationMatched means the line is settled as the donation is recorded
+	ReconciliationMatched = "matched"
+	// ReconciliationMissingDonation means the line is settled by the bank, but no donation is recorded for it
+	ReconciliationMissingDonation = "missing_donation"
+	// ReconciliationMissingSettlement means the donation is paid on the settlement date, but the bank does not settle it
+	ReconciliationMissingSettlement = "missing_settlement"
+	// ReconciliationAmountMismatch means the settled amount or currency differs from the donation
+	ReconciliationAmountMismatch = "amount_mismatch"
+	// ReconciliationStatusMismatch means the line is settled while the donation is not paid, or refunded while the donation is not refunded
+	ReconciliationStatusMismatch = "status_mismatch"
+	// ReconciliationChargeback means the cardholder disputes the transaction, and the bank takes the money back
+	ReconciliationChargeback = "chargeback"
+)
+
+// SettlementReconciliation is the result of reconciling a line of the settlement file, or a donation missing in the file.
+// The results of a settlement date are replaced as a whole when the file of the date is imported again.
+type SettlementReconciliation struct {
+	BankTransactionID null.String `gorm:"type:varchar(50)" json:"bank_transaction_id"`
+	CreatedAt         time.Time   `json:"created_at"`
+	// Currency is the settled currency, or the currency of the donation missing in the file
+	Currency       string   `gorm:"type:char(3);not null" json:"currency"`
+	DonationAmount null.Int `gorm:"type:int(10) unsigned" json:"donation_amount"`
+	DonationID     null.Int `gorm:"type:int(10) unsigned" json:"donation_id"`
+	// DonationType is prime or token, it is null if the donation is missing
+	DonationType null.String `gorm:"type:ENUM('prime','token')" json:"donation_type"`
+	ID           uint        `gorm:"primary_key" json:"id"`
+	// ImportedBy is the staff who imports the settlement file
+	ImportedBy null.Int `gorm:"type:int(10) unsigned" json:"imported_by"`
+	// Line is the line number in the settlement file, it is null if the line is missing
+	Line          null.Int    `gorm:"type:int unsigned" json:"line"`
+	OrderNumber   null.String `gorm:"type:varchar(50)" json:"order_number"`
+	RecTradeID    null.String `gorm:"type:varchar(20)" json:"rec_trade_id"`
+	Result        string      `gorm:"type:ENUM('matched','missing_donation','missing_settlement','amount_mismatch','status_mismatch','chargeback');not null;index:idx_settlement_reconciliations_result" json:"result"`
+	SettledAmount null.Int    `gorm:"type:int" json:"settled_amount"`
+	// SettlementDate is the date of the settlement file in YYYY-MM-DD format
+	SettlementDate string `gorm:"type:char(10);not null;index:idx_settlement_reconciliations_settlement_date" json:"settlement_date"`
+	// TransactionType is payment, refund or chargeback, it is null if the line is missing
+	TransactionType null.String `gorm:"type:ENUM('payment','refund','chargeback')" json:"transaction_type"`
+}
+
+// SettlementDonation is a prime or card token donation charged through TapPay, which is reconciled against the settlement files
+type SettlementDonation struct {
+	Amount            uint
+	BankTransactionID string
+	Currency          string
+	ID                uint
+	OrderNumber       string
+	RecTradeID        string
+	Status            string
+	// Type is prime or token
+	Type string
+}
+
+// SettlementResultCount is the number of the reconciliation results of a settlement date by the result
+type SettlementResultCount struct {
+	Count  int    `json:"count"`
+	Result string `json:"result"`
+}
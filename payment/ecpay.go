@@ -0,0 +1,610 @@
+package payment
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"gopkg.in/guregu/null.v3"
+
+	"twreporter.org/go-api/configs"
+	"twreporter.org/go-api/models"
+)
+
+// ECPayName is the name of ECPay recorded on donations
+const ECPayName = "ecpay"
+
+const (
+	ecpayCurrency         = "TWD"
+	ecpayDateTimeLayout   = "2006/01/02 15:04:05"
+	ecpayMaxTradeNoLength = 20
+	ecpayRefundAction     = "R"
+	ecpayTimezone         = "Asia/Taipei"
+
+	// ecpayTransCodeSuccess is the code of the requests which are decrypted and verified by ECPay
+	ecpayTransCodeSuccess = 1
+	// ecpayRtnCodeSuccess is the code of the transactions which are made successfully on ECPay
+	ecpayRtnCodeSuccess = 1
+	// ecpayStatusInvalidReq is the status of the requests which are not accepted by ECPay
+	ecpayStatusInvalidReq = -1
+
+	ecpayTradeStatusUnpaid = "0"
+	ecpayTradeStatusPaid   = "1"
+
+	// ecpayCreditCardPaymentList and ecpayCreditCardPaymentUIType show the credit card form of one-time payments on the SDK
+	ecpayCreditCardPaymentList   = "1"
+	ecpayCreditCardPaymentUIType = 2
+)
+
+type (
+	ecpayRqHeader struct {
+		Timestamp int64 `json:"Timestamp"`
+	}
+
+	ecpayReq struct {
+		Data       string        `json:"Data"`
+		MerchantID string        `json:"MerchantID"`
+		RqHeader   ecpayRqHeader `json:"RqHeader"`
+	}
+
+	ecpayResp struct {
+		Data       string `json:"Data"`
+		MerchantID string `json:"MerchantID"`
+		TransCode  int64  `json:"TransCode"`
+		TransMsg   string `json:"TransMsg"`
+	}
+
+	ecpayOrderInfo struct {
+		ItemName          string `json:"ItemName,omitempty"`
+		MerchantTradeDate string `json:"MerchantTradeDate,omitempty"`
+		MerchantTradeNo   string `json:"MerchantTradeNo"`
+		PaymentDate       string `json:"PaymentDate,omitempty"`
+		ReturnURL         string `json:"ReturnURL,omitempty"`
+		TotalAmount       uint   `json:"TotalAmount,omitempty"`
+		TradeAmt          uint   `json:"TradeAmt,omitempty"`
+		TradeDesc         string `json:"TradeDesc,omitempty"`
+		TradeNo           string `json:"TradeNo,omitempty"`
+		TradeStatus       string `json:"TradeStatus,omitempty"`
+	}
+
+	ecpayCardInfo struct {
+		AuthCode    string `json:"AuthCode"`
+		Card4No     string `json:"Card4No"`
+		Card6No     string `json:"Card6No"`
+		CardValidMM string `json:"CardValidMM"`
+		CardValidYY string `json:"CardValidYY"`
+		Gwsr        int64  `json:"Gwsr"`
+		IssuingBank string `json:"IssuingBank"`
+	}
+
+	ecpayConsumerInfo struct {
+		Email            string `json:"Email,omitempty"`
+		MerchantMemberID string `json:"MerchantMemberID"`
+	}
+
+	ecpayThreeDInfo struct {
+		ThreeDURL string `json:"ThreeDURL"`
+	}
+
+	ecpayTradeCardInfo struct {
+		OrderResultURL string `json:"OrderResultURL,omitempty"`
+	}
+
+	ecpayTokenByTradeReqData struct {
+		CardInfo          ecpayTradeCardInfo `json:"CardInfo"`
+		ChoosePaymentList string             `json:"ChoosePaymentList"`
+		ConsumerInfo      ecpayConsumerInfo  `json:"ConsumerInfo"`
+		MerchantID        string             `json:"MerchantID"`
+		OrderInfo         ecpayOrderInfo     `json:"OrderInfo"`
+		PaymentUIType     int                `json:"PaymentUIType"`
+		RememberCard      int                `json:"RememberCard"`
+	}
+
+	ecpayPaymentReqData struct {
+		MerchantID      string `json:"MerchantID"`
+		MerchantTradeNo string `json:"MerchantTradeNo"`
+		PayToken        string `json:"PayToken"`
+	}
+
+	ecpayCardIDPaymentReqData struct {
+		BindCardID   string            `json:"BindCardID"`
+		ConsumerInfo ecpayConsumerInfo `json:"ConsumerInfo"`
+		MerchantID   string            `json:"MerchantID"`
+		OrderInfo    ecpayOrderInfo    `json:"OrderInfo"`
+	}
+
+	ecpayBindCardReqData struct {
+		BindCardPayToken string `json:"BindCardPayToken"`
+		MerchantID       string `json:"MerchantID"`
+		MerchantMemberID string `json:"MerchantMemberID"`
+	}
+
+	ecpayRefundReqData struct {
+		Action          string `json:"Action"`
+		MerchantID      string `json:"MerchantID"`
+		MerchantTradeNo string `json:"MerchantTradeNo"`
+		TotalAmount     uint   `json:"TotalAmount"`
+		TradeNo         string `json:"TradeNo"`
+	}
+
+	ecpayQueryTradeReqData struct {
+		MerchantID      string `json:"MerchantID"`
+		MerchantTradeNo string `json:"MerchantTradeNo"`
+	}
+
+	ecpayRespData struct {
+		BindCardID string          `json:"BindCardID"`
+		CardInfo   ecpayCardInfo   `json:"CardInfo"`
+		OrderInfo  ecpayOrderInfo  `json:"OrderInfo"`
+		RtnCode    int64           `json:"RtnCode"`
+		RtnMsg     string          `json:"RtnMsg"`
+		ThreeDInfo ecpayThreeDInfo `json:"ThreeDInfo"`
+		Token      string          `json:"Token"`
+		TradeNo    string          `json:"TradeNo"`
+	}
+)
+
+// ECPay makes credit card payments through ECPay In-site Payment 2.0 (站內付2.0).
+// The trade is created with the amount by CreateTrade, and its token is given to ECPay SDK.
+// The prime of requests is the PayToken (or BindCardPayToken for binding cards) which the client gets from ECPay SDK by the token,
+// and the card secret consists of the member ID and the bind card ID on ECPay.
+// ECPay charges with the merchant ID of the config, the merchant IDs of requests are ignored.
+type ECPay struct {
+	conf configs.DonationConfig
+}
+
+// NewECPay returns an ECPay gateway with the ECPay urls and keys of the config
+func NewECPay(conf configs.DonationConfig) *ECPay {
+	return &ECPay{conf: conf}
+}
+
+// Name is the method of PaymentGateway interface
+func (ep *ECPay) Name() string {
+	return ECPayName
+}
+
+// PayMethods is the method of PaymentGateway interface
+func (ep *ECPay) PayMethods() []string {
+	return []string{PayMethodCreditCard}
+}
+
+// CreateTrade is the method of TradeCreator interface.
+// The trade number is derived from the order number, so the donation of the order number pays the trade.
+func (ep *ECPay) CreateTrade(req TradeReq) (string, error) {
+	var data ecpayRespData
+	var rememberCard int
+
+	if req.Currency != ecpayCurrency {
+		return "", fmt.Errorf("currency %s is not supported by ecpay", req.Currency)
+	}
+
+	if req.Remember {
+		rememberCard = 1
+	}
+
+	if _, err := ep.request(ep.conf.ECPayURL+"/Merchant/GetTokenbyTrade", ecpayTokenByTradeReqData{
+		CardInfo:          ecpayTradeCardInfo{OrderResultURL: ep.conf.ECPayReturnURL},
+		ChoosePaymentList: ecpayCreditCardPaymentList,
+		ConsumerInfo: ecpayConsumerInfo{
+			Email:            req.Email,
+			MerchantMemberID: ecpayMemberID(req.UserID),
+		},
+		MerchantID: ep.conf.ECPayMerchantID,
+		OrderInfo: ecpayOrderInfo{
+			ItemName:          req.Details,
+			MerchantTradeDate: time.Now().In(ecpayLocation()).Format(ecpayDateTimeLayout),
+			MerchantTradeNo:   ecpayTradeNo(req.OrderNumber),
+			ReturnURL:         ep.conf.ECPayReturnURL,
+			TotalAmount:       req.Amount,
+			TradeDesc:         req.Details,
+		},
+		PaymentUIType: ecpayCreditCardPaymentUIType,
+		RememberCard:  rememberCard,
+	}, &data); nil != err {
+		return "", err
+	}
+
+	if ecpayRtnCodeSuccess != data.RtnCode || data.Token == "" {
+		log.Error("ecpay msg: " + data.RtnMsg)
+		return "", errors.New("Cannot create the trade on ecpay")
+	}
+
+	return data.Token, nil
+}
+
+// PayByPrime is the method of PaymentGateway interface.
+// The trade of the order number should be created by CreateTrade with the amount of the request.
+func (ep *ECPay) PayByPrime(req PrimeReq) (Transaction, error) {
+	var data ecpayRespData
+
+	if req.Currency != ecpayCurrency {
+		return Transaction{Status: ecpayStatusInvalidReq}, fmt.Errorf("currency %s is not supported by ecpay", req.Currency)
+	}
+
+	if status, err := ep.request(ep.conf.ECPayURL+"/Merchant/CreatePayment", ecpayPaymentReqData{
+		MerchantID:      ep.conf.ECPayMerchantID,
+		MerchantTradeNo: ecpayTradeNo(req.OrderNumber),
+		PayToken:        req.Prime,
+	}, &data); nil != err {
+		return Transaction{Status: status}, err
+	}
+
+	t := data.toTransaction()
+
+	if StatusSuccess != t.Status {
+		log.Error("ecpay msg: " + data.RtnMsg)
+		return t, errors.New("Cannot make success transaction on ecpay")
+	}
+
+	// The amount is decided by the trade, which could differ from the donation if the trade is created for another amount.
+	// The card is charged already, so the result is left unknown for staffs to refund it rather than recorded as paid.
+	// The amount of the transaction authenticated by 3-D Secure is checked when it is resolved by the trade record.
+	if t.PaymentURL == "" && data.OrderInfo.TradeAmt != req.Amount {
+		log.Errorf("ecpay charges %d for the transaction(order_number: %s, amount: %d)", data.OrderInfo.TradeAmt, req.OrderNumber, req.Amount)
+		return Transaction{Status: StatusSuccess}, fmt.Errorf("amount of the ecpay trade(%d) does not match the request(%d)", data.OrderInfo.TradeAmt, req.Amount)
+	}
+
+	if req.Remember {
+		if data.BindCardID == "" {
+			log.Warnf("ecpay does not bind the card of the transaction(order_number: %s)", req.OrderNumber)
+		}
+
+		t.CardSecret = CardSecret{
+			Key:   ecpayMemberID(req.UserID),
+			Token: data.BindCardID,
+		}
+	}
+
+	return t, nil
+}
+
+// PayByToken is the method of PaymentGateway interface
+func (ep *ECPay) PayByToken(req TokenReq) (Transaction, error) {
+	var data ecpayRespData
+
+	if req.Currency != ecpayCurrency {
+		return Transaction{Status: ecpayStatusInvalidReq}, fmt.Errorf("currency %s is not supported by ecpay", req.Currency)
+	}
+
+	if status, err := ep.request(ep.conf.ECPayURL+"/Merchant/CreatePaymentWithCardID", ecpayCardIDPaymentReqData{
+		BindCardID:   req.CardSecret.Token,
+		ConsumerInfo: ecpayConsumerInfo{MerchantMemberID: req.CardSecret.Key},
+		MerchantID:   ep.conf.ECPayMerchantID,
+		OrderInfo: ecpayOrderInfo{
+			ItemName:          req.Details,
+			MerchantTradeDate: time.Now().In(ecpayLocation()).Format(ecpayDateTimeLayout),
+			MerchantTradeNo:   ecpayTradeNo(req.OrderNumber),
+			ReturnURL:         ep.conf.ECPayReturnURL,
+			TotalAmount:       req.Amount,
+			TradeDesc:         req.Details,
+		},
+	}, &data); nil != err {
+		return Transaction{Status: status}, err
+	}
+
+	t := data.toTransaction()
+
+	if StatusSuccess != t.Status {
+		log.Error("ecpay msg: " + data.RtnMsg)
+		return t, errors.New("Cannot make success transaction on ecpay")
+	}
+
+	return t, nil
+}
+
+// BindCard is the method of PaymentGateway interface
+func (ep *ECPay) BindCard(req BindCardReq) (Card, error) {
+	var data ecpayRespData
+
+	memberID := ecpayMemberID(req.UserID)
+
+	if status, err := ep.request(ep.conf.ECPayURL+"/Merchant/CreateBindCard", ecpayBindCardReqData{
+		BindCardPayToken: req.Prime,
+		MerchantID:       ep.conf.ECPayMerchantID,
+		MerchantMemberID: memberID,
+	}, &data); nil != err {
+		return Card{Status: status}, err
+	}
+
+	card := Card{
+		CardInfo: data.CardInfo.toCardInfo(),
+		CardSecret: CardSecret{
+			Key:   memberID,
+			Token: data.BindCardID,
+		},
+		Msg:    data.RtnMsg,
+		Status: ecpayStatus(data.RtnCode),
+	}
+
+	if StatusSuccess != card.Status {
+		log.Error("ecpay msg: " + data.RtnMsg)
+		return card, errors.New("Cannot bind the card on ecpay")
+	}
+
+	return card, nil
+}
+
+// Refund is the method of PaymentGateway interface
+func (ep *ECPay) Refund(req RefundReq) (Refund, error) {
+	var data ecpayRespData
+
+	if status, err := ep.request(ep.conf.ECPayDoActionURL, ecpayRefundReqData{
+		Action:          ecpayRefundAction,
+		MerchantID:      ep.conf.ECPayMerchantID,
+		MerchantTradeNo: ecpayTradeNo(req.OrderNumber),
+		TotalAmount:     req.Amount,
+		TradeNo:         req.RecTradeID,
+	}, &data); nil != err {
+		return Refund{Status: status}, err
+	}
+
+	refund := Refund{
+		Msg:    data.RtnMsg,
+		Status: ecpayStatus(data.RtnCode),
+	}
+
+	if StatusSuccess != refund.Status {
+		log.Error("ecpay msg: " + data.RtnMsg)
+		return refund, errors.New("Cannot make success refund on ecpay")
+	}
+
+	return refund, nil
+}
+
+// QueryRecord is the method of PaymentGateway interface.
+// ECPay looks up trade records by the order numbers only.
+func (ep *ECPay) QueryRecord(filters RecordFilters) (Record, error) {
+	var data ecpayRespData
+
+	if filters.OrderNumber == "" {
+		return Record{}, errors.New("ecpay looks up trade records by order numbers")
+	}
+
+	if _, err := ep.request(ep.conf.ECPayURL+"/Merchant/QueryTrade", ecpayQueryTradeReqData{
+		MerchantID:      ep.conf.ECPayMerchantID,
+		MerchantTradeNo: ecpayTradeNo(filters.OrderNumber),
+	}, &data); nil != err {
+		return Record{}, err
+	}
+
+	if ecpayRtnCodeSuccess != data.RtnCode {
+		log.Error("ecpay msg: " + data.RtnMsg)
+		return Record{}, errors.New("Cannot query the trade record on ecpay")
+	}
+
+	if filters.RecTradeID != "" && data.OrderInfo.TradeNo != filters.RecTradeID {
+		return Record{}, errors.New("Cannot find the trade record on ecpay")
+	}
+
+	t := data.toTransaction()
+
+	r := Record{
+		TappayResp:  t.TappayResp,
+		Amount:      data.OrderInfo.TradeAmt,
+		CardInfo:    t.CardInfo,
+		Currency:    ecpayCurrency,
+		OrderNumber: filters.OrderNumber,
+	}
+
+	switch data.OrderInfo.TradeStatus {
+	case ecpayTradeStatusPaid:
+		r.State = RecordStatePaid
+	case ecpayTradeStatusUnpaid:
+		r.State = RecordStatePending
+	default:
+		r.State = RecordStateFailed
+	}
+
+	return r, nil
+}
+
+// request encrypts reqData into the request of ECPay API of url, and decrypts the data of the response into respData.
+// The RtnCode of the data is left to callers.
+// The status is ecpayStatusInvalidReq if ECPay does not accept the request, otherwise the result is unknown if an error is returned.
+func (ep *ECPay) request(url string, reqData interface{}, respData interface{}) (int64, error) {
+	var resp ecpayResp
+
+	data, err := ep.encrypt(reqData)
+	if nil != err {
+		log.Error(err.Error())
+		return ecpayStatusInvalidReq, errors.New("Cannot encrypt the request to ecpay")
+	}
+
+	reqBodyJson, _ := json.Marshal(ecpayReq{
+		Data:       data,
+		MerchantID: ep.conf.ECPayMerchantID,
+		RqHeader:   ecpayRqHeader{Timestamp: time.Now().Unix()},
+	})
+
+	client := &http.Client{Timeout: defaultRequestTimeout}
+
+	req, _ := http.NewRequest("POST", url, bytes.NewBuffer(reqBodyJson))
+	req.Header.Add("Content-Type", "application/json")
+
+	rawResp, err := client.Do(req)
+	if nil != err {
+		log.Error(err.Error())
+		return StatusSuccess, errors.New("cannot request to ecpay server")
+	}
+	defer rawResp.Body.Close()
+
+	body, err := ioutil.ReadAll(rawResp.Body)
+	if nil != err {
+		log.Error(err.Error())
+		return StatusSuccess, errors.New("Cannot read response from ecpay server")
+	}
+
+	if err = json.Unmarshal(body, &resp); nil != err {
+		log.Error(err.Error())
+		return StatusSuccess, errors.New("Cannot unmarshal json response from ecpay server")
+	}
+
+	if ecpayTransCodeSuccess != resp.TransCode {
+		log.Error("ecpay msg: " + resp.TransMsg)
+		return ecpayStatusInvalidReq, fmt.Errorf("ecpay does not accept the request. %s", resp.TransMsg)
+	}
+
+	if err = ep.decrypt(resp.Data, respData); nil != err {
+		log.Error(err.Error())
+		return StatusSuccess, errors.New("Cannot decrypt the response from ecpay server")
+	}
+
+	return StatusSuccess, nil
+}
+
+// encrypt url-encodes the JSON of v and encrypts it by AES-128-CBC with the hash key and IV of ECPay
+func (ep *ECPay) encrypt(v interface{}) (string, error) {
+	plaintext, err := json.Marshal(v)
+	if nil != err {
+		return "", err
+	}
+
+	block, err := aes.NewCipher([]byte(ep.conf.ECPayHashKey))
+	if nil != err {
+		return "", err
+	}
+
+	data := pkcs7Pad([]byte(url.QueryEscape(string(plaintext))), block.BlockSize())
+	ciphertext := make([]byte, len(data))
+	cipher.NewCBCEncrypter(block, []byte(ep.conf.ECPayHashIV)).CryptBlocks(ciphertext, data)
+
+	return base64.StdEncoding.EncodeToString(ciphertext), nil
+}
+
+// decrypt is the reverse of encrypt, the JSON is parsed into v
+func (ep *ECPay) decrypt(data string, v interface{}) error {
+	ciphertext, err := base64.StdEncoding.DecodeString(data)
+	if nil != err {
+		return err
+	}
+
+	block, err := aes.NewCipher([]byte(ep.conf.ECPayHashKey))
+	if nil != err {
+		return err
+	}
+
+	if len(ciphertext) == 0 || len(ciphertext)%block.BlockSize() != 0 {
+		return errors.New("ciphertext is not a multiple of the block size")
+	}
+
+	plaintext := make([]byte, len(ciphertext))
+	cipher.NewCBCDecrypter(block, []byte(ep.conf.ECPayHashIV)).CryptBlocks(plaintext, ciphertext)
+
+	if plaintext, err = pkcs7Unpad(plaintext, block.BlockSize()); nil != err {
+		return err
+	}
+
+	unescaped, err := url.QueryUnescape(string(plaintext))
+	if nil != err {
+		return err
+	}
+
+	return json.Unmarshal([]byte(unescaped), v)
+}
+
+func (data ecpayRespData) toTransaction() Transaction {
+	t := Transaction{
+		CardInfo:   data.CardInfo.toCardInfo(),
+		PaymentURL: data.ThreeDInfo.ThreeDURL,
+		Status:     ecpayStatus(data.RtnCode),
+	}
+
+	t.AuthCode = data.CardInfo.AuthCode
+	t.Msg = data.RtnMsg
+	t.RecTradeID = data.OrderInfo.TradeNo
+
+	if data.CardInfo.Gwsr != 0 {
+		t.BankTransactionID = strconv.FormatInt(data.CardInfo.Gwsr, 10)
+	}
+
+	if pt, err := time.ParseInLocation(ecpayDateTimeLayout, data.OrderInfo.PaymentDate, ecpayLocation()); nil == err {
+		t.TransactionTime = null.TimeFrom(pt)
+	}
+
+	return t
+}
+
+func (c ecpayCardInfo) toCardInfo() models.CardInfo {
+	m := models.CardInfo{}
+
+	if c.Card6No != "" {
+		m.BinCode = null.StringFrom(c.Card6No)
+	}
+
+	if c.Card4No != "" {
+		m.LastFour = null.StringFrom(c.Card4No)
+	}
+
+	if c.IssuingBank != "" {
+		m.Issuer = null.StringFrom(c.IssuingBank)
+	}
+
+	// keep the expiry date in YYYYMM as TapPay does
+	if c.CardValidYY != "" && c.CardValidMM != "" {
+		m.ExpiryDate = null.StringFrom(fmt.Sprintf("20%s%s", c.CardValidYY, c.CardValidMM))
+	}
+
+	return m
+}
+
+// ecpayStatus maps the RtnCode of ECPay onto the status of results
+func ecpayStatus(rtnCode int64) int64 {
+	if ecpayRtnCodeSuccess == rtnCode {
+		return StatusSuccess
+	}
+	return rtnCode
+}
+
+// ecpayTradeNo returns the merchant trade number of the order number.
+// ECPay limits merchant trade numbers to 20 alphanumerics,
+// the last 20 alphanumerics of order numbers are unique since they end with the timestamps in nanoseconds.
+func ecpayTradeNo(orderNumber string) string {
+	alphanumerics := strings.Map(func(r rune) rune {
+		if (r >= '0' && r <= '9') || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') {
+			return r
+		}
+		return -1
+	}, orderNumber)
+
+	if len(alphanumerics) > ecpayMaxTradeNoLength {
+		return alphanumerics[len(alphanumerics)-ecpayMaxTradeNoLength:]
+	}
+	return alphanumerics
+}
+
+// ecpayMemberID returns the member ID on ECPay which the cards of the user are bound to
+func ecpayMemberID(userID uint) string {
+	return fmt.Sprintf("twreporter%d", userID)
+}
+
+func ecpayLocation() *time.Location {
+	loc, err := time.LoadLocation(ecpayTimezone)
+	if nil != err {
+		return time.Local
+	}
+	return loc
+}
+
+func pkcs7Pad(data []byte, blockSize int) []byte {
+	padding := blockSize - len(data)%blockSize
+	return append(data, bytes.Repeat([]byte{byte(padding)}, padding)...)
+}
+
+func pkcs7Unpad(data []byte, blockSize int) ([]byte, error) {
+	padding := int(data[len(data)-1])
+	if padding == 0 || padding > blockSize || padding > len(data) {
+		return nil, errors.New("invalid padding")
+	}
+	return data[:len(data)-padding], nil
+}
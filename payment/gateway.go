@@ -0,0 +1,149 @@
+package payment
+
+import (
+	"twreporter.org/go-api/models"
+)
+
+// StatusSuccess is the status of the requests which are made successfully on payment gateways
+const StatusSuccess = 0
+
+// states of trade records, regardless of the payment gateways
+const (
+	RecordStatePaid    = "paid"
+	RecordStateFailed  = "failed"
+	RecordStatePending = "pending"
+)
+
+type (
+	// CardSecret is issued by payment gateways to charge the remembered card later without donors
+	CardSecret struct {
+		Key   string
+		Token string
+	}
+
+	// PrimeReq charges a donor by the prime which the client gets from the SDK of the payment gateway
+	PrimeReq struct {
+		Amount      uint
+		Cardholder  models.Cardholder
+		Currency    string
+		Details     string
+		MerchantID  string
+		OrderNumber string
+		PayMethod   string
+		Prime       string
+		// Remember asks the payment gateway to issue the card secret for the later installments
+		Remember bool
+		// ThreeDomainSecure asks the card issuer to authenticate the donor by 3-D Secure on the payment url
+		ThreeDomainSecure bool
+		// FrontendRedirectURL and BackendNotifyURL are used by the payments which donors confirm on the payment url, such as LINE Pay and 3-D Secure
+		FrontendRedirectURL string
+		BackendNotifyURL    string
+		UserID              uint
+	}
+
+	// TradeReq creates the trade which the donor pays by the prime later, the amount of the trade is decided by the server
+	TradeReq struct {
+		Amount      uint
+		Currency    string
+		Details     string
+		Email       string
+		OrderNumber string
+		// Remember asks the payment gateway to issue the card secret for the later installments
+		Remember bool
+		UserID   uint
+	}
+
+	// TokenReq charges a remembered card by the card secret
+	TokenReq struct {
+		Amount      uint
+		CardSecret  CardSecret
+		Currency    string
+		Details     string
+		MerchantID  string
+		OrderNumber string
+	}
+
+	// BindCardReq remembers a card by the prime without charging
+	BindCardReq struct {
+		Cardholder models.Cardholder
+		Currency   string
+		MerchantID string
+		Prime      string
+		UserID     uint
+	}
+
+	// RefundReq refunds the amount of a transaction, the rest of the transaction amount is refunded if the amount is zero
+	RefundReq struct {
+		Amount      uint
+		OrderNumber string
+		RecTradeID  string
+	}
+
+	// RecordFilters looks up a trade record by the order number and/or the trade ID of the payment gateway
+	RecordFilters struct {
+		OrderNumber string
+		RecTradeID  string
+	}
+
+	// Transaction is the result of charging by a prime or a card secret
+	Transaction struct {
+		models.TappayResp
+		CardInfo   models.CardInfo
+		CardSecret CardSecret
+		// PaymentURL is where donors confirm the payment, the result is unknown until the payment gateway notifies
+		PaymentURL string
+		Status     int64
+	}
+
+	// Card is the result of binding a card
+	Card struct {
+		CardInfo   models.CardInfo
+		CardSecret CardSecret
+		Msg        string
+		Status     int64
+	}
+
+	// Refund is the result of a refund
+	Refund struct {
+		Msg      string
+		RefundID string
+		Status   int64
+	}
+
+	// Record is the trade record kept by the payment gateway
+	Record struct {
+		models.TappayResp
+		Amount         uint
+		CardInfo       models.CardInfo
+		Currency       string
+		OrderNumber    string
+		RefundedAmount uint
+		// RefundReported tells whether RefundedAmount is reported by the payment gateway
+		RefundReported bool
+		// State is one of RecordStatePaid, RecordStateFailed and RecordStatePending
+		State string
+	}
+
+	// PaymentGateway defines the payment processors donations are made through.
+	//
+	// The methods return an error if the request is not made successfully.
+	// The status of the result tells why the payment gateway rejects the request,
+	// and the result is unknown if the status is still StatusSuccess, e.g. the payment gateway is not reachable.
+	PaymentGateway interface {
+		// Name is recorded on donations to make the later requests of the donations through the same payment gateway
+		Name() string
+		// PayMethods are the pay methods supported by the payment gateway
+		PayMethods() []string
+		PayByPrime(req PrimeReq) (Transaction, error)
+		PayByToken(req TokenReq) (Transaction, error)
+		BindCard(req BindCardReq) (Card, error)
+		Refund(req RefundReq) (Refund, error)
+		QueryRecord(filters RecordFilters) (Record, error)
+	}
+
+	// TradeCreator is implemented by the payment gateways whose trades are created by the server before donors pay, such as ECPay.
+	// The token of the trade is given to the SDK of the payment gateway, which returns the prime to pay the trade of the order number.
+	TradeCreator interface {
+		CreateTrade(req TradeReq) (string, error)
+	}
+)
@@ -0,0 +1,88 @@
+package payment
+
+import (
+	"fmt"
+
+	"twreporter.org/go-api/configs"
+	"twreporter.org/go-api/utils"
+)
+
+// pay methods which could be selected for payment gateways
+const (
+	PayMethodCreditCard = "credit_card"
+	PayMethodLine       = "line"
+	PayMethodGoogle     = "google"
+	PayMethodApple      = "apple"
+	PayMethodSamsung    = "samsung"
+)
+
+// Gateways keeps the payment gateways by names, and selects the payment gateway of each pay method
+type Gateways struct {
+	byName      map[string]PaymentGateway
+	byPayMethod map[string]PaymentGateway
+}
+
+// NewGateways returns the payment gateways of the config.
+// Pay methods are made through TapPay unless other payment gateways are selected by `donation.payment_gateways`, e.g.
+//
+//	payment_gateways:
+//	    credit_card: ecpay
+func NewGateways(conf configs.DonationConfig) (*Gateways, error) {
+	g := &Gateways{
+		byName:      make(map[string]PaymentGateway),
+		byPayMethod: make(map[string]PaymentGateway),
+	}
+
+	tapPay := NewTapPay(conf)
+	g.Register(tapPay, tapPay.PayMethods()...)
+	g.Register(NewECPay(conf))
+
+	for payMethod, name := range conf.PaymentGateways {
+		gw, ok := g.byName[name]
+		if !ok {
+			return nil, fmt.Errorf("payment gateway %s of pay method %s is not supported", name, payMethod)
+		}
+
+		if !utils.ContainsString(gw.PayMethods(), payMethod) {
+			return nil, fmt.Errorf("pay method %s is not supported by payment gateway %s", payMethod, name)
+		}
+
+		g.byPayMethod[payMethod] = gw
+	}
+
+	return g, nil
+}
+
+// Register adds the payment gateway, and selects it for the pay methods
+func (g *Gateways) Register(gw PaymentGateway, payMethods ...string) {
+	g.byName[gw.Name()] = gw
+
+	for _, payMethod := range payMethods {
+		g.byPayMethod[payMethod] = gw
+	}
+}
+
+// Get returns the payment gateway of the name.
+// The donations made before payment gateways are recorded are regarded as made through TapPay.
+func (g *Gateways) Get(name string) (PaymentGateway, error) {
+	if name == "" {
+		name = TapPayName
+	}
+
+	gw, ok := g.byName[name]
+	if !ok {
+		return nil, fmt.Errorf("payment gateway %s is not supported", name)
+	}
+
+	return gw, nil
+}
+
+// GetByPayMethod returns the payment gateway selected for the pay method
+func (g *Gateways) GetByPayMethod(payMethod string) (PaymentGateway, error) {
+	gw, ok := g.byPayMethod[payMethod]
+	if !ok {
+		return nil, fmt.Errorf("no payment gateway is selected for pay method %s", payMethod)
+	}
+
+	return gw, nil
+}
@@ -0,0 +1,494 @@
+package payment
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"gopkg.in/guregu/null.v3"
+
+	"twreporter.org/go-api/configs"
+	"twreporter.org/go-api/models"
+)
+
+// TapPayName is the name of TapPay recorded on donations
+const TapPayName = "tappay"
+
+const (
+	defaultRequestTimeout = 45 * time.Second
+
+	secToMsec     = 1000
+	msecToNanosec = 1000000
+)
+
+// record status of TapPay Record API
+// https://docs.tappaysdk.com/tutorial/zh/back.html#record-api
+const (
+	tapPayRecordStatusError           = -1
+	tapPayRecordStatusAuth            = 0
+	tapPayRecordStatusOK              = 1
+	tapPayRecordStatusPartialRefunded = 2
+	tapPayRecordStatusRefunded        = 3
+	tapPayRecordStatusPending         = 4
+	tapPayRecordStatusCancel          = 5
+)
+
+type (
+	bankTransactionTime struct {
+		StartTimeMillis string `json:"start_time_millis"`
+		EndTimeMillis   string `json:"end_time_millis"`
+	}
+
+	cardSecret struct {
+		CardToken string `json:"card_token"`
+		CardKey   string `json:"card_key"`
+	}
+
+	tapPayResultUrl struct {
+		FrontendRedirectUrl string `json:"frontend_redirect_url"`
+		BackendNotifyUrl    string `json:"backend_notify_url"`
+	}
+
+	tapPayTransactionReq struct {
+		Amount      uint              `json:"amount"`
+		Cardholder  models.Cardholder `json:"cardholder"`
+		Currency    string            `json:"currency"`
+		Details     string            `json:"details"`
+		MerchantID  string            `json:"merchant_id"`
+		OrderNumber string            `json:"order_number"`
+		PartnerKey  string            `json:"partner_key"`
+		Prime       string            `json:"prime"`
+		Remember    bool              `json:"remember"`
+		ResultUrl   tapPayResultUrl   `json:"result_url"`
+		// ThreeDomainSecure requires result_url to redirect the donor back and notify the result
+		ThreeDomainSecure bool `json:"three_domain_secure"`
+	}
+
+	tapPayCardTokenReq struct {
+		Amount      uint   `json:"amount"`
+		CardKey     string `json:"card_key"`
+		CardToken   string `json:"card_token"`
+		Currency    string `json:"currency"`
+		Details     string `json:"details"`
+		MerchantID  string `json:"merchant_id"`
+		OrderNumber string `json:"order_number"`
+		PartnerKey  string `json:"partner_key"`
+	}
+
+	tapPayTransactionResp struct {
+		models.TappayResp
+		BankTransactionTime   bankTransactionTime `json:"bank_transaction_time"`
+		CardInfo              models.CardInfo     `json:"card_info"`
+		CardSecret            cardSecret          `json:"card_secret"`
+		PaymentUrl            string              `json:"payment_url"`
+		Status                int64               `json:"status"`
+		TransactionTimeMillis int64               `json:"transaction_time_millis"`
+	}
+
+	tapPayMinTransactionResp struct {
+		Status int64  `json:"status"`
+		Msg    string `json:"msg"`
+	}
+
+	tapPayBindCardReq struct {
+		Cardholder models.Cardholder `json:"cardholder"`
+		Currency   string            `json:"currency"`
+		MerchantID string            `json:"merchant_id"`
+		PartnerKey string            `json:"partner_key"`
+		Prime      string            `json:"prime"`
+	}
+
+	tapPayBindCardResp struct {
+		CardInfo   models.CardInfo `json:"card_info"`
+		CardSecret cardSecret      `json:"card_secret"`
+		Msg        string          `json:"msg"`
+		Status     int64           `json:"status"`
+	}
+
+	tapPayRefundReq struct {
+		Amount     uint   `json:"amount"`
+		PartnerKey string `json:"partner_key"`
+		RecTradeID string `json:"rec_trade_id"`
+	}
+
+	tapPayRefundResp struct {
+		Currency     string `json:"currency"`
+		Msg          string `json:"msg"`
+		RefundAmount uint   `json:"refund_amount"`
+		RefundID     string `json:"refund_id"`
+		Status       int64  `json:"status"`
+	}
+
+	tapPayRecordFilters struct {
+		OrderNumber string `json:"order_number,omitempty"`
+		RecTradeID  string `json:"rec_trade_id,omitempty"`
+	}
+
+	tapPayRecordReq struct {
+		Filters    tapPayRecordFilters `json:"filters"`
+		PartnerKey string              `json:"partner_key"`
+	}
+
+	tapPayTradeRecord struct {
+		Amount            uint            `json:"amount"`
+		AuthCode          string          `json:"auth_code"`
+		BankResultCode    null.String     `json:"bank_result_code"`
+		BankResultMsg     null.String     `json:"bank_result_msg"`
+		BankTransactionID string          `json:"bank_transaction_id"`
+		CardInfo          models.CardInfo `json:"card_info"`
+		Currency          string          `json:"currency"`
+		OrderNumber       string          `json:"order_number"`
+		RecTradeID        string          `json:"rec_trade_id"`
+		RecordStatus      int64           `json:"record_status"`
+		RefundedAmount    uint            `json:"refunded_amount"`
+		TimeMillis        int64           `json:"time"`
+	}
+
+	tapPayRecordResp struct {
+		Msg          string              `json:"msg"`
+		Status       int64               `json:"status"`
+		TradeRecords []tapPayTradeRecord `json:"trade_records"`
+	}
+)
+
+// TapPay makes payments through TapPay Backend API
+// https://docs.tappaysdk.com/tutorial/zh/back.html
+type TapPay struct {
+	conf configs.DonationConfig
+}
+
+// NewTapPay returns a TapPay gateway with the TapPay urls and partner key of the config
+func NewTapPay(conf configs.DonationConfig) *TapPay {
+	return &TapPay{conf: conf}
+}
+
+// Name is the method of PaymentGateway interface
+func (tp *TapPay) Name() string {
+	return TapPayName
+}
+
+// PayMethods is the method of PaymentGateway interface
+func (tp *TapPay) PayMethods() []string {
+	return []string{PayMethodCreditCard, PayMethodLine, PayMethodGoogle, PayMethodApple, PayMethodSamsung}
+}
+
+// PayByPrime is the method of PaymentGateway interface
+func (tp *TapPay) PayByPrime(req PrimeReq) (Transaction, error) {
+	tapPayReq := tapPayTransactionReq{
+		Amount:      req.Amount,
+		Cardholder:  req.Cardholder,
+		Currency:    req.Currency,
+		Details:     req.Details,
+		MerchantID:  req.MerchantID,
+		OrderNumber: req.OrderNumber,
+		PartnerKey:  tp.conf.TapPayPartnerKey,
+		Prime:       req.Prime,
+		Remember:    req.Remember,
+		ResultUrl: tapPayResultUrl{
+			FrontendRedirectUrl: req.FrontendRedirectURL,
+			BackendNotifyUrl:    req.BackendNotifyURL,
+		},
+		ThreeDomainSecure: req.ThreeDomainSecure,
+	}
+
+	// Per required fields (even empty) of cardholder of tappay documents,
+	// use empty strings for name and phonenumber fields instead of empty.
+	if !tapPayReq.Cardholder.Name.Valid {
+		tapPayReq.Cardholder.Name = null.StringFrom("")
+	}
+
+	if !tapPayReq.Cardholder.PhoneNumber.Valid {
+		tapPayReq.Cardholder.PhoneNumber = null.StringFrom("")
+	}
+
+	// Do not let clients decide where TapPay notifies the transaction result
+	if tp.conf.TapPayBackendNotifyURL != "" {
+		tapPayReq.ResultUrl.BackendNotifyUrl = tp.conf.TapPayBackendNotifyURL
+	}
+
+	tapPayReqJson, _ := json.Marshal(tapPayReq)
+
+	resp, err := serveHttp(tp.conf.TapPayURL, tapPayReq.PartnerKey, tapPayReqJson)
+	return resp.toTransaction(), err
+}
+
+// PayByToken is the method of PaymentGateway interface
+func (tp *TapPay) PayByToken(req TokenReq) (Transaction, error) {
+	tapPayReq := tapPayCardTokenReq{
+		Amount:      req.Amount,
+		CardKey:     req.CardSecret.Key,
+		CardToken:   req.CardSecret.Token,
+		Currency:    req.Currency,
+		Details:     req.Details,
+		MerchantID:  req.MerchantID,
+		OrderNumber: req.OrderNumber,
+		PartnerKey:  tp.conf.TapPayPartnerKey,
+	}
+
+	tapPayReqJson, _ := json.Marshal(tapPayReq)
+
+	resp, err := serveHttp(tp.conf.TapPayCardTokenURL, tapPayReq.PartnerKey, tapPayReqJson)
+	return resp.toTransaction(), err
+}
+
+// BindCard is the method of PaymentGateway interface
+func (tp *TapPay) BindCard(req BindCardReq) (Card, error) {
+	var resp tapPayBindCardResp
+
+	tapPayReq := tapPayBindCardReq{
+		Cardholder: req.Cardholder,
+		Currency:   req.Currency,
+		MerchantID: req.MerchantID,
+		PartnerKey: tp.conf.TapPayPartnerKey,
+		Prime:      req.Prime,
+	}
+
+	// Per required fields (even empty) of cardholder of tappay documents
+	if !tapPayReq.Cardholder.Name.Valid {
+		tapPayReq.Cardholder.Name = null.StringFrom("")
+	}
+
+	if !tapPayReq.Cardholder.PhoneNumber.Valid {
+		tapPayReq.Cardholder.PhoneNumber = null.StringFrom("")
+	}
+
+	if err := tp.request(tp.conf.TapPayBindCardURL, tapPayReq, &resp); nil != err {
+		return Card{}, err
+	}
+
+	card := Card{
+		CardInfo: resp.CardInfo,
+		CardSecret: CardSecret{
+			Key:   resp.CardSecret.CardKey,
+			Token: resp.CardSecret.CardToken,
+		},
+		Msg:    resp.Msg,
+		Status: resp.Status,
+	}
+
+	if StatusSuccess != resp.Status {
+		log.Error("tap pay msg: " + resp.Msg)
+		return card, errors.New("Cannot bind the card on tap pay")
+	}
+
+	return card, nil
+}
+
+// Refund is the method of PaymentGateway interface
+func (tp *TapPay) Refund(req RefundReq) (Refund, error) {
+	var resp tapPayRefundResp
+
+	if err := tp.request(tp.conf.TapPayRefundURL, tapPayRefundReq{
+		Amount:     req.Amount,
+		PartnerKey: tp.conf.TapPayPartnerKey,
+		RecTradeID: req.RecTradeID,
+	}, &resp); nil != err {
+		return Refund{}, err
+	}
+
+	refund := Refund{
+		Msg:      resp.Msg,
+		RefundID: resp.RefundID,
+		Status:   resp.Status,
+	}
+
+	if StatusSuccess != resp.Status {
+		log.Error("tap pay msg: " + resp.Msg)
+		return refund, errors.New("Cannot make success refund on tap pay")
+	}
+
+	return refund, nil
+}
+
+// QueryRecord is the method of PaymentGateway interface
+func (tp *TapPay) QueryRecord(filters RecordFilters) (Record, error) {
+	var resp tapPayRecordResp
+
+	if err := tp.request(tp.conf.TapPayRecordURL, tapPayRecordReq{
+		Filters: tapPayRecordFilters{
+			OrderNumber: filters.OrderNumber,
+			RecTradeID:  filters.RecTradeID,
+		},
+		PartnerKey: tp.conf.TapPayPartnerKey,
+	}, &resp); nil != err {
+		return Record{}, err
+	}
+
+	if StatusSuccess != resp.Status {
+		log.Error("tap pay msg: " + resp.Msg)
+		return Record{}, errors.New("Cannot query the trade record on tap pay")
+	}
+
+	for _, r := range resp.TradeRecords {
+		if (filters.OrderNumber == "" || r.OrderNumber == filters.OrderNumber) &&
+			(filters.RecTradeID == "" || r.RecTradeID == filters.RecTradeID) {
+			return r.toRecord(), nil
+		}
+	}
+
+	return Record{}, errors.New("Cannot find the trade record on tap pay")
+}
+
+// request posts reqBody to the TapPay API of url and parses the JSON response into respBody.
+// The status in the response is left to callers.
+func (tp *TapPay) request(url string, reqBody interface{}, respBody interface{}) error {
+	reqBodyJson, _ := json.Marshal(reqBody)
+
+	client := &http.Client{Timeout: defaultRequestTimeout}
+
+	req, _ := http.NewRequest("POST", url, bytes.NewBuffer(reqBodyJson))
+	req.Header.Add("x-api-key", tp.conf.TapPayPartnerKey)
+	req.Header.Add("Content-Type", "application/json")
+
+	rawResp, err := client.Do(req)
+	if nil != err {
+		log.Error(err.Error())
+		return errors.New("cannot request to tap pay server")
+	}
+	defer rawResp.Body.Close()
+
+	body, err := ioutil.ReadAll(rawResp.Body)
+	if nil != err {
+		log.Error(err.Error())
+		return errors.New("Cannot read response from tap pay server")
+	}
+
+	if err = json.Unmarshal(body, respBody); nil != err {
+		log.Error(err.Error())
+		return errors.New("Cannot unmarshal json response from tap pay server")
+	}
+
+	return nil
+}
+
+func (resp tapPayTransactionResp) toTransaction() Transaction {
+	t := Transaction{
+		TappayResp: resp.TappayResp,
+		CardInfo:   resp.CardInfo,
+		CardSecret: CardSecret{
+			Key:   resp.CardSecret.CardKey,
+			Token: resp.CardSecret.CardToken,
+		},
+		PaymentURL: resp.PaymentUrl,
+		Status:     resp.Status,
+	}
+
+	ttm := time.Unix(resp.TransactionTimeMillis/secToMsec, (resp.TransactionTimeMillis%secToMsec)*msecToNanosec)
+	t.TransactionTime = null.TimeFrom(ttm)
+
+	ms, err := strconv.ParseInt(resp.BankTransactionTime.StartTimeMillis, 10, strconv.IntSize)
+	if nil == err {
+		stm := time.Unix(ms/secToMsec, ms%secToMsec)
+		t.BankTransactionStartTime = null.TimeFrom(stm)
+	}
+
+	ms, err = strconv.ParseInt(resp.BankTransactionTime.EndTimeMillis, 10, strconv.IntSize)
+	if nil == err {
+		etm := time.Unix(ms/secToMsec, ms%secToMsec)
+		t.BankTransactionEndTime = null.TimeFrom(etm)
+	}
+
+	return t
+}
+
+func (r tapPayTradeRecord) toRecord() Record {
+	m := Record{
+		Amount:         r.Amount,
+		CardInfo:       r.CardInfo,
+		Currency:       r.Currency,
+		OrderNumber:    r.OrderNumber,
+		RefundedAmount: r.RefundedAmount,
+		RefundReported: true,
+	}
+
+	m.AuthCode = r.AuthCode
+	m.BankResultCode = r.BankResultCode
+	m.BankResultMsg = r.BankResultMsg
+	m.BankTransactionID = r.BankTransactionID
+	m.RecTradeID = r.RecTradeID
+	m.TappayRecordStatus = null.IntFrom(r.RecordStatus)
+
+	if r.TimeMillis > 0 {
+		ttm := time.Unix(r.TimeMillis/secToMsec, (r.TimeMillis%secToMsec)*msecToNanosec)
+		m.TransactionTime = null.TimeFrom(ttm)
+	}
+
+	switch r.RecordStatus {
+	case tapPayRecordStatusAuth, tapPayRecordStatusOK, tapPayRecordStatusPartialRefunded, tapPayRecordStatusRefunded:
+		m.State = RecordStatePaid
+	case tapPayRecordStatusError, tapPayRecordStatusCancel:
+		m.State = RecordStateFailed
+	default:
+		m.State = RecordStatePending
+	}
+
+	return m
+}
+
+func handleTapPayBodyParseError(body []byte) (tapPayTransactionResp, error) {
+	var minResp tapPayMinTransactionResp
+	var resp tapPayTransactionResp
+	var err error
+
+	if err = json.Unmarshal(body, &minResp); nil != err {
+		return tapPayTransactionResp{}, errors.New("Cannot unmarshal json response from tap pay server")
+	}
+
+	if StatusSuccess != minResp.Status {
+		log.Error("tap pay msg: " + minResp.Msg)
+		err = errors.New("Cannot make success transaction on tap pay")
+	}
+
+	resp.Status = minResp.Status
+	resp.Msg = minResp.Msg
+
+	return resp, err
+}
+
+func serveHttp(url string, key string, reqBodyJson []byte) (tapPayTransactionResp, error) {
+	// Setup HTTP client with timeout
+	client := &http.Client{Timeout: defaultRequestTimeout}
+
+	req, _ := http.NewRequest("POST", url, bytes.NewBuffer(reqBodyJson))
+	req.Header.Add("x-api-key", key)
+	req.Header.Add("Content-Type", "application/json")
+
+	rawResp, err := client.Do(req)
+
+	// If fail to sending request
+	if nil != err {
+		log.Error(err.Error())
+		return tapPayTransactionResp{}, errors.New("cannot request to tap pay server")
+	}
+	defer rawResp.Body.Close()
+
+	// If timeout or other errors occur during reading the body...
+	// TODO: Might require a mechanism to notify users
+	body, err := ioutil.ReadAll(rawResp.Body)
+	if nil != err {
+		log.Error(err.Error())
+		return tapPayTransactionResp{}, errors.New("Cannot read response from tap pay server")
+	}
+
+	resp := tapPayTransactionResp{}
+
+	err = json.Unmarshal(body, &resp)
+
+	switch {
+	case nil != err:
+		log.Error(err.Error())
+		return handleTapPayBodyParseError(body)
+	case StatusSuccess != resp.Status:
+		log.Error("tap pay msg: " + resp.Msg)
+		return resp, errors.New("Cannot make success transaction on tap pay")
+	default:
+		// Omit intentionally
+	}
+
+	return resp, nil
+}
@@ -0,0 +1,117 @@
+// Package receipt renders the tax-deductible donation receipts into PDF files
+package receipt
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/jung-kurt/gofpdf"
+
+	"twreporter.org/go-api/configs"
+	"twreporter.org/go-api/currency"
+	"twreporter.org/go-api/models"
+)
+
+const (
+	fontFamily   = "receipt"
+	fallbackFont = "Helvetica"
+
+	dateLayout = "2006-01-02"
+
+	pageWidth  = 170.0
+	lineHeight = 8.0
+)
+
+var periodTypeLabels = map[string]string{
+	"monthly": "月",
+	"yearly":  "年",
+}
+
+// Renderer renders the receipts with the issuer and the font of the config
+type Renderer struct {
+	conf       configs.DonationConfig
+	currencies currency.Currencies
+	location   *time.Location
+}
+
+// NewRenderer returns the receipt renderer of the config.
+// Chinese is printed only if `donation.receipt_font_path` is a TrueType font with Chinese glyphs.
+func NewRenderer(conf configs.DonationConfig) *Renderer {
+	location, _ := time.LoadLocation("Asia/Taipei")
+	return &Renderer{conf: conf, currencies: currency.FromConfig(conf), location: location}
+}
+
+// Render prints the receipt and the donations on it into a PDF file
+func (r *Renderer) Render(mr models.Receipt, items []models.ReceiptItem) ([]byte, error) {
+	var out bytes.Buffer
+
+	pdf := gofpdf.New("P", "mm", "A4", filepath.Dir(r.conf.ReceiptFontPath))
+	pdf.SetTitle(fmt.Sprintf("%s %s", mr.ReceiptNumber, r.conf.ReceiptIssuer), true)
+	pdf.SetCreationDate(mr.CreatedAt)
+
+	font := fallbackFont
+	if r.conf.ReceiptFontPath != "" {
+		pdf.AddUTF8Font(fontFamily, "", filepath.Base(r.conf.ReceiptFontPath))
+		font = fontFamily
+	}
+
+	pdf.AddPage()
+
+	pdf.SetFont(font, "", 20)
+	pdf.CellFormat(pageWidth, 14, "捐款收據", "", 1, "C", false, 0, "")
+
+	pdf.SetFont(font, "", 11)
+	r.field(pdf, "收據編號", mr.ReceiptNumber)
+	r.field(pdf, "開立日期", mr.CreatedAt.In(r.location).Format(dateLayout))
+	r.field(pdf, "捐款期間", fmt.Sprintf("%s 至 %s（%s收據）",
+		mr.PeriodStart.In(r.location).Format(dateLayout),
+		mr.PeriodEnd.In(r.location).AddDate(0, 0, -1).Format(dateLayout),
+		periodTypeLabels[mr.PeriodType]))
+	if mr.IsOrganization() {
+		// the cardholder is the contact of the organization
+		r.field(pdf, "捐款單位", mr.CompanyName)
+		r.field(pdf, "統一編號", mr.TaxID)
+		r.field(pdf, "聯絡人", mr.Name)
+	} else {
+		r.field(pdf, "捐款人", mr.Name)
+		r.field(pdf, "身分證字號／統一編號", mr.NationalID)
+	}
+	r.field(pdf, "地址", mr.Address)
+	pdf.Ln(4)
+
+	// donations on the receipt
+	pdf.CellFormat(40, lineHeight, "捐款日期", "1", 0, "C", false, 0, "")
+	pdf.CellFormat(90, lineHeight, "贊助編號", "1", 0, "C", false, 0, "")
+	pdf.CellFormat(40, lineHeight, fmt.Sprintf("金額（%s）", mr.Currency), "1", 1, "C", false, 0, "")
+
+	for _, item := range items {
+		pdf.CellFormat(40, lineHeight, item.PaidAt.In(r.location).Format(dateLayout), "1", 0, "C", false, 0, "")
+		pdf.CellFormat(90, lineHeight, item.OrderNumber, "1", 0, "L", false, 0, "")
+		pdf.CellFormat(40, lineHeight, r.currencies.Format(mr.Currency, item.Amount), "1", 1, "R", false, 0, "")
+	}
+
+	pdf.CellFormat(130, lineHeight, "合計", "1", 0, "R", false, 0, "")
+	pdf.CellFormat(40, lineHeight, r.currencies.Format(mr.Currency, mr.Amount), "1", 1, "R", false, 0, "")
+	pdf.Ln(6)
+
+	pdf.MultiCell(pageWidth, lineHeight, "本收據可作為申報綜合所得稅列舉扣除額或營利事業所得稅捐贈費用之憑證。", "", "L", false)
+	pdf.Ln(4)
+
+	r.field(pdf, "開立單位", r.conf.ReceiptIssuer)
+	if r.conf.ReceiptIssuerTaxID != "" {
+		r.field(pdf, "統一編號", r.conf.ReceiptIssuerTaxID)
+	}
+
+	if err := pdf.Output(&out); nil != err {
+		return nil, fmt.Errorf("cannot render the receipt(%s): %s", mr.ReceiptNumber, err.Error())
+	}
+
+	return out.Bytes(), nil
+}
+
+func (r *Renderer) field(pdf *gofpdf.Fpdf, label, value string) {
+	pdf.CellFormat(50, lineHeight, label, "", 0, "L", false, 0, "")
+	pdf.CellFormat(pageWidth-50, lineHeight, value, "", 1, "L", false, 0, "")
+}
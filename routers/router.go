@@ -2,6 +2,7 @@ package routers
 
 import (
 	"fmt"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/gin-contrib/cors"
@@ -17,6 +18,9 @@ import (
 
 const (
 	maxAge = 3600
+
+	// the responses of the requests with the same Idempotency-Key are replayed within the window
+	idempotencyKeyWindow = 24 * time.Hour
 )
 
 type wrappedFn func(c *gin.Context) (int, gin.H, error)
@@ -61,6 +65,7 @@ func SetupRouter(cf *controllers.ControllerFactory) *gin.Engine {
 	}
 
 	config.AddAllowHeaders("Authorization")
+	config.AddAllowHeaders("Idempotency-Key")
 	config.AddAllowMethods("DELETE")
 	config.AddAllowMethods("PATCH")
 
@@ -91,28 +96,72 @@ func SetupRouter(cf *controllers.ControllerFactory) *gin.Engine {
 	v1Group.DELETE("/users/:userID/bookmarks/:bookmarkID", middlewares.ValidateAuthorization(), middlewares.ValidateUserID(), middlewares.SetCacheControl("no-store"), ginResponseWrapper(mc.DeleteABookmarkOfAUser))
 
 	// endpoints for donation
-	v1Group.POST("/periodic-donations", middlewares.ValidateAuthentication(), middlewares.ValidateAuthorization(), middlewares.ValidateUserIDInReqBody(), middlewares.SetCacheControl("no-store"), ginResponseWrapper(mc.CreateAPeriodicDonationOfAUser))
+	v1Group.POST("/periodic-donations", middlewares.ValidateAuthentication(), middlewares.ValidateAuthorization(), middlewares.ValidateUserIDInReqBody(), middlewares.SetCacheControl("no-store"), middlewares.ValidateIdempotencyKey(mc.Storage, idempotencyKeyWindow), ginResponseWrapper(mc.CreateAPeriodicDonationOfAUser))
 	v1Group.PATCH("/periodic-donations/:id", middlewares.ValidateAuthentication(), middlewares.ValidateAuthorization(), middlewares.ValidateUserIDInReqBody(), middlewares.SetCacheControl("no-store"), ginResponseWrapper(func(c *gin.Context) (int, gin.H, error) {
 		return mc.PatchADonationOfAUser(c, globals.PeriodicDonationType)
 	}))
 	v1Group.GET("/periodic-donations/:id", middlewares.ValidateAuthentication(), middlewares.ValidateAuthorization(), middlewares.SetCacheControl("no-store"), ginResponseWrapper(func(c *gin.Context) (int, gin.H, error) {
 		return mc.GetADonationOfAUser(c, globals.PeriodicDonationType)
 	}))
-	v1Group.POST("/donations/prime", middlewares.ValidateAuthentication(), middlewares.ValidateAuthorization(), middlewares.ValidateUserIDInReqBody(), middlewares.SetCacheControl("no-store"), ginResponseWrapper(mc.CreateADonationOfAUser))
+	v1Group.POST("/periodic-donations/:id/stop", middlewares.ValidateAuthentication(), middlewares.ValidateAuthorization(), middlewares.ValidateUserIDInReqBody(), middlewares.SetCacheControl("no-store"), ginResponseWrapper(mc.StopAPeriodicDonationOfAUser))
+	v1Group.POST("/periodic-donations/:id/changes", middlewares.ValidateAuthentication(), middlewares.ValidateAuthorization(), middlewares.ValidateUserIDInReqBody(), middlewares.SetCacheControl("no-store"), ginResponseWrapper(mc.ChangeAPeriodicDonationOfAUser))
+	v1Group.GET("/periodic-donations/:id/changes", middlewares.ValidateAuthentication(), middlewares.ValidateAuthorization(), middlewares.SetCacheControl("no-store"), ginResponseWrapper(mc.GetChangesOfAPeriodicDonationOfAUser))
+	v1Group.PUT("/periodic-donations/:id/card", middlewares.ValidateAuthentication(), middlewares.ValidateAuthorization(), middlewares.ValidateUserIDInReqBody(), middlewares.SetCacheControl("no-store"), ginResponseWrapper(mc.ReplaceTheCardOfAPeriodicDonationOfAUser))
+	// endpoint for donors to replace the expiring cards by the links in the card expiry reminders without signing in
+	v1Group.POST("/card-replacements", middlewares.SetCacheControl("no-store"), ginResponseWrapper(mc.ReplaceTheCardByAReminderLink))
+	v1Group.POST("/donations/trades", middlewares.ValidateAuthentication(), middlewares.ValidateAuthorization(), middlewares.ValidateUserIDInReqBody(), middlewares.SetCacheControl("no-store"), ginResponseWrapper(mc.CreateATradeOfAUser))
+	v1Group.POST("/donations/prime", middlewares.ValidateAuthentication(), middlewares.ValidateAuthorization(), middlewares.ValidateUserIDInReqBody(), middlewares.SetCacheControl("no-store"), middlewares.ValidateIdempotencyKey(mc.Storage, idempotencyKeyWindow), ginResponseWrapper(mc.CreateADonationOfAUser))
 	v1Group.PATCH("/donations/prime/:id", middlewares.ValidateAuthentication(), middlewares.ValidateAuthorization(), middlewares.ValidateUserIDInReqBody(), middlewares.SetCacheControl("no-store"), ginResponseWrapper(func(c *gin.Context) (int, gin.H, error) {
 		return mc.PatchADonationOfAUser(c, globals.PrimeDonaitionType)
 	}))
-	// v1Group.GET("/users/:userID/donations", middlewares.ValidateAuthorization(), middlewares.ValidateUserID(), ginResponseWrapper(mc.GetDonationsOfAUser))
+	v1Group.GET("/users/:userID/donations", middlewares.ValidateAuthentication(), middlewares.ValidateAuthorization(), middlewares.ValidateUserID(), middlewares.SetCacheControl("no-store"), ginResponseWrapper(mc.GetDonationsOfAUser))
+	// tax-deductible receipts of the donations
+	v1Group.GET("/users/:userID/receipts", middlewares.ValidateAuthentication(), middlewares.ValidateAuthorization(), middlewares.ValidateUserID(), middlewares.SetCacheControl("no-store"), ginResponseWrapper(mc.GetReceiptsOfAUser))
+	v1Group.GET("/users/:userID/receipts/:receiptNumber", middlewares.ValidateAuthentication(), middlewares.ValidateAuthorization(), middlewares.ValidateUserID(), middlewares.SetCacheControl("no-store"), mc.DownloadAReceiptOfAUser)
+	// donor profiles which pre-fill the new donations, and the cards on file of the periodic donations
+	v1Group.GET("/users/:userID/donor-profile", middlewares.ValidateAuthentication(), middlewares.ValidateAuthorization(), middlewares.ValidateUserID(), middlewares.SetCacheControl("no-store"), ginResponseWrapper(mc.GetTheDonorProfileOfAUser))
+	v1Group.PUT("/users/:userID/donor-profile", middlewares.ValidateAuthentication(), middlewares.ValidateAuthorization(), middlewares.ValidateUserID(), middlewares.SetCacheControl("no-store"), ginResponseWrapper(mc.SaveTheDonorProfileOfAUser))
+	v1Group.GET("/users/:userID/cards", middlewares.ValidateAuthentication(), middlewares.ValidateAuthorization(), middlewares.ValidateUserID(), middlewares.SetCacheControl("no-store"), ginResponseWrapper(mc.GetCardsOnFileOfAUser))
+	v1Group.DELETE("/users/:userID/cards/:cardID", middlewares.ValidateAuthentication(), middlewares.ValidateAuthorization(), middlewares.ValidateUserID(), middlewares.SetCacheControl("no-store"), ginResponseWrapper(mc.RemoveACardOnFileOfAUser))
 	// one-time donation including credit_card, line pay, apple pay, google pay and samsung pay
 	v1Group.GET("/donations/prime/:id", middlewares.ValidateAuthentication(), middlewares.ValidateAuthorization(), middlewares.SetCacheControl("no-store"), ginResponseWrapper(func(c *gin.Context) (int, gin.H, error) {
 		return mc.GetADonationOfAUser(c, globals.PrimeDonaitionType)
 	}))
+	// status polling for the prime donations confirmed asynchronously, such as line pay
+	v1Group.GET("/donations/orders/:order_number/status", middlewares.ValidateAuthentication(), middlewares.ValidateAuthorization(), middlewares.SetCacheControl("no-store"), ginResponseWrapper(mc.GetAPrimeDonationStatusOfAUser))
+	// endpoints for admins to refund donations
+	v1Group.POST("/donations/prime/:id/refunds", middlewares.ValidateAuthentication(), middlewares.ValidateAuthorization(), middlewares.ValidateUserIDInReqBody(), middlewares.ValidateAdminPrivilege(mc.Storage), middlewares.SetCacheControl("no-store"), ginResponseWrapper(func(c *gin.Context) (int, gin.H, error) {
+		return mc.RefundADonation(c, globals.PrimeDonaitionType)
+	}))
+	v1Group.POST("/donations/token/:id/refunds", middlewares.ValidateAuthentication(), middlewares.ValidateAuthorization(), middlewares.ValidateUserIDInReqBody(), middlewares.ValidateAdminPrivilege(mc.Storage), middlewares.SetCacheControl("no-store"), ginResponseWrapper(func(c *gin.Context) (int, gin.H, error) {
+		return mc.RefundADonation(c, globals.TokenDonationType)
+	}))
+	// endpoints for admins to record the donations made outside the payment gateways, such as bank transfers
+	v1Group.POST("/donations/others", middlewares.ValidateAuthentication(), middlewares.ValidateAuthorization(), middlewares.ValidateUserIDInReqBody(), middlewares.ValidateAdminPrivilege(mc.Storage), middlewares.SetCacheControl("no-store"), ginResponseWrapper(mc.CreateAnOtherMethodDonation))
+	v1Group.POST("/donations/others/imports", middlewares.ValidateAuthentication(), middlewares.ValidateAuthorization(), middlewares.ValidateUserIDInReqBody(), middlewares.ValidateAdminPrivilege(mc.Storage), middlewares.SetCacheControl("no-store"), ginResponseWrapper(mc.ImportOtherMethodDonationsByAFile))
+	v1Group.POST("/settlements/imports", middlewares.ValidateAuthentication(), middlewares.ValidateAuthorization(), middlewares.ValidateUserIDInReqBody(), middlewares.ValidateAdminPrivilege(mc.Storage), middlewares.SetCacheControl("no-store"), ginResponseWrapper(mc.ImportASettlementFile))
+	v1Group.GET("/settlements/:date/reconciliations", middlewares.ValidateAuthentication(), middlewares.ValidateAuthorization(), middlewares.ValidateAdminPrivilege(mc.Storage), middlewares.SetCacheControl("no-store"), ginResponseWrapper(mc.GetSettlementReconciliations))
+	// endpoints for admins to check and requeue the webhook deliveries which fail the last attempts
+	v1Group.GET("/webhooks/dead-letters", middlewares.ValidateAuthentication(), middlewares.ValidateAuthorization(), middlewares.ValidateAdminPrivilege(mc.Storage), middlewares.SetCacheControl("no-store"), ginResponseWrapper(mc.GetDeadWebhookDeliveries))
+	v1Group.POST("/webhooks/dead-letters/:id/retries", middlewares.ValidateAuthentication(), middlewares.ValidateAuthorization(), middlewares.ValidateUserIDInReqBody(), middlewares.ValidateAdminPrivilege(mc.Storage), middlewares.SetCacheControl("no-store"), ginResponseWrapper(mc.RequeueADeadWebhookDelivery))
+	// endpoint for admins to export the accounting ledger of donations
+	v1Group.GET("/donations/export", middlewares.ValidateAuthentication(), middlewares.ValidateAuthorization(), middlewares.ValidateAdminPrivilege(mc.Storage), middlewares.SetCacheControl("no-store"), mc.ExportDonations)
+	// endpoints for admins to ship the feedback gifts
+	v1Group.GET("/gifts/shipping-list", middlewares.ValidateAuthentication(), middlewares.ValidateAuthorization(), middlewares.ValidateAdminPrivilege(mc.Storage), middlewares.SetCacheControl("no-store"), mc.ExportGiftShippingList)
+	v1Group.POST("/gifts/:id/shipment", middlewares.ValidateAuthentication(), middlewares.ValidateAuthorization(), middlewares.ValidateUserIDInReqBody(), middlewares.ValidateAdminPrivilege(mc.Storage), middlewares.SetCacheControl("no-store"), ginResponseWrapper(mc.ShipAGift))
+	// endpoint for admins to list the upcoming card expirations of periodic donations by month
+	v1Group.GET("/donations/card-expirations", middlewares.ValidateAuthentication(), middlewares.ValidateAuthorization(), middlewares.ValidateAdminPrivilege(mc.Storage), middlewares.SetCacheControl("no-store"), ginResponseWrapper(mc.GetCardExpirations))
+	// endpoint for anyone to get the progress of a fundraising campaign
+	v1Group.GET("/campaigns/:slug", middlewares.SetCacheControl("public,max-age=60"), ginResponseWrapper(mc.GetACampaign))
+	// endpoint for anyone to list the donors who agree to be thanked publicly
+	v1Group.GET("/donor-wall", middlewares.SetCacheControl("public,max-age=60"), ginResponseWrapper(mc.GetDonorWall))
+	// endpoint for tap pay to notify the transaction results
+	v1Group.POST("/donations/backend-notify", middlewares.SetCacheControl("no-store"), ginResponseWrapper(mc.ReceiveBackendNotify))
 
-	// TODO
 	// donations derived from the periodic donation
-	// v1Group.GET("/users/:userID/donations/token/:id", middlewares.ValidateAuthorization(), middlewares.ValidateUserID(), ginResponseWrapper(func(c *gin.Context) (int, gin.H, error) {
-	//  return mc.GetADonationOfAUser(c, globals.TokenDonationType)
-	//}))
+	v1Group.GET("/donations/token/:id", middlewares.ValidateAuthentication(), middlewares.ValidateAuthorization(), middlewares.SetCacheControl("no-store"), ginResponseWrapper(func(c *gin.Context) (int, gin.H, error) {
+		return mc.GetADonationOfAUser(c, globals.TokenDonationType)
+	}))
 
 	// other donations not included in the above endpoints
 	v1Group.GET("/donations/others/:id", middlewares.ValidateAuthentication(), middlewares.ValidateAuthorization(), middlewares.SetCacheControl("no-store"), ginResponseWrapper(func(c *gin.Context) (int, gin.H, error) {
@@ -161,6 +210,13 @@ func SetupRouter(cf *controllers.ControllerFactory) *gin.Engine {
 	mailMiddleware := middlewares.GetMailServiceMiddleware()
 	v1Group.POST(fmt.Sprintf("/%s", globals.SendActivationRoutePath), mailMiddleware.ValidateAuthorization(), middlewares.SetCacheControl("no-store"), ginResponseWrapper(mailContrl.SendActivation))
 	v1Group.POST(fmt.Sprintf("/%s", globals.SendSuccessDonationRoutePath), mailMiddleware.ValidateAuthorization(), middlewares.SetCacheControl("no-store"), ginResponseWrapper(mailContrl.SendDonationSuccessMail))
+	v1Group.POST(fmt.Sprintf("/%s", globals.SendRefundDonationRoutePath), mailMiddleware.ValidateAuthorization(), middlewares.SetCacheControl("no-store"), ginResponseWrapper(mailContrl.SendDonationRefundMail))
+	v1Group.POST(fmt.Sprintf("/%s", globals.SendReceiptRoutePath), mailMiddleware.ValidateAuthorization(), middlewares.SetCacheControl("no-store"), ginResponseWrapper(mailContrl.SendReceiptMail))
+	v1Group.POST(fmt.Sprintf("/%s", globals.SendPeriodicDonationFailureRoutePath), mailMiddleware.ValidateAuthorization(), middlewares.SetCacheControl("no-store"), ginResponseWrapper(mailContrl.SendPeriodicDonationFailureMail))
+	v1Group.POST(fmt.Sprintf("/%s", globals.SendAtRiskPeriodicDonationsRoutePath), mailMiddleware.ValidateAuthorization(), middlewares.SetCacheControl("no-store"), ginResponseWrapper(mailContrl.SendAtRiskPeriodicDonationsMail))
+	v1Group.POST(fmt.Sprintf("/%s", globals.SendCardExpiryReminderRoutePath), mailMiddleware.ValidateAuthorization(), middlewares.SetCacheControl("no-store"), ginResponseWrapper(mailContrl.SendCardExpiryReminderMail))
+	v1Group.POST(fmt.Sprintf("/%s", globals.SendGiftShippedRoutePath), mailMiddleware.ValidateAuthorization(), middlewares.SetCacheControl("no-store"), ginResponseWrapper(mailContrl.SendGiftShippedMail))
+	v1Group.POST(fmt.Sprintf("/%s", globals.SendMatchingReportRoutePath), mailMiddleware.ValidateAuthorization(), middlewares.SetCacheControl("no-store"), ginResponseWrapper(mailContrl.SendMatchingReportMail))
 
 	// =============================
 	// v2 oauth endpoints
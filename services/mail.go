@@ -1,12 +1,16 @@
 package services
 
 import (
+	"bytes"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"mime"
+	"mime/multipart"
 	"net/http"
 	"net/mail"
 	"net/smtp"
+	"net/textproto"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
@@ -23,6 +27,14 @@ import (
 // MailService defines an interface to be implemented
 type MailService interface {
 	Send(to, subject, body string) error
+	SendWithAttachments(to, subject, body string, attachments []Attachment) error
+}
+
+// Attachment is a file attached to the mail
+type Attachment struct {
+	ContentType string
+	Data        []byte
+	Filename    string
 }
 
 // NewAmazonMailService returns a AamzonMailStrategy struct with required config
@@ -113,6 +125,51 @@ func (s *AmazonMailStrategy) Send(to, subject, body string) error {
 	return nil
 }
 
+// SendWithAttachments is a pointer receiver function of AmazonMailStrategy,
+// which uses SES to send the raw mail with the attachments
+func (s *AmazonMailStrategy) SendWithAttachments(to, subject, body string, attachments []Attachment) error {
+	emailSettings := s.conf
+
+	if len(emailSettings.Sender) == 0 {
+		log.Info("utils.mail.send: Sender is not set")
+		return nil
+	}
+
+	sess, err := session.NewSession(&aws.Config{
+		Region: aws.String(emailSettings.AwsRegion)},
+	)
+	if err != nil {
+		return models.NewAppError("AmazonMailSender.SendWithAttachments", "cannot create a session to AWS", err.Error(), http.StatusInternalServerError)
+	}
+
+	message, err := buildMessageWithAttachments(emailSettings.Sender, to, subject, body, attachments)
+	if err != nil {
+		return models.NewAppError("AmazonMailSender.SendWithAttachments", "internal server error: fail to build email", err.Error(), http.StatusInternalServerError)
+	}
+
+	svc := ses.New(sess)
+
+	result, err := svc.SendRawEmail(&ses.SendRawEmailInput{
+		Destinations: []*string{aws.String(to)},
+		RawMessage:   &ses.RawMessage{Data: message},
+		Source:       aws.String(emailSettings.Sender),
+	})
+
+	log.WithFields(log.Fields{
+		"to":          to,
+		"subject":     subject,
+		"attachments": len(attachments),
+		"emailConfig": emailSettings,
+		"results":     result,
+	}).Debug("utils.mail.sendWithAttachments")
+
+	if err != nil {
+		return models.NewAppError("AmazonMailSender.SendWithAttachments", "internal server error: fail to send email", err.Error(), http.StatusInternalServerError)
+	}
+
+	return nil
+}
+
 // NewSMTPMailService returns a SMTPMailStrategy struct with required config
 func NewSMTPMailService() MailService {
 	return &SMTPMailStrategy{conf: globals.Conf.Email.SMTP}
@@ -157,6 +214,34 @@ func (s *SMTPMailStrategy) Send(to, subject, body string) error {
 	return nil
 }
 
+// SendWithAttachments is a pointer receiver function of SMTPMailStrategy,
+// which uses smtp servers to send the mail with the attachments
+func (s *SMTPMailStrategy) SendWithAttachments(to, subject, body string, attachments []Attachment) error {
+	emailSettings := s.conf
+
+	if len(emailSettings.Server) == 0 {
+		log.Info("utils.mail.send: SMTPServer is not set")
+		return nil
+	}
+
+	fromMail := mail.Address{Name: emailSettings.FeedbackName, Address: emailSettings.Username}
+	toMail := mail.Address{Name: "", Address: to}
+
+	addr := emailSettings.Server + ":" + emailSettings.Port
+	auth := LoginAuth(emailSettings.Username, emailSettings.Password)
+
+	message, err := buildMessageWithAttachments(fromMail.String(), toMail.String(), subject, body, attachments)
+	if err != nil {
+		return models.NewAppError("SMTPEmailSender.SendWithAttachments", "internal server error: fail to build email", err.Error(), http.StatusInternalServerError)
+	}
+
+	if err = smtp.SendMail(addr, auth, emailSettings.Username, []string{to}, message); err != nil {
+		return models.NewAppError("SMTPEmailSender.SendWithAttachments", "internal server error: fail to send email", err.Error(), http.StatusInternalServerError)
+	}
+
+	return nil
+}
+
 func encodeRFC2047Word(s string) string {
 	return mime.BEncoding.Encode("utf-8", s)
 }
@@ -179,6 +264,63 @@ func buildMessage(from, to, subject, body string) string {
 	return message
 }
 
+// buildMessageWithAttachments builds the multipart message with the html body followed by the base64 encoded attachments
+func buildMessageWithAttachments(from, to, subject, body string, attachments []Attachment) ([]byte, error) {
+	var message bytes.Buffer
+	var parts bytes.Buffer
+
+	writer := multipart.NewWriter(&parts)
+
+	headers := make(map[string]string)
+	headers["From"] = from
+	headers["To"] = to
+	headers["Subject"] = encodeRFC2047Word(subject)
+	headers["MIME-version"] = "1.0"
+	headers["Content-Type"] = fmt.Sprintf("multipart/mixed; boundary=%q", writer.Boundary())
+	headers["Date"] = time.Now().Format(time.RFC1123Z)
+
+	for k, v := range headers {
+		message.WriteString(fmt.Sprintf("%s: %s\r\n", k, v))
+	}
+	message.WriteString("\r\n")
+
+	bodyPart, err := writer.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {"text/html; charset=\"utf-8\""},
+		"Content-Transfer-Encoding": {"8bit"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	bodyPart.Write([]byte("<html><body>" + body + "</body></html>"))
+
+	for _, a := range attachments {
+		part, err := writer.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {fmt.Sprintf("%s; name=%q", a.ContentType, a.Filename)},
+			"Content-Transfer-Encoding": {"base64"},
+			"Content-Disposition":       {fmt.Sprintf("attachment; filename=%q", a.Filename)},
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		// lines of base64 encoded content should not exceed 76 characters
+		encoded := base64.StdEncoding.EncodeToString(a.Data)
+		for len(encoded) > 76 {
+			part.Write([]byte(encoded[:76] + "\r\n"))
+			encoded = encoded[76:]
+		}
+		part.Write([]byte(encoded + "\r\n"))
+	}
+
+	if err = writer.Close(); err != nil {
+		return nil, err
+	}
+
+	message.Write(parts.Bytes())
+
+	return message.Bytes(), nil
+}
+
 // loginAuth is used to implement smtp.Auth interface
 type loginAuth struct {
 	username, password string
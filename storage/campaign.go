@@ -0,0 +1,84 @@
+package storage
+
+import (
+	"fmt"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+
+	"twreporter.org/go-api/globals"
+	"twreporter.org/go-api/models"
+)
+
+// campaignDonationQueries select the paid donations of a campaign with the emails of their donors.
+// Card token donations take the emails from their periodic donations, and other method donations are always paid.
+var campaignDonationQueries = []string{
+	fmt.Sprintf(`SELECT d.amount, d.currency, d.cardholder_email AS email FROM %s AS d
+		WHERE d.deleted_at IS NULL AND d.campaign = ? AND d.status = 'paid' AND d.created_at >= ? AND d.created_at < ?`, globals.TablePayByPrimeDonations),
+	fmt.Sprintf(`SELECT d.amount, d.currency, p.cardholder_email AS email FROM %s AS d JOIN %s AS p ON p.id = d.periodic_id
+		WHERE d.deleted_at IS NULL AND d.campaign = ? AND d.status = 'paid' AND d.created_at >= ? AND d.created_at < ?`, globals.TablePayByCardTokenDonations, globals.TablePeriodicDonations),
+	fmt.Sprintf(`SELECT d.amount, d.currency, d.email FROM %s AS d
+		WHERE d.deleted_at IS NULL AND d.campaign = ? AND d.created_at >= ? AND d.created_at < ?`, globals.TablePayByOtherMethodDonations),
+}
+
+// CreateACampaign creates the campaign, it fails with 409 if the slug is taken
+func (g *GormStorage) CreateACampaign(m *models.Campaign) error {
+	errWhere := "GormStorage.CreateACampaign"
+
+	if err := g.db.Create(m).Error; nil != err {
+		log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+		return g.NewStorageError(err, errWhere, fmt.Sprintf("cannot create the campaign(slug: %s)", m.Slug))
+	}
+
+	return nil
+}
+
+// GetACampaign returns the campaign of the slug
+func (g *GormStorage) GetACampaign(slug string) (models.Campaign, error) {
+	errWhere := "GormStorage.GetACampaign"
+	var campaign models.Campaign
+
+	if err := g.db.Where("slug = ?", slug).First(&campaign).Error; nil != err {
+		log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+		return campaign, g.NewStorageError(err, errWhere, fmt.Sprintf("cannot get the campaign(slug: %s)", slug))
+	}
+
+	return campaign, nil
+}
+
+// GetCampaignProgress sums up the paid donations attributed to the campaign during its date range,
+// and counts the donors and the periodic donations pledged in the campaign.
+func (g *GormStorage) GetCampaignProgress(campaign models.Campaign) (models.CampaignProgress, error) {
+	errWhere := "GormStorage.GetCampaignProgress"
+	var args []interface{}
+	var progress models.CampaignProgress
+
+	for range campaignDonationQueries {
+		args = append(args, campaign.Slug, campaign.StartAt, campaign.EndAt)
+	}
+	donations := strings.Join(campaignDonationQueries, " UNION ALL ")
+
+	err := g.db.Raw(fmt.Sprintf("SELECT donations.currency, SUM(donations.amount) AS amount FROM (%s) AS donations GROUP BY donations.currency ORDER BY donations.currency ASC", donations), args...).
+		Scan(&progress.Amounts).Error
+	if nil != err {
+		log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+		return progress, g.NewStorageError(err, errWhere, fmt.Sprintf("cannot sum up the donations of the campaign(slug: %s)", campaign.Slug))
+	}
+
+	err = g.db.Raw(fmt.Sprintf("SELECT COUNT(DISTINCT donations.email) FROM (%s) AS donations", donations), args...).Row().Scan(&progress.Donors)
+	if nil != err {
+		log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+		return progress, g.NewStorageError(err, errWhere, fmt.Sprintf("cannot count the donors of the campaign(slug: %s)", campaign.Slug))
+	}
+
+	err = g.db.Model(&models.PeriodicDonation{}).
+		Where("campaign = ? AND created_at >= ? AND created_at < ?", campaign.Slug, campaign.StartAt, campaign.EndAt).
+		Where("last_success_at IS NOT NULL").
+		Count(&progress.RecurringPledges).Error
+	if nil != err {
+		log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+		return progress, g.NewStorageError(err, errWhere, fmt.Sprintf("cannot count the recurring pledges of the campaign(slug: %s)", campaign.Slug))
+	}
+
+	return progress, nil
+}
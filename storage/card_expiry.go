@@ -0,0 +1,86 @@
+package storage
+
+import (
+	"fmt"
+
+	log "github.com/Sirupsen/logrus"
+
+	"twreporter.org/go-api/models"
+)
+
+// activeCardStatuses are the statuses of the periodic donations whose cards are still charged
+var activeCardStatuses = []string{"paid", "fail"}
+
+// GetExpiringPeriodicDonations returns the active periodic donations whose cards expire in the months of [from, until),
+// and whose donors are not reminded of the expiring cards yet. The months are in YYYYMM format.
+// Records are ordered by id and start after `afterID`, so that callers can walk through all records batch by batch.
+func (g *GormStorage) GetExpiringPeriodicDonations(from string, until string, afterID uint, limit int) ([]models.PeriodicDonation, error) {
+	errWhere := "GormStorage.GetExpiringPeriodicDonations"
+	var pds []models.PeriodicDonation
+
+	err := g.db.Where("id > ? AND status IN (?)", afterID, activeCardStatuses).
+		Where("last_success_at IS NOT NULL").
+		Where("card_info_expiry_date >= ? AND card_info_expiry_date < ?", from, until).
+		Where("NOT EXISTS (SELECT 1 FROM periodic_donation_card_expiry_reminders WHERE periodic_donation_card_expiry_reminders.periodic_id = periodic_donations.id AND periodic_donation_card_expiry_reminders.card_info_expiry_date = periodic_donations.card_info_expiry_date)").
+		Order("id asc").
+		Limit(limit).
+		Find(&pds).Error
+
+	if nil != err {
+		log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+		return pds, g.NewStorageError(err, errWhere, fmt.Sprintf("cannot get expiring periodic donations(from: %s, until: %s, afterID: %d)", from, until, afterID))
+	}
+
+	return pds, nil
+}
+
+// CreateACardExpiryReminder records the reminder of the expiring card before it is sent.
+// It returns false if the donor is already reminded of the card, so that the donor is not reminded twice by concurrent workers.
+func (g *GormStorage) CreateACardExpiryReminder(m *models.PeriodicDonationCardExpiryReminder) (bool, error) {
+	errWhere := "GormStorage.CreateACardExpiryReminder"
+
+	if err := g.db.Create(m).Error; nil != err {
+		if IsDuplicateEntryError(err) {
+			return false, nil
+		}
+		log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+		return false, g.NewStorageError(err, errWhere, fmt.Sprintf("cannot create the card expiry reminder(%#v)", m))
+	}
+
+	return true, nil
+}
+
+// DeleteACardExpiryReminder removes the record of the reminder which fails to be sent, so that it is sent again next time
+func (g *GormStorage) DeleteACardExpiryReminder(id uint) error {
+	errWhere := "GormStorage.DeleteACardExpiryReminder"
+
+	if err := g.db.Unscoped().Where("id = ?", id).Delete(&models.PeriodicDonationCardExpiryReminder{}).Error; nil != err {
+		log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+		return g.NewStorageError(err, errWhere, fmt.Sprintf("cannot delete the card expiry reminder(id: %d)", id))
+	}
+
+	return nil
+}
+
+// GetCardExpirationsByMonth summarizes the active periodic donations by the months of [from, until) when their cards expire, and by the currencies.
+// The months are in YYYYMM format, and the months without expiring cards are omitted.
+func (g *GormStorage) GetCardExpirationsByMonth(from string, until string) ([]models.CardExpirationMonth, error) {
+	errWhere := "GormStorage.GetCardExpirationsByMonth"
+	var months []models.CardExpirationMonth
+
+	err := g.db.Model(&models.PeriodicDonation{}).
+		Select("periodic_donations.card_info_expiry_date, periodic_donations.currency, COUNT(*) AS periodic_donations, COALESCE(SUM(periodic_donations.amount), 0) AS amount, COUNT(periodic_donation_card_expiry_reminders.id) AS reminded").
+		Joins("LEFT JOIN periodic_donation_card_expiry_reminders ON periodic_donation_card_expiry_reminders.periodic_id = periodic_donations.id AND periodic_donation_card_expiry_reminders.card_info_expiry_date = periodic_donations.card_info_expiry_date").
+		Where("periodic_donations.status IN (?) AND periodic_donations.last_success_at IS NOT NULL", activeCardStatuses).
+		Where("periodic_donations.card_info_expiry_date >= ? AND periodic_donations.card_info_expiry_date < ?", from, until).
+		Group("periodic_donations.card_info_expiry_date, periodic_donations.currency").
+		Order("periodic_donations.card_info_expiry_date asc, periodic_donations.currency asc").
+		Scan(&months).Error
+
+	if nil != err {
+		log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+		return months, g.NewStorageError(err, errWhere, fmt.Sprintf("cannot get card expirations(from: %s, until: %s)", from, until))
+	}
+
+	return months, nil
+}
@@ -2,10 +2,17 @@ package storage
 
 import (
 	"fmt"
+	"net/http"
+	"strings"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
+	"github.com/jinzhu/gorm"
+	"gopkg.in/guregu/null.v3"
 
+	"twreporter.org/go-api/globals"
 	"twreporter.org/go-api/models"
+	"twreporter.org/go-api/utils"
 )
 
 // CreateAPeriodicDonation creates the draft record along with the first draft tap pay transaction
@@ -36,6 +43,12 @@ func (g *GormStorage) CreateAPeriodicDonation(mpd *models.PeriodicDonation, mtd
 		return g.NewStorageError(err, errWhere, fmt.Sprintf("cannot create a draft card token donation(%#v)", mtd))
 	}
 
+	if err := writePledgeEvent(tx, models.EventPledgeCreated, mpd.ID); nil != err {
+		tx.Rollback()
+		log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+		return g.NewStorageError(err, errWhere, fmt.Sprintf("cannot write the event of the periodic donation(id: %d)", mpd.ID))
+	}
+
 	if err := tx.Commit().Error; nil != err {
 		log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
 		return g.NewStorageError(err, errWhere, "cannot commit the draft periodic donation creation transaction")
@@ -103,6 +116,24 @@ func (g *GormStorage) UpdatePeriodicAndCardTokenDonationInTRX(periodicID uint, m
 		return g.NewStorageError(err, errWhere, fmt.Sprintf("cannot update the periodic donation (data: %#v)", pd))
 	}
 
+	if err := tx.Model(&pd).Where("id = ?", periodicID).Updates(dunningUpdates(pd)).Error; nil != err {
+		tx.Rollback()
+		log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+		return g.NewStorageError(err, errWhere, fmt.Sprintf("cannot update the dunning of the periodic donation (data: %#v)", pd))
+	}
+
+	if err := writeDonationAndPledgeEvents(tx, periodicID, td.ID, pd.Status); nil != err {
+		tx.Rollback()
+		log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+		return g.NewStorageError(err, errWhere, fmt.Sprintf("cannot write the events of the periodic donation(id: %d)", periodicID))
+	}
+
+	if err := matchACardTokenDonation(tx, periodicID, td.ID); nil != err {
+		tx.Rollback()
+		log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+		return g.NewStorageError(err, errWhere, fmt.Sprintf("cannot match the installment of the periodic donation(id: %d)", periodicID))
+	}
+
 	if err := tx.Commit().Error; nil != err {
 		log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
 		return g.NewStorageError(err, errWhere, "cannot commit the draft periodic donation update transaction")
@@ -110,7 +141,915 @@ func (g *GormStorage) UpdatePeriodicAndCardTokenDonationInTRX(periodicID uint, m
 	return nil
 }
 
-//TODO
-func (g *GormStorage) CreateAPayByOtherMethodDonation(m models.PayByOtherMethodDonation) error {
+// CreateAPayByOtherMethodDonation records the donation made outside the payment gateways, and matches it in the same transaction.
+// It fails with 409 if the bank reference is recorded on another donation.
+func (g *GormStorage) CreateAPayByOtherMethodDonation(m *models.PayByOtherMethodDonation) error {
+	errWhere := "GormStorage.CreateAPayByOtherMethodDonation"
+
+	tx := g.db.Begin()
+
+	if err := tx.Error; nil != err {
+		log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+		return g.NewStorageError(err, errWhere, "cannot begin the other method donation creation transaction")
+	}
+
+	if err := tx.Create(m).Error; nil != err {
+		tx.Rollback()
+		log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+		return g.NewStorageError(err, errWhere, fmt.Sprintf("cannot create the other method donation(bank_reference: %s)", m.BankReference.ValueOrZero()))
+	}
+
+	if err := matchAPaidDonation(tx, models.MatchableDonation{
+		Amount:       m.Amount,
+		Campaign:     m.Campaign,
+		CreatedAt:    m.CreatedAt,
+		Currency:     m.Currency,
+		DonationType: globals.OthersDonationType,
+		ID:           m.ID,
+		OrderNumber:  m.OrderNumber,
+	}); nil != err {
+		tx.Rollback()
+		log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+		return g.NewStorageError(err, errWhere, fmt.Sprintf("cannot match the other method donation(id: %d)", m.ID))
+	}
+
+	if err := tx.Commit().Error; nil != err {
+		log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+		return g.NewStorageError(err, errWhere, "cannot commit the other method donation creation transaction")
+	}
+
+	return nil
+}
+
+// UpdateAPrimeDonationInTRX updates the prime donation if it is in one of the statuses, or in any status if statuses are empty.
+// The donation.paid or donation.failed event is written in the same transaction once the donation is paid or fails,
+// and so is the match of the paid donation by the sponsors.
+// It returns the number of the updated records.
+func (g *GormStorage) UpdateAPrimeDonationInTRX(id uint, statuses []string, m models.PayByPrimeDonation) (int64, error) {
+	errWhere := "GormStorage.UpdateAPrimeDonationInTRX"
+
+	tx := g.db.Begin()
+
+	if err := tx.Error; nil != err {
+		log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+		return 0, g.NewStorageError(err, errWhere, "cannot begin the prime donation update transaction")
+	}
+
+	query := tx.Model(&models.PayByPrimeDonation{}).Where("id = ?", id)
+	if len(statuses) > 0 {
+		query = query.Where("status IN (?)", statuses)
+	}
+
+	updates := query.Updates(m)
+
+	if err := updates.Error; nil != err {
+		tx.Rollback()
+		log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+		return 0, g.NewStorageError(err, errWhere, fmt.Sprintf("cannot update the prime donation(id: %d)", id))
+	}
+
+	if updates.RowsAffected == 0 {
+		tx.Rollback()
+		return 0, nil
+	}
+
+	if "" != donationEventType(m.Status) {
+		if err := writePrimeDonationEvent(tx, id); nil != err {
+			tx.Rollback()
+			log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+			return 0, g.NewStorageError(err, errWhere, fmt.Sprintf("cannot write the event of the prime donation(id: %d)", id))
+		}
+	}
+
+	if "paid" == m.Status {
+		if err := matchAPrimeDonation(tx, id); nil != err {
+			tx.Rollback()
+			log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+			return 0, g.NewStorageError(err, errWhere, fmt.Sprintf("cannot match the prime donation(id: %d)", id))
+		}
+	}
+
+	if err := tx.Commit().Error; nil != err {
+		log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+		return 0, g.NewStorageError(err, errWhere, "cannot commit the prime donation update transaction")
+	}
+
+	return updates.RowsAffected, nil
+}
+
+// StopAPeriodicDonation stops the periodic donation if it is in one of the statuses,
+// and writes the pledge.stopped event in the same transaction. It returns the number of the updated records.
+func (g *GormStorage) StopAPeriodicDonation(id uint, statuses []string, m models.PeriodicDonation) (int64, error) {
+	errWhere := "GormStorage.StopAPeriodicDonation"
+
+	tx := g.db.Begin()
+
+	if err := tx.Error; nil != err {
+		log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+		return 0, g.NewStorageError(err, errWhere, "cannot begin the periodic donation stop transaction")
+	}
+
+	updates := tx.Model(&models.PeriodicDonation{}).Where("id = ? AND status IN (?)", id, statuses).Updates(m)
+
+	if err := updates.Error; nil != err {
+		tx.Rollback()
+		log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+		return 0, g.NewStorageError(err, errWhere, fmt.Sprintf("cannot stop the periodic donation(id: %d)", id))
+	}
+
+	if updates.RowsAffected == 0 {
+		tx.Rollback()
+		return 0, nil
+	}
+
+	if err := writePledgeEvent(tx, models.EventPledgeStopped, id); nil != err {
+		tx.Rollback()
+		log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+		return 0, g.NewStorageError(err, errWhere, fmt.Sprintf("cannot write the event of the periodic donation(id: %d)", id))
+	}
+
+	if err := tx.Commit().Error; nil != err {
+		log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+		return 0, g.NewStorageError(err, errWhere, "cannot commit the periodic donation stop transaction")
+	}
+
+	return updates.RowsAffected, nil
+}
+
+// writeDonationAndPledgeEvents writes the event of the installment once it is paid or fails,
+// and the pledge.stopped event if the periodic donation turns into the status which is no longer charged
+func writeDonationAndPledgeEvents(tx *gorm.DB, periodicID uint, tokenID uint, periodicStatus string) error {
+	if err := writeCardTokenDonationEvent(tx, periodicID, tokenID); nil != err {
+		return err
+	}
+
+	if isPledgeStopped(periodicStatus) {
+		return writePledgeEvent(tx, models.EventPledgeStopped, periodicID)
+	}
+
+	return nil
+}
+
+// GetDuePeriodicDonations returns the paid periodic donations whose next installment is due at the given time,
+// and which are not paused and have not reached their max paid times yet.
+// Records are ordered by id and start after `afterID`, so that callers can walk through all due records batch by batch.
+func (g *GormStorage) GetDuePeriodicDonations(now time.Time, afterID uint, limit int) ([]models.PeriodicDonation, error) {
+	errWhere := "GormStorage.GetDuePeriodicDonations"
+	var pds []models.PeriodicDonation
+
+	err := g.db.Where("id > ? AND status = ?", afterID, "paid").
+		Where("paused_until IS NULL OR paused_until <= ?", now).
+		Where("(frequency = 'monthly' AND last_success_at <= DATE_SUB(?, INTERVAL 1 MONTH)) OR (frequency = 'yearly' AND last_success_at <= DATE_SUB(?, INTERVAL 1 YEAR))", now, now).
+		Where("max_paid_times > (SELECT COUNT(*) FROM pay_by_card_token_donations WHERE pay_by_card_token_donations.periodic_id = periodic_donations.id AND pay_by_card_token_donations.status IN ('paid', 'refunded') AND pay_by_card_token_donations.deleted_at IS NULL)").
+		Order("id asc").
+		Limit(limit).
+		Find(&pds).Error
+
+	if nil != err {
+		log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+		return pds, g.NewStorageError(err, errWhere, fmt.Sprintf("cannot get due periodic donations(now: %v, afterID: %d)", now, afterID))
+	}
+
+	return pds, nil
+}
+
+// GetDunningPeriodicDonations returns the periodic donations whose failed installments are due to be retried at the given time,
+// and which are not paused.
+// Records are ordered by id and start after `afterID`, so that callers can walk through all due records batch by batch.
+func (g *GormStorage) GetDunningPeriodicDonations(now time.Time, afterID uint, limit int) ([]models.PeriodicDonation, error) {
+	errWhere := "GormStorage.GetDunningPeriodicDonations"
+	var pds []models.PeriodicDonation
+
+	err := g.db.Where("id > ? AND status = ?", afterID, "fail").
+		Where("next_retry_at IS NOT NULL AND next_retry_at <= ?", now).
+		Where("paused_until IS NULL OR paused_until <= ?", now).
+		Order("id asc").
+		Limit(limit).
+		Find(&pds).Error
+
+	if nil != err {
+		log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+		return pds, g.NewStorageError(err, errWhere, fmt.Sprintf("cannot get dunning periodic donations(now: %v, afterID: %d)", now, afterID))
+	}
+
+	return pds, nil
+}
+
+// GetAtRiskPeriodicDonations returns the periodic donations whose failed installments are being retried,
+// and the ones which turn 'invalid' after the last retries fail since the given time.
+// Records are ordered by the time the dunning started.
+func (g *GormStorage) GetAtRiskPeriodicDonations(since time.Time) ([]models.PeriodicDonation, error) {
+	errWhere := "GormStorage.GetAtRiskPeriodicDonations"
+	var pds []models.PeriodicDonation
+
+	err := g.db.Where("dunning_started_at IS NOT NULL").
+		Where("status IN (?) OR (status = ? AND updated_at >= ?)", []string{"fail", "paying"}, "invalid", since).
+		Order("dunning_started_at asc, id asc").
+		Find(&pds).Error
+
+	if nil != err {
+		log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+		return pds, g.NewStorageError(err, errWhere, fmt.Sprintf("cannot get at-risk periodic donations(since: %v)", since))
+	}
+
+	return pds, nil
+}
+
+// dunningUpdates returns the dunning fields of the periodic donation.
+// They are updated by map since the fields are reset to zero values and null once the installment is paid.
+func dunningUpdates(mpd models.PeriodicDonation) map[string]interface{} {
+	return map[string]interface{}{
+		"dunning_retries":    mpd.DunningRetries,
+		"dunning_started_at": mpd.DunningStartedAt,
+		"next_retry_at":      mpd.NextRetryAt,
+	}
+}
+
+// GetPaidTimesOfAPeriodicDonation counts the paid card token donations of the periodic donation.
+// The refunded installments are counted as well since they were charged.
+func (g *GormStorage) GetPaidTimesOfAPeriodicDonation(periodicID uint) (uint, error) {
+	errWhere := "GormStorage.GetPaidTimesOfAPeriodicDonation"
+	var count uint
+
+	err := g.db.Model(&models.PayByCardTokenDonation{}).Where("periodic_id = ? AND status IN (?)", periodicID, []string{"paid", "refunded"}).Count(&count).Error
+
+	if nil != err {
+		log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+		return 0, g.NewStorageError(err, errWhere, fmt.Sprintf("cannot count paid card token donations(periodicID: %d)", periodicID))
+	}
+
+	return count, nil
+}
+
+// GetTheFirstInstallmentOfAPeriodicDonation returns the first card token donation of the periodic donation,
+// which is created when the card is bound
+func (g *GormStorage) GetTheFirstInstallmentOfAPeriodicDonation(periodicID uint) (models.PayByCardTokenDonation, error) {
+	errWhere := "GormStorage.GetTheFirstInstallmentOfAPeriodicDonation"
+	var td models.PayByCardTokenDonation
+
+	err := g.db.Where("periodic_id = ?", periodicID).Order("id ASC").First(&td).Error
+
+	if nil != err {
+		log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+		return td, g.NewStorageError(err, errWhere, fmt.Sprintf("cannot get the first installment(periodicID: %d)", periodicID))
+	}
+
+	return td, nil
+}
+
+// ClaimAPeriodicDonationCharge marks the periodic donation as 'paying' and creates the draft card token donation of the next installment.
+// The periodic donation is claimed only if it is still in the state the caller read,
+// which prevents two workers from charging the same installment.
+// It returns false if the periodic donation is claimed by others.
+func (g *GormStorage) ClaimAPeriodicDonationCharge(mpd models.PeriodicDonation, mtd *models.PayByCardTokenDonation) (bool, error) {
+	errWhere := "GormStorage.ClaimAPeriodicDonationCharge"
+
+	tx := g.db.Begin()
+
+	if err := tx.Error; nil != err {
+		log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+		return false, g.NewStorageError(err, errWhere, "cannot begin the periodic donation charge transaction")
+	}
+
+	claim := tx.Model(&models.PeriodicDonation{}).
+		Where("id = ? AND status = ? AND last_success_at = ? AND dunning_retries = ?", mpd.ID, mpd.Status, mpd.LastSuccessAt, mpd.DunningRetries).
+		Update("status", "paying")
+
+	if err := claim.Error; nil != err {
+		tx.Rollback()
+		log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+		return false, g.NewStorageError(err, errWhere, fmt.Sprintf("cannot claim the periodic donation(id: %d)", mpd.ID))
+	}
+
+	if claim.RowsAffected == 0 {
+		tx.Rollback()
+		return false, nil
+	}
+
+	mtd.PeriodicID = mpd.ID
+
+	// Create a draft record for the installment
+	if err := tx.Create(mtd).Error; nil != err {
+		tx.Rollback()
+		log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+		return false, g.NewStorageError(err, errWhere, fmt.Sprintf("cannot create a draft card token donation(%#v)", mtd))
+	}
+
+	if err := tx.Commit().Error; nil != err {
+		log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+		return false, g.NewStorageError(err, errWhere, "cannot commit the periodic donation charge transaction")
+	}
+
+	return true, nil
+}
+
+// ReplaceTheCardOfAPeriodicDonation binds the new card secrets and the payment gateway issuing them onto the periodic donation,
+// and keeps the card info of the replaced card in periodic_donation_card_changes.
+// The periodic donation is locked until the card is replaced,
+// and only the periodic donations which have been charged and are not being charged or stopped could replace the cards.
+// The periodic donation turns into 'paid' so that the next installment is charged with the new card.
+func (g *GormStorage) ReplaceTheCardOfAPeriodicDonation(mpd models.PeriodicDonation, mc *models.PeriodicDonationCardChange) error {
+	errWhere := "GormStorage.ReplaceTheCardOfAPeriodicDonation"
+	var old models.PeriodicDonation
+
+	tx := g.db.Begin()
+
+	if err := tx.Error; nil != err {
+		log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+		return g.NewStorageError(err, errWhere, "cannot begin the card replacement transaction")
+	}
+
+	if err := tx.Set("gorm:query_option", "FOR UPDATE").Where("id = ?", mpd.ID).Find(&old).Error; nil != err {
+		tx.Rollback()
+		log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+		return g.NewStorageError(err, errWhere, fmt.Sprintf("cannot get the periodic donation(id: %d)", mpd.ID))
+	}
+
+	if !utils.ContainsString([]string{"paid", "fail", "invalid"}, old.Status) || !old.LastSuccessAt.Valid {
+		tx.Rollback()
+		return models.NewAppError(errWhere, fmt.Sprintf("the periodic donation(id: %d) is %s, the card could not be replaced", mpd.ID, old.Status), "", http.StatusConflict)
+	}
+
+	mc.CardInfo = old.CardInfo
+	mc.PeriodicID = old.ID
+
+	if err := tx.Create(mc).Error; nil != err {
+		tx.Rollback()
+		log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+		return g.NewStorageError(err, errWhere, fmt.Sprintf("cannot create the card change(%#v)", mc))
+	}
+
+	// update by map since the fields of the new card info could be null
+	if err := tx.Model(&old).Updates(map[string]interface{}{
+		"card_info_bin_code":     mpd.CardInfo.BinCode,
+		"card_info_country":      mpd.CardInfo.Country,
+		"card_info_country_code": mpd.CardInfo.CountryCode,
+		"card_info_expiry_date":  mpd.CardInfo.ExpiryDate,
+		"card_info_funding":      mpd.CardInfo.Funding,
+		"card_info_issuer":       mpd.CardInfo.Issuer,
+		"card_info_last_four":    mpd.CardInfo.LastFour,
+		"card_info_level":        mpd.CardInfo.Level,
+		"card_info_type":         mpd.CardInfo.Type,
+		"card_key":               mpd.CardKey,
+		"card_token":             mpd.CardToken,
+		"dunning_retries":        0,
+		"dunning_started_at":     nil,
+		"next_retry_at":          nil,
+		"payment_gateway":        mpd.PaymentGateway,
+		"status":                 "paid",
+	}).Error; nil != err {
+		tx.Rollback()
+		log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+		return g.NewStorageError(err, errWhere, fmt.Sprintf("cannot update the card of the periodic donation(id: %d)", mpd.ID))
+	}
+
+	if err := tx.Commit().Error; nil != err {
+		log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+		return g.NewStorageError(err, errWhere, "cannot commit the card replacement transaction")
+	}
+
+	return nil
+}
+
+// CreateAPeriodicDonationChange schedules the change of the periodic donation.
+// A periodic donation has at most one scheduled change, the new change supersedes the other scheduled changes.
+// The change is applied at once if it is effective at `now`.
+func (g *GormStorage) CreateAPeriodicDonationChange(mc *models.PeriodicDonationChange, now time.Time) error {
+	errWhere := "GormStorage.CreateAPeriodicDonationChange"
+	var pd models.PeriodicDonation
+
+	tx := g.db.Begin()
+
+	if err := tx.Error; nil != err {
+		log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+		return g.NewStorageError(err, errWhere, "cannot begin the periodic donation change transaction")
+	}
+
+	if err := tx.Set("gorm:query_option", "FOR UPDATE").Where("id = ?", mc.PeriodicID).Find(&pd).Error; nil != err {
+		tx.Rollback()
+		log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+		return g.NewStorageError(err, errWhere, fmt.Sprintf("cannot get the periodic donation(id: %d)", mc.PeriodicID))
+	}
+
+	if "stopped" == pd.Status || "invalid" == pd.Status {
+		tx.Rollback()
+		return models.NewAppError(errWhere, fmt.Sprintf("the periodic donation(id: %d) is %s, it could not be changed", pd.ID, pd.Status), "", http.StatusConflict)
+	}
+
+	if err := tx.Model(&models.PeriodicDonationChange{}).Where("periodic_id = ? AND status = ?", pd.ID, "scheduled").Update("status", "cancelled").Error; nil != err {
+		tx.Rollback()
+		log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+		return g.NewStorageError(err, errWhere, fmt.Sprintf("cannot cancel the scheduled changes of the periodic donation(id: %d)", pd.ID))
+	}
+
+	mc.Status = "scheduled"
+
+	if err := tx.Create(mc).Error; nil != err {
+		tx.Rollback()
+		log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+		return g.NewStorageError(err, errWhere, fmt.Sprintf("cannot create the periodic donation change(%#v)", mc))
+	}
+
+	if !mc.EffectiveAt.After(now) {
+		if err := applyAPeriodicDonationChange(tx, pd, mc, now); nil != err {
+			tx.Rollback()
+			log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+			return g.NewStorageError(err, errWhere, fmt.Sprintf("cannot apply the periodic donation change(id: %d)", mc.ID))
+		}
+	}
+
+	if err := tx.Commit().Error; nil != err {
+		log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+		return g.NewStorageError(err, errWhere, "cannot commit the periodic donation change transaction")
+	}
+
+	return nil
+}
+
+// ApplyDuePeriodicDonationChanges applies the scheduled changes which are effective at `now` in order of the effective time,
+// and returns the number of the applied changes.
+// The changes of the periodic donations which are stopped or invalid are cancelled instead.
+func (g *GormStorage) ApplyDuePeriodicDonationChanges(now time.Time) (int, error) {
+	errWhere := "GormStorage.ApplyDuePeriodicDonationChanges"
+	var applied int
+	var ids []uint
+
+	if err := g.db.Model(&models.PeriodicDonationChange{}).Where("status = ? AND effective_at <= ?", "scheduled", now).Order("effective_at asc, id asc").Pluck("id", &ids).Error; nil != err {
+		log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+		return 0, g.NewStorageError(err, errWhere, fmt.Sprintf("cannot get the due periodic donation changes(now: %v)", now))
+	}
+
+	for _, id := range ids {
+		var mc models.PeriodicDonationChange
+		var pd models.PeriodicDonation
+
+		tx := g.db.Begin()
+
+		if err := tx.Error; nil != err {
+			log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+			return applied, g.NewStorageError(err, errWhere, "cannot begin the periodic donation change transaction")
+		}
+
+		// the change might be applied or superseded by others in the meantime
+		if err := tx.Set("gorm:query_option", "FOR UPDATE").Where("id = ? AND status = ?", id, "scheduled").Find(&mc).Error; nil != err {
+			tx.Rollback()
+			if IsRecordNotFoundError(err) {
+				continue
+			}
+			log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+			return applied, g.NewStorageError(err, errWhere, fmt.Sprintf("cannot get the periodic donation change(id: %d)", id))
+		}
+
+		if err := tx.Set("gorm:query_option", "FOR UPDATE").Where("id = ?", mc.PeriodicID).Find(&pd).Error; nil != err {
+			tx.Rollback()
+			log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+			return applied, g.NewStorageError(err, errWhere, fmt.Sprintf("cannot get the periodic donation(id: %d)", mc.PeriodicID))
+		}
+
+		if "stopped" == pd.Status || "invalid" == pd.Status {
+			mc.Status = "cancelled"
+			if err := tx.Model(&mc).Update("status", mc.Status).Error; nil != err {
+				tx.Rollback()
+				log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+				return applied, g.NewStorageError(err, errWhere, fmt.Sprintf("cannot cancel the periodic donation change(id: %d)", id))
+			}
+		} else {
+			if err := applyAPeriodicDonationChange(tx, pd, &mc, now); nil != err {
+				tx.Rollback()
+				log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+				return applied, g.NewStorageError(err, errWhere, fmt.Sprintf("cannot apply the periodic donation change(id: %d)", id))
+			}
+			applied++
+		}
+
+		if err := tx.Commit().Error; nil != err {
+			log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+			return applied, g.NewStorageError(err, errWhere, "cannot commit the periodic donation change transaction")
+		}
+	}
+
+	return applied, nil
+}
+
+// applyAPeriodicDonationChange updates the periodic donation with the non-null fields of the change,
+// and marks the change as applied along with the previous values of the periodic donation.
+func applyAPeriodicDonationChange(tx *gorm.DB, pd models.PeriodicDonation, mc *models.PeriodicDonationChange, now time.Time) error {
+	mc.AppliedAt = null.TimeFrom(now)
+	mc.PreviousAmount = null.IntFrom(int64(pd.Amount))
+	mc.PreviousFrequency = null.StringFrom(pd.Frequency)
+	mc.PreviousPausedUntil = pd.PausedUntil
+	mc.Status = "applied"
+
+	updates := map[string]interface{}{}
+
+	if mc.Amount.Valid {
+		updates["amount"] = mc.Amount.Int64
+	}
+
+	if mc.Frequency.Valid {
+		updates["frequency"] = mc.Frequency.String
+	}
+
+	if mc.PausedUntil.Valid {
+		updates["paused_until"] = mc.PausedUntil
+	}
+
+	if err := tx.Model(&pd).Updates(updates).Error; nil != err {
+		return err
+	}
+
+	return tx.Model(mc).Updates(map[string]interface{}{
+		"applied_at":            mc.AppliedAt,
+		"previous_amount":       mc.PreviousAmount,
+		"previous_frequency":    mc.PreviousFrequency,
+		"previous_paused_until": mc.PreviousPausedUntil,
+		"status":                mc.Status,
+	}).Error
+}
+
+// GetStalePayingDonations loads the 'paying' donations which are not updated since `before` into `m`,
+// which should be a pointer to a slice of prime or card token donations.
+// Records are ordered by id and start after `afterID`, so that callers can walk through all stale records batch by batch.
+func (g *GormStorage) GetStalePayingDonations(before time.Time, afterID uint, limit int, m interface{}) error {
+	errWhere := "GormStorage.GetStalePayingDonations"
+
+	err := g.db.Where("id > ? AND status = ? AND updated_at <= ?", afterID, "paying", before).
+		Order("id asc").
+		Limit(limit).
+		Find(m).Error
+
+	if nil != err {
+		log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+		return g.NewStorageError(err, errWhere, fmt.Sprintf("cannot get stale paying donations(before: %v, afterID: %d)", before, afterID))
+	}
+
+	return nil
+}
+
+// ResolveAPayingCardTokenDonation updates the 'paying' card token donation and its periodic donation with the transaction result.
+// The records are updated only if they are still 'paying', so the result is never applied twice.
+// The pending card secrets of the card token donation are erased, the caller moves them onto the periodic donation if it is paid.
+// It returns false if the card token donation has been resolved by others.
+func (g *GormStorage) ResolveAPayingCardTokenDonation(mtd models.PayByCardTokenDonation, mpd models.PeriodicDonation) (bool, error) {
+	errWhere := "GormStorage.ResolveAPayingCardTokenDonation"
+
+	tx := g.db.Begin()
+
+	if err := tx.Error; nil != err {
+		log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+		return false, g.NewStorageError(err, errWhere, "cannot begin the card token donation resolution transaction")
+	}
+
+	updates := tx.Model(&models.PayByCardTokenDonation{}).Where("id = ? AND status = ?", mtd.ID, "paying").Updates(mtd)
+
+	if err := updates.Error; nil != err {
+		tx.Rollback()
+		log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+		return false, g.NewStorageError(err, errWhere, fmt.Sprintf("cannot update the card token donation(data: %#v)", mtd))
+	}
+
+	if updates.RowsAffected == 0 {
+		tx.Rollback()
+		return false, nil
+	}
+
+	if err := tx.Model(&models.PayByCardTokenDonation{}).Where("id = ?", mtd.ID).Updates(map[string]interface{}{
+		"pending_card_key":   nil,
+		"pending_card_token": nil,
+	}).Error; nil != err {
+		tx.Rollback()
+		log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+		return false, g.NewStorageError(err, errWhere, fmt.Sprintf("cannot erase the pending card secrets of the card token donation(id: %d)", mtd.ID))
+	}
+
+	// the dunning is updated before the status, which is the condition of both updates
+	if err := tx.Model(&models.PeriodicDonation{}).Where("id = ? AND status = ?", mpd.ID, "paying").Updates(dunningUpdates(mpd)).Error; nil != err {
+		tx.Rollback()
+		log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+		return false, g.NewStorageError(err, errWhere, fmt.Sprintf("cannot update the dunning of the periodic donation(data: %#v)", mpd))
+	}
+
+	if err := tx.Model(&models.PeriodicDonation{}).Where("id = ? AND status = ?", mpd.ID, "paying").Updates(mpd).Error; nil != err {
+		tx.Rollback()
+		log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+		return false, g.NewStorageError(err, errWhere, fmt.Sprintf("cannot update the periodic donation(data: %#v)", mpd))
+	}
+
+	if err := writeDonationAndPledgeEvents(tx, mpd.ID, mtd.ID, mpd.Status); nil != err {
+		tx.Rollback()
+		log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+		return false, g.NewStorageError(err, errWhere, fmt.Sprintf("cannot write the events of the card token donation(id: %d)", mtd.ID))
+	}
+
+	if err := matchACardTokenDonation(tx, mpd.ID, mtd.ID); nil != err {
+		tx.Rollback()
+		log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+		return false, g.NewStorageError(err, errWhere, fmt.Sprintf("cannot match the card token donation(id: %d)", mtd.ID))
+	}
+
+	if err := tx.Commit().Error; nil != err {
+		log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+		return false, g.NewStorageError(err, errWhere, "cannot commit the card token donation resolution transaction")
+	}
+
+	return true, nil
+}
+
+// refundedDonationTables maps the donation types which could be refunded onto their tables
+var refundedDonationTables = map[string]string{
+	globals.PrimeDonaitionType: globals.TablePayByPrimeDonations,
+	globals.TokenDonationType:  globals.TablePayByCardTokenDonations,
+}
+
+// CreateADraftDonationRefund creates a 'refunding' record for the donation.
+// The donation is locked until the record is created,
+// so the sum of the refunds never exceeds the donation amount even if refunds are requested at the same time.
+// If the amount of the refund is zero, the rest of the donation amount is refunded.
+func (g *GormStorage) CreateADraftDonationRefund(mr *models.DonationRefund) error {
+	errWhere := "GormStorage.CreateADraftDonationRefund"
+	var d struct {
+		Amount uint
+		Status string
+	}
+	var refunded struct {
+		Total uint
+	}
+
+	table, ok := refundedDonationTables[mr.DonationType]
+	if !ok {
+		return models.NewAppError(errWhere, fmt.Sprintf("donation type %s cannot be refunded", mr.DonationType), "", http.StatusBadRequest)
+	}
+
+	tx := g.db.Begin()
+
+	if err := tx.Error; nil != err {
+		log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+		return g.NewStorageError(err, errWhere, "cannot begin the donation refund transaction")
+	}
+
+	if err := tx.Set("gorm:query_option", "FOR UPDATE").Table(table).Select("amount, status").Where("id = ? AND deleted_at IS NULL", mr.DonationID).Scan(&d).Error; nil != err {
+		tx.Rollback()
+		log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+		return g.NewStorageError(err, errWhere, fmt.Sprintf("cannot get the %s donation(id: %d)", mr.DonationType, mr.DonationID))
+	}
+
+	if "paid" != d.Status {
+		tx.Rollback()
+		return models.NewAppError(errWhere, fmt.Sprintf("the %s donation(id: %d) is %s, only paid donations could be refunded", mr.DonationType, mr.DonationID, d.Status), "", http.StatusConflict)
+	}
+
+	// refunds which are not failed occupy the refundable amount
+	if err := tx.Model(&models.DonationRefund{}).Select("COALESCE(SUM(amount), 0) AS total").Where("donation_id = ? AND donation_type = ? AND status <> ?", mr.DonationID, mr.DonationType, "fail").Scan(&refunded).Error; nil != err {
+		tx.Rollback()
+		log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+		return g.NewStorageError(err, errWhere, fmt.Sprintf("cannot sum the refunds of the %s donation(id: %d)", mr.DonationType, mr.DonationID))
+	}
+
+	if 0 == mr.Amount {
+		mr.Amount = d.Amount - refunded.Total
+	}
+
+	if 0 == mr.Amount || refunded.Total+mr.Amount > d.Amount {
+		tx.Rollback()
+		return models.NewAppError(errWhere, fmt.Sprintf("refund amount exceeds the refundable amount(%d) of the %s donation(id: %d)", d.Amount-refunded.Total, mr.DonationType, mr.DonationID), "", http.StatusConflict)
+	}
+
+	if err := tx.Create(mr).Error; nil != err {
+		tx.Rollback()
+		log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+		return g.NewStorageError(err, errWhere, fmt.Sprintf("cannot create a draft donation refund(%#v)", mr))
+	}
+
+	if err := tx.Commit().Error; nil != err {
+		log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+		return g.NewStorageError(err, errWhere, "cannot commit the donation refund transaction")
+	}
+
 	return nil
 }
+
+// GetStaleRefundingRefunds returns the refunds which are left in 'refunding' since `before`.
+// Records are ordered by id and start after `afterID`, so that callers can walk through all stale records batch by batch.
+func (g *GormStorage) GetStaleRefundingRefunds(before time.Time, afterID uint, limit int) ([]models.DonationRefund, error) {
+	errWhere := "GormStorage.GetStaleRefundingRefunds"
+	var refunds []models.DonationRefund
+
+	err := g.db.Where("id > ? AND status = ? AND updated_at <= ?", afterID, "refunding", before).
+		Order("id asc").
+		Limit(limit).
+		Find(&refunds).Error
+
+	if nil != err {
+		log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+		return refunds, g.NewStorageError(err, errWhere, fmt.Sprintf("cannot get stale refunding refunds(before: %v, afterID: %d)", before, afterID))
+	}
+
+	return refunds, nil
+}
+
+// GetRefundedAmountOfADonation sums the amounts of the refunded refunds of the donation
+func (g *GormStorage) GetRefundedAmountOfADonation(donationType string, donationID uint) (uint, error) {
+	errWhere := "GormStorage.GetRefundedAmountOfADonation"
+	var refunded struct {
+		Total uint
+	}
+
+	if err := g.db.Model(&models.DonationRefund{}).Select("COALESCE(SUM(amount), 0) AS total").Where("donation_id = ? AND donation_type = ? AND status = ?", donationID, donationType, "refunded").Scan(&refunded).Error; nil != err {
+		log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+		return 0, g.NewStorageError(err, errWhere, fmt.Sprintf("cannot sum the refunds of the %s donation(id: %d)", donationType, donationID))
+	}
+
+	return refunded.Total, nil
+}
+
+// UpdateADonationRefundInTRX updates the refund with the response of TapPay.
+// The match of the refunded donation is reduced in proportion to the refund in the same transaction.
+// Once the refunds cover the whole donation amount, the donation turns into 'refunded'.
+// It returns whether the donation is fully refunded.
+func (g *GormStorage) UpdateADonationRefundInTRX(mr models.DonationRefund) (bool, error) {
+	errWhere := "GormStorage.UpdateADonationRefundInTRX"
+	var d struct {
+		Amount uint
+	}
+	var fullyRefunded bool
+	var refunded struct {
+		Total uint
+	}
+
+	table, ok := refundedDonationTables[mr.DonationType]
+	if !ok {
+		return false, models.NewAppError(errWhere, fmt.Sprintf("donation type %s cannot be refunded", mr.DonationType), "", http.StatusBadRequest)
+	}
+
+	tx := g.db.Begin()
+
+	if err := tx.Error; nil != err {
+		log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+		return false, g.NewStorageError(err, errWhere, "cannot begin the donation refund update transaction")
+	}
+
+	if err := tx.Model(&mr).Updates(mr).Error; nil != err {
+		tx.Rollback()
+		log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+		return false, g.NewStorageError(err, errWhere, fmt.Sprintf("cannot update the donation refund(data: %#v)", mr))
+	}
+
+	if "refunded" == mr.Status {
+		if err := tx.Table(table).Select("amount").Where("id = ?", mr.DonationID).Scan(&d).Error; nil != err {
+			tx.Rollback()
+			log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+			return false, g.NewStorageError(err, errWhere, fmt.Sprintf("cannot get the %s donation(id: %d)", mr.DonationType, mr.DonationID))
+		}
+
+		if err := tx.Model(&models.DonationRefund{}).Select("COALESCE(SUM(amount), 0) AS total").Where("donation_id = ? AND donation_type = ? AND status = ?", mr.DonationID, mr.DonationType, "refunded").Scan(&refunded).Error; nil != err {
+			tx.Rollback()
+			log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+			return false, g.NewStorageError(err, errWhere, fmt.Sprintf("cannot sum the refunds of the %s donation(id: %d)", mr.DonationType, mr.DonationID))
+		}
+
+		var remaining uint
+		if refunded.Total < d.Amount {
+			remaining = d.Amount - refunded.Total
+		}
+
+		if err := unmatchARefundedDonation(tx, mr.DonationType, mr.DonationID, remaining); nil != err {
+			tx.Rollback()
+			log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+			return false, g.NewStorageError(err, errWhere, fmt.Sprintf("cannot reduce the match of the %s donation(id: %d)", mr.DonationType, mr.DonationID))
+		}
+
+		if refunded.Total >= d.Amount {
+			fullyRefunded = true
+
+			if err := tx.Table(table).Where("id = ?", mr.DonationID).Update("status", "refunded").Error; nil != err {
+				tx.Rollback()
+				log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+				return false, g.NewStorageError(err, errWhere, fmt.Sprintf("cannot update the %s donation(id: %d) to refunded", mr.DonationType, mr.DonationID))
+			}
+		}
+	}
+
+	if err := tx.Commit().Error; nil != err {
+		log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+		return false, g.NewStorageError(err, errWhere, "cannot commit the donation refund update transaction")
+	}
+
+	return fullyRefunded, nil
+}
+
+// GetDonationIndexesOfAUser merges the prime, periodic and other method donations of the user,
+// and returns the indexes of the donations sorted by the creation time in descending order,
+// along with the total number of the donations matching the filter.
+func (g *GormStorage) GetDonationIndexesOfAUser(userID uint, filter models.DonationFilter, limit, offset int) ([]models.DonationIndex, int, error) {
+	errWhere := "GormStorage.GetDonationIndexesOfAUser"
+	var args []interface{}
+	var count struct {
+		Total int
+	}
+	var indexes []models.DonationIndex
+	var subqueries []string
+
+	tables := []struct {
+		name         string
+		donationType string
+		hasStatus    bool
+	}{
+		{globals.TablePayByPrimeDonations, globals.PrimeDonaitionType, true},
+		{globals.TablePeriodicDonations, globals.PeriodicDonationType, true},
+		{globals.TablePayByOtherMethodDonations, globals.OthersDonationType, false},
+	}
+
+	for _, t := range tables {
+		if len(filter.Types) > 0 && !utils.ContainsString(filter.Types, t.donationType) {
+			continue
+		}
+
+		conds := []string{"user_id = ?", "deleted_at IS NULL"}
+		tableArgs := []interface{}{userID}
+
+		if filter.Status != "" {
+			if t.hasStatus {
+				conds = append(conds, "status = ?")
+				tableArgs = append(tableArgs, filter.Status)
+			} else if "paid" != filter.Status {
+				// other method donations are always paid
+				continue
+			}
+		}
+
+		if filter.Since.Valid {
+			conds = append(conds, "created_at >= ?")
+			tableArgs = append(tableArgs, filter.Since.Time)
+		}
+
+		if filter.Until.Valid {
+			conds = append(conds, "created_at < ?")
+			tableArgs = append(tableArgs, filter.Until.Time)
+		}
+
+		subqueries = append(subqueries, fmt.Sprintf("SELECT id, '%s' AS type, created_at FROM %s WHERE %s", t.donationType, t.name, strings.Join(conds, " AND ")))
+		args = append(args, tableArgs...)
+	}
+
+	if len(subqueries) == 0 {
+		return indexes, 0, nil
+	}
+
+	union := strings.Join(subqueries, " UNION ALL ")
+
+	if err := g.db.Raw(fmt.Sprintf("SELECT COUNT(*) AS total FROM (%s) AS donations", union), args...).Scan(&count).Error; nil != err {
+		log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+		return indexes, 0, g.NewStorageError(err, errWhere, fmt.Sprintf("cannot count the donations of the user(id: %d)", userID))
+	}
+
+	args = append(args, limit, offset)
+
+	if err := g.db.Raw(fmt.Sprintf("SELECT id, type, created_at FROM (%s) AS donations ORDER BY created_at DESC, id DESC LIMIT ? OFFSET ?", union), args...).Scan(&indexes).Error; nil != err {
+		log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+		return indexes, 0, g.NewStorageError(err, errWhere, fmt.Sprintf("cannot get the donations of the user(id: %d)", userID))
+	}
+
+	return indexes, count.Total, nil
+}
+
+// GetPeriodicDonationCardSecrets returns the ids and the encrypted card secrets of the periodic donations which have card secrets.
+// Records are ordered by id and start after `afterID`, so that callers can walk through all records batch by batch.
+func (g *GormStorage) GetPeriodicDonationCardSecrets(afterID uint, limit int) ([]models.PeriodicDonation, error) {
+	errWhere := "GormStorage.GetPeriodicDonationCardSecrets"
+	var pds []models.PeriodicDonation
+
+	err := g.db.Select("id, card_key, card_token").
+		Where("id > ?", afterID).
+		Where("card_key IS NOT NULL AND card_key != '' AND card_token IS NOT NULL AND card_token != ''").
+		Order("id asc").
+		Limit(limit).
+		Find(&pds).Error
+
+	if nil != err {
+		log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+		return pds, g.NewStorageError(err, errWhere, fmt.Sprintf("cannot get the card secrets of periodic donations(afterID: %d)", afterID))
+	}
+
+	return pds, nil
+}
+
+// UpdateTheCardSecretsOfAPeriodicDonation replaces the encrypted card secrets of the periodic donation,
+// only if they are still the ones the caller read, so that the card replaced in the meantime is never overwritten.
+// It returns false if the card secrets are changed by others.
+func (g *GormStorage) UpdateTheCardSecretsOfAPeriodicDonation(old models.PeriodicDonation, cardKey, cardToken string) (bool, error) {
+	errWhere := "GormStorage.UpdateTheCardSecretsOfAPeriodicDonation"
+
+	db := g.db.Model(&models.PeriodicDonation{}).
+		Where("id = ? AND card_key = ? AND card_token = ?", old.ID, old.CardKey, old.CardToken).
+		Updates(map[string]interface{}{
+			"card_key":   cardKey,
+			"card_token": cardToken,
+		})
+
+	if err := db.Error; nil != err {
+		log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+		return false, g.NewStorageError(err, errWhere, fmt.Sprintf("cannot update the card secrets of the periodic donation(id: %d)", old.ID))
+	}
+
+	return db.RowsAffected > 0, nil
+}
@@ -0,0 +1,140 @@
+package storage
+
+import (
+	"fmt"
+
+	log "github.com/Sirupsen/logrus"
+
+	"twreporter.org/go-api/models"
+)
+
+// GetADonorProfile returns the donor profile of the user
+func (g *GormStorage) GetADonorProfile(userID uint) (models.DonorProfile, error) {
+	errWhere := "GormStorage.GetADonorProfile"
+	var profile models.DonorProfile
+
+	if err := g.db.Where("user_id = ?", userID).First(&profile).Error; nil != err {
+		if !IsRecordNotFoundError(err) {
+			log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+		}
+		return profile, g.NewStorageError(err, errWhere, fmt.Sprintf("cannot get the donor profile of the user(id: %d)", userID))
+	}
+
+	return profile, nil
+}
+
+// SaveADonorProfile creates the donor profile of the user, or replaces all the fields of the existing one
+func (g *GormStorage) SaveADonorProfile(m *models.DonorProfile) error {
+	errWhere := "GormStorage.SaveADonorProfile"
+	var existing models.DonorProfile
+
+	tx := g.db.Begin()
+
+	if err := tx.Error; nil != err {
+		log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+		return g.NewStorageError(err, errWhere, "cannot begin the donor profile save transaction")
+	}
+
+	err := tx.Set("gorm:query_option", "FOR UPDATE").Where("user_id = ?", m.UserID).First(&existing).Error
+
+	switch {
+	case nil == err:
+		m.ID = existing.ID
+		m.CreatedAt = existing.CreatedAt
+		err = tx.Save(m).Error
+	case IsRecordNotFoundError(err):
+		err = tx.Create(m).Error
+	}
+
+	if nil != err {
+		tx.Rollback()
+		log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+		return g.NewStorageError(err, errWhere, fmt.Sprintf("cannot save the donor profile of the user(id: %d)", m.UserID))
+	}
+
+	if err = tx.Commit().Error; nil != err {
+		log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+		return g.NewStorageError(err, errWhere, "cannot commit the donor profile save transaction")
+	}
+
+	return nil
+}
+
+// GetCardedPeriodicDonationsOfAUser returns the active periodic donations of the user along with their masked card info, ordered by id
+func (g *GormStorage) GetCardedPeriodicDonationsOfAUser(userID uint) ([]models.PeriodicDonation, error) {
+	errWhere := "GormStorage.GetCardedPeriodicDonationsOfAUser"
+	var pds []models.PeriodicDonation
+
+	err := g.db.Select("id, order_number, status, card_info_bin_code, card_info_expiry_date, card_info_last_four, card_info_type, payment_gateway").
+		Where("user_id = ? AND status IN (?)", userID, activeCardStatuses).
+		Where("last_success_at IS NOT NULL AND card_info_last_four IS NOT NULL").
+		Order("id asc").
+		Find(&pds).Error
+
+	if nil != err {
+		log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+		return pds, g.NewStorageError(err, errWhere, fmt.Sprintf("cannot get the periodic donations with cards of the user(id: %d)", userID))
+	}
+
+	return pds, nil
+}
+
+// StopThePeriodicDonationsOfARemovedCard stops the periodic donations among `ids` which are still charged by the removed card,
+// erases their card secrets, and writes the pledge.stopped events in the same transaction.
+// It returns the ids of the stopped periodic donations.
+func (g *GormStorage) StopThePeriodicDonationsOfARemovedCard(ids []uint, m models.PeriodicDonation) ([]uint, error) {
+	errWhere := "GormStorage.StopThePeriodicDonationsOfARemovedCard"
+	var pds []models.PeriodicDonation
+	var stopped []uint
+
+	tx := g.db.Begin()
+
+	if err := tx.Error; nil != err {
+		log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+		return stopped, g.NewStorageError(err, errWhere, "cannot begin the card removal transaction")
+	}
+
+	// lock the periodic donations, so that none of them is being charged while the card is removed
+	if err := tx.Set("gorm:query_option", "FOR UPDATE").Select("id").Where("id IN (?) AND status IN (?)", ids, activeCardStatuses).Find(&pds).Error; nil != err {
+		tx.Rollback()
+		log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+		return stopped, g.NewStorageError(err, errWhere, fmt.Sprintf("cannot lock the periodic donations(ids: %v)", ids))
+	}
+
+	for _, pd := range pds {
+		stopped = append(stopped, pd.ID)
+	}
+
+	if len(stopped) == 0 {
+		tx.Rollback()
+		return stopped, nil
+	}
+
+	if err := tx.Model(&models.PeriodicDonation{}).Where("id IN (?)", stopped).Updates(m).Error; nil != err {
+		tx.Rollback()
+		log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+		return nil, g.NewStorageError(err, errWhere, fmt.Sprintf("cannot stop the periodic donations(ids: %v)", stopped))
+	}
+
+	// gorm skips the blank fields of the struct, so the card secrets are erased by a map
+	if err := tx.Model(&models.PeriodicDonation{}).Where("id IN (?)", stopped).Updates(map[string]interface{}{"card_key": nil, "card_token": nil}).Error; nil != err {
+		tx.Rollback()
+		log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+		return nil, g.NewStorageError(err, errWhere, fmt.Sprintf("cannot erase the card secrets of the periodic donations(ids: %v)", stopped))
+	}
+
+	for _, id := range stopped {
+		if err := writePledgeEvent(tx, models.EventPledgeStopped, id); nil != err {
+			tx.Rollback()
+			log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+			return nil, g.NewStorageError(err, errWhere, fmt.Sprintf("cannot write the event of the periodic donation(id: %d)", id))
+		}
+	}
+
+	if err := tx.Commit().Error; nil != err {
+		log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+		return nil, g.NewStorageError(err, errWhere, "cannot commit the card removal transaction")
+	}
+
+	return stopped, nil
+}
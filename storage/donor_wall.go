@@ -0,0 +1,67 @@
+package storage
+
+import (
+	"fmt"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+
+	"twreporter.org/go-api/globals"
+	"twreporter.org/go-api/models"
+)
+
+// donorWallQueries select the donations whose donors agree to be listed on the donor wall.
+// Only the fields shown on the wall are selected, and the amounts are selected as NULL if the donors hide them.
+var donorWallQueries = []string{
+	fmt.Sprintf(`SELECT id, display_name, IF(hide_amount, NULL, amount) AS amount, currency, campaign, created_at, 'one_time' AS frequency FROM %s
+		WHERE deleted_at IS NULL AND status = 'paid' AND show_on_wall = 1 AND display_name IS NOT NULL AND display_name != ''`, globals.TablePayByPrimeDonations),
+	fmt.Sprintf(`SELECT id, display_name, IF(hide_amount, NULL, amount) AS amount, currency, campaign, created_at, frequency FROM %s
+		WHERE deleted_at IS NULL AND last_success_at IS NOT NULL AND show_on_wall = 1 AND display_name IS NOT NULL AND display_name != ''`, globals.TablePeriodicDonations),
+}
+
+// GetDonorWallEntries returns the donations listed on the donor wall sorted by the creation time in descending order,
+// along with the total number of the donations matching the filter
+func (g *GormStorage) GetDonorWallEntries(filter models.DonorWallFilter, limit, offset int) ([]models.DonorWallEntry, int, error) {
+	errWhere := "GormStorage.GetDonorWallEntries"
+	var args []interface{}
+	var count struct {
+		Total int
+	}
+	var entries []models.DonorWallEntry
+	var subqueries []string
+
+	for _, query := range donorWallQueries {
+		if filter.Campaign != "" {
+			query += " AND campaign = ?"
+			args = append(args, filter.Campaign)
+		}
+
+		if filter.Since.Valid {
+			query += " AND created_at >= ?"
+			args = append(args, filter.Since.Time)
+		}
+
+		if filter.Until.Valid {
+			query += " AND created_at < ?"
+			args = append(args, filter.Until.Time)
+		}
+
+		subqueries = append(subqueries, query)
+	}
+
+	union := strings.Join(subqueries, " UNION ALL ")
+
+	if err := g.db.Raw(fmt.Sprintf("SELECT COUNT(*) AS total FROM (%s) AS donations", union), args...).Scan(&count).Error; nil != err {
+		log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+		return entries, 0, g.NewStorageError(err, errWhere, fmt.Sprintf("cannot count the donations on the donor wall(filter: %+v)", filter))
+	}
+
+	args = append(args, limit, offset)
+
+	if err := g.db.Raw(fmt.Sprintf("SELECT * FROM (%s) AS donations ORDER BY created_at DESC, id DESC LIMIT ? OFFSET ?", union), args...).Scan(&entries).Error; nil != err {
+		log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+		return entries, 0, g.NewStorageError(err, errWhere, fmt.Sprintf("cannot get the donations on the donor wall(filter: %+v)", filter))
+	}
+
+	return entries, count.Total, nil
+}
@@ -0,0 +1,55 @@
+package storage
+
+import (
+	"fmt"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	"twreporter.org/go-api/models"
+)
+
+// the layout of the date column, dates are passed as strings so that they are never shifted by the time zones
+const exchangeRateDateLayout = "2006-01-02"
+
+// UpsertExchangeRates stores the rates in a transaction, the existing rates of the same dates and currencies are overwritten
+func (g *GormStorage) UpsertExchangeRates(rates []models.ExchangeRate) error {
+	errWhere := "GormStorage.UpsertExchangeRates"
+	now := time.Now()
+
+	tx := g.db.Begin()
+
+	if err := tx.Error; nil != err {
+		log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+		return g.NewStorageError(err, errWhere, "cannot begin the exchange rates transaction")
+	}
+
+	for _, r := range rates {
+		if err := tx.Exec("INSERT INTO exchange_rates (created_at, updated_at, date, currency, rate) VALUES (?, ?, ?, ?, ?) ON DUPLICATE KEY UPDATE rate = VALUES(rate), updated_at = VALUES(updated_at), deleted_at = NULL",
+			now, now, r.Date.Format(exchangeRateDateLayout), r.Currency, r.Rate).Error; nil != err {
+			tx.Rollback()
+			log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+			return g.NewStorageError(err, errWhere, fmt.Sprintf("cannot store the exchange rate(%s on %s)", r.Currency, r.Date.Format(exchangeRateDateLayout)))
+		}
+	}
+
+	if err := tx.Commit().Error; nil != err {
+		log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+		return g.NewStorageError(err, errWhere, "cannot commit the exchange rates transaction")
+	}
+
+	return nil
+}
+
+// GetExchangeRates returns the rates on or before the date of `until`, see `models.ExchangeRate.Date`
+func (g *GormStorage) GetExchangeRates(until time.Time) ([]models.ExchangeRate, error) {
+	errWhere := "GormStorage.GetExchangeRates"
+	var rates []models.ExchangeRate
+
+	if err := g.db.Where("date <= ?", until.Format(exchangeRateDateLayout)).Order("date asc").Find(&rates).Error; nil != err {
+		log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+		return rates, g.NewStorageError(err, errWhere, fmt.Sprintf("cannot get the exchange rates(until: %s)", until.Format(exchangeRateDateLayout)))
+	}
+
+	return rates, nil
+}
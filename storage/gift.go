@@ -0,0 +1,106 @@
+package storage
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"gopkg.in/guregu/null.v3"
+
+	"twreporter.org/go-api/globals"
+	"twreporter.org/go-api/models"
+)
+
+// GetGiftEligiblePeriodicDonations returns the active periodic donations which want the feedback gifts,
+// meet the rule and are not queued yet.
+// Records are ordered by id and start after `afterID`, so that callers can walk through all records batch by batch.
+func (g *GormStorage) GetGiftEligiblePeriodicDonations(rule models.FeedbackGiftRule, afterID uint, limit int) ([]models.PeriodicDonation, error) {
+	errWhere := "GormStorage.GetGiftEligiblePeriodicDonations"
+	var amountArgs []interface{}
+	var amountConds []string
+	var pds []models.PeriodicDonation
+
+	for code, minAmount := range rule.MinAmounts {
+		amountConds = append(amountConds, "(currency = ? AND amount >= ?)")
+		amountArgs = append(amountArgs, code, minAmount)
+	}
+
+	if len(amountConds) == 0 {
+		return pds, nil
+	}
+
+	err := g.db.Where("id > ? AND status IN (?) AND to_feedback = ?", afterID, activeCardStatuses, true).
+		Where(strings.Join(amountConds, " OR "), amountArgs...).
+		Where(fmt.Sprintf("NOT EXISTS (SELECT 1 FROM %s AS g WHERE g.periodic_id = %s.id)", globals.TableGiftFulfillments, globals.TablePeriodicDonations)).
+		Where(fmt.Sprintf("(SELECT COUNT(*) FROM %s AS t WHERE t.periodic_id = %s.id AND t.status = 'paid') >= ?", globals.TablePayByCardTokenDonations, globals.TablePeriodicDonations), rule.MinInstallments).
+		Order("id asc").
+		Limit(limit).
+		Find(&pds).Error
+
+	if nil != err {
+		log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+		return pds, g.NewStorageError(err, errWhere, fmt.Sprintf("cannot get the gift eligible periodic donations(rule: %+v, afterID: %d)", rule, afterID))
+	}
+
+	return pds, nil
+}
+
+// CreateAGiftFulfillment queues the feedback gift of the periodic donation.
+// It returns false if the gift is already queued, so that a gift is never queued twice by concurrent workers.
+func (g *GormStorage) CreateAGiftFulfillment(m *models.GiftFulfillment) (bool, error) {
+	errWhere := "GormStorage.CreateAGiftFulfillment"
+
+	if err := g.db.Create(m).Error; nil != err {
+		if IsDuplicateEntryError(err) {
+			return false, nil
+		}
+		log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+		return false, g.NewStorageError(err, errWhere, fmt.Sprintf("cannot create the gift fulfillment(%#v)", m))
+	}
+
+	return true, nil
+}
+
+// GetQueuedGiftShippingItems returns the queued gifts with the addresses to ship to, the earliest queued first.
+// The gifts of the periodic donations which no longer want the gifts are left out.
+func (g *GormStorage) GetQueuedGiftShippingItems() ([]models.GiftShippingItem, error) {
+	errWhere := "GormStorage.GetQueuedGiftShippingItems"
+	var items []models.GiftShippingItem
+
+	err := g.db.Table(fmt.Sprintf("%s AS g", globals.TableGiftFulfillments)).
+		Select(`g.id, g.periodic_id, g.created_at AS queued_at, p.order_number, p.amount, p.currency, COALESCE(p.company_name, '') AS company_name,
+			p.cardholder_address, p.cardholder_email, p.cardholder_name, p.cardholder_phone_number, p.cardholder_zip_code`).
+		Joins(fmt.Sprintf("JOIN %s AS p ON p.id = g.periodic_id", globals.TablePeriodicDonations)).
+		Where("g.status = ? AND p.to_feedback = ? AND p.deleted_at IS NULL", models.GiftFulfillmentQueued, true).
+		Order("g.created_at asc, g.id asc").
+		Scan(&items).Error
+
+	if nil != err {
+		log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+		return items, g.NewStorageError(err, errWhere, "cannot get the queued gift shipping items")
+	}
+
+	return items, nil
+}
+
+// ShipAGiftFulfillment marks the queued gift shipped with the tracking number.
+// It returns false if the gift is not queued, e.g. it is already shipped.
+func (g *GormStorage) ShipAGiftFulfillment(id uint, carrier string, trackingNumber string, shippedBy uint, now time.Time) (bool, error) {
+	errWhere := "GormStorage.ShipAGiftFulfillment"
+
+	updates := g.db.Model(&models.GiftFulfillment{}).Where("id = ? AND status = ?", id, models.GiftFulfillmentQueued).Updates(map[string]interface{}{
+		"carrier":         null.NewString(carrier, carrier != ""),
+		"shipped_at":      now,
+		"shipped_by":      shippedBy,
+		"status":          models.GiftFulfillmentShipped,
+		"tracking_number": trackingNumber,
+	})
+
+	if err := updates.Error; nil != err {
+		log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+		return false, g.NewStorageError(err, errWhere, fmt.Sprintf("cannot mark the gift fulfillment(id: %d) shipped", id))
+	}
+
+	return updates.RowsAffected != 0, nil
+}
@@ -0,0 +1,54 @@
+package storage
+
+import (
+	"fmt"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	"twreporter.org/go-api/models"
+)
+
+// ClaimAnIdempotencyKey creates the idempotency key of the user if the key is not used since `expiredBefore`,
+// or the request of the key is still in progress since `abandonedBefore`.
+// It returns the created key and true if the key is claimed,
+// otherwise it returns the key claimed by the previous request and false.
+func (g *GormStorage) ClaimAnIdempotencyKey(m models.IdempotencyKey, expiredBefore time.Time, abandonedBefore time.Time) (models.IdempotencyKey, bool, error) {
+	errWhere := "GormStorage.ClaimAnIdempotencyKey"
+	var claimed models.IdempotencyKey
+
+	// the expired key and the key of the abandoned request, e.g. the process dies, could be reused
+	if err := g.db.Where("user_id = ? AND `key` = ? AND (created_at < ? OR (status_code = 0 AND created_at < ?))", m.UserID, m.Key, expiredBefore, abandonedBefore).Delete(&models.IdempotencyKey{}).Error; nil != err {
+		log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+		return m, false, g.NewStorageError(err, errWhere, fmt.Sprintf("cannot delete the expired idempotency key(user_id: %d, key: %s)", m.UserID, m.Key))
+	}
+
+	err := g.db.Create(&m).Error
+	if nil == err {
+		return m, true, nil
+	}
+
+	if !IsDuplicateEntryError(err) {
+		log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+		return m, false, g.NewStorageError(err, errWhere, fmt.Sprintf("cannot create the idempotency key(user_id: %d, key: %s)", m.UserID, m.Key))
+	}
+
+	if err = g.db.Where("user_id = ? AND `key` = ?", m.UserID, m.Key).Find(&claimed).Error; nil != err {
+		log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+		return m, false, g.NewStorageError(err, errWhere, fmt.Sprintf("cannot get the idempotency key(user_id: %d, key: %s)", m.UserID, m.Key))
+	}
+
+	return claimed, false, nil
+}
+
+// ReleaseAnIdempotencyKey deletes the idempotency key, so that the request could be made again with the key
+func (g *GormStorage) ReleaseAnIdempotencyKey(id uint) error {
+	errWhere := "GormStorage.ReleaseAnIdempotencyKey"
+
+	if err := g.db.Where("id = ?", id).Delete(&models.IdempotencyKey{}).Error; nil != err {
+		log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+		return g.NewStorageError(err, errWhere, fmt.Sprintf("cannot delete the idempotency key(id: %d)", id))
+	}
+
+	return nil
+}
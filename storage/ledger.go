@@ -0,0 +1,109 @@
+package storage
+
+import (
+	"fmt"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+
+	"twreporter.org/go-api/globals"
+	"twreporter.org/go-api/models"
+	"twreporter.org/go-api/utils"
+)
+
+// ledgerTables are the donation tables in the accounting ledger.
+// Card token donations are charged by credit cards, and take the card information and the donor identity from their periodic donations.
+// Other method donations are made by individuals.
+var ledgerTables = []struct {
+	donationType string
+	query        string
+	hasStatus    bool
+}{
+	{globals.PrimeDonaitionType, fmt.Sprintf(`SELECT '%s' AS type, d.id, d.created_at, d.transaction_time, d.order_number, d.bank_transaction_id, d.rec_trade_id,
+		d.amount, d.currency, d.pay_method, d.card_info_type, d.card_info_last_four, d.status,
+		d.donor_type, COALESCE(d.company_name, '') AS company_name, COALESCE(d.tax_id, '') AS tax_id
+		FROM %s AS d`, globals.PrimeDonaitionType, globals.TablePayByPrimeDonations), true},
+	{globals.TokenDonationType, fmt.Sprintf(`SELECT '%s' AS type, d.id, d.created_at, d.transaction_time, d.order_number, d.bank_transaction_id, d.rec_trade_id,
+		d.amount, d.currency, 'credit_card' AS pay_method, p.card_info_type, p.card_info_last_four, d.status,
+		p.donor_type, COALESCE(p.company_name, '') AS company_name, COALESCE(p.tax_id, '') AS tax_id
+		FROM %s AS d JOIN %s AS p ON p.id = d.periodic_id`, globals.TokenDonationType, globals.TablePayByCardTokenDonations, globals.TablePeriodicDonations), true},
+	{globals.OthersDonationType, fmt.Sprintf(`SELECT '%s' AS type, d.id, d.created_at, NULL AS transaction_time, d.order_number, '' AS bank_transaction_id, '' AS rec_trade_id,
+		d.amount, d.currency, d.pay_method, NULL AS card_info_type, NULL AS card_info_last_four, 'paid' AS status,
+		'individual' AS donor_type, '' AS company_name, '' AS tax_id
+		FROM %s AS d`, globals.OthersDonationType, globals.TablePayByOtherMethodDonations), false},
+}
+
+// IterateLedgerEntries calls `fn` with the donations matching the filter one by one,
+// sorted by the creation time in ascending order.
+// The donations are read from the database cursor instead of being loaded at once,
+// so that the ledger of any range could be exported. The iteration stops if `fn` returns an error.
+func (g *GormStorage) IterateLedgerEntries(filter models.LedgerFilter, fn func(models.LedgerEntry) error) error {
+	errWhere := "GormStorage.IterateLedgerEntries"
+	var args []interface{}
+	var subqueries []string
+
+	for _, t := range ledgerTables {
+		if len(filter.Types) > 0 && !utils.ContainsString(filter.Types, t.donationType) {
+			continue
+		}
+
+		conds := []string{"d.deleted_at IS NULL", "d.created_at >= ?", "d.created_at < ?"}
+		tableArgs := []interface{}{filter.Since, filter.Until}
+
+		if filter.Status != "" {
+			if t.hasStatus {
+				conds = append(conds, "d.status = ?")
+				tableArgs = append(tableArgs, filter.Status)
+			} else if "paid" != filter.Status {
+				// other method donations are always paid
+				continue
+			}
+		}
+
+		if len(filter.PayMethods) > 0 {
+			if globals.TokenDonationType == t.donationType {
+				if !utils.ContainsString(filter.PayMethods, "credit_card") {
+					continue
+				}
+			} else {
+				conds = append(conds, "d.pay_method IN (?)")
+				tableArgs = append(tableArgs, filter.PayMethods)
+			}
+		}
+
+		subqueries = append(subqueries, fmt.Sprintf("%s WHERE %s", t.query, strings.Join(conds, " AND ")))
+		args = append(args, tableArgs...)
+	}
+
+	if len(subqueries) == 0 {
+		return nil
+	}
+
+	rows, err := g.db.Raw(fmt.Sprintf("SELECT * FROM (%s) AS ledger ORDER BY created_at ASC, type ASC, id ASC", strings.Join(subqueries, " UNION ALL ")), args...).Rows()
+	if nil != err {
+		log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+		return g.NewStorageError(err, errWhere, fmt.Sprintf("cannot get the ledger entries(filter: %+v)", filter))
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var entry models.LedgerEntry
+
+		if err = g.db.ScanRows(rows, &entry); nil != err {
+			log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+			return g.NewStorageError(err, errWhere, "cannot scan the ledger entry")
+		}
+
+		if err = fn(entry); nil != err {
+			return err
+		}
+	}
+
+	if err = rows.Err(); nil != err {
+		log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+		return g.NewStorageError(err, errWhere, "cannot iterate the ledger entries")
+	}
+
+	return nil
+}
@@ -0,0 +1,231 @@
+package storage
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/jinzhu/gorm"
+
+	"twreporter.org/go-api/globals"
+	"twreporter.org/go-api/models"
+)
+
+// CreateAMatchingRule creates the matching rule of the sponsor
+func (g *GormStorage) CreateAMatchingRule(m *models.MatchingRule) error {
+	errWhere := "GormStorage.CreateAMatchingRule"
+
+	if err := g.db.Create(m).Error; nil != err {
+		log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+		return g.NewStorageError(err, errWhere, fmt.Sprintf("cannot create the matching rule of the sponsor(%s)", m.Sponsor))
+	}
+
+	return nil
+}
+
+// matchAPaidDonation matches the paid donation by the first active rule which still has budget, in the transaction of the payment.
+// The rule is locked until the transaction ends, so that the matched amounts never exceed the budget
+// even if donations of the rule are paid at the same time.
+func matchAPaidDonation(tx *gorm.DB, d models.MatchableDonation) error {
+	var matched int
+	var rule models.MatchingRule
+
+	err := tx.Set("gorm:query_option", "FOR UPDATE").
+		Where("start_at <= ? AND end_at > ? AND currency = ? AND consumed < budget", d.CreatedAt, d.CreatedAt, d.Currency).
+		Where("FIND_IN_SET(?, donation_types) > 0", d.DonationType).
+		Where("campaign IS NULL OR campaign = ?", d.Campaign.ValueOrZero()).
+		Order("id asc").
+		First(&rule).Error
+
+	if IsRecordNotFoundError(err) {
+		return nil
+	} else if nil != err {
+		return err
+	}
+
+	// the donation is matched once even if its payment result is applied again
+	err = tx.Set("gorm:query_option", "FOR UPDATE").Model(&models.DonationMatch{}).
+		Where("donation_type = ? AND donation_id = ?", d.DonationType, d.ID).
+		Count(&matched).Error
+	if nil != err || matched > 0 {
+		return err
+	}
+
+	// the ratio is in two decimal places, which is multiplied in integers to avoid the rounding errors of floats
+	amount := d.Amount * uint(math.Round(rule.Ratio*100)) / 100
+	if rest := rule.Budget - rule.Consumed; amount > rest {
+		amount = rest
+	}
+
+	if amount == 0 {
+		return nil
+	}
+
+	if err = tx.Model(&models.MatchingRule{}).Where("id = ?", rule.ID).Update("consumed", gorm.Expr("consumed + ?", amount)).Error; nil != err {
+		return err
+	}
+
+	return tx.Create(&models.DonationMatch{
+		Amount:        d.Amount,
+		CreatedAt:     d.CreatedAt,
+		Currency:      d.Currency,
+		DonationID:    d.ID,
+		DonationType:  d.DonationType,
+		MatchedAmount: amount,
+		OrderNumber:   d.OrderNumber,
+		RuleID:        rule.ID,
+	}).Error
+}
+
+// matchAPrimeDonation matches the prime donation read in the transaction if it is paid
+func matchAPrimeDonation(tx *gorm.DB, id uint) error {
+	var d models.PayByPrimeDonation
+
+	if err := tx.Where("id = ?", id).First(&d).Error; nil != err {
+		return err
+	}
+
+	if d.Status != "paid" {
+		return nil
+	}
+
+	return matchAPaidDonation(tx, models.MatchableDonation{
+		Amount:       d.Amount,
+		Campaign:     d.Campaign,
+		CreatedAt:    d.CreatedAt,
+		Currency:     d.Currency,
+		DonationType: globals.PrimeDonaitionType,
+		ID:           d.ID,
+		OrderNumber:  d.OrderNumber,
+	})
+}
+
+// matchACardTokenDonation matches the card token donation read in the transaction if it is paid.
+// The latest installment of the periodic donation is read if id is zero.
+func matchACardTokenDonation(tx *gorm.DB, periodicID uint, id uint) error {
+	var d models.PayByCardTokenDonation
+
+	query := tx.Where("periodic_id = ?", periodicID)
+	if 0 != id {
+		query = query.Where("id = ?", id)
+	}
+
+	if err := query.Order("id desc").First(&d).Error; nil != err {
+		return err
+	}
+
+	if d.Status != "paid" {
+		return nil
+	}
+
+	return matchAPaidDonation(tx, models.MatchableDonation{
+		Amount:       d.Amount,
+		Campaign:     d.Campaign,
+		CreatedAt:    d.CreatedAt,
+		Currency:     d.Currency,
+		DonationType: globals.TokenDonationType,
+		ID:           d.ID,
+		OrderNumber:  d.OrderNumber,
+	})
+}
+
+// unmatchARefundedDonation reduces the match of the donation in proportion to its refund, in the transaction of the refund.
+// `remaining` is the amount of the donation which is not refunded yet.
+// The reduced amount is given back to the budget of the rule, and the match is removed once the donation is fully refunded.
+func unmatchARefundedDonation(tx *gorm.DB, donationType string, donationID uint, remaining uint) error {
+	var m models.DonationMatch
+
+	err := tx.Set("gorm:query_option", "FOR UPDATE").
+		Where("donation_type = ? AND donation_id = ?", donationType, donationID).
+		First(&m).Error
+
+	if IsRecordNotFoundError(err) {
+		return nil
+	} else if nil != err {
+		return err
+	}
+
+	if remaining >= m.Amount {
+		return nil
+	}
+
+	// the match is kept in proportion to the amount which is not refunded, the amount of the match is reduced along with the refunds
+	matchedAmount := uint(uint64(m.MatchedAmount) * uint64(remaining) / uint64(m.Amount))
+
+	if err = tx.Model(&models.MatchingRule{}).Where("id = ?", m.RuleID).Update("consumed", gorm.Expr("consumed - ?", m.MatchedAmount-matchedAmount)).Error; nil != err {
+		return err
+	}
+
+	if 0 == matchedAmount {
+		return tx.Delete(&models.DonationMatch{}, "id = ?", m.ID).Error
+	}
+
+	return tx.Model(&models.DonationMatch{}).Where("id = ?", m.ID).Updates(map[string]interface{}{
+		"amount":         remaining,
+		"matched_amount": matchedAmount,
+	}).Error
+}
+
+// GetADonationMatch returns the match of the donation along with the sponsor, it fails with 404 if the donation is not matched
+func (g *GormStorage) GetADonationMatch(donationType string, donationID uint) (models.DonationMatchWithSponsor, error) {
+	errWhere := "GormStorage.GetADonationMatch"
+	var m models.DonationMatchWithSponsor
+
+	err := g.db.Table(fmt.Sprintf("%s AS m", globals.TableDonationMatches)).
+		Select("m.*, r.sponsor").
+		Joins(fmt.Sprintf("JOIN %s AS r ON r.id = m.rule_id", globals.TableMatchingRules)).
+		Where("m.donation_type = ? AND m.donation_id = ?", donationType, donationID).
+		Limit(1).
+		Scan(&m).Error
+
+	if nil != err {
+		if !IsRecordNotFoundError(err) {
+			log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+		}
+		return m, g.NewStorageError(err, errWhere, fmt.Sprintf("cannot get the match of the %s donation(id: %d)", donationType, donationID))
+	}
+
+	return m, nil
+}
+
+// GetUnreportedMatchingRules returns the rules which end by `now` and whose reports are not mailed yet
+func (g *GormStorage) GetUnreportedMatchingRules(now time.Time) ([]models.MatchingRule, error) {
+	errWhere := "GormStorage.GetUnreportedMatchingRules"
+	var rules []models.MatchingRule
+
+	if err := g.db.Where("end_at <= ? AND reported_at IS NULL", now).Order("id asc").Find(&rules).Error; nil != err {
+		log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+		return rules, g.NewStorageError(err, errWhere, "cannot get the unreported matching rules")
+	}
+
+	return rules, nil
+}
+
+// GetDonationMatchesOfARule returns the matches of the rule in the order the donations are paid
+func (g *GormStorage) GetDonationMatchesOfARule(ruleID uint) ([]models.DonationMatch, error) {
+	errWhere := "GormStorage.GetDonationMatchesOfARule"
+	var matches []models.DonationMatch
+
+	if err := g.db.Where("rule_id = ?", ruleID).Order("created_at asc, id asc").Find(&matches).Error; nil != err {
+		log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+		return matches, g.NewStorageError(err, errWhere, fmt.Sprintf("cannot get the matches of the rule(id: %d)", ruleID))
+	}
+
+	return matches, nil
+}
+
+// MarkAMatchingRuleReported records when the report of the rule is mailed.
+// It returns false if the report is mailed by others.
+func (g *GormStorage) MarkAMatchingRuleReported(id uint, now time.Time) (bool, error) {
+	errWhere := "GormStorage.MarkAMatchingRuleReported"
+
+	updates := g.db.Model(&models.MatchingRule{}).Where("id = ? AND reported_at IS NULL", id).Update("reported_at", now)
+
+	if err := updates.Error; nil != err {
+		log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+		return false, g.NewStorageError(err, errWhere, fmt.Sprintf("cannot mark the matching rule(id: %d) reported", id))
+	}
+
+	return updates.RowsAffected != 0, nil
+}
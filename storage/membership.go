@@ -2,6 +2,8 @@ package storage
 
 import (
 	"fmt"
+	"reflect"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/jinzhu/gorm"
@@ -35,6 +37,7 @@ type MembershipStorage interface {
 	InsertReporterAccount(models.ReporterAccount) error
 	InsertUserByOAuth(models.OAuthAccount) (models.User, error)
 	InsertUserByReporterAccount(models.ReporterAccount) (models.User, error)
+	InsertUserByEmail(string) (models.User, error)
 	UpdateOAuthData(models.OAuthAccount) (models.OAuthAccount, error)
 	UpdateReporterAccount(models.ReporterAccount) error
 
@@ -50,10 +53,94 @@ type MembershipStorage interface {
 	CreateAWebPushSubscription(models.WebPushSubscription) error
 	GetAWebPushSubscription(uint32, string) (models.WebPushSubscription, error)
 
+	/** Idempotency Key methods **/
+	ClaimAnIdempotencyKey(models.IdempotencyKey, time.Time, time.Time) (models.IdempotencyKey, bool, error)
+	ReleaseAnIdempotencyKey(uint) error
+
 	/** Donation methods **/
 	CreateAPeriodicDonation(*models.PeriodicDonation, *models.PayByCardTokenDonation) error
+	CreateAPayByOtherMethodDonation(*models.PayByOtherMethodDonation) error
 	DeleteAPeriodicDonation(uint, models.PayByCardTokenDonation) error
 	UpdatePeriodicAndCardTokenDonationInTRX(uint, models.PeriodicDonation, models.PayByCardTokenDonation) error
+	UpdateAPrimeDonationInTRX(uint, []string, models.PayByPrimeDonation) (int64, error)
+	StopAPeriodicDonation(uint, []string, models.PeriodicDonation) (int64, error)
+	GetDuePeriodicDonations(time.Time, uint, int) ([]models.PeriodicDonation, error)
+	GetDunningPeriodicDonations(time.Time, uint, int) ([]models.PeriodicDonation, error)
+	GetAtRiskPeriodicDonations(time.Time) ([]models.PeriodicDonation, error)
+	GetPaidTimesOfAPeriodicDonation(uint) (uint, error)
+	GetTheFirstInstallmentOfAPeriodicDonation(uint) (models.PayByCardTokenDonation, error)
+	ClaimAPeriodicDonationCharge(models.PeriodicDonation, *models.PayByCardTokenDonation) (bool, error)
+	ReplaceTheCardOfAPeriodicDonation(models.PeriodicDonation, *models.PeriodicDonationCardChange) error
+	GetPeriodicDonationCardSecrets(uint, int) ([]models.PeriodicDonation, error)
+	UpdateTheCardSecretsOfAPeriodicDonation(models.PeriodicDonation, string, string) (bool, error)
+	GetExpiringPeriodicDonations(string, string, uint, int) ([]models.PeriodicDonation, error)
+	CreateACardExpiryReminder(*models.PeriodicDonationCardExpiryReminder) (bool, error)
+	DeleteACardExpiryReminder(uint) error
+	GetCardExpirationsByMonth(string, string) ([]models.CardExpirationMonth, error)
+	CreateAPeriodicDonationChange(*models.PeriodicDonationChange, time.Time) error
+	ApplyDuePeriodicDonationChanges(time.Time) (int, error)
+	GetStalePayingDonations(time.Time, uint, int, interface{}) error
+	ResolveAPayingCardTokenDonation(models.PayByCardTokenDonation, models.PeriodicDonation) (bool, error)
+	CreateADraftDonationRefund(*models.DonationRefund) error
+	UpdateADonationRefundInTRX(models.DonationRefund) (bool, error)
+	GetStaleRefundingRefunds(time.Time, uint, int) ([]models.DonationRefund, error)
+	GetRefundedAmountOfADonation(string, uint) (uint, error)
+	GetDonationIndexesOfAUser(uint, models.DonationFilter, int, int) ([]models.DonationIndex, int, error)
+	IterateLedgerEntries(models.LedgerFilter, func(models.LedgerEntry) error) error
+
+	/** Outbox methods **/
+	GetUndispatchedOutboxEvents(int) ([]models.OutboxEvent, error)
+	DispatchAnOutboxEvent(models.OutboxEvent, []models.WebhookDelivery, time.Time) (bool, error)
+	GetDueWebhookDeliveries(time.Time, uint, int) ([]models.WebhookDeliveryWithEvent, error)
+	ClaimAWebhookDelivery(models.WebhookDelivery, time.Time) (bool, error)
+	UpdateAWebhookDelivery(models.WebhookDelivery) error
+	GetDeadWebhookDeliveries(int, int) ([]models.WebhookDeliveryWithEvent, int, error)
+	RequeueADeadWebhookDelivery(uint, time.Time) (bool, error)
+
+	/** Campaign methods **/
+	CreateACampaign(*models.Campaign) error
+	GetACampaign(string) (models.Campaign, error)
+	GetCampaignProgress(models.Campaign) (models.CampaignProgress, error)
+
+	/** Donor wall methods **/
+	GetDonorWallEntries(models.DonorWallFilter, int, int) ([]models.DonorWallEntry, int, error)
+
+	/** Donor profile methods **/
+	GetADonorProfile(uint) (models.DonorProfile, error)
+	SaveADonorProfile(*models.DonorProfile) error
+	GetCardedPeriodicDonationsOfAUser(uint) ([]models.PeriodicDonation, error)
+	StopThePeriodicDonationsOfARemovedCard([]uint, models.PeriodicDonation) ([]uint, error)
+
+	/** Gift fulfillment methods **/
+	GetGiftEligiblePeriodicDonations(models.FeedbackGiftRule, uint, int) ([]models.PeriodicDonation, error)
+	CreateAGiftFulfillment(*models.GiftFulfillment) (bool, error)
+	GetQueuedGiftShippingItems() ([]models.GiftShippingItem, error)
+	ShipAGiftFulfillment(uint, string, string, uint, time.Time) (bool, error)
+
+	/** Matching gift methods **/
+	CreateAMatchingRule(*models.MatchingRule) error
+	GetADonationMatch(string, uint) (models.DonationMatchWithSponsor, error)
+	GetUnreportedMatchingRules(time.Time) ([]models.MatchingRule, error)
+	GetDonationMatchesOfARule(uint) ([]models.DonationMatch, error)
+	MarkAMatchingRuleReported(uint, time.Time) (bool, error)
+
+	/** Settlement reconciliation methods **/
+	GetSettlementDonationsByTransactionIDs([]string, []string) ([]models.SettlementDonation, error)
+	GetSettlementDonationsByTransactionTime(time.Time, time.Time) ([]models.SettlementDonation, error)
+	GetRefundsByRecTradeIDs([]string) ([]models.DonationRefund, error)
+	ReplaceSettlementReconciliations(string, []models.SettlementReconciliation) error
+	GetSettlementReconciliations(string, string, int, int) ([]models.SettlementReconciliation, int, error)
+	CountSettlementReconciliations(string) ([]models.SettlementResultCount, error)
+
+	/** Exchange Rate methods **/
+	UpsertExchangeRates([]models.ExchangeRate) error
+	GetExchangeRates(time.Time) ([]models.ExchangeRate, error)
+
+	/** Receipt methods **/
+	GetReceiptableDonations([]string, time.Time, time.Time) ([]models.ReceiptableDonation, error)
+	GetRefundsOfIssuedReceipts(string, time.Time, time.Time) ([]models.ReceiptRefund, error)
+	CreateAReceipt(*models.Receipt, []models.ReceiptItem) error
+	GetReceiptsOfAUser(uint) ([]models.Receipt, error)
 }
 
 // NewGormStorage initializes the storage connected to MySQL database by gorm library
@@ -95,7 +182,7 @@ func (gs *GormStorage) GetByConditions(cond map[string]interface{}, m interface{
 	var err error
 	var errWhere string = "GormStorage.GetByConditions"
 
-	err = gs.db.Where(cond).Find(m).Error
+	err = whereConditions(gs.db, cond).Find(m).Error
 
 	if err != nil {
 		log.Error(err.Error())
@@ -111,7 +198,7 @@ func (gs *GormStorage) UpdateByConditions(cond map[string]interface{}, m interfa
 
 	// caution:
 	// it will perform batch updates if cond is zero value and primary key of m is zero value
-	updates := gs.db.Model(m).Where(cond).Updates(m)
+	updates := whereConditions(gs.db.Model(m), cond).Updates(m)
 	err = updates.Error
 
 	if err != nil {
@@ -124,6 +211,27 @@ func (gs *GormStorage) UpdateByConditions(cond map[string]interface{}, m interfa
 	return nil, rowsAffected
 }
 
+// whereConditions appends the conditions onto the query.
+// Slice values are matched by `IN` since gorm compares map conditions by `=` only,
+// and the keys are quoted as the column names.
+func whereConditions(db *gorm.DB, cond map[string]interface{}) *gorm.DB {
+	eq := make(map[string]interface{})
+
+	for key, value := range cond {
+		if nil != value && reflect.TypeOf(value).Kind() == reflect.Slice {
+			db = db.Where(fmt.Sprintf("%s IN (?)", db.NewScope(nil).Quote(key)), value)
+			continue
+		}
+		eq[key] = value
+	}
+
+	if len(eq) > 0 {
+		db = db.Where(eq)
+	}
+
+	return db
+}
+
 // Delete method of MembershipStorage interface
 func (gs *GormStorage) Delete(id uint, m interface{}) error {
 	return nil
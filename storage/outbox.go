@@ -0,0 +1,321 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/jinzhu/gorm"
+
+	"twreporter.org/go-api/globals"
+	"twreporter.org/go-api/models"
+)
+
+// writeOutboxEvent writes the event into the outbox in the transaction of the change
+func writeOutboxEvent(tx *gorm.DB, eventType string, data interface{}) error {
+	payload, err := json.Marshal(data)
+	if nil != err {
+		return err
+	}
+
+	return tx.Create(&models.OutboxEvent{Type: eventType, Payload: string(payload)}).Error
+}
+
+// donationEventType returns the event of the donation status, or empty if the status is not final
+func donationEventType(status string) string {
+	switch status {
+	case "paid":
+		return models.EventDonationPaid
+	case "fail":
+		return models.EventDonationFailed
+	}
+	return ""
+}
+
+// writePrimeDonationEvent writes the event of the prime donation read in the transaction
+func writePrimeDonationEvent(tx *gorm.DB, id uint) error {
+	var d models.PayByPrimeDonation
+
+	if err := tx.Where("id = ?", id).First(&d).Error; nil != err {
+		return err
+	}
+
+	eventType := donationEventType(d.Status)
+	if eventType == "" {
+		return nil
+	}
+
+	return writeOutboxEvent(tx, eventType, models.DonationEventData{
+		Amount:       d.Amount,
+		Campaign:     d.Campaign,
+		Currency:     d.Currency,
+		DonationType: globals.PrimeDonaitionType,
+		Email:        d.Email,
+		ID:           d.ID,
+		Msg:          d.Msg,
+		OrderNumber:  d.OrderNumber,
+		PayMethod:    d.PayMethod,
+		Status:       d.Status,
+		UserID:       d.UserID,
+	})
+}
+
+// writeCardTokenDonationEvent writes the event of the card token donation read in the transaction.
+// The latest installment of the periodic donation is read if id is zero.
+func writeCardTokenDonationEvent(tx *gorm.DB, periodicID uint, id uint) error {
+	var d models.PayByCardTokenDonation
+	var pd models.PeriodicDonation
+
+	query := tx.Where("periodic_id = ?", periodicID)
+	if 0 != id {
+		query = query.Where("id = ?", id)
+	}
+
+	if err := query.Order("id desc").First(&d).Error; nil != err {
+		return err
+	}
+
+	eventType := donationEventType(d.Status)
+	if eventType == "" {
+		return nil
+	}
+
+	if err := tx.Unscoped().Where("id = ?", periodicID).First(&pd).Error; nil != err {
+		return err
+	}
+
+	return writeOutboxEvent(tx, eventType, models.DonationEventData{
+		Amount:       d.Amount,
+		Campaign:     d.Campaign,
+		Currency:     d.Currency,
+		DonationType: globals.TokenDonationType,
+		Email:        pd.Email,
+		ID:           d.ID,
+		Msg:          d.Msg,
+		OrderNumber:  d.OrderNumber,
+		PayMethod:    "credit_card",
+		PeriodicID:   d.PeriodicID,
+		Status:       d.Status,
+		UserID:       pd.UserID,
+	})
+}
+
+// writePledgeEvent writes the event of the periodic donation read in the transaction
+func writePledgeEvent(tx *gorm.DB, eventType string, periodicID uint) error {
+	var pd models.PeriodicDonation
+
+	if err := tx.Unscoped().Where("id = ?", periodicID).First(&pd).Error; nil != err {
+		return err
+	}
+
+	return writeOutboxEvent(tx, eventType, models.PledgeEventData{
+		Amount:      pd.Amount,
+		Campaign:    pd.Campaign,
+		Currency:    pd.Currency,
+		Email:       pd.Email,
+		Frequency:   pd.Frequency,
+		ID:          pd.ID,
+		OrderNumber: pd.OrderNumber,
+		Status:      pd.Status,
+		StopReason:  pd.StopReason,
+		UserID:      pd.UserID,
+	})
+}
+
+// isPledgeStopped tells whether the periodic donation is no longer charged
+func isPledgeStopped(status string) bool {
+	return status == "stopped" || status == "invalid"
+}
+
+// createAUser creates the user along with the user.created event
+func (g *GormStorage) createAUser(user *models.User) error {
+	tx := g.db.Begin()
+
+	if err := tx.Error; nil != err {
+		return err
+	}
+
+	if err := tx.Create(user).Error; nil != err {
+		tx.Rollback()
+		return err
+	}
+
+	if err := writeOutboxEvent(tx, models.EventUserCreated, models.UserEventData{
+		Email:            user.Email,
+		ID:               user.ID,
+		RegistrationDate: user.RegistrationDate,
+	}); nil != err {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit().Error
+}
+
+// GetUndispatchedOutboxEvents returns the events whose deliveries are not created yet, in the order they happen
+func (g *GormStorage) GetUndispatchedOutboxEvents(limit int) ([]models.OutboxEvent, error) {
+	errWhere := "GormStorage.GetUndispatchedOutboxEvents"
+	var events []models.OutboxEvent
+
+	if err := g.db.Where("dispatched_at IS NULL").Order("id asc").Limit(limit).Find(&events).Error; nil != err {
+		log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+		return events, g.NewStorageError(err, errWhere, "cannot get the undispatched outbox events")
+	}
+
+	return events, nil
+}
+
+// DispatchAnOutboxEvent creates the deliveries of the event to the webhooks, and marks the event dispatched.
+// It returns false if the event is dispatched by others.
+func (g *GormStorage) DispatchAnOutboxEvent(e models.OutboxEvent, deliveries []models.WebhookDelivery, now time.Time) (bool, error) {
+	errWhere := "GormStorage.DispatchAnOutboxEvent"
+
+	tx := g.db.Begin()
+
+	if err := tx.Error; nil != err {
+		log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+		return false, g.NewStorageError(err, errWhere, "cannot begin the outbox event dispatch transaction")
+	}
+
+	claim := tx.Model(&models.OutboxEvent{}).Where("id = ? AND dispatched_at IS NULL", e.ID).Update("dispatched_at", now)
+
+	if err := claim.Error; nil != err {
+		tx.Rollback()
+		log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+		return false, g.NewStorageError(err, errWhere, fmt.Sprintf("cannot claim the outbox event(id: %d)", e.ID))
+	}
+
+	if claim.RowsAffected == 0 {
+		tx.Rollback()
+		return false, nil
+	}
+
+	for i := range deliveries {
+		deliveries[i].EventID = e.ID
+
+		if err := tx.Create(&deliveries[i]).Error; nil != err {
+			tx.Rollback()
+			log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+			return false, g.NewStorageError(err, errWhere, fmt.Sprintf("cannot create the webhook delivery(event_id: %d, endpoint: %s)", e.ID, deliveries[i].Endpoint))
+		}
+	}
+
+	if err := tx.Commit().Error; nil != err {
+		log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+		return false, g.NewStorageError(err, errWhere, "cannot commit the outbox event dispatch transaction")
+	}
+
+	return true, nil
+}
+
+// webhookDeliveryWithEventQuery selects the deliveries along with their events
+func (g *GormStorage) webhookDeliveryWithEventQuery() *gorm.DB {
+	return g.db.Table("webhook_deliveries").
+		Select("webhook_deliveries.*, outbox_events.created_at AS event_created_at, outbox_events.payload AS event_payload, outbox_events.type AS event_type").
+		Joins("JOIN outbox_events ON outbox_events.id = webhook_deliveries.event_id")
+}
+
+// GetDueWebhookDeliveries returns the pending deliveries due at the given time.
+// Records are ordered by id and start after `afterID`, so that callers can walk through all due records batch by batch.
+func (g *GormStorage) GetDueWebhookDeliveries(now time.Time, afterID uint, limit int) ([]models.WebhookDeliveryWithEvent, error) {
+	errWhere := "GormStorage.GetDueWebhookDeliveries"
+	var deliveries []models.WebhookDeliveryWithEvent
+
+	err := g.webhookDeliveryWithEventQuery().
+		Where("webhook_deliveries.status = ? AND webhook_deliveries.next_attempt_at <= ? AND webhook_deliveries.id > ?", models.WebhookDeliveryPending, now, afterID).
+		Order("webhook_deliveries.id asc").
+		Limit(limit).
+		Scan(&deliveries).Error
+
+	if nil != err {
+		log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+		return deliveries, g.NewStorageError(err, errWhere, "cannot get the due webhook deliveries")
+	}
+
+	return deliveries, nil
+}
+
+// ClaimAWebhookDelivery postpones the pending delivery until `leaseUntil` before it is attempted,
+// so that the delivery is not attempted by other workers at the same time.
+// It returns false if the delivery is claimed by others.
+func (g *GormStorage) ClaimAWebhookDelivery(d models.WebhookDelivery, leaseUntil time.Time) (bool, error) {
+	errWhere := "GormStorage.ClaimAWebhookDelivery"
+
+	claim := g.db.Model(&models.WebhookDelivery{}).
+		Where("id = ? AND status = ? AND attempts = ? AND next_attempt_at = ?", d.ID, models.WebhookDeliveryPending, d.Attempts, d.NextAttemptAt).
+		Update("next_attempt_at", leaseUntil)
+
+	if err := claim.Error; nil != err {
+		log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+		return false, g.NewStorageError(err, errWhere, fmt.Sprintf("cannot claim the webhook delivery(id: %d)", d.ID))
+	}
+
+	return claim.RowsAffected != 0, nil
+}
+
+// UpdateAWebhookDelivery updates the result of the attempt
+func (g *GormStorage) UpdateAWebhookDelivery(d models.WebhookDelivery) error {
+	errWhere := "GormStorage.UpdateAWebhookDelivery"
+
+	err := g.db.Model(&models.WebhookDelivery{}).Where("id = ?", d.ID).Updates(map[string]interface{}{
+		"attempts":        d.Attempts,
+		"delivered_at":    d.DeliveredAt,
+		"last_error":      d.LastError,
+		"next_attempt_at": d.NextAttemptAt,
+		"status":          d.Status,
+	}).Error
+
+	if nil != err {
+		log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+		return g.NewStorageError(err, errWhere, fmt.Sprintf("cannot update the webhook delivery(id: %d)", d.ID))
+	}
+
+	return nil
+}
+
+// GetDeadWebhookDeliveries returns the dead deliveries, the latest first, along with the total number of them
+func (g *GormStorage) GetDeadWebhookDeliveries(offset, limit int) ([]models.WebhookDeliveryWithEvent, int, error) {
+	errWhere := "GormStorage.GetDeadWebhookDeliveries"
+	var deliveries []models.WebhookDeliveryWithEvent
+	var total int
+
+	if err := g.db.Model(&models.WebhookDelivery{}).Where("status = ?", models.WebhookDeliveryDead).Count(&total).Error; nil != err {
+		log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+		return deliveries, 0, g.NewStorageError(err, errWhere, "cannot count the dead webhook deliveries")
+	}
+
+	err := g.webhookDeliveryWithEventQuery().
+		Where("webhook_deliveries.status = ?", models.WebhookDeliveryDead).
+		Order("webhook_deliveries.updated_at desc, webhook_deliveries.id desc").
+		Offset(offset).
+		Limit(limit).
+		Scan(&deliveries).Error
+
+	if nil != err {
+		log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+		return deliveries, 0, g.NewStorageError(err, errWhere, "cannot get the dead webhook deliveries")
+	}
+
+	return deliveries, total, nil
+}
+
+// RequeueADeadWebhookDelivery turns the dead delivery pending, and it is attempted again from the first attempt.
+// The last error is kept until the next attempt.
+// It returns false if the delivery is not dead.
+func (g *GormStorage) RequeueADeadWebhookDelivery(id uint, now time.Time) (bool, error) {
+	errWhere := "GormStorage.RequeueADeadWebhookDelivery"
+
+	updates := g.db.Model(&models.WebhookDelivery{}).Where("id = ? AND status = ?", id, models.WebhookDeliveryDead).Updates(map[string]interface{}{
+		"attempts":        0,
+		"next_attempt_at": now,
+		"status":          models.WebhookDeliveryPending,
+	})
+
+	if err := updates.Error; nil != err {
+		log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+		return false, g.NewStorageError(err, errWhere, fmt.Sprintf("cannot requeue the webhook delivery(id: %d)", id))
+	}
+
+	return updates.RowsAffected != 0, nil
+}
@@ -0,0 +1,173 @@
+package storage
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	"twreporter.org/go-api/globals"
+	"twreporter.org/go-api/models"
+)
+
+// receiptListColumns are the columns of receipts except the PDF files
+const receiptListColumns = "id, address, amount, company_name, created_at, currency, email, mailed_at, name, national_id, period_end, period_start, period_type, receipt_number, send_receipt, tax_id, updated_at, user_id"
+
+// receiptRefundedAmountQuery sums the refunded refunds of the donation `d` of the type, which are not tax-deductible
+const receiptRefundedAmountQuery = `COALESCE((SELECT SUM(r.amount) FROM donation_refunds AS r
+		WHERE r.donation_type = '%s' AND r.donation_id = d.id AND r.status = 'refunded' AND r.deleted_at IS NULL), 0)`
+
+// receiptableDonationQueries select the paid donations of each donation table which are not on any receipt.
+// The amounts of the prime and card token donations exclude the ones refunded partially.
+// The prime and other method donations keep the donor information on their own,
+// while the card token donations take it from their periodic donations.
+// The organization fields are empty unless the donations are made by organizations.
+var receiptableDonationQueries = []string{
+	fmt.Sprintf(`SELECT '%s' AS donation_type, d.id AS donation_id, d.user_id, d.cardholder_email AS email,
+		COALESCE(d.cardholder_name, '') AS name, COALESCE(d.cardholder_national_id, '') AS national_id, COALESCE(d.cardholder_address, '') AS address,
+		COALESCE(d.company_name, '') AS company_name, COALESCE(d.tax_id, '') AS tax_id,
+		d.amount - %s AS amount, d.currency, d.order_number, COALESCE(d.transaction_time, d.created_at) AS paid_at, d.send_receipt
+		FROM %s AS d
+		WHERE d.status = 'paid' AND d.deleted_at IS NULL AND d.send_receipt IN (?)
+		AND COALESCE(d.transaction_time, d.created_at) >= ? AND COALESCE(d.transaction_time, d.created_at) < ?
+		AND NOT EXISTS (SELECT 1 FROM receipt_items AS i WHERE i.donation_type = '%s' AND i.donation_id = d.id)`,
+		globals.PrimeDonaitionType, fmt.Sprintf(receiptRefundedAmountQuery, globals.PrimeDonaitionType), globals.TablePayByPrimeDonations, globals.PrimeDonaitionType),
+	fmt.Sprintf(`SELECT '%s' AS donation_type, d.id AS donation_id, p.user_id, p.cardholder_email AS email,
+		COALESCE(p.cardholder_name, '') AS name, COALESCE(p.cardholder_national_id, '') AS national_id, COALESCE(p.cardholder_address, '') AS address,
+		COALESCE(p.company_name, '') AS company_name, COALESCE(p.tax_id, '') AS tax_id,
+		d.amount - %s AS amount, d.currency, d.order_number, COALESCE(d.transaction_time, d.created_at) AS paid_at, p.send_receipt
+		FROM %s AS d JOIN %s AS p ON p.id = d.periodic_id
+		WHERE d.status = 'paid' AND d.deleted_at IS NULL AND p.send_receipt IN (?)
+		AND COALESCE(d.transaction_time, d.created_at) >= ? AND COALESCE(d.transaction_time, d.created_at) < ?
+		AND NOT EXISTS (SELECT 1 FROM receipt_items AS i WHERE i.donation_type = '%s' AND i.donation_id = d.id)`,
+		globals.TokenDonationType, fmt.Sprintf(receiptRefundedAmountQuery, globals.TokenDonationType), globals.TablePayByCardTokenDonations, globals.TablePeriodicDonations, globals.TokenDonationType),
+	fmt.Sprintf(`SELECT '%s' AS donation_type, d.id AS donation_id, d.user_id, d.email,
+		COALESCE(d.name, '') AS name, COALESCE(d.national_id, '') AS national_id, COALESCE(d.address, '') AS address,
+		'' AS company_name, '' AS tax_id,
+		d.amount, d.currency, d.order_number, d.created_at AS paid_at, d.send_receipt
+		FROM %s AS d
+		WHERE d.deleted_at IS NULL AND d.send_receipt IN (?)
+		AND d.created_at >= ? AND d.created_at < ?
+		AND NOT EXISTS (SELECT 1 FROM receipt_items AS i WHERE i.donation_type = '%s' AND i.donation_id = d.id)`,
+		globals.OthersDonationType, globals.TablePayByOtherMethodDonations, globals.OthersDonationType),
+}
+
+// GetReceiptableDonations returns the paid donations which are not on any receipt yet.
+// The donations are paid in [since, until) and their `send_receipt` is one of sendReceipts.
+// They are sorted by the donors and the payment time.
+func (g *GormStorage) GetReceiptableDonations(sendReceipts []string, since, until time.Time) ([]models.ReceiptableDonation, error) {
+	errWhere := "GormStorage.GetReceiptableDonations"
+	var args []interface{}
+	var donations []models.ReceiptableDonation
+
+	for range receiptableDonationQueries {
+		args = append(args, sendReceipts, since, until)
+	}
+
+	query := fmt.Sprintf("SELECT * FROM (%s) AS donations ORDER BY user_id ASC, paid_at ASC, donation_id ASC", strings.Join(receiptableDonationQueries, " UNION ALL "))
+
+	if err := g.db.Raw(query, args...).Scan(&donations).Error; nil != err {
+		log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+		return donations, g.NewStorageError(err, errWhere, fmt.Sprintf("cannot get the receiptable donations(since: %v, until: %v)", since, until))
+	}
+
+	return donations, nil
+}
+
+// GetRefundsOfIssuedReceipts returns the refunds completed in [since, until) whose donations are on the receipts of the period type issued before.
+// The receipts are not changed by the refunds, so staffs should void and reissue them.
+func (g *GormStorage) GetRefundsOfIssuedReceipts(periodType string, since, until time.Time) ([]models.ReceiptRefund, error) {
+	errWhere := "GormStorage.GetRefundsOfIssuedReceipts"
+	var refunds []models.ReceiptRefund
+
+	err := g.db.Raw(`SELECT rc.receipt_number, rc.user_id, i.donation_type, i.donation_id, i.order_number, r.amount, r.currency, r.updated_at AS refunded_at
+		FROM donation_refunds AS r
+		JOIN receipt_items AS i ON i.donation_type = r.donation_type AND i.donation_id = r.donation_id
+		JOIN receipts AS rc ON rc.id = i.receipt_id
+		WHERE r.status = 'refunded' AND r.deleted_at IS NULL AND rc.deleted_at IS NULL AND rc.period_type = ?
+		AND r.updated_at >= ? AND r.updated_at < ? AND r.updated_at >= rc.created_at
+		ORDER BY r.id ASC`, periodType, since, until).Scan(&refunds).Error
+
+	if nil != err {
+		log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+		return refunds, g.NewStorageError(err, errWhere, fmt.Sprintf("cannot get the refunds of the issued %s receipts(since: %v, until: %v)", periodType, since, until))
+	}
+
+	return refunds, nil
+}
+
+// CreateAReceipt assigns the next receipt number of the year to the receipt, and creates it along with its items.
+// The receipt number is the year of `PeriodStart` followed by the serial number in the year, e.g. 2019-000001.
+// The serial of the year is locked until the receipt is created, so the numbers are sequential even if receipts are issued at the same time,
+// and the serial is not consumed if any donation of the items is on another receipt.
+func (g *GormStorage) CreateAReceipt(mr *models.Receipt, items []models.ReceiptItem) error {
+	errWhere := "GormStorage.CreateAReceipt"
+	var serial models.ReceiptSerial
+
+	year := uint(mr.PeriodStart.Year())
+
+	tx := g.db.Begin()
+
+	if err := tx.Error; nil != err {
+		log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+		return g.NewStorageError(err, errWhere, "cannot begin the receipt creation transaction")
+	}
+
+	if err := tx.Exec("INSERT IGNORE INTO receipt_serials (year, last_serial) VALUES (?, 0)", year).Error; nil != err {
+		tx.Rollback()
+		log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+		return g.NewStorageError(err, errWhere, fmt.Sprintf("cannot initialize the receipt serial of year %d", year))
+	}
+
+	if err := tx.Set("gorm:query_option", "FOR UPDATE").Where("year = ?", year).Find(&serial).Error; nil != err {
+		tx.Rollback()
+		log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+		return g.NewStorageError(err, errWhere, fmt.Sprintf("cannot get the receipt serial of year %d", year))
+	}
+
+	serial.LastSerial++
+
+	if err := tx.Model(&models.ReceiptSerial{}).Where("year = ?", year).Update("last_serial", serial.LastSerial).Error; nil != err {
+		tx.Rollback()
+		log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+		return g.NewStorageError(err, errWhere, fmt.Sprintf("cannot update the receipt serial of year %d", year))
+	}
+
+	mr.ReceiptNumber = fmt.Sprintf("%d-%06d", year, serial.LastSerial)
+
+	if err := tx.Create(mr).Error; nil != err {
+		tx.Rollback()
+		log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+		return g.NewStorageError(err, errWhere, fmt.Sprintf("cannot create the receipt(%s)", mr.ReceiptNumber))
+	}
+
+	for _, item := range items {
+		item.ReceiptID = mr.ID
+		if err := tx.Create(&item).Error; nil != err {
+			tx.Rollback()
+			log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+			return g.NewStorageError(err, errWhere, fmt.Sprintf("cannot add the %s donation(id: %d) onto the receipt(%s)", item.DonationType, item.DonationID, mr.ReceiptNumber))
+		}
+	}
+
+	if err := tx.Commit().Error; nil != err {
+		log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+		return g.NewStorageError(err, errWhere, "cannot commit the receipt creation transaction")
+	}
+
+	return nil
+}
+
+// GetReceiptsOfAUser returns the receipts of the user without the PDF files, the latest period comes first
+func (g *GormStorage) GetReceiptsOfAUser(userID uint) ([]models.Receipt, error) {
+	errWhere := "GormStorage.GetReceiptsOfAUser"
+	var receipts []models.Receipt
+
+	if err := g.db.Select(receiptListColumns).Where("user_id = ?", userID).Order("period_start desc, id desc").Find(&receipts).Error; nil != err {
+		log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+		return receipts, g.NewStorageError(err, errWhere, fmt.Sprintf("cannot get the receipts of the user(id: %d)", userID))
+	}
+
+	return receipts, nil
+}
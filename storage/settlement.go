@@ -0,0 +1,164 @@
+package storage
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	"twreporter.org/go-api/globals"
+	"twreporter.org/go-api/models"
+)
+
+// settlementDonationQueries select the prime and card token donations charged through TapPay, which are settled by the acquiring bank
+var settlementDonationQueries = []string{
+	fmt.Sprintf(`SELECT '%s' AS type, id, order_number, amount, currency, status, rec_trade_id, bank_transaction_id FROM %s
+		WHERE deleted_at IS NULL AND payment_gateway = 'tappay'`, globals.PrimeDonaitionType, globals.TablePayByPrimeDonations),
+	fmt.Sprintf(`SELECT '%s' AS type, id, order_number, amount, currency, status, rec_trade_id, bank_transaction_id FROM %s
+		WHERE deleted_at IS NULL AND payment_gateway = 'tappay'`, globals.TokenDonationType, globals.TablePayByCardTokenDonations),
+}
+
+// getSettlementDonations returns the donations of all settlementDonationQueries with the same condition
+func (g *GormStorage) getSettlementDonations(cond string, condArgs ...interface{}) ([]models.SettlementDonation, error) {
+	var args []interface{}
+	var donations []models.SettlementDonation
+	var subqueries []string
+
+	for _, query := range settlementDonationQueries {
+		subqueries = append(subqueries, fmt.Sprintf("%s AND %s", query, cond))
+		args = append(args, condArgs...)
+	}
+
+	err := g.db.Raw(fmt.Sprintf("SELECT * FROM (%s) AS donations ORDER BY type ASC, id ASC", strings.Join(subqueries, " UNION ALL ")), args...).Scan(&donations).Error
+	return donations, err
+}
+
+// GetSettlementDonationsByTransactionIDs returns the donations whose rec trade ids or bank transaction ids are among the given ones
+func (g *GormStorage) GetSettlementDonationsByTransactionIDs(recTradeIDs []string, bankTransactionIDs []string) ([]models.SettlementDonation, error) {
+	errWhere := "GormStorage.GetSettlementDonationsByTransactionIDs"
+
+	// `IN (?)` of an empty slice is not valid SQL
+	recTradeIDs = append(recTradeIDs, "")
+	bankTransactionIDs = append(bankTransactionIDs, "")
+
+	donations, err := g.getSettlementDonations("((rec_trade_id IN (?) AND rec_trade_id != '') OR (bank_transaction_id IN (?) AND bank_transaction_id != ''))", recTradeIDs, bankTransactionIDs)
+	if nil != err {
+		log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+		return donations, g.NewStorageError(err, errWhere, "cannot get the donations by the transaction ids")
+	}
+
+	return donations, nil
+}
+
+// GetSettlementDonationsByTransactionTime returns the paid or refunded donations whose transactions are made during [since, until),
+// which the acquiring bank should settle
+func (g *GormStorage) GetSettlementDonationsByTransactionTime(since time.Time, until time.Time) ([]models.SettlementDonation, error) {
+	errWhere := "GormStorage.GetSettlementDonationsByTransactionTime"
+
+	donations, err := g.getSettlementDonations("status IN ('paid', 'refunded') AND transaction_time >= ? AND transaction_time < ?", since, until)
+	if nil != err {
+		log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+		return donations, g.NewStorageError(err, errWhere, fmt.Sprintf("cannot get the donations made during [%s, %s)", since, until))
+	}
+
+	return donations, nil
+}
+
+// GetRefundsByRecTradeIDs returns the refunds of the donations of the rec trade ids ordered by id,
+// which the refund lines of the settlement files are matched to
+func (g *GormStorage) GetRefundsByRecTradeIDs(recTradeIDs []string) ([]models.DonationRefund, error) {
+	errWhere := "GormStorage.GetRefundsByRecTradeIDs"
+	var refunds []models.DonationRefund
+
+	// `IN (?)` of an empty slice is not valid SQL
+	recTradeIDs = append(recTradeIDs, "")
+
+	if err := g.db.Where("rec_trade_id IN (?) AND rec_trade_id != ''", recTradeIDs).Order("id asc").Find(&refunds).Error; nil != err {
+		log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+		return refunds, g.NewStorageError(err, errWhere, "cannot get the refunds by the rec trade ids")
+	}
+
+	return refunds, nil
+}
+
+// ReplaceSettlementReconciliations replaces the reconciliation results of the settlement date in a transaction,
+// so that the file of the same date could be imported again after the donations are fixed
+func (g *GormStorage) ReplaceSettlementReconciliations(settlementDate string, records []models.SettlementReconciliation) error {
+	errWhere := "GormStorage.ReplaceSettlementReconciliations"
+
+	tx := g.db.Begin()
+
+	if err := tx.Error; nil != err {
+		log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+		return g.NewStorageError(err, errWhere, "cannot begin the settlement reconciliation transaction")
+	}
+
+	if err := tx.Where("settlement_date = ?", settlementDate).Delete(&models.SettlementReconciliation{}).Error; nil != err {
+		tx.Rollback()
+		log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+		return g.NewStorageError(err, errWhere, fmt.Sprintf("cannot delete the reconciliation results of the settlement date %s", settlementDate))
+	}
+
+	for i := range records {
+		records[i].SettlementDate = settlementDate
+
+		if err := tx.Create(&records[i]).Error; nil != err {
+			tx.Rollback()
+			log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+			return g.NewStorageError(err, errWhere, fmt.Sprintf("cannot create the reconciliation result(%#v)", records[i]))
+		}
+	}
+
+	if err := tx.Commit().Error; nil != err {
+		log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+		return g.NewStorageError(err, errWhere, "cannot commit the settlement reconciliation transaction")
+	}
+
+	return nil
+}
+
+// GetSettlementReconciliations returns the reconciliation results of the settlement date ordered by id,
+// along with the total number of the results. All results are returned if `result` is empty.
+func (g *GormStorage) GetSettlementReconciliations(settlementDate string, result string, limit int, offset int) ([]models.SettlementReconciliation, int, error) {
+	errWhere := "GormStorage.GetSettlementReconciliations"
+	var records []models.SettlementReconciliation
+	var total int
+
+	query := g.db.Model(&models.SettlementReconciliation{}).Where("settlement_date = ?", settlementDate)
+	if result != "" {
+		query = query.Where("result = ?", result)
+	}
+
+	if err := query.Count(&total).Error; nil != err {
+		log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+		return records, 0, g.NewStorageError(err, errWhere, fmt.Sprintf("cannot count the reconciliation results(settlement date: %s, result: %s)", settlementDate, result))
+	}
+
+	if err := query.Order("id asc").Limit(limit).Offset(offset).Find(&records).Error; nil != err {
+		log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+		return records, 0, g.NewStorageError(err, errWhere, fmt.Sprintf("cannot get the reconciliation results(settlement date: %s, result: %s)", settlementDate, result))
+	}
+
+	return records, total, nil
+}
+
+// CountSettlementReconciliations counts the reconciliation results of the settlement date by the results
+func (g *GormStorage) CountSettlementReconciliations(settlementDate string) ([]models.SettlementResultCount, error) {
+	errWhere := "GormStorage.CountSettlementReconciliations"
+	var counts []models.SettlementResultCount
+
+	err := g.db.Model(&models.SettlementReconciliation{}).
+		Select("result, COUNT(*) AS count").
+		Where("settlement_date = ?", settlementDate).
+		Group("result").
+		Order("result asc").
+		Scan(&counts).Error
+
+	if nil != err {
+		log.Error(fmt.Sprintf("%s: %s", errWhere, err.Error()))
+		return counts, g.NewStorageError(err, errWhere, fmt.Sprintf("cannot count the reconciliation results of the settlement date %s", settlementDate))
+	}
+
+	return counts, nil
+}
@@ -113,7 +113,7 @@ func (gs *GormStorage) InsertUserByOAuth(omodel models.OAuthAccount) (user model
 		Privilege:        constants.PrivilegeRegistered,
 		RegistrationDate: null.TimeFrom(time.Now()),
 	}
-	err = gs.db.Create(&user).Error
+	err = gs.createAUser(&user)
 	return user, err
 }
 
@@ -124,10 +124,24 @@ func (gs *GormStorage) InsertUserByReporterAccount(raModel models.ReporterAccoun
 		Email:            null.StringFrom(raModel.Email),
 		RegistrationDate: null.NewTime(time.Now(), true),
 	}
-	err := gs.db.Create(&user).Error
+	err := gs.createAUser(&user)
 	return user, err
 }
 
+// InsertUserByEmail inserts a user with the email only, e.g. the donor of a bank transfer who never signs in.
+// The user is connected to the reporter account once the donor signs in by the email.
+func (gs *GormStorage) InsertUserByEmail(email string) (models.User, error) {
+	user := models.User{
+		Email:            null.StringFrom(email),
+		RegistrationDate: null.TimeFrom(time.Now()),
+	}
+
+	if err := gs.createAUser(&user); err != nil {
+		return user, gs.NewStorageError(err, "GormStorage.InsertUserByEmail", fmt.Sprintf("create user(email: %s) error", email))
+	}
+	return user, nil
+}
+
 // UpdateOAuthData updates the corresponding OAuth by using the OAuth information
 func (gs *GormStorage) UpdateOAuthData(newData models.OAuthAccount) (models.OAuthAccount, error) {
 	log.Info("Getting the matching OAuth data", newData.AId)
@@ -0,0 +1,107 @@
+package tests
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/guregu/null.v3"
+	"twreporter.org/go-api/controllers"
+	"twreporter.org/go-api/models"
+	"twreporter.org/go-api/storage"
+)
+
+func TestCampaigns(t *testing.T) {
+	// setup before test
+	const slug = "test-year-end"
+	donor := createUser("campaign-donor@twreporter.org")
+	mc := controllers.NewMembershipController(storage.NewGormStorage(Globs.GormDB), Globs.PaymentGateways, Globs.CardKeyring)
+
+	location, _ := time.LoadLocation("Asia/Taipei")
+	today := time.Now().In(location).Format("2006-01-02")
+
+	donate := func(path string, campaign string, frequency string) responseBody {
+		return createDefaultDonationRecord(requestBody{
+			Amount:   testAmount,
+			Campaign: campaign,
+			Cardholder: models.Cardholder{
+				Email: donor.Email.ValueOrZero(),
+				Name:  null.StringFrom(testName),
+			},
+			Frequency:  frequency,
+			MerchantID: testMerchantID,
+			PayMethod:  creditCardPayMethod,
+			Prime:      testPrime,
+			UserID:     donor.ID,
+		}, path, donor)
+	}
+
+	t.Run("CreateACampaign", func(t *testing.T) {
+		_, err := mc.CreateACampaign("Year End!", "年終募款", 3000000, today, today, "")
+		assert.NotNil(t, err)
+
+		_, err = mc.CreateACampaign(slug, "年終募款", 3000000, today, "2000-01-01", "")
+		assert.NotNil(t, err)
+
+		campaign, err := mc.CreateACampaign(slug, "年終募款", 3000000, today, today, "報導者之友")
+		assert.Nil(t, err)
+		assert.Equal(t, 24*time.Hour, campaign.EndAt.Sub(campaign.StartAt))
+
+		// the slug is unique
+		_, err = mc.CreateACampaign(slug, "年終募款", 3000000, today, today, "")
+		assert.NotNil(t, err)
+	})
+
+	t.Run("DonateToAnUnknownCampaign", func(t *testing.T) {
+		resBody := donate("/v1/donations/prime", "unknown-campaign", "")
+		assert.Equal(t, "fail", resBody.Status)
+	})
+
+	t.Run("AttributeDonationsToTheCampaign", func(t *testing.T) {
+		primeID := donate("/v1/donations/prime", slug, "").Data.ID
+		periodicID := donate("/v1/periodic-donations", slug, monthlyFrequency).Data.ID
+		// the donation without the campaign does not count
+		createDefaultPrimeDonationRecord(donor)
+
+		d := models.PayByPrimeDonation{}
+		Globs.GormDB.Where("id = ?", primeID).Find(&d)
+		assert.Equal(t, slug, d.Campaign.ValueOrZero())
+
+		installment := models.PayByCardTokenDonation{}
+		Globs.GormDB.Where("periodic_id = ?", periodicID).Find(&installment)
+		assert.Equal(t, slug, installment.Campaign.ValueOrZero())
+	})
+
+	t.Run("GetTheProgress", func(t *testing.T) {
+		resp := serveHTTP("GET", "/v1/campaigns/"+slug, "", "", "")
+		assert.Equal(t, http.StatusOK, resp.Code)
+		assert.Equal(t, "public,max-age=60", resp.Header().Get("Cache-Control"))
+
+		resBody := struct {
+			Data struct {
+				Amounts []struct {
+					Amount   uint   `json:"amount"`
+					Currency string `json:"currency"`
+				} `json:"amounts"`
+				Donors           uint        `json:"donors"`
+				GoalAmount       uint        `json:"goal_amount"`
+				MatchingSponsor  null.String `json:"matching_sponsor"`
+				Raised           uint        `json:"raised"`
+				RecurringPledges uint        `json:"recurring_pledges"`
+			} `json:"data"`
+		}{}
+		json.Unmarshal(resp.Body.Bytes(), &resBody)
+
+		assert.Equal(t, uint(3000000), resBody.Data.GoalAmount)
+		assert.Equal(t, "報導者之友", resBody.Data.MatchingSponsor.ValueOrZero())
+		assert.Equal(t, 2*testAmount, resBody.Data.Raised)
+		assert.Equal(t, 1, len(resBody.Data.Amounts))
+		assert.Equal(t, uint(1), resBody.Data.Donors)
+		assert.Equal(t, uint(1), resBody.Data.RecurringPledges)
+
+		resp = serveHTTP("GET", "/v1/campaigns/unknown-campaign", "", "", "")
+		assert.Equal(t, http.StatusNotFound, resp.Code)
+	})
+}
@@ -0,0 +1,134 @@
+package tests
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"twreporter.org/go-api/configs/constants"
+	"twreporter.org/go-api/controllers"
+	"twreporter.org/go-api/models"
+	"twreporter.org/go-api/storage"
+	"twreporter.org/go-api/utils"
+)
+
+func TestRemindExpiringCards(t *testing.T) {
+	// setup before test
+	donor := createUser("card-expiry-donor@twreporter.org")
+	periodicID := createDefaultPeriodicDonationRecord(donor).Data.ID
+	notExpiringID := createDefaultPeriodicDonationRecord(donor).Data.ID
+
+	admin := createUser("card-expiry-admin@twreporter.org")
+	Globs.GormDB.Model(&models.User{}).Where("id = ?", admin.ID).Update("privilege", constants.PrivilegeAdmin)
+
+	mc := controllers.NewMembershipController(storage.NewGormStorage(Globs.GormDB), Globs.PaymentGateways, Globs.CardKeyring)
+
+	location, _ := time.LoadLocation("Asia/Taipei")
+	now := time.Now().In(location)
+	thisMonth := now.Format("200601")
+
+	// the card expires at the end of this month, the other expires next year
+	Globs.GormDB.Model(&models.PeriodicDonation{}).Where("id = ?", periodicID).Update("card_info_expiry_date", thisMonth)
+	Globs.GormDB.Model(&models.PeriodicDonation{}).Where("id = ?", notExpiringID).Update("card_info_expiry_date", now.AddDate(1, 0, 0).Format("200601"))
+
+	countReminders := func(id uint) (count int) {
+		Globs.GormDB.Model(&models.PeriodicDonationCardExpiryReminder{}).Where("periodic_id = ?", id).Count(&count)
+		return
+	}
+
+	t.Run("RemindTheExpiringCards", func(t *testing.T) {
+		summary, err := mc.RemindExpiringCards(now, 31, 1)
+		assert.Nil(t, err)
+		assert.Empty(t, summary.Failed)
+		assert.True(t, summary.Reminded >= 1)
+
+		assert.Equal(t, 1, countReminders(periodicID))
+		assert.Equal(t, 0, countReminders(notExpiringID))
+
+		reminder := models.PeriodicDonationCardExpiryReminder{}
+		Globs.GormDB.Where("periodic_id = ?", periodicID).Find(&reminder)
+		assert.Equal(t, thisMonth, reminder.ExpiryDate)
+		assert.Equal(t, donor.Email.ValueOrZero(), reminder.Email)
+	})
+
+	t.Run("RemindOncePerCard", func(t *testing.T) {
+		_, err := mc.RemindExpiringCards(now, 31, 10)
+		assert.Nil(t, err)
+		assert.Equal(t, 1, countReminders(periodicID))
+	})
+
+	t.Run("ListTheCardExpirations", func(t *testing.T) {
+		list := func(user models.User, query string) *http.Response {
+			cookie := http.Cookie{
+				HttpOnly: true,
+				MaxAge:   3600,
+				Name:     "id_token",
+				Secure:   false,
+				Value:    generateIDToken(user),
+			}
+			return serveHTTPWithCookies("GET", "/v1/donations/card-expirations?"+query, "", "", fmt.Sprintf("Bearer %s", generateJWT(user)), cookie).Result()
+		}
+
+		assert.Equal(t, http.StatusForbidden, list(donor, "").StatusCode)
+		assert.Equal(t, http.StatusBadRequest, list(admin, "months=0").StatusCode)
+		assert.Equal(t, http.StatusBadRequest, list(admin, "months=25").StatusCode)
+
+		resp := list(admin, "months=2")
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		resBody := struct {
+			Data struct {
+				Months []struct {
+					Month             string `json:"month"`
+					PeriodicDonations uint   `json:"periodic_donations"`
+					Amount            uint   `json:"amount"`
+					Reminded          uint   `json:"reminded"`
+				} `json:"months"`
+			} `json:"data"`
+		}{}
+		json.NewDecoder(resp.Body).Decode(&resBody)
+
+		assert.Equal(t, 2, len(resBody.Data.Months))
+		assert.Equal(t, now.Format("2006-01"), resBody.Data.Months[0].Month)
+		assert.True(t, resBody.Data.Months[0].PeriodicDonations >= 1)
+		assert.True(t, resBody.Data.Months[0].Amount >= testAmount)
+		assert.True(t, resBody.Data.Months[0].Reminded >= 1)
+	})
+
+	t.Run("ReplaceTheCardByTheLink", func(t *testing.T) {
+		path := "/v1/card-replacements"
+		token, _ := utils.RetrieveCardReplacementToken(periodicID, donor.ID, thisMonth, 3600)
+
+		// the access token is not accepted as the link token
+		accessToken, _ := utils.RetrieveV2AccessToken(donor.ID, donor.Email.ValueOrZero(), 3600)
+		resp := serveHTTP("POST", path, fmt.Sprintf(`{"prime":"%s","token":"%s"}`, testPrime, accessToken), "application/json", "")
+		assert.Equal(t, http.StatusUnauthorized, resp.Code)
+
+		expired, _ := utils.RetrieveCardReplacementToken(periodicID, donor.ID, thisMonth, -60)
+		resp = serveHTTP("POST", path, fmt.Sprintf(`{"prime":"%s","token":"%s"}`, testPrime, expired), "application/json", "")
+		assert.Equal(t, http.StatusUnauthorized, resp.Code)
+
+		resp = serveHTTP("POST", path, fmt.Sprintf(`{"token":"%s"}`, token), "application/json", "")
+		assert.Equal(t, http.StatusBadRequest, resp.Code)
+
+		resp = serveHTTP("POST", path, fmt.Sprintf(`{"prime":"%s","token":"%s"}`, testPrime, token), "application/json", "")
+		assert.Equal(t, http.StatusOK, resp.Code)
+		assert.NotContains(t, resp.Body.String(), donor.Email.ValueOrZero())
+
+		pd := models.PeriodicDonation{}
+		Globs.GormDB.Where("id = ?", periodicID).Find(&pd)
+		assert.NotEqual(t, thisMonth, pd.CardInfo.ExpiryDate.ValueOrZero())
+
+		changes := []models.PeriodicDonationCardChange{}
+		Globs.GormDB.Where("periodic_id = ?", periodicID).Find(&changes)
+		assert.Equal(t, 1, len(changes))
+		assert.Equal(t, donor.ID, changes[0].UserID)
+
+		// the link is no longer accepted once the card is replaced
+		resp = serveHTTP("POST", path, fmt.Sprintf(`{"prime":"%s","token":"%s"}`, testPrime, token), "application/json", "")
+		assert.Equal(t, http.StatusConflict, resp.Code)
+	})
+}
@@ -0,0 +1,163 @@
+package tests
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"twreporter.org/go-api/controllers"
+	"twreporter.org/go-api/globals"
+	"twreporter.org/go-api/keyring"
+	"twreporter.org/go-api/models"
+	"twreporter.org/go-api/storage"
+)
+
+const (
+	testPrimaryKeyID   = "test-1"
+	testRotatedKeyID   = "test-2"
+	testCardSecretKeys = "test-1:MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY=,test-2:ZmVkY2JhOTg3NjU0MzIxMGZlZGNiYTk4NzY1NDMyMTA="
+)
+
+var testKeySet = keyring.KeySet{
+	PrimaryKeyID: testPrimaryKeyID,
+	Keys: map[string]string{
+		"test-1": "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY=",
+		"test-2": "ZmVkY2JhOTg3NjU0MzIxMGZlZGNiYTk4NzY1NDMyMTA=",
+	},
+}
+
+// legacyEncrypt encrypts the way card secrets were encrypted before keys are versioned
+func legacyEncrypt(data string, key string) string {
+	hash := sha256.Sum256([]byte(key))
+	block, _ := aes.NewCipher(hash[:])
+	gcm, _ := cipher.NewGCM(block)
+	nonce := make([]byte, gcm.NonceSize())
+	io.ReadFull(rand.Reader, nonce)
+	return string(gcm.Seal(nonce, nonce, []byte(data), nil))
+}
+
+func TestCardSecretKeyring(t *testing.T) {
+	t.Run("EncryptByThePrimaryKey", func(t *testing.T) {
+		ciphertext, err := Globs.CardKeyring.Encrypt("card-token")
+		assert.Nil(t, err)
+		assert.True(t, strings.HasPrefix(ciphertext, "$test-1$"))
+		assert.Equal(t, testPrimaryKeyID, Globs.CardKeyring.KeyID(ciphertext))
+		assert.True(t, Globs.CardKeyring.IsCurrent(ciphertext))
+
+		plaintext, err := Globs.CardKeyring.Decrypt(ciphertext)
+		assert.Nil(t, err)
+		assert.Equal(t, "card-token", plaintext)
+	})
+
+	t.Run("DecryptByTheRetiredKey", func(t *testing.T) {
+		ks := testKeySet
+		ks.PrimaryKeyID = testRotatedKeyID
+		rotated, err := keyring.NewKeyring(ks, "")
+		assert.Nil(t, err)
+
+		ciphertext, _ := Globs.CardKeyring.Encrypt("card-token")
+		assert.False(t, rotated.IsCurrent(ciphertext))
+
+		plaintext, err := rotated.Decrypt(ciphertext)
+		assert.Nil(t, err)
+		assert.Equal(t, "card-token", plaintext)
+	})
+
+	t.Run("DecryptByTheLegacyKey", func(t *testing.T) {
+		ciphertext := legacyEncrypt("card-token", globals.Conf.Donation.CardSecretKey)
+		assert.Equal(t, "", Globs.CardKeyring.KeyID(ciphertext))
+
+		plaintext, err := Globs.CardKeyring.Decrypt(ciphertext)
+		assert.Nil(t, err)
+		assert.Equal(t, "card-token", plaintext)
+
+		// no plaintext is returned without the legacy key
+		noLegacy, _ := keyring.NewKeyring(testKeySet, "")
+		_, err = noLegacy.Decrypt(ciphertext)
+		assert.NotNil(t, err)
+	})
+
+	t.Run("InvalidKeySet", func(t *testing.T) {
+		_, err := keyring.NewKeyring(keyring.KeySet{PrimaryKeyID: "test-3", Keys: testKeySet.Keys}, "")
+		assert.NotNil(t, err)
+
+		_, err = keyring.NewKeyring(keyring.KeySet{PrimaryKeyID: "short", Keys: map[string]string{"short": "c2hvcnQ="}}, "")
+		assert.NotNil(t, err)
+
+		_, err = keyring.NewKeyring(keyring.KeySet{PrimaryKeyID: "a$b", Keys: map[string]string{"a$b": testKeySet.Keys["test-1"]}}, "")
+		assert.NotNil(t, err)
+	})
+}
+
+func TestRotateCardSecrets(t *testing.T) {
+	// setup before test
+	user := createUser("rotate-card-secrets@twreporter.org")
+	periodicID := createDefaultPeriodicDonationRecord(user).Data.ID
+	legacyID := createDefaultPeriodicDonationRecord(user).Data.ID
+
+	getPeriodicDonation := func(id uint) (pd models.PeriodicDonation) {
+		Globs.GormDB.Where("id = ?", id).Find(&pd)
+		return
+	}
+
+	pd := getPeriodicDonation(periodicID)
+	assert.Equal(t, testPrimaryKeyID, Globs.CardKeyring.KeyID(pd.CardToken))
+	assert.Equal(t, testPrimaryKeyID, Globs.CardKeyring.KeyID(pd.CardKey))
+	cardToken, _ := Globs.CardKeyring.Decrypt(pd.CardToken)
+	cardKey, _ := Globs.CardKeyring.Decrypt(pd.CardKey)
+
+	// pretend the card secrets were stored before keys are versioned
+	Globs.GormDB.Model(&models.PeriodicDonation{}).Where("id = ?", legacyID).Updates(map[string]interface{}{
+		"card_key":   legacyEncrypt(cardKey, globals.Conf.Donation.CardSecretKey),
+		"card_token": legacyEncrypt(cardToken, globals.Conf.Donation.CardSecretKey),
+	})
+
+	ks := testKeySet
+	ks.PrimaryKeyID = testRotatedKeyID
+	rotated, _ := keyring.NewKeyring(ks, globals.Conf.Donation.CardSecretKey)
+	mc := controllers.NewMembershipController(storage.NewGormStorage(Globs.GormDB), Globs.PaymentGateways, rotated)
+
+	t.Run("RotateToTheNewPrimaryKey", func(t *testing.T) {
+		summary, err := mc.RotateCardSecrets(1)
+		assert.Nil(t, err)
+		assert.Empty(t, summary.Failed)
+		assert.True(t, summary.Rotated >= 2)
+
+		for _, id := range []uint{periodicID, legacyID} {
+			pd := getPeriodicDonation(id)
+			assert.Equal(t, testRotatedKeyID, rotated.KeyID(pd.CardToken))
+			assert.Equal(t, testRotatedKeyID, rotated.KeyID(pd.CardKey))
+
+			token, err := rotated.Decrypt(pd.CardToken)
+			assert.Nil(t, err)
+			assert.Equal(t, cardToken, token)
+
+			key, err := rotated.Decrypt(pd.CardKey)
+			assert.Nil(t, err)
+			assert.Equal(t, cardKey, key)
+		}
+	})
+
+	t.Run("RotatedSecretsAreSkipped", func(t *testing.T) {
+		summary, err := mc.RotateCardSecrets(10)
+		assert.Nil(t, err)
+		assert.Equal(t, 0, summary.Rotated)
+		assert.Empty(t, summary.Failed)
+	})
+
+	t.Run("RotateBack", func(t *testing.T) {
+		// the other tests charge the card secrets by the default keyring
+		original := controllers.NewMembershipController(storage.NewGormStorage(Globs.GormDB), Globs.PaymentGateways, Globs.CardKeyring)
+		summary, err := original.RotateCardSecrets(10)
+		assert.Nil(t, err)
+		assert.Empty(t, summary.Failed)
+
+		pd := getPeriodicDonation(periodicID)
+		assert.Equal(t, testPrimaryKeyID, Globs.CardKeyring.KeyID(pd.CardToken))
+	})
+}
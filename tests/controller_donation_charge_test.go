@@ -0,0 +1,76 @@
+package tests
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"twreporter.org/go-api/controllers"
+	"twreporter.org/go-api/models"
+	"twreporter.org/go-api/storage"
+)
+
+func countCardTokenDonations(periodicID uint, status string) (count int) {
+	Globs.GormDB.Model(&models.PayByCardTokenDonation{}).Where("periodic_id = ? AND status = ?", periodicID, status).Count(&count)
+	return
+}
+
+func TestChargeDuePeriodicDonations(t *testing.T) {
+	// setup before test
+	donorEmail := "charge-periodic-donor@twreporter.org"
+	user := createUser(donorEmail)
+	periodicRes := createDefaultPeriodicDonationRecord(user)
+	periodicID := periodicRes.Data.ID
+
+	mc := controllers.NewMembershipController(storage.NewGormStorage(Globs.GormDB), Globs.PaymentGateways, Globs.CardKeyring)
+
+	t.Run("NotDueYet", func(t *testing.T) {
+		_, err := mc.ChargeDuePeriodicDonations(time.Now(), 10)
+		assert.Nil(t, err)
+		assert.Equal(t, 1, countCardTokenDonations(periodicID, "paid"))
+	})
+
+	t.Run("ChargeTheSecondInstallment", func(t *testing.T) {
+		// pretend the first installment was paid a month ago
+		lastSuccessAt := time.Now().AddDate(0, -1, -1)
+		Globs.GormDB.Model(&models.PeriodicDonation{}).Where("id = ?", periodicID).Updates(map[string]interface{}{
+			"last_success_at": lastSuccessAt,
+			"max_paid_times":  2,
+		})
+
+		_, err := mc.ChargeDuePeriodicDonations(time.Now(), 10)
+		assert.Nil(t, err)
+		assert.Equal(t, 2, countCardTokenDonations(periodicID, "paid"))
+
+		pd := models.PeriodicDonation{}
+		Globs.GormDB.Where("id = ?", periodicID).Find(&pd)
+		// the periodic donation reaches max paid times
+		assert.Equal(t, "stopped", pd.Status)
+		// the billing date is kept rather than moved to the day the installment is charged
+		assert.WithinDuration(t, lastSuccessAt.AddDate(0, 1, 0), pd.LastSuccessAt.Time, 2*time.Second)
+	})
+
+	t.Run("NoDoubleCharge", func(t *testing.T) {
+		_, err := mc.ChargeDuePeriodicDonations(time.Now().AddDate(0, 2, 0), 10)
+		assert.Nil(t, err)
+		assert.Equal(t, 2, countCardTokenDonations(periodicID, "paid"))
+	})
+
+	t.Run("RefundedInstallmentAtTheCap", func(t *testing.T) {
+		// pretend the second installment is refunded while the periodic donation is still charged
+		second := models.PayByCardTokenDonation{}
+		Globs.GormDB.Where("periodic_id = ?", periodicID).Order("id desc").First(&second)
+		Globs.GormDB.Model(&models.PayByCardTokenDonation{}).Where("id = ?", second.ID).Update("status", "refunded")
+		Globs.GormDB.Model(&models.PeriodicDonation{}).Where("id = ?", periodicID).Updates(map[string]interface{}{
+			"last_success_at": time.Now().AddDate(0, -1, -1),
+			"status":          "paid",
+		})
+
+		_, err := mc.ChargeDuePeriodicDonations(time.Now(), 10)
+		assert.Nil(t, err)
+		// the refunded installment is counted toward max paid times
+		assert.Equal(t, 1, countCardTokenDonations(periodicID, "paid"))
+		assert.Equal(t, 1, countCardTokenDonations(periodicID, "refunded"))
+		assert.Equal(t, 0, countCardTokenDonations(periodicID, "paying"))
+	})
+}
@@ -0,0 +1,115 @@
+package tests
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/guregu/null.v3"
+	"twreporter.org/go-api/configs"
+	"twreporter.org/go-api/controllers"
+	"twreporter.org/go-api/currency"
+	"twreporter.org/go-api/globals"
+	"twreporter.org/go-api/models"
+	"twreporter.org/go-api/storage"
+)
+
+func TestCreateADonationInCurrencies(t *testing.T) {
+	// setup before test
+	user := createUser("currency-donor@twreporter.org")
+
+	currencies := globals.Conf.Donation.Currencies
+	globals.Conf.Donation.Currencies = map[string]configs.CurrencyConfig{
+		"TWD": {MinAmount: 1, MaxAmount: 1000000, Symbol: "NT$"},
+		"USD": {MinAmount: 1, MaxAmount: 30000, MerchantID: testMerchantID, Symbol: "US$"},
+	}
+	defer func() { globals.Conf.Donation.Currencies = currencies }()
+
+	create := func(code string, amount uint, merchantID string) *http.Response {
+		reqBody := requestBody{
+			Amount: amount,
+			Cardholder: models.Cardholder{
+				Email: user.Email.ValueOrZero(),
+				Name:  null.StringFrom(testName),
+			},
+			Currency:   code,
+			MerchantID: merchantID,
+			PayMethod:  creditCardPayMethod,
+			Prime:      testPrime,
+			UserID:     user.ID,
+		}
+		reqBodyInBytes, _ := json.Marshal(reqBody)
+
+		cookie := http.Cookie{
+			HttpOnly: true,
+			MaxAge:   3600,
+			Name:     "id_token",
+			Secure:   false,
+			Value:    generateIDToken(user),
+		}
+		return serveHTTPWithCookies("POST", "/v1/donations/prime", string(reqBodyInBytes), "application/json", fmt.Sprintf("Bearer %s", generateJWT(user)), cookie).Result()
+	}
+
+	t.Run("UnsupportedCurrency", func(t *testing.T) {
+		assert.Equal(t, http.StatusBadRequest, create("XYZ", testAmount, "").StatusCode)
+	})
+
+	t.Run("AmountOutOfRange", func(t *testing.T) {
+		assert.Equal(t, http.StatusBadRequest, create("USD", 30001, "").StatusCode)
+	})
+
+	t.Run("AnotherMerchant", func(t *testing.T) {
+		assert.Equal(t, http.StatusBadRequest, create("USD", 30, "twreporter_CTBC").StatusCode)
+	})
+}
+
+func TestLoadExchangeRates(t *testing.T) {
+	mc := controllers.NewMembershipController(storage.NewGormStorage(Globs.GormDB), Globs.PaymentGateways, Globs.CardKeyring)
+
+	t.Run("InvalidFile", func(t *testing.T) {
+		for _, file := range []string{
+			"date,currency\n2019-06-03,USD\n",
+			"date,currency,rate\n2019/06/03,USD,31.52\n",
+			"date,currency,rate\n2019-06-03,TWD,1\n",
+			"date,currency,rate\n2019-06-03,USD,-31.52\n",
+		} {
+			_, err := mc.LoadExchangeRates(strings.NewReader(file))
+			assert.NotNil(t, err, file)
+		}
+	})
+
+	t.Run("ConvertByTheLatestRates", func(t *testing.T) {
+		count, err := mc.LoadExchangeRates(strings.NewReader("date,currency,rate\n2019-06-03,USD,31\n2019-06-05,USD,30\n"))
+		assert.Nil(t, err)
+		assert.Equal(t, 2, count)
+
+		// the rates are overwritten once they are loaded again
+		_, err = mc.LoadExchangeRates(strings.NewReader("date,currency,rate\n2019-06-03,USD,31.5\n"))
+		assert.Nil(t, err)
+
+		location, _ := time.LoadLocation("Asia/Taipei")
+		rates, err := storage.NewGormStorage(Globs.GormDB).GetExchangeRates(time.Date(2019, 6, 30, 0, 0, 0, 0, location))
+		assert.Nil(t, err)
+		table := currency.NewRateTable(rates)
+
+		amount, ok := table.ToTWD("USD", 10, time.Date(2019, 6, 4, 12, 0, 0, 0, location))
+		assert.True(t, ok)
+		assert.Equal(t, uint(315), amount)
+
+		amount, ok = table.ToTWD("USD", 10, time.Date(2019, 6, 5, 0, 0, 0, 0, location))
+		assert.True(t, ok)
+		assert.Equal(t, uint(300), amount)
+
+		// no rate before the first one is loaded
+		_, ok = table.ToTWD("USD", 10, time.Date(2019, 6, 2, 0, 0, 0, 0, location))
+		assert.False(t, ok)
+
+		amount, ok = table.ToTWD("TWD", 10, time.Date(2019, 6, 2, 0, 0, 0, 0, location))
+		assert.True(t, ok)
+		assert.Equal(t, uint(10), amount)
+	})
+}
@@ -0,0 +1,103 @@
+package tests
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"twreporter.org/go-api/controllers"
+	"twreporter.org/go-api/globals"
+	"twreporter.org/go-api/models"
+	"twreporter.org/go-api/storage"
+)
+
+func TestDunningPeriodicDonations(t *testing.T) {
+	// setup before test
+	user := createUser("dunning-periodic-donor@twreporter.org")
+	periodicID := createDefaultPeriodicDonationRecord(user).Data.ID
+
+	mc := controllers.NewMembershipController(storage.NewGormStorage(Globs.GormDB), Globs.PaymentGateways, Globs.CardKeyring)
+
+	// the card token is rejected by the payment gateway
+	invalidToken, _ := Globs.CardKeyring.Encrypt("invalid-card-token")
+	Globs.GormDB.Model(&models.PeriodicDonation{}).Where("id = ?", periodicID).Updates(map[string]interface{}{
+		"card_token":      invalidToken,
+		"last_success_at": time.Now().AddDate(0, -1, -1),
+	})
+
+	getPeriodicDonation := func() (pd models.PeriodicDonation) {
+		Globs.GormDB.Where("id = ?", periodicID).Find(&pd)
+		return
+	}
+
+	startedAt := time.Now()
+
+	t.Run("TheFirstFailureStartsDunning", func(t *testing.T) {
+		summary, err := mc.ChargeDuePeriodicDonations(startedAt, 10)
+		assert.Nil(t, err)
+		assert.True(t, summary.Failed >= 1)
+		assert.Equal(t, 1, countCardTokenDonations(periodicID, "fail"))
+
+		pd := getPeriodicDonation()
+		assert.Equal(t, "fail", pd.Status)
+		assert.Equal(t, uint(0), pd.DunningRetries)
+		assert.WithinDuration(t, startedAt, pd.DunningStartedAt.Time, 2*time.Second)
+		assert.WithinDuration(t, startedAt.AddDate(0, 0, 1), pd.NextRetryAt.Time, 2*time.Second)
+	})
+
+	t.Run("NotRetriedBeforeTheSchedule", func(t *testing.T) {
+		_, err := mc.ChargeDuePeriodicDonations(startedAt.Add(23*time.Hour), 10)
+		assert.Nil(t, err)
+		assert.Equal(t, 1, countCardTokenDonations(periodicID, "fail"))
+	})
+
+	t.Run("RetryByTheSchedule", func(t *testing.T) {
+		summary, err := mc.ChargeDuePeriodicDonations(startedAt.AddDate(0, 0, 1).Add(time.Minute), 10)
+		assert.Nil(t, err)
+		assert.True(t, summary.Retried >= 1)
+		assert.Equal(t, 2, countCardTokenDonations(periodicID, "fail"))
+
+		pd := getPeriodicDonation()
+		assert.Equal(t, "fail", pd.Status)
+		assert.Equal(t, uint(1), pd.DunningRetries)
+		assert.WithinDuration(t, startedAt.AddDate(0, 0, 3), pd.NextRetryAt.Time, 2*time.Second)
+
+		_, err = mc.ChargeDuePeriodicDonations(startedAt.AddDate(0, 0, 3).Add(time.Minute), 10)
+		assert.Nil(t, err)
+		assert.Equal(t, 3, countCardTokenDonations(periodicID, "fail"))
+
+		pd = getPeriodicDonation()
+		assert.Equal(t, uint(2), pd.DunningRetries)
+		assert.WithinDuration(t, startedAt.AddDate(0, 0, 7), pd.NextRetryAt.Time, 2*time.Second)
+	})
+
+	t.Run("InvalidAfterTheLastRetryFails", func(t *testing.T) {
+		summary, err := mc.ChargeDuePeriodicDonations(startedAt.AddDate(0, 0, 7).Add(time.Minute), 10)
+		assert.Nil(t, err)
+		assert.True(t, summary.Invalidated >= 1)
+		assert.Equal(t, 4, countCardTokenDonations(periodicID, "fail"))
+
+		pd := getPeriodicDonation()
+		assert.Equal(t, "invalid", pd.Status)
+		assert.False(t, pd.NextRetryAt.Valid)
+
+		// invalid periodic donations are never retried
+		_, err = mc.ChargeDuePeriodicDonations(startedAt.AddDate(0, 0, 30), 10)
+		assert.Nil(t, err)
+		assert.Equal(t, 4, countCardTokenDonations(periodicID, "fail"))
+	})
+
+	t.Run("SummarizeAtRiskPeriodicDonations", func(t *testing.T) {
+		count, err := mc.SendAtRiskPeriodicDonationsSummary(startedAt.Add(-time.Hour))
+		assert.Nil(t, err)
+		// no summary is sent without the staff email
+		assert.Equal(t, 0, count)
+
+		globals.Conf.Donation.StaffEmail = "donation@twreporter.org"
+		defer func() { globals.Conf.Donation.StaffEmail = "" }()
+
+		count, err = mc.SendAtRiskPeriodicDonationsSummary(startedAt.Add(-time.Hour))
+		assert.Nil(t, err)
+		assert.True(t, count >= 1)
+	})
+}
@@ -0,0 +1,77 @@
+package tests
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"twreporter.org/go-api/configs/constants"
+	"twreporter.org/go-api/models"
+)
+
+func TestExportDonations(t *testing.T) {
+	// setup before test
+	donor := createUser("export-donor@twreporter.org")
+	primeRes := createDefaultPrimeDonationRecord(donor)
+
+	admin := createUser("export-admin@twreporter.org")
+	Globs.GormDB.Model(&models.User{}).Where("id = ?", admin.ID).Update("privilege", constants.PrivilegeAdmin)
+
+	location, _ := time.LoadLocation("Asia/Taipei")
+	today := time.Now().In(location).Format("2006-01-02")
+
+	export := func(user models.User, query string) (int, string, string) {
+		cookie := http.Cookie{
+			HttpOnly: true,
+			MaxAge:   3600,
+			Name:     "id_token",
+			Secure:   false,
+			Value:    generateIDToken(user),
+		}
+		resp := serveHTTPWithCookies("GET", "/v1/donations/export?"+query, "", "", fmt.Sprintf("Bearer %s", generateJWT(user)), cookie)
+		return resp.Code, resp.Header().Get("Content-Type"), resp.Body.String()
+	}
+
+	t.Run("StatusCode=StatusForbidden", func(t *testing.T) {
+		code, _, _ := export(donor, fmt.Sprintf("since=%s&until=%s", today, today))
+		assert.Equal(t, http.StatusForbidden, code)
+	})
+
+	t.Run("StatusCode=StatusBadRequest", func(t *testing.T) {
+		code, _, _ := export(admin, fmt.Sprintf("since=%s", today))
+		assert.Equal(t, http.StatusBadRequest, code)
+
+		code, _, _ = export(admin, fmt.Sprintf("since=%s&until=%s&format=pdf", today, today))
+		assert.Equal(t, http.StatusBadRequest, code)
+
+		code, _, _ = export(admin, fmt.Sprintf("since=%s&until=%s&type=periodic_donation", today, today))
+		assert.Equal(t, http.StatusBadRequest, code)
+	})
+
+	t.Run("ExportCSV", func(t *testing.T) {
+		code, contentType, body := export(admin, fmt.Sprintf("since=%s&until=%s&type=prime", today, today))
+		assert.Equal(t, http.StatusOK, code)
+		assert.Equal(t, "text/csv; charset=utf-8", contentType)
+
+		lines := strings.Split(strings.TrimSpace(body), "\n")
+		assert.Equal(t, "type,id,created_at,transaction_time,order_number,bank_transaction_id,rec_trade_id,amount,currency,pay_method,card_type,card_last_four,status,exchange_rate,amount_twd,donor_type,company_name,tax_id", lines[0])
+		assert.Contains(t, body, fmt.Sprintf("prime,%d,", primeRes.Data.ID))
+		assert.Contains(t, body, fmt.Sprintf(",%d,TWD,credit_card,", testAmount))
+
+		// the donations of the other types are filtered out
+		for _, line := range lines[1:] {
+			assert.True(t, strings.HasPrefix(line, "prime,"))
+		}
+	})
+
+	t.Run("ExportXLSX", func(t *testing.T) {
+		code, contentType, body := export(admin, fmt.Sprintf("since=%s&until=%s&format=xlsx", today, today))
+		assert.Equal(t, http.StatusOK, code)
+		assert.Equal(t, "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet", contentType)
+		// xlsx files are zip files
+		assert.True(t, strings.HasPrefix(body, "PK"))
+	})
+}
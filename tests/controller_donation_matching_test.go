@@ -0,0 +1,158 @@
+package tests
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"twreporter.org/go-api/configs/constants"
+	"twreporter.org/go-api/controllers"
+	"twreporter.org/go-api/globals"
+	"twreporter.org/go-api/models"
+	"twreporter.org/go-api/storage"
+)
+
+func TestMatchingGifts(t *testing.T) {
+	const slug = "matching-gifts"
+	const sponsor = "報導者之友基金會"
+
+	// setup before test
+	donor := createUser("matching-donor@twreporter.org")
+	mc := controllers.NewMembershipController(storage.NewGormStorage(Globs.GormDB), Globs.PaymentGateways, Globs.CardKeyring)
+
+	location, _ := time.LoadLocation("Asia/Taipei")
+	today := time.Now().In(location).Format("2006-01-02")
+
+	cookie := http.Cookie{
+		HttpOnly: true,
+		MaxAge:   3600,
+		Name:     "id_token",
+		Secure:   false,
+		Value:    generateIDToken(donor),
+	}
+	authorization := fmt.Sprintf("Bearer %s", generateJWT(donor))
+
+	type matching struct {
+		MatchedAmount uint   `json:"matched_amount"`
+		Sponsor       string `json:"sponsor"`
+	}
+
+	donate := func() (uint, *matching) {
+		reqBody := fmt.Sprintf(`{"amount":%d,"campaign":"%s","details":"%s","donor":{"email":"%s","name":"%s"},"merchant_id":"%s","pay_method":"credit_card","prime":"%s","user_id":%d}`,
+			testAmount, slug, testDetails, donor.Email.ValueOrZero(), testName, testMerchantID, testPrime, donor.ID)
+		resp := serveHTTPWithCookies("POST", "/v1/donations/prime", reqBody, "application/json", authorization, cookie)
+
+		resBody := struct {
+			Data struct {
+				ID       uint      `json:"id"`
+				Matching *matching `json:"matching"`
+			} `json:"data"`
+		}{}
+		json.Unmarshal(resp.Body.Bytes(), &resBody)
+		return resBody.Data.ID, resBody.Data.Matching
+	}
+
+	var matchedID uint
+	var rule models.MatchingRule
+
+	t.Run("CreateAMatchingRule", func(t *testing.T) {
+		_, err := mc.CreateACampaign(slug, "配捐測試", 3000000, today, today, sponsor)
+		assert.Nil(t, err)
+
+		_, err = mc.CreateAMatchingRule(sponsor, "not-an-email", 1, 700, "TWD", "prime", slug, today, today)
+		assert.NotNil(t, err)
+
+		_, err = mc.CreateAMatchingRule(sponsor, "sponsor@twreporter.org", 1, 700, "TWD", "prime,periodic", slug, today, today)
+		assert.NotNil(t, err)
+
+		_, err = mc.CreateAMatchingRule(sponsor, "sponsor@twreporter.org", 1, 700, "TWD", "prime", "unknown-campaign", today, today)
+		assert.NotNil(t, err)
+
+		rule, err = mc.CreateAMatchingRule(sponsor, "sponsor@twreporter.org", 1, 700, "TWD", "prime", slug, today, today)
+		assert.Nil(t, err)
+		assert.Equal(t, globals.PrimeDonaitionType, rule.DonationTypes)
+	})
+
+	t.Run("MatchUpToTheBudget", func(t *testing.T) {
+		id, m := donate()
+		if assert.NotNil(t, m) {
+			assert.Equal(t, testAmount, m.MatchedAmount)
+			assert.Equal(t, sponsor, m.Sponsor)
+		}
+
+		// the rest of the budget is matched
+		_, m = donate()
+		if assert.NotNil(t, m) {
+			assert.Equal(t, uint(200), m.MatchedAmount)
+		}
+
+		// the budget runs out
+		_, m = donate()
+		assert.Nil(t, m)
+
+		var r models.MatchingRule
+		Globs.GormDB.Where("id = ?", rule.ID).Find(&r)
+		assert.Equal(t, uint(700), r.Consumed)
+
+		resp := serveHTTPWithCookies("GET", fmt.Sprintf("/v1/donations/prime/%d?user_id=%d", id, donor.ID), "", "", authorization, cookie)
+		assert.Equal(t, http.StatusOK, resp.Code)
+		assert.Contains(t, resp.Body.String(), `"matched_amount":500`)
+
+		matchedID = id
+	})
+
+	t.Run("GiveBackTheRefunds", func(t *testing.T) {
+		admin := createUser("matching-admin@twreporter.org")
+		Globs.GormDB.Model(&models.User{}).Where("id = ?", admin.ID).Update("privilege", constants.PrivilegeAdmin)
+
+		refund := func(amount uint) int {
+			adminCookie := cookie
+			adminCookie.Value = generateIDToken(admin)
+			reqBody := fmt.Sprintf(`{"user_id":%d,"amount":%d,"reason":"duplicate donation"}`, admin.ID, amount)
+			resp := serveHTTPWithCookies("POST", fmt.Sprintf("/v1/donations/prime/%d/refunds", matchedID), reqBody, "application/json", fmt.Sprintf("Bearer %s", generateJWT(admin)), adminCookie)
+			return resp.Code
+		}
+
+		var m models.DonationMatch
+		var r models.MatchingRule
+
+		// the match is reduced in proportion to the partial refund
+		assert.Equal(t, http.StatusCreated, refund(100))
+		Globs.GormDB.Where("donation_type = ? AND donation_id = ?", globals.PrimeDonaitionType, matchedID).Find(&m)
+		assert.Equal(t, testAmount-100, m.Amount)
+		assert.Equal(t, testAmount-100, m.MatchedAmount)
+		Globs.GormDB.Where("id = ?", rule.ID).Find(&r)
+		assert.Equal(t, uint(600), r.Consumed)
+
+		// the match is removed once the donation is fully refunded
+		assert.Equal(t, http.StatusCreated, refund(0))
+		count := 0
+		Globs.GormDB.Model(&models.DonationMatch{}).Where("donation_type = ? AND donation_id = ?", globals.PrimeDonaitionType, matchedID).Count(&count)
+		assert.Equal(t, 0, count)
+		Globs.GormDB.Where("id = ?", rule.ID).Find(&r)
+		assert.Equal(t, uint(200), r.Consumed)
+	})
+
+	t.Run("ReportToTheSponsor", func(t *testing.T) {
+		// the rule is reported after it ends
+		reported, err := mc.ReportMatchingGifts(time.Now())
+		assert.Nil(t, err)
+		assert.Equal(t, 0, reported)
+
+		reported, err = mc.ReportMatchingGifts(rule.EndAt)
+		assert.Nil(t, err)
+		assert.Equal(t, 1, reported)
+
+		var r models.MatchingRule
+		Globs.GormDB.Where("id = ?", rule.ID).Find(&r)
+		assert.True(t, r.ReportedAt.Valid)
+
+		// each rule is reported once
+		reported, err = mc.ReportMatchingGifts(rule.EndAt)
+		assert.Nil(t, err)
+		assert.Equal(t, 0, reported)
+	})
+}
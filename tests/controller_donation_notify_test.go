@@ -0,0 +1,216 @@
+package tests
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"twreporter.org/go-api/controllers"
+	"twreporter.org/go-api/globals"
+	"twreporter.org/go-api/models"
+	"twreporter.org/go-api/payment"
+	"twreporter.org/go-api/storage"
+)
+
+const authenticatingGatewayRecTradeID = "D20191201AUTH000001"
+
+// authenticatingGateway asks donors to confirm every payment on the payment url, and the trade records are paid
+type authenticatingGateway struct {
+	payment.PaymentGateway
+}
+
+func (g authenticatingGateway) Name() string {
+	return "authenticating"
+}
+
+func (g authenticatingGateway) PayByPrime(req payment.PrimeReq) (payment.Transaction, error) {
+	t := payment.Transaction{
+		CardSecret: payment.CardSecret{Key: "authenticating-card-key", Token: "authenticating-card-token"},
+		PaymentURL: "https://payment.example.com/3ds",
+	}
+	t.RecTradeID = authenticatingGatewayRecTradeID
+	return t, nil
+}
+
+func (g authenticatingGateway) QueryRecord(filters payment.RecordFilters) (payment.Record, error) {
+	r := payment.Record{Amount: testAmount, Currency: "TWD", OrderNumber: filters.OrderNumber, State: payment.RecordStatePaid}
+	r.RecTradeID = authenticatingGatewayRecTradeID
+	return r, nil
+}
+
+func TestReceiveBackendNotify(t *testing.T) {
+	const path = "/v1/donations/backend-notify"
+
+	t.Run("StatusCode=StatusBadRequest", func(t *testing.T) {
+		resp := serveHTTP("POST", path, `{"order_number":"twreporter-notify-test"}`, "application/json", "")
+		assert.Equal(t, http.StatusBadRequest, resp.Code)
+	})
+
+	t.Run("StatusCode=StatusNotFound", func(t *testing.T) {
+		resp := serveHTTP("POST", path, `{"order_number":"twreporter-not-found","rec_trade_id":"D20190101000000000000"}`, "application/json", "")
+		assert.Equal(t, http.StatusNotFound, resp.Code)
+	})
+
+	t.Run("StatusCode=StatusOK", func(t *testing.T) {
+		// a paid donation is not changed by notifications anymore
+		user := createUser("backend-notify-donor@twreporter.org")
+		primeRes := createDefaultPrimeDonationRecord(user)
+
+		reqBody := fmt.Sprintf(`{"order_number":"%s","rec_trade_id":"D20190101000000000000"}`, primeRes.Data.OrderNumber)
+		resp := serveHTTP("POST", path, reqBody, "application/json", "")
+		assert.Equal(t, http.StatusOK, resp.Code)
+		assert.Equal(t, "paid", getDonationStatus(resp.Result().Body))
+
+		// the first installment of a periodic donation
+		td := models.PayByCardTokenDonation{}
+		Globs.GormDB.Where("periodic_id = ?", createDefaultPeriodicDonationRecord(user).Data.ID).Find(&td)
+
+		reqBody = fmt.Sprintf(`{"order_number":"%s","rec_trade_id":"D20190101000000000000"}`, td.OrderNumber)
+		resp = serveHTTP("POST", path, reqBody, "application/json", "")
+		assert.Equal(t, http.StatusOK, resp.Code)
+		assert.Equal(t, "paid", getDonationStatus(resp.Result().Body))
+	})
+}
+
+func TestGetAPrimeDonationStatusOfAUser(t *testing.T) {
+	// setup before test
+	user := createUser("donation-status-donor@twreporter.org")
+	primeRes := createDefaultPrimeDonationRecord(user)
+
+	authorization := fmt.Sprintf("Bearer %s", generateJWT(user))
+	cookie := http.Cookie{
+		HttpOnly: true,
+		MaxAge:   3600,
+		Name:     "id_token",
+		Secure:   false,
+		Value:    generateIDToken(user),
+	}
+
+	t.Run("StatusCode=StatusForbidden", func(t *testing.T) {
+		path := fmt.Sprintf("/v1/donations/orders/%s/status?user_id=%d", primeRes.Data.OrderNumber, getUser(Globs.Defaults.Account).ID)
+		resp := serveHTTPWithCookies("GET", path, "", "application/json", authorization, cookie)
+		assert.Equal(t, http.StatusForbidden, resp.Code)
+	})
+
+	t.Run("StatusCode=StatusNotFound", func(t *testing.T) {
+		path := fmt.Sprintf("/v1/donations/orders/%s/status?user_id=%d", "twreporter-not-found", user.ID)
+		resp := serveHTTPWithCookies("GET", path, "", "application/json", authorization, cookie)
+		assert.Equal(t, http.StatusNotFound, resp.Code)
+	})
+
+	t.Run("StatusCode=StatusOK", func(t *testing.T) {
+		path := fmt.Sprintf("/v1/donations/orders/%s/status?user_id=%d", primeRes.Data.OrderNumber, user.ID)
+		resp := serveHTTPWithCookies("GET", path, "", "application/json", authorization, cookie)
+		assert.Equal(t, http.StatusOK, resp.Code)
+		assert.Equal(t, "paid", getDonationStatus(resp.Result().Body))
+
+		// the order number of a periodic donation
+		periodicRes := createDefaultPeriodicDonationRecord(user)
+		path = fmt.Sprintf("/v1/donations/orders/%s/status?user_id=%d", periodicRes.Data.OrderNumber, user.ID)
+		resp = serveHTTPWithCookies("GET", path, "", "application/json", authorization, cookie)
+		assert.Equal(t, http.StatusOK, resp.Code)
+		assert.Equal(t, "paid", getDonationStatus(resp.Result().Body))
+	})
+}
+
+func TestThreeDomainSecure(t *testing.T) {
+	// setup before test
+	conf := globals.Conf.Donation.ThreeDomainSecure
+	globals.Conf.Donation.ThreeDomainSecure = true
+	defer func() { globals.Conf.Donation.ThreeDomainSecure = conf }()
+
+	user := createUser("three-domain-secure-donor@twreporter.org")
+	authorization := fmt.Sprintf("Bearer %s", generateJWT(user))
+	cookie := http.Cookie{
+		HttpOnly: true,
+		MaxAge:   3600,
+		Name:     "id_token",
+		Secure:   false,
+		Value:    generateIDToken(user),
+	}
+
+	t.Run("StatusCode=StatusBadRequest", func(t *testing.T) {
+		// the donors could not be redirected back after being authenticated
+		for _, path := range []string{"/v1/donations/prime", "/v1/periodic-donations"} {
+			reqBody := fmt.Sprintf(`{"amount":%d,"details":"%s","donor":{"email":"%s"},"merchant_id":"%s","pay_method":"credit_card","prime":"%s","user_id":%d}`,
+				testAmount, testDetails, user.Email.ValueOrZero(), testMerchantID, testPrime, user.ID)
+			resp := serveHTTPWithCookies("POST", path, reqBody, "application/json", authorization, cookie)
+			assert.Equal(t, http.StatusBadRequest, resp.Code)
+			assert.Contains(t, resp.Body.String(), "frontend_redirect_url")
+		}
+	})
+}
+
+func TestKeepTheCardSecretsUntilAuthenticated(t *testing.T) {
+	// setup before test
+	user := createUser("pending-card-secret-donor@twreporter.org")
+
+	// the notification is resolved by the gateway of the installment
+	Globs.PaymentGateways.Register(authenticatingGateway{})
+
+	gws, _ := payment.NewGateways(globals.Conf.Donation)
+	gws.Register(authenticatingGateway{}, "credit_card")
+	mc := controllers.NewMembershipController(storage.NewGormStorage(Globs.GormDB), gws, Globs.CardKeyring)
+
+	reqBody := fmt.Sprintf(`{"amount":%d,"details":"%s","donor":{"email":"%s"},"frequency":"monthly","merchant_id":"%s","prime":"%s","user_id":%d}`,
+		testAmount, testDetails, user.Email.ValueOrZero(), testMerchantID, testPrime, user.ID)
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest("POST", "/v1/periodic-donations", strings.NewReader(reqBody))
+	c.Request.Header.Set("Content-Type", "application/json")
+
+	code, _, err := mc.CreateAPeriodicDonationOfAUser(c)
+	if !assert.Nil(t, err) || !assert.Equal(t, http.StatusCreated, code) {
+		return
+	}
+
+	pd := models.PeriodicDonation{}
+	Globs.GormDB.Where("user_id = ?", user.ID).Find(&pd)
+	td := models.PayByCardTokenDonation{}
+	Globs.GormDB.Where("periodic_id = ?", pd.ID).Find(&td)
+
+	t.Run("PendingSecretsAreOffThePeriodicDonation", func(t *testing.T) {
+		assert.Equal(t, "paying", pd.Status)
+		assert.Equal(t, "", pd.CardToken)
+		assert.Equal(t, "", pd.CardKey)
+
+		assert.Equal(t, "paying", td.Status)
+		token, err := Globs.CardKeyring.Decrypt(td.PendingCardToken)
+		assert.Nil(t, err)
+		assert.Equal(t, "authenticating-card-token", token)
+	})
+
+	t.Run("MoveTheSecretsOnceAuthenticated", func(t *testing.T) {
+		resp := serveHTTP("POST", "/v1/donations/backend-notify", fmt.Sprintf(`{"order_number":"%s","rec_trade_id":"%s"}`, td.OrderNumber, authenticatingGatewayRecTradeID), "application/json", "")
+		assert.Equal(t, http.StatusOK, resp.Code)
+		assert.Equal(t, "paid", getDonationStatus(resp.Result().Body))
+
+		Globs.GormDB.Where("id = ?", pd.ID).Find(&pd)
+		assert.Equal(t, "paid", pd.Status)
+		token, err := Globs.CardKeyring.Decrypt(pd.CardToken)
+		assert.Nil(t, err)
+		assert.Equal(t, "authenticating-card-token", token)
+
+		Globs.GormDB.Where("id = ?", td.ID).Find(&td)
+		assert.Equal(t, "", td.PendingCardToken)
+		assert.Equal(t, "", td.PendingCardKey)
+	})
+}
+
+func getDonationStatus(body io.ReadCloser) string {
+	defer body.Close()
+	resBody := struct {
+		Data struct {
+			Status string `json:"status"`
+		} `json:"data"`
+	}{}
+	respInBytes, _ := ioutil.ReadAll(body)
+	json.Unmarshal(respInBytes, &resBody)
+	return resBody.Data.Status
+}
@@ -0,0 +1,113 @@
+package tests
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/guregu/null.v3"
+	"twreporter.org/go-api/controllers"
+	"twreporter.org/go-api/models"
+	"twreporter.org/go-api/storage"
+)
+
+func TestOrganizationDonations(t *testing.T) {
+	const testCompanyName = "報導者測試股份有限公司"
+	const testTaxID = "22099131"
+
+	// setup before test
+	donor := createUser("organization-donor@twreporter.org")
+	mc := controllers.NewMembershipController(storage.NewGormStorage(Globs.GormDB), Globs.PaymentGateways, Globs.CardKeyring)
+
+	cookie := http.Cookie{
+		HttpOnly: true,
+		MaxAge:   3600,
+		Name:     "id_token",
+		Secure:   false,
+		Value:    generateIDToken(donor),
+	}
+	authorization := fmt.Sprintf("Bearer %s", generateJWT(donor))
+
+	createAPrimeDonation := func(identity string) (int, models.DonorIdentity, uint) {
+		reqBody := fmt.Sprintf(`{"amount":%d,"details":"%s","donor":{"email":"%s","name":"%s","national_id":"%s"},"merchant_id":"%s","pay_method":"credit_card","prime":"%s","user_id":%d,%s}`,
+			testAmount, testDetails, donor.Email.ValueOrZero(), testName, testNationalID, testMerchantID, testPrime, donor.ID, identity)
+		resp := serveHTTPWithCookies("POST", "/v1/donations/prime", reqBody, "application/json", authorization, cookie)
+
+		resBody := struct {
+			Data struct {
+				models.DonorIdentity
+				ID uint `json:"id"`
+			} `json:"data"`
+		}{}
+		json.Unmarshal(resp.Body.Bytes(), &resBody)
+		return resp.Code, resBody.Data.DonorIdentity, resBody.Data.ID
+	}
+
+	var donationID uint
+
+	t.Run("StatusCode=StatusBadRequest", func(t *testing.T) {
+		// the checksum of the tax ID is invalid
+		code, _, _ := createAPrimeDonation(fmt.Sprintf(`"donor_type":"organization","company_name":"%s","tax_id":"22099132"`, testCompanyName))
+		assert.Equal(t, http.StatusBadRequest, code)
+
+		code, _, _ = createAPrimeDonation(fmt.Sprintf(`"donor_type":"organization","tax_id":"%s"`, testTaxID))
+		assert.Equal(t, http.StatusBadRequest, code)
+
+		code, _, _ = createAPrimeDonation(fmt.Sprintf(`"donor_type":"company","company_name":"%s","tax_id":"%s"`, testCompanyName, testTaxID))
+		assert.Equal(t, http.StatusBadRequest, code)
+	})
+
+	t.Run("StatusCode=StatusCreated", func(t *testing.T) {
+		code, identity, id := createAPrimeDonation(fmt.Sprintf(`"donor_type":"organization","company_name":"%s","tax_id":"%s"`, testCompanyName, testTaxID))
+		assert.Equal(t, http.StatusCreated, code)
+		assert.True(t, identity.IsOrganization())
+		assert.Equal(t, testCompanyName, identity.CompanyName.ValueOrZero())
+		assert.Equal(t, testTaxID, identity.TaxID.ValueOrZero())
+		donationID = id
+
+		// the organization fields are given by organizations only
+		code, _, _ = createAPrimeDonation(fmt.Sprintf(`"company_name":"%s"`, testCompanyName))
+		assert.Equal(t, http.StatusBadRequest, code)
+
+		// the organization fields of individuals are dropped
+		code, identity, _ = createAPrimeDonation(fmt.Sprintf(`"donor_type":"individual","company_name":"%s"`, testCompanyName))
+		assert.Equal(t, http.StatusCreated, code)
+		assert.Equal(t, models.DonorTypeIndividual, identity.DonorType)
+		assert.False(t, identity.CompanyName.Valid)
+	})
+
+	t.Run("IssueTheReceiptToTheOrganization", func(t *testing.T) {
+		_, err := mc.IssueReceipts("monthly", time.Now())
+		assert.Nil(t, err)
+
+		var receipts []models.Receipt
+		Globs.GormDB.Where("user_id = ? AND tax_id = ?", donor.ID, testTaxID).Find(&receipts)
+		if assert.Equal(t, 1, len(receipts)) {
+			assert.Equal(t, testCompanyName, receipts[0].CompanyName)
+			assert.Equal(t, testAmount, receipts[0].Amount)
+		}
+
+		// the donation of the individual is on another receipt
+		Globs.GormDB.Where("user_id = ? AND tax_id = ''", donor.ID).Find(&receipts)
+		assert.Equal(t, 1, len(receipts))
+	})
+
+	t.Run("ChangeToAnIndividual", func(t *testing.T) {
+		path := fmt.Sprintf("/v1/donations/prime/%d", donationID)
+
+		resp := serveHTTPWithCookies("PATCH", path, fmt.Sprintf(`{"donor_type":"organization","tax_id":"12345678","user_id":%d}`, donor.ID), "application/json", authorization, cookie)
+		assert.Equal(t, http.StatusBadRequest, resp.Code)
+
+		resp = serveHTTPWithCookies("PATCH", path, fmt.Sprintf(`{"donor_type":"individual","user_id":%d}`, donor.ID), "application/json", authorization, cookie)
+		assert.Equal(t, http.StatusNoContent, resp.Code)
+
+		d := models.PayByPrimeDonation{}
+		Globs.GormDB.Where("id = ?", donationID).Find(&d)
+		assert.Equal(t, models.DonorTypeIndividual, d.DonorType)
+		assert.Equal(t, null.StringFrom(""), d.CompanyName)
+		assert.Equal(t, null.StringFrom(""), d.TaxID)
+	})
+}
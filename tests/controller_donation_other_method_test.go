@@ -0,0 +1,155 @@
+package tests
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"twreporter.org/go-api/configs/constants"
+	"twreporter.org/go-api/controllers"
+	"twreporter.org/go-api/models"
+	"twreporter.org/go-api/storage"
+)
+
+func TestRecordOtherMethodDonations(t *testing.T) {
+	// setup before test
+	donor := createUser("transfer-donor@twreporter.org")
+	admin := createUser("transfer-admin@twreporter.org")
+	Globs.GormDB.Model(&models.User{}).Where("id = ?", admin.ID).Update("privilege", constants.PrivilegeAdmin)
+	mc := controllers.NewMembershipController(storage.NewGormStorage(Globs.GormDB), Globs.PaymentGateways, Globs.CardKeyring)
+
+	location, _ := time.LoadLocation("Asia/Taipei")
+	today := time.Now().In(location).Format("2006-01-02")
+
+	record := func(user models.User, body string) (int, map[string]interface{}) {
+		cookie := http.Cookie{
+			HttpOnly: true,
+			MaxAge:   3600,
+			Name:     "id_token",
+			Secure:   false,
+			Value:    generateIDToken(user),
+		}
+		resp := serveHTTPWithCookies("POST", "/v1/donations/others", body, "application/json", fmt.Sprintf("Bearer %s", generateJWT(user)), cookie)
+
+		resBody := struct {
+			Data map[string]interface{} `json:"data"`
+		}{}
+		json.Unmarshal(resp.Body.Bytes(), &resBody)
+		return resp.Code, resBody.Data
+	}
+
+	reqBody := func(user models.User, reference string, email string) string {
+		return fmt.Sprintf(`{"user_id":%d,"pay_method":"transfer","paid_at":"%s","amount":1000,"bank_reference":"%s","donor":{"email":"%s","name":"%s"}}`, user.ID, today, reference, email, testName)
+	}
+
+	getDonation := func(reference string) (d models.PayByOtherMethodDonation) {
+		Globs.GormDB.Where("bank_reference = ?", reference).Find(&d)
+		return
+	}
+
+	t.Run("StatusCode=StatusForbidden", func(t *testing.T) {
+		code, _ := record(donor, reqBody(donor, "TX-FORBIDDEN", donor.Email.ValueOrZero()))
+		assert.Equal(t, http.StatusForbidden, code)
+	})
+
+	t.Run("StatusCode=StatusBadRequest", func(t *testing.T) {
+		code, data := record(admin, reqBody(admin, "", donor.Email.ValueOrZero()))
+		assert.Equal(t, http.StatusBadRequest, code)
+		assert.Contains(t, data, "req.Body.bank_reference")
+
+		code, data = record(admin, strings.Replace(reqBody(admin, "TX-FUTURE", donor.Email.ValueOrZero()), today, "2999-01-01", 1))
+		assert.Equal(t, http.StatusBadRequest, code)
+		assert.Contains(t, data, "req.Body.paid_at")
+	})
+
+	t.Run("StatusCode=StatusCreated", func(t *testing.T) {
+		code, data := record(admin, reqBody(admin, "TX-0001", donor.Email.ValueOrZero()))
+		assert.Equal(t, http.StatusCreated, code)
+		assert.Equal(t, "paid", data["status"])
+
+		d := getDonation("TX-0001")
+		assert.Equal(t, donor.ID, d.UserID)
+		assert.Equal(t, int64(admin.ID), d.RecordedBy.ValueOrZero())
+		assert.Equal(t, today, d.CreatedAt.In(location).Format("2006-01-02"))
+		assert.Equal(t, "monthly", d.SendReceipt)
+	})
+
+	t.Run("StatusCode=StatusConflict", func(t *testing.T) {
+		code, _ := record(admin, reqBody(admin, "TX-0001", donor.Email.ValueOrZero()))
+		assert.Equal(t, http.StatusConflict, code)
+	})
+
+	t.Run("MatchAnUnknownDonor", func(t *testing.T) {
+		const email = "never-signed-in@twreporter.org"
+		code, _ := record(admin, reqBody(admin, "TX-0002", email))
+		assert.Equal(t, http.StatusCreated, code)
+
+		user := models.User{}
+		Globs.GormDB.Where("email = ?", email).Find(&user)
+		assert.NotZero(t, user.ID)
+		assert.Equal(t, user.ID, getDonation("TX-0002").UserID)
+	})
+
+	t.Run("ImportAnInvalidFile", func(t *testing.T) {
+		csv := strings.Join([]string{
+			"paid_at,pay_method,bank_reference,amount,email",
+			fmt.Sprintf("%s,transfer,TX-1001,0,%s", today, donor.Email.ValueOrZero()),
+			fmt.Sprintf("%s,transfer,TX-1002,1000,%s", today, donor.Email.ValueOrZero()),
+			fmt.Sprintf("%s,transfer,TX-1002,1000,%s", today, donor.Email.ValueOrZero()),
+		}, "\n")
+
+		_, failData, err := mc.ImportOtherMethodDonations(strings.NewReader(csv), admin.ID)
+		assert.Nil(t, err)
+		assert.Contains(t, failData, "req.Body.file.line.2.amount")
+		assert.Contains(t, failData, "req.Body.file.line.4.bank_reference")
+		// nothing is imported
+		assert.Zero(t, getDonation("TX-1002").ID)
+
+		_, failData, _ = mc.ImportOtherMethodDonations(strings.NewReader("paid_at,amount,unknown_column\n"), admin.ID)
+		assert.Contains(t, failData, "req.Body.file")
+	})
+
+	t.Run("ImportAFile", func(t *testing.T) {
+		csv := strings.Join([]string{
+			"\ufeffpaid_at,pay_method,bank_reference,amount,email,name,send_receipt",
+			fmt.Sprintf("%s,transfer,TX-0001,1000,%s,%s,monthly", today, donor.Email.ValueOrZero(), testName),
+			fmt.Sprintf("%s,postal_transfer,TX-1003,\"1,200\",%s,%s,no", today, donor.Email.ValueOrZero(), testName),
+			fmt.Sprintf("%s,cash,,300,%s,%s,", today, donor.Email.ValueOrZero(), testName),
+		}, "\n")
+
+		var body bytes.Buffer
+		w := multipart.NewWriter(&body)
+		w.WriteField("user_id", fmt.Sprint(admin.ID))
+		part, _ := w.CreateFormFile("file", "transfers.csv")
+		part.Write([]byte(csv))
+		w.Close()
+
+		cookie := http.Cookie{
+			HttpOnly: true,
+			MaxAge:   3600,
+			Name:     "id_token",
+			Secure:   false,
+			Value:    generateIDToken(admin),
+		}
+		resp := serveHTTPWithCookies("POST", "/v1/donations/others/imports", body.String(), w.FormDataContentType(), fmt.Sprintf("Bearer %s", generateJWT(admin)), cookie)
+		assert.Equal(t, http.StatusCreated, resp.Code)
+
+		resBody := struct {
+			Data controllers.OtherMethodDonationImportSummary `json:"data"`
+		}{}
+		json.Unmarshal(resp.Body.Bytes(), &resBody)
+		assert.Equal(t, 2, resBody.Data.Created)
+		assert.Equal(t, []string{"TX-0001"}, resBody.Data.Duplicated)
+
+		d := getDonation("TX-1003")
+		assert.Equal(t, uint(1200), d.Amount)
+		assert.Equal(t, "no", d.SendReceipt)
+		assert.Equal(t, "postal_transfer", d.PayMethod)
+	})
+}
@@ -0,0 +1,230 @@
+package tests
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"twreporter.org/go-api/globals"
+	"twreporter.org/go-api/models"
+	"twreporter.org/go-api/storage"
+)
+
+func serveAPeriodicDonationRequest(user models.User, method, path, reqBody string) (int, responseBody) {
+	cookie := http.Cookie{
+		HttpOnly: true,
+		MaxAge:   3600,
+		Name:     "id_token",
+		Secure:   false,
+		Value:    generateIDToken(user),
+	}
+	resp := serveHTTPWithCookies(method, path, reqBody, "application/json", fmt.Sprintf("Bearer %s", generateJWT(user)), cookie)
+
+	resBody := responseBody{}
+	respInBytes, _ := ioutil.ReadAll(resp.Result().Body)
+	defer resp.Result().Body.Close()
+	json.Unmarshal(respInBytes, &resBody)
+	return resp.Code, resBody
+}
+
+func TestStopAPeriodicDonation(t *testing.T) {
+	// setup before test
+	donor := createUser("stop-periodic-donor@twreporter.org")
+	other := createUser("stop-periodic-other@twreporter.org")
+	periodicRes := createDefaultPeriodicDonationRecord(donor)
+	path := fmt.Sprintf("/v1/periodic-donations/%d/stop", periodicRes.Data.ID)
+
+	t.Run("StatusCode=StatusBadRequest", func(t *testing.T) {
+		code, _ := serveAPeriodicDonationRequest(donor, "POST", path, fmt.Sprintf(`{"user_id":%d}`, donor.ID))
+		assert.Equal(t, http.StatusBadRequest, code)
+	})
+
+	t.Run("StatusCode=StatusForbidden", func(t *testing.T) {
+		code, _ := serveAPeriodicDonationRequest(other, "POST", path, fmt.Sprintf(`{"user_id":%d,"reason":"moving abroad"}`, other.ID))
+		assert.Equal(t, http.StatusForbidden, code)
+	})
+
+	t.Run("StatusCode=StatusNotFound", func(t *testing.T) {
+		code, _ := serveAPeriodicDonationRequest(donor, "POST", "/v1/periodic-donations/1000/stop", fmt.Sprintf(`{"user_id":%d,"reason":"moving abroad"}`, donor.ID))
+		assert.Equal(t, http.StatusNotFound, code)
+	})
+
+	t.Run("StatusCode=StatusOK", func(t *testing.T) {
+		code, resBody := serveAPeriodicDonationRequest(donor, "POST", path, fmt.Sprintf(`{"user_id":%d,"reason":"moving abroad"}`, donor.ID))
+		assert.Equal(t, http.StatusOK, code)
+		assert.Equal(t, "stopped", resBody.Data.Status)
+
+		pd := models.PeriodicDonation{}
+		Globs.GormDB.Where("id = ?", periodicRes.Data.ID).Find(&pd)
+		assert.Equal(t, "stopped", pd.Status)
+		assert.Equal(t, "moving abroad", pd.StopReason)
+		assert.True(t, pd.StoppedAt.Valid)
+	})
+
+	t.Run("StatusCode=StatusConflict", func(t *testing.T) {
+		code, _ := serveAPeriodicDonationRequest(donor, "POST", path, fmt.Sprintf(`{"user_id":%d,"reason":"moving abroad"}`, donor.ID))
+		assert.Equal(t, http.StatusConflict, code)
+	})
+}
+
+func TestReplaceTheCardOfAPeriodicDonation(t *testing.T) {
+	// setup before test
+	donor := createUser("replace-card-donor@twreporter.org")
+	other := createUser("replace-card-other@twreporter.org")
+	periodicRes := createDefaultPeriodicDonationRecord(donor)
+	path := fmt.Sprintf("/v1/periodic-donations/%d/card", periodicRes.Data.ID)
+	reqBody := fmt.Sprintf(`{"user_id":%d,"prime":"%s"}`, donor.ID, testPrime)
+
+	t.Run("StatusCode=StatusBadRequest", func(t *testing.T) {
+		code, _ := serveAPeriodicDonationRequest(donor, "PUT", path, fmt.Sprintf(`{"user_id":%d}`, donor.ID))
+		assert.Equal(t, http.StatusBadRequest, code)
+	})
+
+	t.Run("StatusCode=StatusForbidden", func(t *testing.T) {
+		code, _ := serveAPeriodicDonationRequest(other, "PUT", path, fmt.Sprintf(`{"user_id":%d,"prime":"%s"}`, other.ID, testPrime))
+		assert.Equal(t, http.StatusForbidden, code)
+	})
+
+	t.Run("StatusCode=StatusOK", func(t *testing.T) {
+		old := models.PeriodicDonation{}
+		Globs.GormDB.Where("id = ?", periodicRes.Data.ID).Find(&old)
+		// pretend the last installment was failed due to the card
+		Globs.GormDB.Model(&models.PeriodicDonation{}).Where("id = ?", old.ID).Update("status", "fail")
+
+		code, resBody := serveAPeriodicDonationRequest(donor, "PUT", path, reqBody)
+		assert.Equal(t, http.StatusOK, code)
+		assert.Equal(t, "paid", resBody.Data.Status)
+
+		pd := models.PeriodicDonation{}
+		Globs.GormDB.Where("id = ?", old.ID).Find(&pd)
+		assert.Equal(t, "paid", pd.Status)
+		assert.NotEqual(t, old.CardToken, pd.CardToken)
+		assert.NotEqual(t, old.CardKey, pd.CardKey)
+
+		changes := []models.PeriodicDonationCardChange{}
+		Globs.GormDB.Where("periodic_id = ?", old.ID).Find(&changes)
+		assert.Equal(t, 1, len(changes))
+		assert.Equal(t, donor.ID, changes[0].UserID)
+		assert.Equal(t, old.CardInfo.LastFour, changes[0].CardInfo.LastFour)
+	})
+
+	t.Run("StatusCode=StatusConflict", func(t *testing.T) {
+		Globs.GormDB.Model(&models.PeriodicDonation{}).Where("id = ?", periodicRes.Data.ID).Update("status", "stopped")
+
+		code, _ := serveAPeriodicDonationRequest(donor, "PUT", path, reqBody)
+		assert.Equal(t, http.StatusConflict, code)
+	})
+}
+
+func TestChangeAPeriodicDonation(t *testing.T) {
+	// setup before test
+	donor := createUser("change-periodic-donor@twreporter.org")
+	periodicRes := createDefaultPeriodicDonationRecord(donor)
+	periodicID := periodicRes.Data.ID
+	path := fmt.Sprintf("/v1/periodic-donations/%d/changes", periodicID)
+
+	change := func(reqBody string) (int, models.PeriodicDonationChange) {
+		cookie := http.Cookie{
+			HttpOnly: true,
+			MaxAge:   3600,
+			Name:     "id_token",
+			Secure:   false,
+			Value:    generateIDToken(donor),
+		}
+		resp := serveHTTPWithCookies("POST", path, reqBody, "application/json", fmt.Sprintf("Bearer %s", generateJWT(donor)), cookie)
+
+		resBody := struct {
+			Data models.PeriodicDonationChange `json:"data"`
+		}{}
+		respInBytes, _ := ioutil.ReadAll(resp.Result().Body)
+		defer resp.Result().Body.Close()
+		json.Unmarshal(respInBytes, &resBody)
+		return resp.Code, resBody.Data
+	}
+
+	getPeriodicDonation := func() (pd models.PeriodicDonation) {
+		Globs.GormDB.Where("id = ?", periodicID).Find(&pd)
+		return
+	}
+
+	t.Run("StatusCode=StatusBadRequest", func(t *testing.T) {
+		code, _ := change(fmt.Sprintf(`{"user_id":%d}`, donor.ID))
+		assert.Equal(t, http.StatusBadRequest, code)
+
+		code, _ = change(fmt.Sprintf(`{"user_id":%d,"frequency":"weekly"}`, donor.ID))
+		assert.Equal(t, http.StatusBadRequest, code)
+
+		code, _ = change(fmt.Sprintf(`{"user_id":%d,"amount":800,"effective_date":"2000-01-01"}`, donor.ID))
+		assert.Equal(t, http.StatusBadRequest, code)
+
+		code, _ = change(fmt.Sprintf(`{"user_id":%d,"paused_until":"%s"}`, donor.ID, time.Now().AddDate(2, 0, 0).Format("2006-01-02")))
+		assert.Equal(t, http.StatusBadRequest, code)
+
+		// the amount is out of the range of the currency of the periodic donation
+		code, _ = change(fmt.Sprintf(`{"user_id":%d,"amount":%d}`, donor.ID, globals.Conf.Donation.Currencies["TWD"].MaxAmount+1))
+		assert.Equal(t, http.StatusBadRequest, code)
+		assert.Equal(t, testAmount, getPeriodicDonation().Amount)
+	})
+
+	t.Run("ChangeTheAmountAtOnce", func(t *testing.T) {
+		code, c := change(fmt.Sprintf(`{"user_id":%d,"amount":800}`, donor.ID))
+		assert.Equal(t, http.StatusCreated, code)
+		assert.Equal(t, "applied", c.Status)
+		assert.Equal(t, int64(testAmount), c.PreviousAmount.Int64)
+		assert.Equal(t, uint(800), getPeriodicDonation().Amount)
+	})
+
+	t.Run("ScheduleTheFrequency", func(t *testing.T) {
+		effectiveDate := time.Now().AddDate(0, 0, 10)
+		code, c := change(fmt.Sprintf(`{"user_id":%d,"frequency":"yearly","effective_date":"%s"}`, donor.ID, effectiveDate.Format("2006-01-02")))
+		assert.Equal(t, http.StatusCreated, code)
+		assert.Equal(t, "scheduled", c.Status)
+		assert.Equal(t, "monthly", getPeriodicDonation().Frequency)
+
+		applied, err := storage.NewGormStorage(Globs.GormDB).ApplyDuePeriodicDonationChanges(effectiveDate.AddDate(0, 0, 1))
+		assert.Nil(t, err)
+		assert.Equal(t, 1, applied)
+		assert.Equal(t, "yearly", getPeriodicDonation().Frequency)
+	})
+
+	t.Run("PauseThePeriodicDonation", func(t *testing.T) {
+		pausedUntil := time.Now().AddDate(0, 2, 0)
+		code, c := change(fmt.Sprintf(`{"user_id":%d,"paused_until":"%s"}`, donor.ID, pausedUntil.Format("2006-01-02")))
+		assert.Equal(t, http.StatusCreated, code)
+		assert.Equal(t, "applied", c.Status)
+
+		// pretend the last installment was paid two years ago
+		Globs.GormDB.Model(&models.PeriodicDonation{}).Where("id = ?", periodicID).Update("last_success_at", time.Now().AddDate(-2, 0, 0))
+
+		gs := storage.NewGormStorage(Globs.GormDB)
+
+		pds, err := gs.GetDuePeriodicDonations(time.Now(), periodicID-1, 1)
+		assert.Nil(t, err)
+		assert.True(t, len(pds) == 0 || pds[0].ID != periodicID)
+
+		pds, err = gs.GetDuePeriodicDonations(pausedUntil.AddDate(0, 0, 1), periodicID-1, 1)
+		assert.Nil(t, err)
+		assert.Equal(t, 1, len(pds))
+		assert.Equal(t, periodicID, pds[0].ID)
+	})
+
+	t.Run("StatusCode=StatusConflict", func(t *testing.T) {
+		Globs.GormDB.Model(&models.PeriodicDonation{}).Where("id = ?", periodicID).Update("status", "stopped")
+
+		code, _ := change(fmt.Sprintf(`{"user_id":%d,"amount":300}`, donor.ID))
+		assert.Equal(t, http.StatusConflict, code)
+	})
+
+	t.Run("GetTheChanges", func(t *testing.T) {
+		code, _ := serveAPeriodicDonationRequest(donor, "GET", fmt.Sprintf("%s?user_id=%d", path, donor.ID), "")
+		assert.Equal(t, http.StatusOK, code)
+
+		changes := []models.PeriodicDonationChange{}
+		Globs.GormDB.Where("periodic_id = ?", periodicID).Find(&changes)
+		assert.Equal(t, 3, len(changes))
+	})
+}
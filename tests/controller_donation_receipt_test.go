@@ -0,0 +1,135 @@
+package tests
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"twreporter.org/go-api/controllers"
+	"twreporter.org/go-api/models"
+	"twreporter.org/go-api/storage"
+)
+
+func TestIssueReceipts(t *testing.T) {
+	const othersAmount = 1000
+
+	// setup before test
+	donor := createUser("receipt-donor@twreporter.org")
+	other := createUser("receipt-other@twreporter.org")
+	const refundedAmount = 100
+	prime := createDefaultPrimeDonationRecord(donor)
+
+	refundThePrimeDonation := func(amount uint, refundedAt time.Time) {
+		Globs.GormDB.Create(&models.DonationRefund{
+			Amount:       amount,
+			CreatedAt:    refundedAt,
+			Currency:     "TWD",
+			DonationID:   prime.Data.ID,
+			DonationType: "prime",
+			RequestedBy:  other.ID,
+			Status:       "refunded",
+			UpdatedAt:    refundedAt,
+		})
+	}
+
+	// the amount refunded before the receipt is issued is excluded
+	refundThePrimeDonation(refundedAmount, time.Now().Add(-time.Minute))
+
+	// a bank transfer with the same name and national ID is on the same receipt
+	Globs.GormDB.Create(&models.PayByOtherMethodDonation{
+		Amount:      othersAmount,
+		Details:     "銀行轉帳",
+		Email:       donor.Email.ValueOrZero(),
+		MerchantID:  testMerchantID,
+		Name:        testName,
+		NationalID:  testNationalID,
+		OrderNumber: "twreporter-receipt-transfer",
+		PayMethod:   "transfer",
+		SendReceipt: "monthly",
+		UserID:      donor.ID,
+	})
+
+	mc := controllers.NewMembershipController(storage.NewGormStorage(Globs.GormDB), Globs.PaymentGateways, Globs.CardKeyring)
+
+	getReceipts := func() (receipts []models.Receipt) {
+		Globs.GormDB.Where("user_id = ?", donor.ID).Find(&receipts)
+		return
+	}
+
+	serveAReceiptRequest := func(user models.User, path string) (int, string, string) {
+		cookie := http.Cookie{
+			HttpOnly: true,
+			MaxAge:   3600,
+			Name:     "id_token",
+			Secure:   false,
+			Value:    generateIDToken(user),
+		}
+		resp := serveHTTPWithCookies("GET", path, "", "", fmt.Sprintf("Bearer %s", generateJWT(user)), cookie)
+		return resp.Code, resp.Header().Get("Content-Type"), resp.Body.String()
+	}
+
+	t.Run("IssueMonthlyReceipts", func(t *testing.T) {
+		summary, err := mc.IssueReceipts("monthly", time.Now())
+		assert.Nil(t, err)
+		assert.True(t, summary.Issued > 0)
+
+		receipts := getReceipts()
+		if assert.Equal(t, 1, len(receipts)) {
+			assert.Equal(t, testAmount-refundedAmount+othersAmount, receipts[0].Amount)
+			assert.Equal(t, testName, receipts[0].Name)
+			assert.Equal(t, testNationalID, receipts[0].NationalID)
+			assert.True(t, strings.HasPrefix(string(receipts[0].PDF), "%PDF"))
+
+			var items []models.ReceiptItem
+			Globs.GormDB.Where("receipt_id = ?", receipts[0].ID).Find(&items)
+			assert.Equal(t, 2, len(items))
+		}
+		assert.Empty(t, summary.Refunded)
+	})
+
+	t.Run("ReportTheRefundsAfterIssued", func(t *testing.T) {
+		refundThePrimeDonation(refundedAmount, time.Now().Add(time.Second))
+
+		summary, err := mc.IssueReceipts("monthly", time.Now())
+		assert.Nil(t, err)
+		if assert.Len(t, summary.Refunded, 1) {
+			assert.Contains(t, summary.Refunded[0], getReceipts()[0].ReceiptNumber)
+		}
+	})
+
+	t.Run("DonationsAreIssuedOnce", func(t *testing.T) {
+		_, err := mc.IssueReceipts("monthly", time.Now())
+		assert.Nil(t, err)
+		assert.Equal(t, 1, len(getReceipts()))
+	})
+
+	t.Run("UnsupportedPeriod", func(t *testing.T) {
+		_, err := mc.IssueReceipts("weekly", time.Now())
+		assert.NotNil(t, err)
+	})
+
+	t.Run("ListReceipts", func(t *testing.T) {
+		code, _, body := serveAReceiptRequest(donor, fmt.Sprintf("/v1/users/%d/receipts", donor.ID))
+		assert.Equal(t, http.StatusOK, code)
+		assert.Contains(t, body, getReceipts()[0].ReceiptNumber)
+	})
+
+	t.Run("DownloadAReceipt", func(t *testing.T) {
+		path := fmt.Sprintf("/v1/users/%d/receipts/%s", donor.ID, getReceipts()[0].ReceiptNumber)
+
+		code, contentType, body := serveAReceiptRequest(donor, path)
+		assert.Equal(t, http.StatusOK, code)
+		assert.Equal(t, "application/pdf", contentType)
+		assert.True(t, strings.HasPrefix(body, "%PDF"))
+
+		// the receipt of others
+		code, _, _ = serveAReceiptRequest(other, path)
+		assert.Equal(t, http.StatusForbidden, code)
+
+		code, _, _ = serveAReceiptRequest(donor, fmt.Sprintf("/v1/users/%d/receipts/not-found", donor.ID))
+		assert.Equal(t, http.StatusNotFound, code)
+	})
+}
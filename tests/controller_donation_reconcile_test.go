@@ -0,0 +1,97 @@
+package tests
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"twreporter.org/go-api/controllers"
+	"twreporter.org/go-api/models"
+	"twreporter.org/go-api/storage"
+)
+
+func TestReconcilePayingDonations(t *testing.T) {
+	// setup before test
+	user := createUser("reconcile-donor@twreporter.org")
+	primeRes := createDefaultPrimeDonationRecord(user)
+	stale := time.Now().Add(-time.Hour)
+
+	// pretend the process died after TapPay charged the card
+	Globs.GormDB.Exec("UPDATE pay_by_prime_donations SET status = 'paying', updated_at = ? WHERE id = ?", stale, primeRes.Data.ID)
+
+	// the donation which never reached TapPay
+	lost := models.PayByPrimeDonation{
+		Amount:      testAmount,
+		Currency:    testCurrency,
+		Details:     testDetails,
+		MerchantID:  testMerchantID,
+		OrderNumber: "twreporter-reconcile-lost",
+		PayMethod:   creditCardPayMethod,
+		Status:      "paying",
+		UserID:      user.ID,
+	}
+	lost.Cardholder.Email = user.Email.ValueOrZero()
+	Globs.GormDB.Create(&lost)
+	Globs.GormDB.Exec("UPDATE pay_by_prime_donations SET updated_at = ? WHERE id = ?", stale, lost.ID)
+
+	mc := controllers.NewMembershipController(storage.NewGormStorage(Globs.GormDB), Globs.PaymentGateways, Globs.CardKeyring)
+
+	t.Run("NotStaleYet", func(t *testing.T) {
+		summary, err := mc.ReconcilePayingDonations(stale.Add(-time.Hour), 10)
+		assert.Nil(t, err)
+		assert.Equal(t, 0, summary.Paid)
+		assert.Equal(t, 0, len(summary.Unresolved))
+	})
+
+	t.Run("ResolveStaleDonations", func(t *testing.T) {
+		summary, err := mc.ReconcilePayingDonations(time.Now(), 10)
+		assert.Nil(t, err)
+		assert.Equal(t, 1, summary.Paid)
+		assert.Equal(t, 1, len(summary.Unresolved))
+		assert.Equal(t, lost.OrderNumber, summary.Unresolved[0].OrderNumber)
+
+		d := models.PayByPrimeDonation{}
+		Globs.GormDB.Where("id = ?", primeRes.Data.ID).Find(&d)
+		assert.Equal(t, "paid", d.Status)
+
+		Globs.GormDB.Where("id = ?", lost.ID).Find(&d)
+		assert.Equal(t, "paying", d.Status)
+	})
+}
+
+func TestReconcileRefundingRefunds(t *testing.T) {
+	// setup before test
+	user := createUser("reconcile-refund-donor@twreporter.org")
+	primeRes := createDefaultPrimeDonationRecord(user)
+	stale := time.Now().Add(-time.Hour)
+
+	d := models.PayByPrimeDonation{}
+	Globs.GormDB.Where("id = ?", primeRes.Data.ID).Find(&d)
+
+	// pretend the process died before the refund reached TapPay
+	refund := models.DonationRefund{
+		Amount:       d.Amount,
+		Currency:     d.Currency,
+		DonationID:   d.ID,
+		DonationType: "prime",
+		RecTradeID:   d.RecTradeID,
+		RequestedBy:  user.ID,
+		Status:       "refunding",
+	}
+	Globs.GormDB.Create(&refund)
+	Globs.GormDB.Exec("UPDATE donation_refunds SET updated_at = ? WHERE id = ?", stale, refund.ID)
+
+	mc := controllers.NewMembershipController(storage.NewGormStorage(Globs.GormDB), Globs.PaymentGateways, Globs.CardKeyring)
+
+	summary, err := mc.ReconcilePayingDonations(time.Now(), 10)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, summary.RefundFailed)
+
+	r := models.DonationRefund{}
+	Globs.GormDB.Where("id = ?", refund.ID).Find(&r)
+	assert.Equal(t, "fail", r.Status)
+
+	// the failed refund no longer occupies the refundable amount
+	Globs.GormDB.Where("id = ?", d.ID).Find(&d)
+	assert.Equal(t, "paid", d.Status)
+}
@@ -0,0 +1,85 @@
+package tests
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"twreporter.org/go-api/configs/constants"
+	"twreporter.org/go-api/models"
+)
+
+func TestRefundAPrimeDonation(t *testing.T) {
+	// setup before test
+	donor := createUser("refund-donor@twreporter.org")
+	primeRes := createDefaultPrimeDonationRecord(donor)
+
+	admin := createUser("refund-admin@twreporter.org")
+	Globs.GormDB.Model(&models.User{}).Where("id = ?", admin.ID).Update("privilege", constants.PrivilegeAdmin)
+
+	refund := func(user models.User, donationID uint, amount uint) (int, models.DonationRefund) {
+		cookie := http.Cookie{
+			HttpOnly: true,
+			MaxAge:   3600,
+			Name:     "id_token",
+			Secure:   false,
+			Value:    generateIDToken(user),
+		}
+		path := fmt.Sprintf("/v1/donations/prime/%d/refunds", donationID)
+		reqBody := fmt.Sprintf(`{"user_id":%d,"amount":%d,"reason":"duplicate donation"}`, user.ID, amount)
+		resp := serveHTTPWithCookies("POST", path, reqBody, "application/json", fmt.Sprintf("Bearer %s", generateJWT(user)), cookie)
+
+		resBody := struct {
+			Data models.DonationRefund `json:"data"`
+		}{}
+		respInBytes, _ := ioutil.ReadAll(resp.Result().Body)
+		defer resp.Result().Body.Close()
+		json.Unmarshal(respInBytes, &resBody)
+		return resp.Code, resBody.Data
+	}
+
+	getDonation := func() (d models.PayByPrimeDonation) {
+		Globs.GormDB.Where("id = ?", primeRes.Data.ID).Find(&d)
+		return
+	}
+
+	t.Run("StatusCode=StatusForbidden", func(t *testing.T) {
+		code, _ := refund(donor, primeRes.Data.ID, 0)
+		assert.Equal(t, http.StatusForbidden, code)
+	})
+
+	t.Run("StatusCode=StatusNotFound", func(t *testing.T) {
+		code, _ := refund(admin, 1000, 0)
+		assert.Equal(t, http.StatusNotFound, code)
+	})
+
+	t.Run("StatusCode=StatusBadRequest", func(t *testing.T) {
+		code, _ := refund(admin, primeRes.Data.ID, testAmount+1)
+		assert.Equal(t, http.StatusBadRequest, code)
+	})
+
+	t.Run("PartialRefund", func(t *testing.T) {
+		code, r := refund(admin, primeRes.Data.ID, 100)
+		assert.Equal(t, http.StatusCreated, code)
+		assert.Equal(t, uint(100), r.Amount)
+		assert.Equal(t, "refunded", r.Status)
+		assert.Equal(t, admin.ID, r.RequestedBy)
+		assert.Equal(t, "paid", getDonation().Status)
+	})
+
+	t.Run("RefundTheRest", func(t *testing.T) {
+		code, r := refund(admin, primeRes.Data.ID, 0)
+		assert.Equal(t, http.StatusCreated, code)
+		assert.Equal(t, testAmount-100, r.Amount)
+		assert.Equal(t, "refunded", getDonation().Status)
+	})
+
+	t.Run("StatusCode=StatusConflict", func(t *testing.T) {
+		// the donation has been fully refunded
+		code, _ := refund(admin, primeRes.Data.ID, 0)
+		assert.Equal(t, http.StatusConflict, code)
+	})
+}
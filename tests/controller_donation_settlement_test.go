@@ -0,0 +1,235 @@
+package tests
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/guregu/null.v3"
+	"twreporter.org/go-api/configs/constants"
+	"twreporter.org/go-api/controllers"
+	"twreporter.org/go-api/models"
+	"twreporter.org/go-api/storage"
+)
+
+func TestReconcileSettlements(t *testing.T) {
+	const settlementDate = "2019-12-01"
+	const fixture = "testdata/settlement.csv"
+
+	// setup before test
+	donor := createUser("settlement-donor@twreporter.org")
+	admin := createUser("settlement-admin@twreporter.org")
+	Globs.GormDB.Model(&models.User{}).Where("id = ?", admin.ID).Update("privilege", constants.PrivilegeAdmin)
+	mc := controllers.NewMembershipController(storage.NewGormStorage(Globs.GormDB), Globs.PaymentGateways, Globs.CardKeyring)
+
+	location, _ := time.LoadLocation("Asia/Taipei")
+	paidAt := time.Date(2019, 12, 1, 10, 0, 0, 0, location)
+
+	createPrime := func(suffix string, amount uint, status string, transactionTime null.Time) models.PayByPrimeDonation {
+		d := models.PayByPrimeDonation{
+			Amount:      amount,
+			Cardholder:  models.Cardholder{Email: donor.Email.ValueOrZero()},
+			Details:     testDetails,
+			MerchantID:  testMerchantID,
+			OrderNumber: fmt.Sprintf("settlement-prime-%s", suffix),
+			PayMethod:   "credit_card",
+			Status:      status,
+			TappayResp: models.TappayResp{
+				BankTransactionID: fmt.Sprintf("TP%s", suffix),
+				RecTradeID:        fmt.Sprintf("D%s", suffix),
+				TransactionTime:   transactionTime,
+			},
+			UserID: donor.ID,
+		}
+		Globs.GormDB.Create(&d)
+		return d
+	}
+
+	matched := createPrime("1201STL0001", 500, "paid", null.TimeFrom(paidAt))
+	mismatched := createPrime("1201STL0002", 800, "paid", null.TimeFrom(paidAt))
+	createPrime("1201STL0003", 300, "fail", null.Time{})
+	missing := createPrime("1201STL0004", 1000, "paid", null.TimeFrom(paidAt.Add(13*time.Hour)))
+	refunded := createPrime("1130STL0005", 600, "refunded", null.TimeFrom(paidAt.AddDate(0, 0, -1)))
+	// the donation refunded partially is left paid
+	refundedPartially := createPrime("1130STL0008", 1000, "paid", null.TimeFrom(paidAt.AddDate(0, 0, -1)))
+	// the donation paid on the next day is settled in the next file
+	createPrime("1202STL0007", 500, "paid", null.TimeFrom(paidAt.Add(14*time.Hour)))
+
+	for _, refund := range []models.DonationRefund{
+		{Amount: 600, DonationID: refunded.ID, RecTradeID: refunded.RecTradeID, Status: "refunded"},
+		{Amount: 200, DonationID: refundedPartially.ID, RecTradeID: refundedPartially.RecTradeID, Status: "refunded"},
+		{Amount: 300, DonationID: refundedPartially.ID, RecTradeID: refundedPartially.RecTradeID, Status: "refunded"},
+	} {
+		refund.Currency = "TWD"
+		refund.DonationType = "prime"
+		refund.RequestedBy = admin.ID
+		Globs.GormDB.Create(&refund)
+	}
+
+	// the installment is matched by the bank transaction id only
+	Globs.GormDB.Create(&models.PayByCardTokenDonation{
+		Amount:      1200,
+		Details:     testDetails,
+		MerchantID:  testMerchantID,
+		OrderNumber: "settlement-token-1201STL0006",
+		PeriodicID:  1,
+		Status:      "paid",
+		TappayResp: models.TappayResp{
+			BankTransactionID: "TP1201STL0006",
+			RecTradeID:        "D1201STL0006",
+			TransactionTime:   null.TimeFrom(paidAt),
+		},
+	})
+
+	cookieOf := func(user models.User) http.Cookie {
+		return http.Cookie{
+			HttpOnly: true,
+			MaxAge:   3600,
+			Name:     "id_token",
+			Secure:   false,
+			Value:    generateIDToken(user),
+		}
+	}
+
+	upload := func(user models.User, date string, csv []byte) (int, string) {
+		var body bytes.Buffer
+		w := multipart.NewWriter(&body)
+		w.WriteField("user_id", fmt.Sprint(user.ID))
+		w.WriteField("settlement_date", date)
+		part, _ := w.CreateFormFile("file", "settlement.csv")
+		part.Write(csv)
+		w.Close()
+
+		resp := serveHTTPWithCookies("POST", "/v1/settlements/imports", body.String(), w.FormDataContentType(), fmt.Sprintf("Bearer %s", generateJWT(user)), cookieOf(user))
+		return resp.Code, resp.Body.String()
+	}
+
+	type report struct {
+		Data struct {
+			Records []models.SettlementReconciliation `json:"records"`
+			Meta    struct {
+				Total int `json:"total"`
+			} `json:"meta"`
+			Summary []models.SettlementResultCount `json:"summary"`
+		} `json:"data"`
+	}
+
+	getReport := func(user models.User, query string) (int, report) {
+		var r report
+		resp := serveHTTPWithCookies("GET", fmt.Sprintf("/v1/settlements/%s/reconciliations?%s", settlementDate, query), "", "", fmt.Sprintf("Bearer %s", generateJWT(user)), cookieOf(user))
+		json.Unmarshal(resp.Body.Bytes(), &r)
+		return resp.Code, r
+	}
+
+	getResult := func(records []models.SettlementReconciliation, line int64) string {
+		for _, r := range records {
+			if r.Line.ValueOrZero() == line {
+				return r.Result
+			}
+		}
+		return ""
+	}
+
+	t.Run("ImportTheFixture", func(t *testing.T) {
+		f, err := os.Open(fixture)
+		if !assert.Nil(t, err) {
+			return
+		}
+		defer f.Close()
+
+		summary, failData, err := mc.ReconcileASettlementFile(f, settlementDate, admin.ID)
+		assert.Nil(t, err)
+		assert.Nil(t, failData)
+		assert.Equal(t, 8, summary.Lines)
+		assert.Equal(t, map[string]int{
+			"amount_mismatch":    1,
+			"chargeback":         1,
+			"matched":            4,
+			"missing_donation":   1,
+			"missing_settlement": 1,
+			"status_mismatch":    1,
+		}, summary.Results)
+	})
+
+	t.Run("GetTheReport", func(t *testing.T) {
+		code, _ := getReport(donor, "")
+		assert.Equal(t, http.StatusForbidden, code)
+
+		code, _ = getReport(admin, "result=unknown")
+		assert.Equal(t, http.StatusBadRequest, code)
+
+		code, r := getReport(admin, "limit=20")
+		assert.Equal(t, http.StatusOK, code)
+		assert.Equal(t, 9, r.Data.Meta.Total)
+		assert.Len(t, r.Data.Summary, 6)
+
+		for line, result := range map[int64]string{
+			2: "matched",
+			3: "amount_mismatch",
+			4: "status_mismatch",
+			5: "matched",
+			6: "missing_donation",
+			7: "matched",
+			8: "chargeback",
+			9: "matched",
+		} {
+			assert.Equal(t, result, getResult(r.Data.Records, line), "line %d", line)
+		}
+
+		code, r = getReport(admin, "result=amount_mismatch")
+		assert.Equal(t, http.StatusOK, code)
+		if assert.Len(t, r.Data.Records, 1) {
+			rec := r.Data.Records[0]
+			assert.Equal(t, int64(mismatched.ID), rec.DonationID.ValueOrZero())
+			assert.Equal(t, int64(800), rec.DonationAmount.ValueOrZero())
+			assert.Equal(t, int64(700), rec.SettledAmount.ValueOrZero())
+			assert.Equal(t, int64(admin.ID), rec.ImportedBy.ValueOrZero())
+		}
+
+		code, r = getReport(admin, "result=missing_settlement")
+		assert.Equal(t, http.StatusOK, code)
+		if assert.Len(t, r.Data.Records, 1) {
+			assert.Equal(t, missing.OrderNumber, r.Data.Records[0].OrderNumber.ValueOrZero())
+			assert.False(t, r.Data.Records[0].Line.Valid)
+		}
+
+		// the chargeback is linked to the donation charged back
+		code, r = getReport(admin, "result=chargeback")
+		if assert.Len(t, r.Data.Records, 1) {
+			assert.Equal(t, int64(matched.ID), r.Data.Records[0].DonationID.ValueOrZero())
+		}
+	})
+
+	t.Run("ImportAgain", func(t *testing.T) {
+		csv, err := ioutil.ReadFile(fixture)
+		if !assert.Nil(t, err) {
+			return
+		}
+
+		code, _ := upload(donor, settlementDate, csv)
+		assert.Equal(t, http.StatusForbidden, code)
+
+		code, body := upload(admin, "2999-01-01", csv)
+		assert.Equal(t, http.StatusBadRequest, code)
+		assert.Contains(t, body, "req.Body.settlement_date")
+
+		code, body = upload(admin, settlementDate, []byte("rec_trade_id,amount\nD1201STL0001,0\nD1201STL0001,500\n"))
+		assert.Equal(t, http.StatusBadRequest, code)
+		assert.Contains(t, body, "req.Body.file.line.2.amount")
+		assert.Contains(t, body, "req.Body.file.line.3.rec_trade_id")
+
+		// the results of the date are replaced rather than appended
+		code, _ = upload(admin, settlementDate, csv)
+		assert.Equal(t, http.StatusCreated, code)
+
+		_, r := getReport(admin, "")
+		assert.Equal(t, 9, r.Data.Meta.Total)
+	})
+}
@@ -7,6 +7,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"gopkg.in/guregu/null.v3"
 
@@ -31,7 +32,14 @@ type (
 		OrderNumber string            `json:"order_number"`
 		PayMethod   string            `json:"pay_method"`
 		SendReceipt string            `json:"send_receipt"`
+		Status      string            `json:"status"`
 		ToFeedback  bool              `json:"to_feedback"`
+		// fields of donation history
+		Installments []struct {
+			ID     uint   `json:"id"`
+			Status string `json:"status"`
+		} `json:"installments"`
+		Type string `json:"type"`
 	}
 	responseBody struct {
 		Status string         `json:"status"`
@@ -50,6 +58,7 @@ type (
 	}
 	requestBody struct {
 		Amount     uint              `json:"amount"`
+		Campaign   string            `json:"campaign,omitempty"`
 		Cardholder models.Cardholder `json:"donor"`
 		Currency   string            `json:"currency"`
 		Details    string            `json:"details"`
@@ -856,6 +865,7 @@ func TestGetAPrimeDonationOfAUser(t *testing.T) {
 		assert.Equal(t, "monthly", resBody.Data.SendReceipt)
 		assert.Equal(t, false, resBody.Data.ToFeedback)
 		assert.Equal(t, oneTimeFrequency, resBody.Data.Frequency)
+		assert.Equal(t, "paid", resBody.Data.Status)
 		assert.Empty(t, resBody.Data.Notes)
 		assert.NotEmpty(t, resBody.Data.OrderNumber)
 	})
@@ -931,171 +941,148 @@ func TestGetAPeriodicDonationOfAUser(t *testing.T) {
 	})
 }
 
-/* GetDonationsOfAUser is not implemented yet
-func TestGetDonations(t *testing.T) {
+func TestGetDonationsOfAUser(t *testing.T) {
 	var resBody responseBodyForList
-	var resp *httptest.ResponseRecorder
-	var path string
 
-	// set up default records
-	setUpBeforeDonationsTest()
+	// setup before test
+	donorEmail := "donations-history-donor@twreporter.org"
+	user := createUser(donorEmail)
+	periodicRes := createDefaultPeriodicDonationRecord(user)
+	primeRes := createDefaultPrimeDonationRecord(user)
+	// make the periodic donation earlier than the prime donation
+	Globs.GormDB.Model(&models.PeriodicDonation{}).Where("id = ?", periodicRes.Data.ID).Update("created_at", time.Now().AddDate(0, 0, -1))
 
-	defaultUser := getUser(Globs.Defaults.Account)
-	user := getUser(donorEmail)
-	jwt := generateJWT(user)
-	authorization := fmt.Sprintf("Bearer %s", jwt)
+	authorization := fmt.Sprintf("Bearer %s", generateJWT(user))
+	cookie := http.Cookie{
+		HttpOnly: true,
+		MaxAge:   3600,
+		Name:     "id_token",
+		Secure:   false,
+		Value:    generateIDToken(user),
+	}
 
-	// ===========================================
-	// Failure (Client Error)
-	// - Get Donations of A Unkonwn User Without Authorization Header
-	// - 401 Unauthorized
-	// ===========================================
-	path = fmt.Sprintf("/v1/users/%d/donations", user.ID)
-	resp = serveHTTP("GET", path, "", "", "")
-	assert.Equal(t, 401, resp.Code)
+	getDonations := func(query string) (int, responseBodyForList) {
+		path := fmt.Sprintf("/v1/users/%d/donations%s", user.ID, query)
+		resp := serveHTTPWithCookies("GET", path, "", "", authorization, cookie)
+		respInBytes, _ := ioutil.ReadAll(resp.Result().Body)
+		defer resp.Result().Body.Close()
 
-	// ===========================================
-	// Failure (Client Error)
-	// - Create a Periodic Donation on Unauthenticated Resource
-	// - 403 Forbidden
-	// ===========================================
-	path = fmt.Sprintf("/v1/users/%d/donations", defaultUser.ID)
-	resp = serveHTTP("GET", path, "", "", authorization)
-	assert.Equal(t, 403, resp.Code)
+		resBody := responseBodyForList{}
+		json.Unmarshal(respInBytes, &resBody)
+		return resp.Code, resBody
+	}
 
-	// ===========================================
-	// Failure (Client Error)
-	// - Get Donations of A Unkonwn User
-	// - 404 Not Found Error
-	// ===========================================
-	path = "/v1/users/1000/donations"
-	jwt = generateJWT(models.User{
-		ID:    1000,
-		Email: null.StringFrom("unknown@twreporter.org"),
+	t.Run("StatusCode=StatusUnauthorized", func(t *testing.T) {
+		path := fmt.Sprintf("/v1/users/%d/donations", user.ID)
+		resp := serveHTTPWithCookies("GET", path, "", "", "", cookie)
+		assert.Equal(t, http.StatusUnauthorized, resp.Code)
 	})
 
-	resp = serveHTTP("GET", path, "", "", fmt.Sprintf("Bearer %s", jwt))
-	assert.Equal(t, 404, resp.Code)
+	t.Run("StatusCode=StatusForbidden", func(t *testing.T) {
+		path := fmt.Sprintf("/v1/users/%d/donations", getUser(Globs.Defaults.Account).ID)
+		resp := serveHTTPWithCookies("GET", path, "", "", authorization, cookie)
+		assert.Equal(t, http.StatusForbidden, resp.Code)
+	})
 
-	// ================================================================
-	// Success
-	// - Get Donations of A User Without `pay_methods` Param
-	// - Missing `pay_methods` Param (which means all pay_methods)
-	// ================================================================
-	path = fmt.Sprintf("/v1/users/%d/donations?offset=%d&limit=%d", user.ID, defaults.Offset, defaults.Limit)
-	resp = serveHTTP("GET", path, "", "", "")
-	resBodyInBytes, _ := ioutil.ReadAll(resp.Result().Body)
-	json.Unmarshal(resBodyInBytes, &resBody)
-	assert.Equal(t, 200, resp.Code)
-	assert.Equal(t, "success", resBody.Status)
-	assert.Equal(t, defaults.Total, resBody.Data.Meta.Total)
-	assert.Equal(t, defaults.Offset, resBody.Data.Meta.Offset)
-	assert.Equal(t, defaults.Limit, resBody.Data.Meta.Limit)
-	assert.Equal(t, defaults.Total, len(resBody.Data.Records))
-	assert.Equal(t, defaults.CreditCard, resBody.Data.Records[0].PayMethod)
-	assert.Equal(t, true, resBody.Data.Records[0].IsPeriodic)
-	assert.Equal(t, defaults.CreditCard, resBody.Data.Records[1].PayMethod)
-	assert.Equal(t, false, resBody.Data.Records[1].IsPeriodic)
-	assert.Equal(t, defaults.CreditCard, resBody.Data.Records[2].PayMethod)
-	assert.Equal(t, true, resBody.Data.Records[2].IsPeriodic)
-
-	// ===================================================
-	// Success
-	// - Get Donations of A User Without `offset` Param
-	// - Missing `offset` Param (which means offset=0)
-	// ===================================================
-	path = fmt.Sprintf("/v1/users/%d/donations?pay_methods=credit_card&limit=%d", user.ID, defaults.Limit)
-	resp = serveHTTP("GET", path, "", "", "")
-	resBodyInBytes, _ = ioutil.ReadAll(resp.Result().Body)
-	json.Unmarshal(resBodyInBytes, &resBody)
-	assert.Equal(t, 200, resp.Code)
-	assert.Equal(t, "success", resBody.Status)
-	assert.Equal(t, defaults.Total, resBody.Data.Meta.Total)
-	assert.Equal(t, defaults.Offset, resBody.Data.Meta.Offset)
-
-	// =====================================================
-	// Success
-	// - Get Donations of A User Without `limit` Param
-	// - Missing `limit` Param (which means limit=10)
-	// =====================================================
-	path = fmt.Sprintf("/v1/users/%d/donations?pay_methods=credit_card&offset=%d", user.ID, defaults.Offset)
-	resp = serveHTTP("GET", path, "", "", "")
-	resBodyInBytes, _ = ioutil.ReadAll(resp.Result().Body)
-	json.Unmarshal(resBodyInBytes, &resBody)
-	assert.Equal(t, 200, resp.Code)
-	assert.Equal(t, "success", resBody.Status)
-	assert.Equal(t, defaults.Total, resBody.Data.Meta.Total)
-	assert.Equal(t, defaults.Offset, resBody.Data.Meta.Limit)
-
-	// ===================================================
-	// Success
-	// - Get Donations of A User Without Any Params
-	// - Missing `pay_method`, `offset` and `limit` Param
-	// ===================================================
-	path = fmt.Sprintf("/v1/users/%d/donations", user.ID)
-	resp = serveHTTP("GET", path, "", "", "")
-	resBodyInBytes, _ = ioutil.ReadAll(resp.Result().Body)
-	json.Unmarshal(resBodyInBytes, &resBody)
-	assert.Equal(t, 200, resp.Code)
-	assert.Equal(t, "success", resBody.Status)
-	assert.Equal(t, defaults.Total, resBody.Data.Meta.Total)
-	assert.Equal(t, defaults.Limit, resBody.Data.Meta.Limit)
-	assert.Equal(t, defaults.Total, len(resBody.Data.Records))
-
-	// ===============================================================
-	// Success
-	// - Get Donations of A User by Providing `offset=1` and `limit=1`
-	// - ?offset=1&limit=1
-	// ===============================================================
-	path = fmt.Sprintf("/v1/users/%d/donations?offset=1&limit=1", user.ID)
-	resp = serveHTTP("GET", path, "", "", "")
-	resBodyInBytes, _ = ioutil.ReadAll(resp.Result().Body)
-	json.Unmarshal(resBodyInBytes, &resBody)
-	assert.Equal(t, 200, resp.Code)
-	assert.Equal(t, "success", resBody.Status)
-	assert.Equal(t, defaults.Total, resBody.Data.Meta.Total)
-	assert.Equal(t, 1, resBody.Data.Meta.Limit)
-	assert.Equal(t, 1, len(resBody.Data.Records))
-	assert.Equal(t, defaults.CreditCard, resBody.Data.Records[0].PayMethod)
-	assert.Equal(t, false, resBody.Data.Records[0].IsPeriodic)
-
-	// ====================================================
-	// Success
-	// - Get Donations of A User With `offset>total`
-	// - ?offset=3&limit=1 (offset is equal to or more than total)
-	// ====================================================
-	path = fmt.Sprintf("/v1/users/%d/donations?offset=%d&limit=1", user.ID, defaults.Total)
-	resp = serveHTTP("GET", path, "", "", "")
-	resBodyInBytes, _ = ioutil.ReadAll(resp.Result().Body)
-	json.Unmarshal(resBodyInBytes, &resBody)
-	assert.Equal(t, 200, resp.Code)
-	assert.Equal(t, "success", resBody.Status)
-	assert.Equal(t, 0, len(resBody.Data.Records))
-
-	// =========================================================
-	// Success
-	// - Get Donations of A User With `limit=0`
-	// - ?offset=0&limit=0 (limit is 0)
-	// =========================================================
-	path = fmt.Sprintf("/v1/users/%d/donations?offset=0&limit=0", user.ID)
-	resp = serveHTTP("GET", path, "", "", "")
-	resBodyInBytes, _ = ioutil.ReadAll(resp.Result().Body)
-	json.Unmarshal(resBodyInBytes, &resBody)
-	assert.Equal(t, 200, resp.Code)
-	assert.Equal(t, "success", resBody.Status)
-	assert.Equal(t, 0, len(resBody.Data.Records))
-
-	// =========================================================
-	// Success
-	// - Get Donations of A User
-	// - Test offset and limit are not unsigned integer
-	// - Test SQL Injection, put statement in pay_methods
-	// - ?limit=NaN&offset=-1&pay_methods=;select * from users;
-	// =========================================================
-	path = fmt.Sprintf("/v1/users/%d/donations?limit=NaN&offset=-1&pay_methods=;select * from users;", user.ID)
-	resp = serveHTTP("GET", path, "", "", "")
-	assert.Equal(t, 200, resp.Code)
-	assert.Equal(t, "success", resBody.Status)
-	assert.Equal(t, 3, len(resBody.Data.Records))
+	t.Run("StatusCode=StatusBadRequest", func(t *testing.T) {
+		code, _ := getDonations("?type=unknown")
+		assert.Equal(t, http.StatusBadRequest, code)
+
+		code, _ = getDonations("?since=yesterday")
+		assert.Equal(t, http.StatusBadRequest, code)
+	})
+
+	t.Run("StatusCode=StatusOK", func(t *testing.T) {
+		var code int
+		code, resBody = getDonations("")
+		assert.Equal(t, http.StatusOK, code)
+		assert.Equal(t, "success", resBody.Status)
+		assert.Equal(t, uint(2), resBody.Data.Meta.Total)
+		assert.Equal(t, defaults.Offset, resBody.Data.Meta.Offset)
+		assert.Equal(t, defaults.Limit, resBody.Data.Meta.Limit)
+		assert.Equal(t, 2, len(resBody.Data.Records))
+
+		// the latest donation comes first
+		assert.Equal(t, "prime", resBody.Data.Records[0].Type)
+		assert.Equal(t, primeRes.Data.ID, resBody.Data.Records[0].ID)
+		assert.Equal(t, "paid", resBody.Data.Records[0].Status)
+		assert.Equal(t, "periodic_donation", resBody.Data.Records[1].Type)
+		assert.Equal(t, periodicRes.Data.ID, resBody.Data.Records[1].ID)
+		assert.Equal(t, 1, len(resBody.Data.Records[1].Installments))
+		assert.Equal(t, "paid", resBody.Data.Records[1].Installments[0].Status)
+	})
+
+	t.Run("Pagination", func(t *testing.T) {
+		_, resBody = getDonations("?offset=1&limit=1")
+		assert.Equal(t, uint(2), resBody.Data.Meta.Total)
+		assert.Equal(t, uint(1), resBody.Data.Meta.Limit)
+		assert.Equal(t, 1, len(resBody.Data.Records))
+		assert.Equal(t, "periodic_donation", resBody.Data.Records[0].Type)
+
+		_, resBody = getDonations("?offset=2&limit=1")
+		assert.Equal(t, 0, len(resBody.Data.Records))
+	})
+
+	t.Run("Filters", func(t *testing.T) {
+		_, resBody = getDonations("?type=periodic_donation")
+		assert.Equal(t, uint(1), resBody.Data.Meta.Total)
+		assert.Equal(t, periodicRes.Data.ID, resBody.Data.Records[0].ID)
+
+		_, resBody = getDonations("?status=fail")
+		assert.Equal(t, uint(0), resBody.Data.Meta.Total)
+
+		_, resBody = getDonations("?since=2000-01-01&until=2000-12-31")
+		assert.Equal(t, uint(0), resBody.Data.Meta.Total)
+
+		// SQL injection in query strings is treated as values
+		_, resBody = getDonations("?status=paid';select%20*%20from%20users;")
+		assert.Equal(t, uint(0), resBody.Data.Meta.Total)
+	})
+}
+
+func TestGetATokenDonationOfAUser(t *testing.T) {
+	// setup before test
+	user := createUser("get-token-donor@twreporter.org")
+	periodicRes := createDefaultPeriodicDonationRecord(user)
+
+	td := models.PayByCardTokenDonation{}
+	Globs.GormDB.Where("periodic_id = ?", periodicRes.Data.ID).Find(&td)
+
+	authorization := fmt.Sprintf("Bearer %s", generateJWT(user))
+	cookie := http.Cookie{
+		HttpOnly: true,
+		MaxAge:   3600,
+		Name:     "id_token",
+		Secure:   false,
+		Value:    generateIDToken(user),
+	}
+
+	t.Run("StatusCode=StatusForbidden", func(t *testing.T) {
+		path := fmt.Sprintf("/v1/donations/token/%d?user_id=%d", td.ID, getUser(Globs.Defaults.Account).ID)
+		resp := serveHTTPWithCookies("GET", path, "", "application/json", authorization, cookie)
+		assert.Equal(t, http.StatusForbidden, resp.Code)
+	})
+
+	t.Run("StatusCode=StatusNotFound", func(t *testing.T) {
+		path := fmt.Sprintf("/v1/donations/token/%d?user_id=%d", 1000, user.ID)
+		resp := serveHTTPWithCookies("GET", path, "", "application/json", authorization, cookie)
+		assert.Equal(t, http.StatusNotFound, resp.Code)
+	})
+
+	t.Run("StatusCode=StatusOK", func(t *testing.T) {
+		path := fmt.Sprintf("/v1/donations/token/%d?user_id=%d", td.ID, user.ID)
+		resp := serveHTTPWithCookies("GET", path, "", "application/json", authorization, cookie)
+		respInBytes, _ := ioutil.ReadAll(resp.Result().Body)
+		defer resp.Result().Body.Close()
+
+		resBody := responseBody{}
+		json.Unmarshal(respInBytes, &resBody)
+		assert.Equal(t, http.StatusOK, resp.Code)
+		assert.Equal(t, td.ID, resBody.Data.ID)
+		assert.Equal(t, testAmount, resBody.Data.Amount)
+		assert.Equal(t, "paid", resBody.Data.Status)
+		assert.Equal(t, monthlyFrequency, resBody.Data.Frequency)
+		assert.Equal(t, "4242", resBody.Data.CardInfo.LastFour.ValueOrZero())
+		assert.Equal(t, testName, resBody.Data.Cardholder.Name.ValueOrZero())
+	})
 }
-*/
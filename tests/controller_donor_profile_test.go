@@ -0,0 +1,119 @@
+package tests
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"twreporter.org/go-api/models"
+)
+
+func TestDonorProfile(t *testing.T) {
+	// setup before test
+	donor := createUser("donor-profile@twreporter.org")
+	profilePath := fmt.Sprintf("/v1/users/%d/donor-profile", donor.ID)
+	cardsPath := fmt.Sprintf("/v1/users/%d/cards", donor.ID)
+
+	cookie := http.Cookie{
+		HttpOnly: true,
+		MaxAge:   3600,
+		Name:     "id_token",
+		Secure:   false,
+		Value:    generateIDToken(donor),
+	}
+	authorization := fmt.Sprintf("Bearer %s", generateJWT(donor))
+
+	type cardsResponse struct {
+		Data []models.CardOnFile `json:"data"`
+	}
+
+	t.Run("SaveTheProfile", func(t *testing.T) {
+		resp := serveHTTPWithCookies("GET", profilePath, "", "", authorization, cookie)
+		assert.Equal(t, http.StatusNotFound, resp.Code)
+
+		resp = serveHTTPWithCookies("PUT", profilePath, `{"send_receipt":"yearly"}`, "application/json", authorization, cookie)
+		assert.Equal(t, http.StatusBadRequest, resp.Code)
+
+		reqBody := fmt.Sprintf(`{"cardholder":{"email":"%s","name":"%s","address":"%s","phone_number":"%s","national_id":"%s","zip_code":"%s"},"send_receipt":"no"}`,
+			donor.Email.ValueOrZero(), testName, testAddress, testPhoneNumber, testNationalID, testZipCode)
+		resp = serveHTTPWithCookies("PUT", profilePath, reqBody, "application/json", authorization, cookie)
+		assert.Equal(t, http.StatusOK, resp.Code)
+
+		resp = serveHTTPWithCookies("GET", profilePath, "", "", authorization, cookie)
+		assert.Equal(t, http.StatusOK, resp.Code)
+
+		resBody := struct {
+			Data models.DonorProfile `json:"data"`
+		}{}
+		json.Unmarshal(resp.Body.Bytes(), &resBody)
+		assert.Equal(t, testAddress, resBody.Data.Address.ValueOrZero())
+		assert.Equal(t, testName, resBody.Data.Name.ValueOrZero())
+		assert.Equal(t, "no", resBody.Data.SendReceipt)
+	})
+
+	t.Run("PrefillTheDonation", func(t *testing.T) {
+		reqBody := fmt.Sprintf(`{"amount":%d,"details":"%s","donor":{"email":"%s","name":"王大明"},"merchant_id":"%s","pay_method":"credit_card","prime":"%s","user_id":%d}`,
+			testAmount, testDetails, donor.Email.ValueOrZero(), testMerchantID, testPrime, donor.ID)
+		resp := serveHTTPWithCookies("POST", "/v1/donations/prime", reqBody, "application/json", authorization, cookie)
+		assert.Equal(t, http.StatusCreated, resp.Code)
+
+		resBody := responseBody{}
+		json.Unmarshal(resp.Body.Bytes(), &resBody)
+		// the given fields are kept, and the rest are filled by the profile
+		assert.Equal(t, "王大明", resBody.Data.Cardholder.Name.ValueOrZero())
+		assert.Equal(t, testAddress, resBody.Data.Cardholder.Address.ValueOrZero())
+		assert.Equal(t, testNationalID, resBody.Data.Cardholder.NationalID.ValueOrZero())
+
+		var d models.PayByPrimeDonation
+		Globs.GormDB.Where("id = ?", resBody.Data.ID).Find(&d)
+		assert.Equal(t, "no", d.SendReceipt)
+	})
+
+	t.Run("RemoveACardOnFile", func(t *testing.T) {
+		first := createDefaultPeriodicDonationRecord(donor)
+		second := createDefaultPeriodicDonationRecord(donor)
+
+		var cards cardsResponse
+		resp := serveHTTPWithCookies("GET", cardsPath, "", "", authorization, cookie)
+		assert.Equal(t, http.StatusOK, resp.Code)
+		json.Unmarshal(resp.Body.Bytes(), &cards)
+
+		// the periodic donations charged by the same card are grouped together
+		if !assert.Len(t, cards.Data, 1) {
+			return
+		}
+		card := cards.Data[0]
+		assert.Equal(t, "4242", card.LastFour)
+		assert.Len(t, card.PeriodicDonations, 2)
+		assert.NotContains(t, resp.Body.String(), "card_token")
+
+		resp = serveHTTPWithCookies("DELETE", fmt.Sprintf("%s/%s?confirm=true", cardsPath, "unknown"), "", "", authorization, cookie)
+		assert.Equal(t, http.StatusNotFound, resp.Code)
+
+		// the periodic donations are not stopped without the confirmation
+		resp = serveHTTPWithCookies("DELETE", fmt.Sprintf("%s/%s", cardsPath, card.ID), "", "", authorization, cookie)
+		assert.Equal(t, http.StatusConflict, resp.Code)
+
+		var pd models.PeriodicDonation
+		Globs.GormDB.Where("id = ?", first.Data.ID).Find(&pd)
+		assert.Equal(t, "paid", pd.Status)
+
+		resp = serveHTTPWithCookies("DELETE", fmt.Sprintf("%s/%s?confirm=true", cardsPath, card.ID), "", "", authorization, cookie)
+		assert.Equal(t, http.StatusOK, resp.Code)
+
+		for _, id := range []uint{first.Data.ID, second.Data.ID} {
+			pd = models.PeriodicDonation{}
+			Globs.GormDB.Where("id = ?", id).Find(&pd)
+			assert.Equal(t, "stopped", pd.Status)
+			assert.Empty(t, pd.CardToken)
+			assert.Empty(t, pd.CardKey)
+		}
+
+		resp = serveHTTPWithCookies("GET", cardsPath, "", "", authorization, cookie)
+		cards = cardsResponse{}
+		json.Unmarshal(resp.Body.Bytes(), &cards)
+		assert.Len(t, cards.Data, 0)
+	})
+}
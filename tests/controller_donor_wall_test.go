@@ -0,0 +1,168 @@
+package tests
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"twreporter.org/go-api/controllers"
+	"twreporter.org/go-api/storage"
+)
+
+func TestDonorWall(t *testing.T) {
+	const slug = "donor-wall"
+
+	// setup before test
+	donor := createUser("donor-wall@twreporter.org")
+	mc := controllers.NewMembershipController(storage.NewGormStorage(Globs.GormDB), Globs.PaymentGateways, Globs.CardKeyring)
+
+	location, _ := time.LoadLocation("Asia/Taipei")
+	now := time.Now().In(location)
+	today := now.Format("2006-01-02")
+
+	cookie := http.Cookie{
+		HttpOnly: true,
+		MaxAge:   3600,
+		Name:     "id_token",
+		Secure:   false,
+		Value:    generateIDToken(donor),
+	}
+	authorization := fmt.Sprintf("Bearer %s", generateJWT(donor))
+
+	type entry struct {
+		Amount      *uint  `json:"amount"`
+		DisplayName string `json:"display_name"`
+		Frequency   string `json:"frequency"`
+	}
+
+	type wall struct {
+		Data struct {
+			Records []entry `json:"records"`
+			Meta    struct {
+				Limit  int `json:"limit"`
+				Offset int `json:"offset"`
+				Total  int `json:"total"`
+			} `json:"meta"`
+		} `json:"data"`
+	}
+
+	donate := func(consent string) (int, uint) {
+		reqBody := fmt.Sprintf(`{"amount":%d,"campaign":"%s","details":"%s","donor":{"email":"%s","name":"%s","national_id":"%s"},"merchant_id":"%s","pay_method":"credit_card","prime":"%s","user_id":%d,%s}`,
+			testAmount, slug, testDetails, donor.Email.ValueOrZero(), testName, testNationalID, testMerchantID, testPrime, donor.ID, consent)
+		resp := serveHTTPWithCookies("POST", "/v1/donations/prime", reqBody, "application/json", authorization, cookie)
+
+		resBody := struct {
+			Data struct {
+				ID uint `json:"id"`
+			} `json:"data"`
+		}{}
+		json.Unmarshal(resp.Body.Bytes(), &resBody)
+		return resp.Code, resBody.Data.ID
+	}
+
+	getWall := func(query string) (int, wall, string) {
+		var w wall
+		resp := serveHTTP("GET", "/v1/donor-wall?"+query, "", "", "")
+		json.Unmarshal(resp.Body.Bytes(), &w)
+		return resp.Code, w, resp.Body.String()
+	}
+
+	var shownID uint
+
+	t.Run("OptIn", func(t *testing.T) {
+		_, err := mc.CreateACampaign(slug, "捐款牆測試", 3000000, today, today, "")
+		assert.Nil(t, err)
+
+		// the display name is required to be shown on the wall
+		code, _ := donate(`"show_on_wall":true`)
+		assert.Equal(t, http.StatusBadRequest, code)
+
+		code, shownID = donate(`"show_on_wall":true,"display_name":" 小明 "`)
+		assert.Equal(t, http.StatusCreated, code)
+
+		code, _ = donate(`"show_on_wall":true,"display_name":"匿名好人","hide_amount":true`)
+		assert.Equal(t, http.StatusCreated, code)
+
+		// the donors who do not agree are not listed
+		code, _ = donate(`"display_name":"不公開"`)
+		assert.Equal(t, http.StatusCreated, code)
+	})
+
+	t.Run("ListTheConsentingDonors", func(t *testing.T) {
+		code, w, body := getWall(fmt.Sprintf("campaign=%s", slug))
+		assert.Equal(t, http.StatusOK, code)
+		assert.Equal(t, 2, w.Data.Meta.Total)
+		if assert.Len(t, w.Data.Records, 2) {
+			// the latest first
+			assert.Equal(t, "匿名好人", w.Data.Records[0].DisplayName)
+			assert.Nil(t, w.Data.Records[0].Amount)
+			assert.Equal(t, "小明", w.Data.Records[1].DisplayName)
+			if assert.NotNil(t, w.Data.Records[1].Amount) {
+				assert.Equal(t, testAmount, *w.Data.Records[1].Amount)
+			}
+			assert.Equal(t, "one_time", w.Data.Records[1].Frequency)
+		}
+
+		// nothing identifies the donors but the display names
+		assert.NotContains(t, body, donor.Email.ValueOrZero())
+		assert.NotContains(t, body, testNationalID)
+		assert.NotContains(t, body, "email")
+		assert.NotContains(t, body, "national_id")
+	})
+
+	t.Run("FilterAndPaginate", func(t *testing.T) {
+		code, w, _ := getWall(fmt.Sprintf("campaign=%s&month=%s", slug, now.Format("2006-01")))
+		assert.Equal(t, http.StatusOK, code)
+		assert.Equal(t, 2, w.Data.Meta.Total)
+
+		code, w, _ = getWall(fmt.Sprintf("campaign=%s&month=%s", slug, now.AddDate(0, -1, 0).Format("2006-01")))
+		assert.Equal(t, http.StatusOK, code)
+		assert.Equal(t, 0, w.Data.Meta.Total)
+		assert.Len(t, w.Data.Records, 0)
+
+		code, w, _ = getWall(fmt.Sprintf("campaign=%s&limit=20&offset=20", slug))
+		assert.Equal(t, http.StatusOK, code)
+		assert.Equal(t, 2, w.Data.Meta.Total)
+		assert.Equal(t, 20, w.Data.Meta.Limit)
+		assert.Len(t, w.Data.Records, 0)
+
+		// the pages are of the fixed sizes and start at the multiples of the size
+		code, _, _ = getWall(fmt.Sprintf("campaign=%s&limit=1&offset=1", slug))
+		assert.Equal(t, http.StatusBadRequest, code)
+
+		code, _, _ = getWall(fmt.Sprintf("campaign=%s&limit=10&offset=5", slug))
+		assert.Equal(t, http.StatusBadRequest, code)
+
+		// the deep pages are capped
+		code, w, _ = getWall(fmt.Sprintf("campaign=%s&offset=100000", slug))
+		assert.Equal(t, http.StatusOK, code)
+		assert.Equal(t, 1000, w.Data.Meta.Offset)
+		assert.Len(t, w.Data.Records, 0)
+
+		code, _, _ = getWall("month=2019-13")
+		assert.Equal(t, http.StatusBadRequest, code)
+
+		code, _, _ = getWall(fmt.Sprintf("month=%s", now.AddDate(0, 1, 0).Format("2006-01")))
+		assert.Equal(t, http.StatusBadRequest, code)
+
+		code, _, _ = getWall("campaign=Not%20A%20Slug")
+		assert.Equal(t, http.StatusBadRequest, code)
+	})
+
+	t.Run("WithdrawTheConsent", func(t *testing.T) {
+		path := fmt.Sprintf("/v1/donations/prime/%d", shownID)
+		resp := serveHTTPWithCookies("PATCH", path, fmt.Sprintf(`{"show_on_wall":false,"user_id":%d}`, donor.ID), "application/json", authorization, cookie)
+		assert.Equal(t, http.StatusNoContent, resp.Code)
+
+		// the withdrawn donation leaves the cached wall right away
+		code, w, _ := getWall(fmt.Sprintf("campaign=%s", slug))
+		assert.Equal(t, http.StatusOK, code)
+		assert.Equal(t, 1, w.Data.Meta.Total)
+		if assert.Len(t, w.Data.Records, 1) {
+			assert.Equal(t, "匿名好人", w.Data.Records[0].DisplayName)
+		}
+	})
+}
@@ -0,0 +1,147 @@
+package tests
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"twreporter.org/go-api/configs"
+	"twreporter.org/go-api/configs/constants"
+	"twreporter.org/go-api/controllers"
+	"twreporter.org/go-api/globals"
+	"twreporter.org/go-api/models"
+	"twreporter.org/go-api/storage"
+)
+
+func TestShipFeedbackGifts(t *testing.T) {
+	// setup before test
+	conf := globals.Conf.Donation
+	globals.Conf.Donation.FeedbackGiftMinInstallments = 2
+	globals.Conf.Donation.Currencies = map[string]configs.CurrencyConfig{
+		"TWD": {MinAmount: 1, MaxAmount: 1000000, Symbol: "NT$", FeedbackGiftMinAmount: testAmount},
+	}
+	defer func() { globals.Conf.Donation = conf }()
+
+	donor := createUser("gift-donor@twreporter.org")
+	admin := createUser("gift-admin@twreporter.org")
+	Globs.GormDB.Model(&models.User{}).Where("id = ?", admin.ID).Update("privilege", constants.PrivilegeAdmin)
+	mc := controllers.NewMembershipController(storage.NewGormStorage(Globs.GormDB), Globs.PaymentGateways, Globs.CardKeyring)
+
+	eligibleID := createDefaultPeriodicDonationRecord(donor).Data.ID
+	noFeedbackID := createDefaultPeriodicDonationRecord(donor).Data.ID
+	Globs.GormDB.Model(&models.PeriodicDonation{}).Where("id = ?", noFeedbackID).Update("to_feedback", false)
+
+	payAnInstallment := func(periodicID uint) {
+		Globs.GormDB.Create(&models.PayByCardTokenDonation{
+			Amount:      testAmount,
+			Details:     testDetails,
+			MerchantID:  testMerchantID,
+			OrderNumber: fmt.Sprintf("gift-installment-%d", periodicID),
+			PeriodicID:  periodicID,
+			Status:      "paid",
+		})
+	}
+
+	getGift := func(periodicID uint) (gf models.GiftFulfillment) {
+		Globs.GormDB.Where("periodic_id = ?", periodicID).Find(&gf)
+		return
+	}
+
+	serve := func(user models.User, method string, path string, body string) (int, []byte) {
+		cookie := http.Cookie{
+			HttpOnly: true,
+			MaxAge:   3600,
+			Name:     "id_token",
+			Secure:   false,
+			Value:    generateIDToken(user),
+		}
+		resp := serveHTTPWithCookies(method, path, body, "application/json", fmt.Sprintf("Bearer %s", generateJWT(user)), cookie)
+		return resp.Code, resp.Body.Bytes()
+	}
+
+	t.Run("QueueByTheRules", func(t *testing.T) {
+		// only the first installments are paid
+		_, err := mc.QueueFeedbackGifts(time.Now(), 1)
+		assert.Nil(t, err)
+		assert.Zero(t, getGift(eligibleID).ID)
+
+		payAnInstallment(eligibleID)
+		payAnInstallment(noFeedbackID)
+
+		_, err = mc.QueueFeedbackGifts(time.Now(), 1)
+		assert.Nil(t, err)
+
+		gf := getGift(eligibleID)
+		assert.Equal(t, models.GiftFulfillmentQueued, gf.Status)
+		assert.Equal(t, donor.ID, gf.UserID)
+		assert.Zero(t, getGift(noFeedbackID).ID)
+
+		// each periodic donation is queued once
+		_, err = mc.QueueFeedbackGifts(time.Now(), 100)
+		assert.Nil(t, err)
+		var count int
+		Globs.GormDB.Model(&models.GiftFulfillment{}).Where("periodic_id = ?", eligibleID).Count(&count)
+		assert.Equal(t, 1, count)
+	})
+
+	t.Run("ExportTheShippingList", func(t *testing.T) {
+		code, _ := serve(donor, "GET", "/v1/gifts/shipping-list", "")
+		assert.Equal(t, http.StatusForbidden, code)
+
+		code, body := serve(admin, "GET", "/v1/gifts/shipping-list", "")
+		assert.Equal(t, http.StatusOK, code)
+
+		records, err := csv.NewReader(strings.NewReader(string(body))).ReadAll()
+		assert.Nil(t, err)
+		assert.Equal(t, "id", records[0][0])
+
+		var found bool
+		for _, r := range records[1:] {
+			if r[0] == fmt.Sprint(getGift(eligibleID).ID) {
+				found = true
+				assert.Equal(t, testName, r[3])
+				assert.Equal(t, testZipCode, r[5])
+				assert.Equal(t, testAddress, r[6])
+			}
+		}
+		assert.True(t, found)
+	})
+
+	t.Run("MarkAGiftShipped", func(t *testing.T) {
+		path := fmt.Sprintf("/v1/gifts/%d/shipment", getGift(eligibleID).ID)
+
+		code, _ := serve(admin, "POST", path, fmt.Sprintf(`{"user_id":%d}`, admin.ID))
+		assert.Equal(t, http.StatusBadRequest, code)
+
+		code, _ = serve(admin, "POST", "/v1/gifts/999999/shipment", fmt.Sprintf(`{"user_id":%d,"tracking_number":"TRACK-1"}`, admin.ID))
+		assert.Equal(t, http.StatusNotFound, code)
+
+		code, body := serve(admin, "POST", path, fmt.Sprintf(`{"user_id":%d,"tracking_number":"TRACK-1","carrier":"中華郵政"}`, admin.ID))
+		assert.Equal(t, http.StatusOK, code)
+
+		resBody := struct {
+			Data models.GiftFulfillment `json:"data"`
+		}{}
+		json.Unmarshal(body, &resBody)
+		assert.Equal(t, models.GiftFulfillmentShipped, resBody.Data.Status)
+		assert.Equal(t, "TRACK-1", resBody.Data.TrackingNumber.ValueOrZero())
+		assert.Equal(t, int64(admin.ID), resBody.Data.ShippedBy.ValueOrZero())
+
+		// a gift is shipped once
+		code, _ = serve(admin, "POST", path, fmt.Sprintf(`{"user_id":%d,"tracking_number":"TRACK-2"}`, admin.ID))
+		assert.Equal(t, http.StatusConflict, code)
+		assert.Equal(t, "TRACK-1", getGift(eligibleID).TrackingNumber.ValueOrZero())
+
+		// the shipped gifts are no longer listed
+		_, body = serve(admin, "GET", "/v1/gifts/shipping-list", "")
+		records, _ := csv.NewReader(strings.NewReader(string(body))).ReadAll()
+		for _, r := range records[1:] {
+			assert.NotEqual(t, fmt.Sprint(resBody.Data.ID), r[0])
+		}
+	})
+}
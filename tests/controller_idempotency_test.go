@@ -0,0 +1,142 @@
+package tests
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"twreporter.org/go-api/configs/constants"
+	"twreporter.org/go-api/middlewares"
+	"twreporter.org/go-api/models"
+	"twreporter.org/go-api/storage"
+)
+
+func TestCreateADonationWithIdempotencyKey(t *testing.T) {
+	// setup before test
+	user := createUser("idempotency-donor@twreporter.org")
+
+	create := func(key string, amount uint) *httptest.ResponseRecorder {
+		reqBody := fmt.Sprintf(`{"amount":%d,"donor":{"email":"%s"},"merchant_id":"%s","pay_method":"%s","prime":"%s","user_id":%d}`,
+			amount, user.Email.ValueOrZero(), testMerchantID, creditCardPayMethod, testPrime, user.ID)
+
+		req := requestWithBody("POST", "/v1/donations/prime", reqBody)
+		req.Header.Add("Content-Type", "application/json")
+		req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", generateJWT(user)))
+		req.Header.Add("Idempotency-Key", key)
+		req.AddCookie(&http.Cookie{
+			HttpOnly: true,
+			MaxAge:   3600,
+			Name:     "id_token",
+			Secure:   false,
+			Value:    generateIDToken(user),
+		})
+
+		resp := httptest.NewRecorder()
+		Globs.GinEngine.ServeHTTP(resp, req)
+		return resp
+	}
+
+	countDonations := func() (count int) {
+		Globs.GormDB.Model(&models.PayByPrimeDonation{}).Where("user_id = ?", user.ID).Count(&count)
+		return
+	}
+
+	parse := func(resp *httptest.ResponseRecorder) responseBody {
+		resBody := responseBody{}
+		respInBytes, _ := ioutil.ReadAll(resp.Result().Body)
+		defer resp.Result().Body.Close()
+		json.Unmarshal(respInBytes, &resBody)
+		return resBody
+	}
+
+	first := create("idempotency-key-1", testAmount)
+	assert.Equal(t, http.StatusCreated, first.Code)
+	firstBody := parse(first)
+
+	t.Run("ReplayTheResponse", func(t *testing.T) {
+		resp := create("idempotency-key-1", testAmount)
+		assert.Equal(t, http.StatusCreated, resp.Code)
+		assert.Equal(t, "true", resp.Header().Get("Idempotent-Replayed"))
+		assert.Equal(t, firstBody.Data.OrderNumber, parse(resp).Data.OrderNumber)
+		assert.Equal(t, 1, countDonations())
+	})
+
+	t.Run("StatusCode=StatusUnprocessableEntity", func(t *testing.T) {
+		resp := create("idempotency-key-1", testAmount+100)
+		assert.Equal(t, http.StatusUnprocessableEntity, resp.Code)
+		assert.Equal(t, 1, countDonations())
+	})
+
+	t.Run("AnotherKey", func(t *testing.T) {
+		resp := create("idempotency-key-2", testAmount)
+		assert.Equal(t, http.StatusCreated, resp.Code)
+		assert.Equal(t, 2, countDonations())
+	})
+
+	t.Run("AbandonedKey", func(t *testing.T) {
+		// pretend the process died while processing the request of the key
+		abandoned := models.IdempotencyKey{Fingerprint: "abandoned", Key: "idempotency-key-3", UserID: user.ID}
+		Globs.GormDB.Create(&abandoned)
+
+		// the key is kept while the request could still be in progress
+		resp := create("idempotency-key-3", testAmount)
+		assert.Equal(t, http.StatusUnprocessableEntity, resp.Code)
+
+		Globs.GormDB.Exec("UPDATE idempotency_keys SET created_at = ? WHERE id = ?", time.Now().Add(-2*time.Minute), abandoned.ID)
+
+		resp = create("idempotency-key-3", testAmount)
+		assert.Equal(t, http.StatusCreated, resp.Code)
+		assert.Equal(t, 3, countDonations())
+	})
+}
+
+func TestReleaseTheIdempotencyKeyOnServerErrors(t *testing.T) {
+	// setup before test
+	user := createUser("idempotency-server-error@twreporter.org")
+
+	var handled int
+	engine := gin.New()
+	engine.POST("/charges", middlewares.ValidateAuthorization(), middlewares.ValidateIdempotencyKey(storage.NewGormStorage(Globs.GormDB), time.Hour), func(c *gin.Context) {
+		handled++
+		if c.Query("charged") == "true" {
+			// the payment gateway times out, the donor may have been charged
+			c.Set(constants.GatewayCalledKey, true)
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"status": "error", "message": "failed"})
+	})
+
+	charge := func(path string, key string) *httptest.ResponseRecorder {
+		req := requestWithBody("POST", path, `{"amount":500}`)
+		req.Header.Add("Content-Type", "application/json")
+		req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", generateJWT(user)))
+		req.Header.Add("Idempotency-Key", key)
+
+		resp := httptest.NewRecorder()
+		engine.ServeHTTP(resp, req)
+		return resp
+	}
+
+	t.Run("BeforeTheGatewayIsCalled", func(t *testing.T) {
+		handled = 0
+		charge("/charges", "server-error-key-1")
+		resp := charge("/charges", "server-error-key-1")
+		assert.Equal(t, http.StatusInternalServerError, resp.Code)
+		assert.Equal(t, "", resp.Header().Get("Idempotent-Replayed"))
+		assert.Equal(t, 2, handled)
+	})
+
+	t.Run("AfterTheGatewayIsCalled", func(t *testing.T) {
+		handled = 0
+		charge("/charges?charged=true", "server-error-key-2")
+		resp := charge("/charges?charged=true", "server-error-key-2")
+		assert.Equal(t, http.StatusInternalServerError, resp.Code)
+		assert.Equal(t, "true", resp.Header().Get("Idempotent-Replayed"))
+		assert.Equal(t, 1, handled)
+	})
+}
@@ -0,0 +1,192 @@
+package tests
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"twreporter.org/go-api/configs"
+	"twreporter.org/go-api/controllers"
+	"twreporter.org/go-api/globals"
+	"twreporter.org/go-api/models"
+	"twreporter.org/go-api/payment"
+	"twreporter.org/go-api/storage"
+)
+
+const declinedGatewayStatus = 10003
+
+// declinedGateway declines every installment without requesting to any payment processor
+type declinedGateway struct {
+	payment.PaymentGateway
+}
+
+func (g declinedGateway) Name() string {
+	return "declined"
+}
+
+func (g declinedGateway) PayByToken(req payment.TokenReq) (payment.Transaction, error) {
+	t := payment.Transaction{Status: declinedGatewayStatus}
+	t.Msg = "card declined"
+	return t, errors.New("card declined")
+}
+
+func TestSelectPaymentGateways(t *testing.T) {
+	t.Run("DefaultToTapPay", func(t *testing.T) {
+		gw, err := Globs.PaymentGateways.GetByPayMethod("line")
+		assert.Nil(t, err)
+		assert.Equal(t, payment.TapPayName, gw.Name())
+
+		// the donations made before payment gateways are recorded
+		gw, err = Globs.PaymentGateways.Get("")
+		assert.Nil(t, err)
+		assert.Equal(t, payment.TapPayName, gw.Name())
+	})
+
+	t.Run("SelectECPay", func(t *testing.T) {
+		conf := globals.Conf.Donation
+		conf.PaymentGateways = map[string]string{"credit_card": payment.ECPayName}
+
+		gws, err := payment.NewGateways(conf)
+		assert.Nil(t, err)
+
+		gw, err := gws.GetByPayMethod("credit_card")
+		assert.Nil(t, err)
+		assert.Equal(t, payment.ECPayName, gw.Name())
+	})
+
+	t.Run("UnsupportedPayMethod", func(t *testing.T) {
+		conf := globals.Conf.Donation
+
+		conf.PaymentGateways = map[string]string{"line": payment.ECPayName}
+		_, err := payment.NewGateways(conf)
+		assert.NotNil(t, err)
+
+		conf.PaymentGateways = map[string]string{"credit_card": "unknown"}
+		_, err = payment.NewGateways(conf)
+		assert.NotNil(t, err)
+	})
+}
+
+func TestChargeThroughTheRecordedPaymentGateway(t *testing.T) {
+	// setup before test
+	user := createUser("declined-gateway-donor@twreporter.org")
+	periodicRes := createDefaultPeriodicDonationRecord(user)
+	periodicID := periodicRes.Data.ID
+
+	Globs.PaymentGateways.Register(declinedGateway{})
+
+	// pretend the card was bound on the declined gateway a month ago
+	Globs.GormDB.Model(&models.PeriodicDonation{}).Where("id = ?", periodicID).Updates(map[string]interface{}{
+		"last_success_at": time.Now().AddDate(0, -1, -1),
+		"payment_gateway": "declined",
+	})
+
+	mc := controllers.NewMembershipController(storage.NewGormStorage(Globs.GormDB), Globs.PaymentGateways, Globs.CardKeyring)
+
+	_, err := mc.ChargeDuePeriodicDonations(time.Now(), 10)
+	assert.Nil(t, err)
+
+	td := models.PayByCardTokenDonation{}
+	Globs.GormDB.Where("periodic_id = ? AND payment_gateway = ?", periodicID, "declined").Find(&td)
+	assert.Equal(t, "fail", td.Status)
+	assert.Equal(t, int64(declinedGatewayStatus), td.TappayApiStatus.Int64)
+
+	pd := models.PeriodicDonation{}
+	Globs.GormDB.Where("id = ?", periodicID).Find(&pd)
+	assert.Equal(t, "fail", pd.Status)
+}
+
+// ecpayServer answers every request with the data encrypted by the hash key and IV of the config
+func ecpayServer(conf configs.DonationConfig, data map[string]interface{}) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		plaintext, _ := json.Marshal(data)
+		block, _ := aes.NewCipher([]byte(conf.ECPayHashKey))
+
+		escaped := []byte(url.QueryEscape(string(plaintext)))
+		padding := block.BlockSize() - len(escaped)%block.BlockSize()
+		escaped = append(escaped, bytes.Repeat([]byte{byte(padding)}, padding)...)
+
+		ciphertext := make([]byte, len(escaped))
+		cipher.NewCBCEncrypter(block, []byte(conf.ECPayHashIV)).CryptBlocks(ciphertext, escaped)
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"Data":       base64.StdEncoding.EncodeToString(ciphertext),
+			"MerchantID": conf.ECPayMerchantID,
+			"TransCode":  1,
+			"TransMsg":   "Success",
+		})
+	}))
+}
+
+func TestPayByECPayTrades(t *testing.T) {
+	const amount = 1000
+	conf := globals.Conf.Donation
+
+	paid := func(tradeAmt uint) map[string]interface{} {
+		return map[string]interface{}{
+			"RtnCode": 1,
+			"RtnMsg":  "Success",
+			"OrderInfo": map[string]interface{}{
+				"MerchantTradeNo": "1234567890ecpay",
+				"PaymentDate":     "2019/12/01 10:00:00",
+				"TradeAmt":        tradeAmt,
+				"TradeNo":         "2012011000000001",
+			},
+		}
+	}
+
+	req := payment.PrimeReq{
+		Amount:      amount,
+		Currency:    "TWD",
+		Details:     testDetails,
+		OrderNumber: "twreporter-157516560000000000000",
+		Prime:       "ecpay-pay-token",
+	}
+
+	t.Run("CreateTheTrade", func(t *testing.T) {
+		server := ecpayServer(conf, map[string]interface{}{"RtnCode": 1, "RtnMsg": "Success", "Token": "ecpay-trade-token"})
+		defer server.Close()
+		conf.ECPayURL = server.URL
+
+		token, err := payment.NewECPay(conf).CreateTrade(payment.TradeReq{
+			Amount:      amount,
+			Currency:    "TWD",
+			Details:     testDetails,
+			OrderNumber: req.OrderNumber,
+		})
+		assert.Nil(t, err)
+		assert.Equal(t, "ecpay-trade-token", token)
+	})
+
+	t.Run("PayTheAmountOfTheTrade", func(t *testing.T) {
+		server := ecpayServer(conf, paid(amount))
+		defer server.Close()
+		conf.ECPayURL = server.URL
+
+		tr, err := payment.NewECPay(conf).PayByPrime(req)
+		assert.Nil(t, err)
+		assert.Equal(t, int64(payment.StatusSuccess), tr.Status)
+		assert.Equal(t, "2012011000000001", tr.RecTradeID)
+	})
+
+	t.Run("RejectTheMismatchedAmount", func(t *testing.T) {
+		server := ecpayServer(conf, paid(900))
+		defer server.Close()
+		conf.ECPayURL = server.URL
+
+		// the card is charged by the trade, so the result is left unknown rather than failed
+		tr, err := payment.NewECPay(conf).PayByPrime(req)
+		assert.NotNil(t, err)
+		assert.Equal(t, int64(payment.StatusSuccess), tr.Status)
+		assert.Equal(t, "", tr.RecTradeID)
+	})
+}
@@ -0,0 +1,189 @@
+package tests
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"twreporter.org/go-api/configs"
+	"twreporter.org/go-api/configs/constants"
+	"twreporter.org/go-api/controllers"
+	"twreporter.org/go-api/globals"
+	"twreporter.org/go-api/models"
+	"twreporter.org/go-api/storage"
+)
+
+func TestDispatchWebhooks(t *testing.T) {
+	// setup before test
+	const secret = "webhook-secret"
+
+	type received struct {
+		Body      []byte
+		Event     string
+		Signature string
+	}
+
+	var mu sync.Mutex
+	var deliveries []received
+
+	ok := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mu.Lock()
+		deliveries = append(deliveries, received{Body: body, Event: r.Header.Get("X-Twreporter-Event"), Signature: r.Header.Get("X-Twreporter-Signature")})
+		mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ok.Close()
+
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer broken.Close()
+
+	conf := globals.Conf.Webhooks
+	globals.Conf.Webhooks = configs.WebhooksConfig{
+		Endpoints: []configs.WebhookEndpointConfig{
+			{URL: ok.URL, Secret: secret, Events: []string{models.EventDonationPaid}},
+			{URL: broken.URL, Secret: secret},
+		},
+		MaxAttempts: 2,
+		Backoff:     time.Minute,
+		MaxBackoff:  time.Hour,
+		Timeout:     5 * time.Second,
+	}
+	defer func() { globals.Conf.Webhooks = conf }()
+
+	donor := createUser("webhook-donor@twreporter.org")
+	admin := createUser("webhook-admin@twreporter.org")
+	Globs.GormDB.Model(&models.User{}).Where("id = ?", admin.ID).Update("privilege", constants.PrivilegeAdmin)
+	mc := controllers.NewMembershipController(storage.NewGormStorage(Globs.GormDB), Globs.PaymentGateways, Globs.CardKeyring)
+
+	orderNumber := createDefaultPrimeDonationRecord(donor).Data.OrderNumber
+	now := time.Now()
+
+	deliveredOf := func(orderNumber string) (ds []received) {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, d := range deliveries {
+			if strings.Contains(string(d.Body), orderNumber) {
+				ds = append(ds, d)
+			}
+		}
+		return
+	}
+
+	t.Run("WriteEventsInTheTransactions", func(t *testing.T) {
+		var count int
+		Globs.GormDB.Model(&models.OutboxEvent{}).Where("type = ? AND payload LIKE ?", models.EventDonationPaid, "%"+orderNumber+"%").Count(&count)
+		assert.Equal(t, 1, count)
+
+		Globs.GormDB.Model(&models.OutboxEvent{}).Where("type = ? AND payload LIKE ?", models.EventUserCreated, "%webhook-donor@twreporter.org%").Count(&count)
+		assert.Equal(t, 1, count)
+	})
+
+	t.Run("DeliverTheSignedEvents", func(t *testing.T) {
+		summary, err := mc.DispatchWebhooks(now, 100)
+		assert.Nil(t, err)
+		assert.NotZero(t, summary.Dispatched)
+		assert.NotZero(t, summary.Retried)
+
+		ds := deliveredOf(orderNumber)
+		if assert.Equal(t, 1, len(ds)) {
+			assert.Equal(t, models.EventDonationPaid, ds[0].Event)
+
+			var timestamp int64
+			var signature string
+			fmt.Sscanf(strings.Replace(ds[0].Signature, ",v1=", " ", 1), "t=%d %s", &timestamp, &signature)
+
+			mac := hmac.New(sha256.New, []byte(secret))
+			mac.Write([]byte(fmt.Sprintf("%d.%s", timestamp, ds[0].Body)))
+			assert.Equal(t, hex.EncodeToString(mac.Sum(nil)), signature)
+
+			body := struct {
+				Data models.DonationEventData `json:"data"`
+				Type string                   `json:"type"`
+			}{}
+			json.Unmarshal(ds[0].Body, &body)
+			assert.Equal(t, models.EventDonationPaid, body.Type)
+			assert.Equal(t, donor.ID, body.Data.UserID)
+			assert.Equal(t, testAmount, body.Data.Amount)
+		}
+	})
+
+	t.Run("RetryByTheBackoff", func(t *testing.T) {
+		// the failed deliveries are not due yet
+		summary, err := mc.DispatchWebhooks(now.Add(30*time.Second), 100)
+		assert.Nil(t, err)
+		assert.Zero(t, summary.Retried)
+		assert.Zero(t, len(summary.Dead))
+
+		summary, err = mc.DispatchWebhooks(now.Add(2*time.Minute), 100)
+		assert.Nil(t, err)
+		assert.NotZero(t, len(summary.Dead))
+		// the delivered event is not delivered again
+		assert.Equal(t, 1, len(deliveredOf(orderNumber)))
+	})
+
+	t.Run("ListAndRequeueTheDeadLetters", func(t *testing.T) {
+		cookie := http.Cookie{
+			HttpOnly: true,
+			MaxAge:   3600,
+			Name:     "id_token",
+			Secure:   false,
+			Value:    generateIDToken(admin),
+		}
+		auth := fmt.Sprintf("Bearer %s", generateJWT(admin))
+
+		resp := serveHTTPWithCookies("GET", "/v1/webhooks/dead-letters?limit=100", "", "", auth, cookie)
+		assert.Equal(t, http.StatusOK, resp.Code)
+
+		resBody := struct {
+			Data struct {
+				Records []struct {
+					Attempts uint   `json:"attempts"`
+					Endpoint string `json:"endpoint"`
+					ID       uint   `json:"id"`
+					Status   string `json:"status"`
+				} `json:"records"`
+				Meta models.MetaOfResponse `json:"meta"`
+			} `json:"data"`
+		}{}
+		json.Unmarshal(resp.Body.Bytes(), &resBody)
+		if !assert.NotZero(t, len(resBody.Data.Records)) {
+			return
+		}
+
+		dead := resBody.Data.Records[0]
+		assert.Equal(t, broken.URL, dead.Endpoint)
+		assert.Equal(t, models.WebhookDeliveryDead, dead.Status)
+		assert.Equal(t, uint(2), dead.Attempts)
+
+		path := fmt.Sprintf("/v1/webhooks/dead-letters/%d/retries", dead.ID)
+		reqBody := fmt.Sprintf(`{"user_id":%d}`, admin.ID)
+		resp = serveHTTPWithCookies("POST", path, reqBody, "application/json", auth, cookie)
+		assert.Equal(t, http.StatusNoContent, resp.Code)
+
+		d := models.WebhookDelivery{}
+		Globs.GormDB.Where("id = ?", dead.ID).Find(&d)
+		assert.Equal(t, models.WebhookDeliveryPending, d.Status)
+		assert.Zero(t, d.Attempts)
+
+		// only the dead deliveries could be requeued
+		resp = serveHTTPWithCookies("POST", path, reqBody, "application/json", auth, cookie)
+		assert.Equal(t, http.StatusNotFound, resp.Code)
+
+		// only admins could see the dead deliveries
+		resp = serveHTTPWithCookies("GET", "/v1/webhooks/dead-letters", "", "", fmt.Sprintf("Bearer %s", generateJWT(donor)), http.Cookie{Name: "id_token", Value: generateIDToken(donor)})
+		assert.Equal(t, http.StatusForbidden, resp.Code)
+	})
+}
@@ -20,8 +20,11 @@ import (
 	"twreporter.org/go-api/configs"
 	"twreporter.org/go-api/controllers"
 	"twreporter.org/go-api/globals"
+	"twreporter.org/go-api/keyring"
 	"twreporter.org/go-api/models"
+	"twreporter.org/go-api/payment"
 	"twreporter.org/go-api/routers"
+	"twreporter.org/go-api/services"
 	"twreporter.org/go-api/storage"
 	"twreporter.org/go-api/utils"
 )
@@ -268,9 +271,13 @@ func (s mockMailStrategy) Send(to, subject, body string) error {
 	return nil
 }
 
-func setupGinServer(gormDB *gorm.DB, mgoDB *mgo.Session) *gin.Engine {
+func (s mockMailStrategy) SendWithAttachments(to, subject, body string, attachments []services.Attachment) error {
+	return s.Send(to, subject, body)
+}
+
+func setupGinServer(gormDB *gorm.DB, mgoDB *mgo.Session, gateways *payment.Gateways, cardKeyring *keyring.Keyring) *gin.Engine {
 	mailSvc := mockMailStrategy{}
-	cf := controllers.NewControllerFactory(gormDB, mgoDB, mailSvc)
+	cf := controllers.NewControllerFactory(gormDB, mgoDB, mailSvc, gateways, cardKeyring)
 	engine := routers.SetupRouter(cf)
 	return engine
 }
@@ -297,8 +304,20 @@ func TestMain(m *testing.M) {
 	Globs.GormDB = gormDB
 	Globs.MgoDB = mgoDB
 
+	// set up payment gateways
+	if Globs.PaymentGateways, err = payment.NewGateways(globals.Conf.Donation); err != nil {
+		panic(fmt.Sprintf("Can not set up payment gateways, but got err=%+v", err))
+	}
+
+	// set up the keyring of card secrets
+	os.Setenv("GOAPI_CARD_SECRET_PRIMARY_KEY_ID", testPrimaryKeyID)
+	os.Setenv("GOAPI_CARD_SECRET_KEYS", testCardSecretKeys)
+	if Globs.CardKeyring, err = keyring.New(globals.Conf.Donation); err != nil {
+		panic(fmt.Sprintf("Can not set up the keyring of card secrets, but got err=%+v", err))
+	}
+
 	// set up gin server
-	engine := setupGinServer(gormDB, mgoDB)
+	engine := setupGinServer(gormDB, mgoDB, Globs.PaymentGateways, Globs.CardKeyring)
 
 	Globs.GinEngine = engine
 
@@ -27,7 +27,7 @@ const (
 )
 
 func runGormMigration(gormDB *gorm.DB) {
-	values := []interface{}{&models.User{}, &models.OAuthAccount{}, &models.ReporterAccount{}, &models.Bookmark{}, &models.Registration{}, &models.Service{}, &models.UsersBookmarks{}, &models.WebPushSubscription{}, &models.PeriodicDonation{}, &models.PayByPrimeDonation{}, &models.PayByCardTokenDonation{}}
+	values := []interface{}{&models.User{}, &models.OAuthAccount{}, &models.ReporterAccount{}, &models.Bookmark{}, &models.Registration{}, &models.Service{}, &models.UsersBookmarks{}, &models.WebPushSubscription{}, &models.PeriodicDonation{}, &models.PayByPrimeDonation{}, &models.PayByCardTokenDonation{}, &models.PayByOtherMethodDonation{}, &models.DonationRefund{}, &models.PeriodicDonationCardChange{}, &models.PeriodicDonationChange{}, &models.PeriodicDonationCardExpiryReminder{}, &models.Campaign{}, &models.OutboxEvent{}, &models.WebhookDelivery{}, &models.GiftFulfillment{}, &models.MatchingRule{}, &models.DonationMatch{}, &models.ExchangeRate{}, &models.IdempotencyKey{}, &models.Receipt{}, &models.ReceiptItem{}, &models.ReceiptSerial{}, &models.DonorProfile{}, &models.SettlementReconciliation{}}
 	for _, value := range values {
 		gormDB.DropTable(value)
 	}
@@ -5,7 +5,9 @@ import (
 	"github.com/jinzhu/gorm"
 	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
+	"twreporter.org/go-api/keyring"
 	"twreporter.org/go-api/models"
+	"twreporter.org/go-api/payment"
 )
 
 type defaultVariables struct {
@@ -42,10 +44,12 @@ type defaultVariables struct {
 }
 
 type globalVariables struct {
-	Defaults  defaultVariables
-	GinEngine *gin.Engine
-	GormDB    *gorm.DB
-	MgoDB     *mgo.Session
+	Defaults        defaultVariables
+	GinEngine       *gin.Engine
+	GormDB          *gorm.DB
+	MgoDB           *mgo.Session
+	PaymentGateways *payment.Gateways
+	CardKeyring     *keyring.Keyring
 }
 
 type webPushSubscriptionPostBody struct {
@@ -1,6 +1,8 @@
 package utils
 
 import (
+	"regexp"
+
 	"gopkg.in/guregu/null.v3"
 	"twreporter.org/go-api/configs/constants"
 
@@ -24,6 +26,62 @@ func GetGender(s string) null.String {
 	return null.StringFrom(gender)
 }
 
+var taxIDPattern = regexp.MustCompile(`^[0-9]{8}$`)
+
+// taxIDWeights are the weights of the digits of the unified business number
+var taxIDWeights = []int{1, 2, 1, 2, 1, 2, 4, 1}
+
+// IsValidTaxID checks the unified business number(統一編號) of Taiwan by its checksum.
+// The digits of the products of the digits and the weights are summed up, and the sum should be divisible by 5.
+// If the 7th digit is 7, its product 28 is summed up as 10 or 1, so either sum divisible by 5 is valid.
+func IsValidTaxID(s string) bool {
+	if !taxIDPattern.MatchString(s) {
+		return false
+	}
+
+	var sum int
+	for i, w := range taxIDWeights {
+		p := int(s[i]-'0') * w
+		sum += p/10 + p%10
+	}
+
+	if sum%5 == 0 {
+		return true
+	}
+
+	return s[6] == '7' && (sum+1)%5 == 0
+}
+
+// ContainsString reports whether the string is in the list
+func ContainsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// ContainsUint reports whether the number is in the list
+func ContainsUint(list []uint, u uint) bool {
+	for _, v := range list {
+		if v == u {
+			return true
+		}
+	}
+	return false
+}
+
+// ContainsInt reports whether the number is in the list
+func ContainsInt(list []int, i int) bool {
+	for _, v := range list {
+		if v == i {
+			return true
+		}
+	}
+	return false
+}
+
 // Check - use to fix GoMetaLinter warning of error not check
 func Check(f func() error) {
 	if err := f(); err != nil {
@@ -1,6 +1,8 @@
 package utils
 
 import (
+	"errors"
+	"fmt"
 	"net/http"
 	"time"
 
@@ -21,8 +23,9 @@ const (
 )
 
 const (
-	IDTokenSubject     = "ID_TOKEN"
-	AccessTokenSubject = "ACCESS_TOKEN"
+	IDTokenSubject              = "ID_TOKEN"
+	AccessTokenSubject          = "ACCESS_TOKEN"
+	CardReplacementTokenSubject = "CARD_REPLACEMENT_TOKEN"
 )
 
 // ReporterJWTClaims JWT claims we used
@@ -47,6 +50,15 @@ type AccessTokenJWTClaims struct {
 	jwt.StandardClaims
 }
 
+// CardReplacementJWTClaims authorizes the donor to replace the card of the periodic donation without signing in.
+// ExpiryDate is the expiry date of the card to be replaced, so the token is no longer accepted once the card is replaced.
+type CardReplacementJWTClaims struct {
+	PeriodicID uint   `json:"periodic_id"`
+	UserID     uint   `json:"user_id"`
+	ExpiryDate string `json:"expiry_date"`
+	jwt.StandardClaims
+}
+
 func (idc IDTokenJWTClaims) Valid() error {
 	const verifyRequired = true
 	var err error
@@ -136,6 +148,72 @@ func RetrieveMailServiceAccessToken(expiration int) (string, error) {
 	return genToken(claims, secret)
 }
 
+// Valid validates the expiration date, the subject, the audience and the issuer of the card replacement token
+func (crc CardReplacementJWTClaims) Valid() error {
+	const verifyRequired = true
+	var err error
+
+	if err = crc.StandardClaims.Valid(); nil != err {
+		return err
+	}
+
+	if CardReplacementTokenSubject != crc.StandardClaims.Subject {
+		return *(jwt.NewValidationError("Invalid subject", jwt.ValidationErrorClaimsInvalid))
+	}
+
+	if !crc.VerifyAudience(globals.Conf.App.JwtAudience, verifyRequired) {
+		return *(jwt.NewValidationError("Invalid audience", jwt.ValidationErrorClaimsInvalid))
+	}
+
+	if !crc.VerifyIssuer(globals.Conf.App.JwtIssuer, verifyRequired) {
+		return *(jwt.NewValidationError("Invalid issuer", jwt.ValidationErrorClaimsInvalid))
+	}
+
+	return nil
+}
+
+// RetrieveCardReplacementToken generates the JWT in the card expiry reminder to replace the expiring card.
+// It is signed by a secret other than the one of access tokens, so it cannot be used to access other resources.
+func RetrieveCardReplacementToken(periodicID uint, userID uint, expiryDate string, expiration int) (string, error) {
+	var secret = globals.CardReplacementJWTPrefix + globals.Conf.App.JwtSecret
+	var claims = CardReplacementJWTClaims{
+		periodicID,
+		userID,
+		expiryDate,
+		jwt.StandardClaims{
+			IssuedAt:  time.Now().Unix(),
+			ExpiresAt: time.Now().Add(time.Second * time.Duration(expiration)).Unix(),
+			Issuer:    globals.Conf.App.JwtIssuer,
+			Audience:  globals.Conf.App.JwtAudience,
+			Subject:   CardReplacementTokenSubject,
+		},
+	}
+
+	return genToken(claims, secret)
+}
+
+// ParseCardReplacementToken validates the card replacement token and returns its claims
+func ParseCardReplacementToken(tokenString string) (CardReplacementJWTClaims, error) {
+	var claims CardReplacementJWTClaims
+	var secret = globals.CardReplacementJWTPrefix + globals.Conf.App.JwtSecret
+
+	token, err := jwt.ParseWithClaims(tokenString, &claims, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method %v", token.Header["alg"])
+		}
+		return []byte(secret), nil
+	})
+	if nil != err {
+		return claims, err
+	}
+
+	if !token.Valid {
+		return claims, errors.New("card replacement token is invalid")
+	}
+
+	return claims, nil
+}
+
 // genToken - generate jwt token according to user's info
 func genToken(claims jwt.Claims, secret string) (string, error) {
 	const errorWhere = "RetrieveToken"